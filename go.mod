@@ -17,6 +17,8 @@ require (
 	github.com/docker/distribution v2.7.1+incompatible // indirect
 	github.com/docker/docker v1.13.1 // indirect
 	github.com/docker/go-connections v0.4.0 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.3.5
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/golang/mock v1.4.4
 	github.com/golang/protobuf v1.4.2
 	github.com/google/uuid v1.1.1
@@ -26,15 +28,21 @@ require (
 	github.com/kata-containers/runtime v0.0.0-20190505030513-a7e2bbd31c56
 	github.com/kr/text v0.2.0 // indirect
 	github.com/miekg/dns v1.1.31
+	github.com/nats-io/nats-server/v2 v2.5.0
+	github.com/nats-io/nats.go v1.12.1
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/onsi/ginkgo v1.14.1
 	github.com/onsi/gomega v1.10.2
-	github.com/smart-edge-open/edgeservices/common/log v0.0.0-20210930114111-edda3e5c2e19
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.7.1
+	github.com/smart-edge-open/edgeservices/common/log v0.0.0-20210930114111-edda3e5c2e19
 	github.com/stretchr/testify v1.5.1 // indirect
 	github.com/undefinedlabs/go-mpatch v1.0.6
+	github.com/xeipuuv/gojsonreference v0.0.0-20180127040603-bd5ef7bd5415
+	github.com/xeipuuv/gojsonschema v1.2.0
 	go.etcd.io/bbolt v1.3.5
 	golang.org/x/sync v0.0.0-20200317015054-43a5402ce75a // indirect
+	golang.org/x/time v0.0.0-20200416051211-89c76fbcd5d1
 	google.golang.org/genproto v0.0.0-20200831141814-d751682dd103
 	google.golang.org/grpc v1.31.0
 	google.golang.org/grpc/examples v0.0.0-20210209174707-61962d0e8e4e // indirect
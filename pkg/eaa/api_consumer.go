@@ -4,8 +4,13 @@
 package eaa
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -17,6 +22,14 @@ var socket = websocket.Upgrader{
 	WriteBufferSize: 512,
 }
 
+// Notification streams parameters
+const (
+	sseKeepAliveInterval   = 15 * time.Second
+	defaultLongPollTimeout = 30 * time.Second
+	maxLongPollTimeout     = 5 * time.Minute
+	maxLongPollBatchSize   = 100
+)
+
 // createWsConn creates a websocket connection for a consumer
 // to receive data from subscribed producers
 func createWsConn(w http.ResponseWriter, r *http.Request) (int, error) {
@@ -27,24 +40,75 @@ func createWsConn(w http.ResponseWriter, r *http.Request) (int, error) {
 
 	// Check if urn ID matches the Host included in the request header
 	if commonName != r.Host {
-		return http.StatusUnauthorized,
-			errors.New("401: Incorrect app ID")
+		return http.StatusForbidden,
+			errors.New("Incorrect app ID")
 	}
 
 	eaaCtx.consumerConnections.Lock()
-	defer eaaCtx.consumerConnections.Unlock()
 
-	// Check if connection was created for urn ID, if so send close
-	// message, close the connection and delete the entry in the
-	// connections structure
+	// Check if connection was created for urn ID, if so close it
+	// and delete the entry in the connections structure
+	closeConsumerConnection(commonName, eaaCtx)
+
+	// Create nil connection obj in consumerConnections map. That means the
+	// procedure of web socket connection has started.
+	eaaCtx.consumerConnections.m[commonName] = ConsumerConnection{
+		connection: nil}
+	conn, err := socket.Upgrade(w, r, nil)
+	if err != nil {
+		delete(eaaCtx.consumerConnections.m, commonName)
+		eaaCtx.consumerConnections.Unlock()
+		return http.StatusInternalServerError, err
+	}
+
+	cc := newConsumerConnection(commonName, conn, eaaCtx)
+	eaaCtx.consumerConnections.m[commonName] = cc
+	cc.writer.start()
+	eaaCtx.consumerConnections.Unlock()
+
+	go readConsumerMessages(commonName, conn, eaaCtx)
+
+	// Deliver notifications queued while the consumer was not connected.
+	// They are passed to the writer outside of consumerConnections lock, so
+	// that a long queue of a slow consumer doesn't hold up other consumers.
+	// Notifications received meanwhile may be delivered before them.
+	replayOfflineQueue(commonName, func(msgID string, msgPayload []byte) error {
+		tracked := trackNotification(commonName, msgID, msgPayload, eaaCtx)
+		if err := cc.writer.enqueueWait(msgID, msgPayload); err != nil {
+			if tracked {
+				untrackNotification(commonName, msgID, eaaCtx)
+			}
+			return err
+		}
+		return nil
+	}, eaaCtx)
+
+	return 0, nil
+}
+
+// closeConsumerConnection closes a websocket or a notification stream of
+// a consumer and removes it from consumer connections. Notifications left
+// in the stream are moved to the offline queue.
+// consumerConnections must be locked by the caller.
+func closeConsumerConnection(commonName string, eaaCtx *Context) {
 	foundConn, connFound := eaaCtx.consumerConnections.m[commonName]
-	if connFound {
-		prevConn := foundConn.connection
+	if !connFound {
+		return
+	}
+
+	if foundConn.writer != nil {
+		// Notifications left in the writer are redelivered once it exits
+		foundConn.writer.stop()
+	}
+
+	if prevConn := foundConn.connection; prevConn != nil {
 		msgType := websocket.CloseMessage
 		closeMessage := websocket.FormatCloseMessage(
 			websocket.CloseServiceRestart,
 			"New connection request, closing this connection")
-		err := prevConn.WriteMessage(msgType, closeMessage)
+		// WriteControl is safe to call concurrently with the writer goroutine
+		err := prevConn.WriteControl(msgType, closeMessage,
+			time.Now().Add(eaaCtx.cfg.Websocket.writeTimeout()))
 		if err != nil {
 			log.Info("Failed to send close message to old connection")
 		}
@@ -52,23 +116,252 @@ func createWsConn(w http.ResponseWriter, r *http.Request) (int, error) {
 		if err != nil {
 			log.Info("Failed to close previous websocket connection")
 		}
-		delete(eaaCtx.consumerConnections.m, commonName)
 	}
 
-	// Create nil connection obj in consumerConnections map. That means the
-	// procedure of web socket connection has started.
-	eaaCtx.consumerConnections.m[commonName] = ConsumerConnection{
-		connection: nil}
-	conn, err := socket.Upgrade(w, r, nil)
-	if err != nil {
-		delete(eaaCtx.consumerConnections.m, commonName)
-		return http.StatusInternalServerError, err
+	if foundConn.stream != nil {
+		for _, n := range foundConn.stream.close() {
+			err := queueNotification(commonName, n.id, n.payload,
+				errors.New("notification stream closed"), eaaCtx)
+			if err != nil {
+				log.Warningf("Dropping notification %s for %s: %v", n.id, commonName, err)
+			}
+		}
 	}
 
-	eaaCtx.consumerConnections.m[commonName] = ConsumerConnection{
-		connection: conn}
+	delete(eaaCtx.consumerConnections.m, commonName)
+}
 
-	return 0, nil
+// replayOfflineQueue delivers notifications queued for a consumer using send
+func replayOfflineQueue(commonName string, send func(msgID string, msgPayload []byte) error,
+	eaaCtx *Context) {
+
+	if eaaCtx.offlineQueue == nil {
+		return
+	}
+
+	if err := eaaCtx.offlineQueue.replay(commonName, send); err != nil {
+		log.Errf("Offline queue replay error: %s", err.Error())
+	}
+}
+
+// notificationStreamKind returns a kind of notification stream requested by
+// a consumer in the Accept header, or an empty string for a websocket
+func notificationStreamKind(r *http.Request) string {
+	if websocket.IsWebSocketUpgrade(r) {
+		return ""
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accept, ";", 2)[0])
+		switch mediaType {
+		case "text/event-stream":
+			return sseStream
+		case "application/json":
+			return longPollStream
+		}
+	}
+
+	return ""
+}
+
+// openNotificationStream creates a notification stream for a consumer. An
+// existing long polling stream is reused, so that notifications received
+// between polls are not lost. A long poll of the returned stream is begun.
+func openNotificationStream(kind string, r *http.Request) (*notificationStream, int, error) {
+	eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
+
+	commonName := r.TLS.PeerCertificates[0].Subject.CommonName
+
+	// Check if urn ID matches the Host included in the request header
+	if commonName != r.Host {
+		return nil, http.StatusForbidden,
+			errors.New("Incorrect app ID")
+	}
+
+	eaaCtx.consumerConnections.Lock()
+	defer eaaCtx.consumerConnections.Unlock()
+
+	foundConn, connFound := eaaCtx.consumerConnections.m[commonName]
+	if connFound && kind == longPollStream && foundConn.stream != nil &&
+		foundConn.stream.kind == longPollStream {
+		foundConn.stream.beginPoll()
+		return foundConn.stream, 0, nil
+	}
+
+	closeConsumerConnection(commonName, eaaCtx)
+
+	stream := newNotificationStream(kind)
+	if kind == longPollStream {
+		stream.beginPoll()
+	}
+	eaaCtx.consumerConnections.m[commonName] = ConsumerConnection{stream: stream}
+
+	replayOfflineQueue(commonName, stream.push, eaaCtx)
+
+	return stream, 0, nil
+}
+
+// endLongPoll ends a long poll of a stream. The stream is closed if the
+// consumer doesn't poll again within the idle timeout, notifications left
+// in it are moved to the offline queue.
+func endLongPoll(commonName string, stream *notificationStream, eaaCtx *Context) {
+	idle, idleSince := stream.endPoll()
+	if !idle {
+		return
+	}
+
+	time.AfterFunc(eaaCtx.cfg.Websocket.longPollIdleTimeout(), func() {
+		eaaCtx.consumerConnections.Lock()
+		defer eaaCtx.consumerConnections.Unlock()
+
+		c, found := eaaCtx.consumerConnections.m[commonName]
+		if found && c.stream == stream && stream.isIdleSince(idleSince) {
+			log.Infof("Closing notification stream of %s, it's not polled anymore",
+				commonName)
+			closeConsumerConnection(commonName, eaaCtx)
+		}
+	})
+}
+
+// removeNotificationStream closes a notification stream and removes it from
+// consumer connections unless it was already replaced by a new one
+func removeNotificationStream(commonName string, stream *notificationStream, eaaCtx *Context) {
+	eaaCtx.consumerConnections.Lock()
+	defer eaaCtx.consumerConnections.Unlock()
+
+	if c, found := eaaCtx.consumerConnections.m[commonName]; found && c.stream == stream {
+		closeConsumerConnection(commonName, eaaCtx)
+	}
+}
+
+// serveSSE sends notifications from a stream as Server-Sent Events until
+// the consumer disconnects or the stream is replaced by a new connection
+func serveSSE(w http.ResponseWriter, r *http.Request, stream *notificationStream) {
+	eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
+	commonName := r.TLS.PeerCertificates[0].Subject.CommonName
+
+	defer removeNotificationStream(commonName, stream, eaaCtx)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Err("Server-Sent Events are not supported by the response writer")
+		writeInternalError(w, "Server-Sent Events are not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Comments keep the connection alive on proxies with idle timeouts
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case n := <-stream.notifications:
+			_, err := fmt.Fprintf(w, "id: %s\nevent: notification\ndata: %s\n\n", n.id,
+				n.payload)
+			if err != nil {
+				if err = queueNotification(commonName, n.id, n.payload, err,
+					eaaCtx); err != nil {
+					log.Warningf("Couldn't send notification to %s: %v", commonName, err)
+				}
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-stream.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveLongPoll waits until there is at least one notification in a stream
+// and sends all buffered notifications as a JSON array. An empty array is
+// sent if there are no notifications before the poll timeout.
+func serveLongPoll(w http.ResponseWriter, r *http.Request, stream *notificationStream) {
+	eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
+	commonName := r.TLS.PeerCertificates[0].Subject.CommonName
+
+	defer endLongPoll(commonName, stream, eaaCtx)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	timeout := defaultLongPollTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		seconds, err := strconv.Atoi(t)
+		if err != nil || seconds < 0 {
+			log.Errf("Invalid long polling timeout: %v", t)
+			writeError(w, http.StatusBadRequest, errorCodeInvalidRequest,
+				"Long polling timeout has to be a non-negative number of seconds")
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+		if timeout > maxLongPollTimeout {
+			timeout = maxLongPollTimeout
+		}
+	}
+
+	var batch []streamedNotification
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case n := <-stream.notifications:
+		batch = append(batch, n)
+	case <-timer.C:
+	case <-stream.done:
+	case <-r.Context().Done():
+		return
+	}
+
+drain:
+	for len(batch) < maxLongPollBatchSize {
+		select {
+		case n := <-stream.notifications:
+			batch = append(batch, n)
+		default:
+			break drain
+		}
+	}
+
+	payloads := []json.RawMessage{}
+	for _, n := range batch {
+		payloads = append(payloads, n.payload)
+	}
+
+	err := json.NewEncoder(w).Encode(payloads)
+	if err == nil {
+		// Failed writes of a buffered response are reported by canceling
+		// the request context once it's flushed
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		err = r.Context().Err()
+	}
+	if err == nil || len(batch) == 0 {
+		return
+	}
+
+	log.Errf("Long polling response error: %s", err.Error())
+	for _, n := range batch {
+		if err := queueNotification(commonName, n.id, n.payload, err,
+			eaaCtx); err != nil {
+			log.Warningf("Couldn't send notification to %s: %v", commonName, err)
+		}
+	}
+	// The consumer is gone, notifications received later are queued after
+	// the batch once the stream is closed
+	removeNotificationStream(commonName, stream, eaaCtx)
 }
 
 // getConsumerSubscriptions returns a list of subscriptions belonging
@@ -88,13 +381,13 @@ func getConsumerSubscriptions(commonName string,
 		// if consumer is in namespace subscription, add it to the list
 		if index := getNamespaceSubscriptionIndex(nameNotif,
 			commonName, eaaCtx); index != -1 {
-			subs.addNamespaceSubscriptionToList(nameNotif, eaaCtx)
+			subs.addNamespaceSubscriptionToList(nameNotif, commonName, eaaCtx)
 		}
 		for srvID := range conSub.serviceSubscriptions {
 			// if consumer is in service subscription, add it to the list
 			if index := getServiceSubscriptionIndex(nameNotif, srvID,
 				commonName, eaaCtx); index != -1 {
-				subs.addServiceSubscriptionToList(nameNotif, srvID, eaaCtx)
+				subs.addServiceSubscriptionToList(nameNotif, srvID, commonName, eaaCtx)
 			}
 		}
 
@@ -4,9 +4,11 @@
 package eaa
 
 import (
+	"bytes"
 	"encoding/json"
 	"net/http"
 
+	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
@@ -23,39 +25,42 @@ func DeregisterApplication(w http.ResponseWriter, r *http.Request) {
 	URN, err := CommonNameStringToURN(commonName)
 	if err != nil {
 		log.Errf("Error during converting Common Name to URN: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusForbidden, errorCodeInvalidIdentity,
+			"Common Name of the client certificate is not a valid URN")
 		return
 	}
 
 	// Check preemptively if a Service exists to return the HTTP code that is more likely to be
 	// correct
-	statusCode := http.StatusNoContent
-	if !isServicePresent(commonName, eaaCtx) {
-		statusCode = http.StatusNotFound
-	}
+	serviceFound := isServicePresent(commonName, eaaCtx)
 
 	// Prepare Service structure
 	var serv Service
 	serv.URN = &URN
-	svcMsg := ServiceMessage{Svc: &serv, Action: serviceActionDeregister}
+	svcMsg := ServiceMessage{Svc: &serv, Action: serviceActionDeregister,
+		Origin: eaaCtx.instanceID}
 
 	// Create Watermill Message and publish it
 	data, err := json.Marshal(svcMsg)
 	if err != nil {
 		log.Errf("Error during Service structure marshaling: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, "Failed to encode the service message")
 		return
 	}
-	msg := message.NewMessage(commonName, data)
+	msg := message.NewMessage(watermill.NewUUID(), data)
 
 	err = eaaCtx.MsgBrokerCtx.publish(servicesTopic, msg)
 	if err != nil {
 		log.Errf("Error during Message publishing: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, "Failed to publish the service deregistration")
 		return
 	}
 
-	w.WriteHeader(statusCode)
+	if !serviceFound {
+		writeError(w, http.StatusNotFound, errorCodeNotFound, "Service is not registered")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 
 	log.Debugf("Successfully processed DeregisterApplication from %s",
 		commonName)
@@ -67,8 +72,7 @@ func GetNotifications(w http.ResponseWriter, r *http.Request) {
 
 	eaaCtx.serviceInfo.RLock()
 	if eaaCtx.serviceInfo.m == nil {
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, "EAA context is not initialized")
 
 		eaaCtx.serviceInfo.RUnlock()
 
@@ -76,12 +80,34 @@ func GetNotifications(w http.ResponseWriter, r *http.Request) {
 	}
 	eaaCtx.serviceInfo.RUnlock()
 
-	statCode, err := createWsConn(w, r)
+	// Open Server-Sent Events and long polls are counted until they return,
+	// websockets only while they are being opened
+	commonName := r.TLS.PeerCertificates[0].Subject.CommonName
+	if !acquireConnection(commonName, eaaCtx) {
+		log.Errf("Connection limit of %s exceeded", commonName)
+		writeLimitExceeded(w, "Connection limit exceeded")
+		return
+	}
+	defer releaseConnection(commonName, eaaCtx)
+
+	// Consumers that can't use a websocket may ask for Server-Sent Events or
+	// long polling in the Accept header
+	var stream *notificationStream
+	var statCode int
+	var err error
+	if kind := notificationStreamKind(r); kind != "" {
+		stream, statCode, err = openNotificationStream(kind, r)
+	} else {
+		statCode, err = createWsConn(w, r)
+	}
 	if err != nil {
-		log.Errf("Error in WebSocket Connection Creation: %#v", err)
-		if statCode != 0 {
-			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-			w.WriteHeader(statCode)
+		log.Errf("Error in Notification Connection Creation: %#v", err)
+		switch statCode {
+		case 0:
+		case http.StatusForbidden:
+			writeError(w, statCode, errorCodeInvalidIdentity, err.Error())
+		default:
+			writeError(w, statCode, errorCodeInternal, err.Error())
 		}
 		return
 	}
@@ -94,39 +120,74 @@ func GetNotifications(w http.ResponseWriter, r *http.Request) {
 		if _, ok := err.(objectAlreadyExistsError); !ok {
 			log.Errf("Error when adding a Subscriber of type: '%v', topic: '%v'", clientSubscriber,
 				topic)
-			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-			w.WriteHeader(http.StatusInternalServerError)
+			if stream != nil {
+				removeNotificationStream(r.TLS.PeerCertificates[0].Subject.CommonName, stream,
+					eaaCtx)
+			}
+			writeInternalError(w, "Failed to subscribe to the consumer topic")
 			return
 		}
 	}
 
 	log.Debugf("Successfully processed GetNotifications from %s",
 		r.TLS.PeerCertificates[0].Subject.CommonName)
+
+	if stream != nil {
+		switch stream.kind {
+		case sseStream:
+			serveSSE(w, r, stream)
+		case longPollStream:
+			serveLongPoll(w, r, stream)
+		}
+	}
 }
 
 // GetServices implements https API
 func GetServices(w http.ResponseWriter, r *http.Request) {
-	var servList ServiceList
 	eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
+	query, problems := parseServiceQuery(r.URL.Query())
+	if len(problems) > 0 {
+		writeErrorResponse(w, http.StatusBadRequest, ErrorResponse{
+			Code:    errorCodeInvalidRequest,
+			Message: "Invalid services query",
+			Details: problems,
+		})
+		return
+	}
+
 	eaaCtx.serviceInfo.RLock()
 	defer eaaCtx.serviceInfo.RUnlock()
 
 	if eaaCtx.serviceInfo.m == nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, "EAA context is not initialized")
 		return
 	}
 
-	for _, serv := range eaaCtx.serviceInfo.m {
-		servList.Services = append(servList.Services, serv)
-	}
+	servList := queryServices(query, eaaCtx)
 
-	encoder := json.NewEncoder(w)
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
 	err := encoder.Encode(servList)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Errf("Error during Service list encoding: %s", err.Error())
+		writeInternalError(w, "Failed to encode the service list")
+		return
+	}
+
+	// Consumers polling the services get 304 while the page doesn't change
+	etag := entityTag(body.Bytes())
+	w.Header().Set("ETag", etag)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" &&
+		etagMatches(ifNoneMatch, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if _, err = w.Write(body.Bytes()); err != nil {
+		log.Errf("Error during GetServices response writing: %s", err.Error())
 		return
 	}
 
@@ -148,14 +209,14 @@ func GetSubscriptions(w http.ResponseWriter, r *http.Request) {
 	commonName = r.TLS.PeerCertificates[0].Subject.CommonName
 
 	if subs, err = getConsumerSubscriptions(commonName, eaaCtx); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, "Failed to get subscriptions")
 		log.Errf("Consumer Subscription List Getter: %s",
 			err.Error())
 		return
 	}
 
 	if err = json.NewEncoder(w).Encode(*subs); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, "Failed to encode the subscription list")
 		log.Errf("Consumer Subscription List Getter: %s",
 			err.Error())
 		return
@@ -164,24 +225,68 @@ func GetSubscriptions(w http.ResponseWriter, r *http.Request) {
 	log.Debugf("Successfully processed GetSubscriptions from %s", commonName)
 }
 
+// GetNotificationSchema implements https API
+func GetNotificationSchema(w http.ResponseWriter, r *http.Request) {
+	eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	vars := mux.Vars(r)
+	key := UniqueNotif{
+		namespace:    vars["namespace"],
+		notifName:    vars["name"],
+		notifVersion: vars["version"],
+	}
+
+	schema := getNotificationSchema(key, eaaCtx)
+	if schema == nil {
+		writeError(w, http.StatusNotFound, errorCodeNotFound, "Notification has no schema")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/schema+json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(schema.raw); err != nil {
+		log.Errf("Notification Schema Getter: %s", err.Error())
+		return
+	}
+
+	log.Debugf("Successfully processed GetNotificationSchema from %s",
+		r.TLS.PeerCertificates[0].Subject.CommonName)
+}
+
 // PushNotificationToSubscribers implements https API
 func PushNotificationToSubscribers(w http.ResponseWriter, r *http.Request) {
 	eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	var notif NotificationFromProducer
 
+	commonName := r.TLS.PeerCertificates[0].Subject.CommonName
+	if !allowPublish(commonName, eaaCtx) {
+		log.Errf("Publish rate limit of %s exceeded", commonName)
+		w.Header().Set("Retry-After", "1")
+		writeLimitExceeded(w, "Publish rate limit exceeded")
+		return
+	}
+
 	err := json.NewDecoder(r.Body).Decode(&notif)
 	if err != nil {
 		log.Errf("Error in Publish Notification: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeMalformedBodyError(w, err)
+		return
+	}
+
+	if !allowPayloadSize(commonName, notif.Payload, eaaCtx) {
+		log.Errf("Notification payload of %s exceeds the size limit", commonName)
+		writeError(w, http.StatusRequestEntityTooLarge, errorCodeLimitExceeded,
+			"Notification payload exceeds the size limit")
 		return
 	}
 
-	commonName := r.TLS.PeerCertificates[0].Subject.CommonName
 	URN, err := CommonNameStringToURN(commonName)
 	if err != nil {
 		log.Errf("Error during URN generation: %s", err.Error())
-		w.WriteHeader(http.StatusUnauthorized)
+		writeError(w, http.StatusForbidden, errorCodeInvalidIdentity,
+			"Common Name of the client certificate is not a valid URN")
 		return
 	}
 
@@ -192,46 +297,12 @@ func PushNotificationToSubscribers(w http.ResponseWriter, r *http.Request) {
 	_, serviceFound := eaaCtx.serviceInfo.m[commonName]
 	if !serviceFound {
 		log.Err("Producer is not registered")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	notifTopic := getNotificationTopicName(URN.Namespace)
-
-	// Add a Publisher to the Notification Namespace topic (if not subscribed already)
-	err = eaaCtx.MsgBrokerCtx.addPublisher(notificationPublisher, notifTopic, r)
-	if err != nil {
-		// Ignore objectAlreadyExistsError error
-		if _, ok := err.(objectAlreadyExistsError); !ok {
-			log.Errf("Error when adding a Publisher of type: '%v', id: '%v'. Error: %s",
-				notificationPublisher, notifTopic, err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// Prepare NotificationMessage that will be published using a Message Broker
-	notifMsg := NotificationMessage{Notification: &notif, URN: &URN}
-
-	// Create Watermill Message and publish it
-	data, err := json.Marshal(notifMsg)
-	if err != nil {
-		log.Errf("Error during Service structure marshaling: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	msg := message.NewMessage(commonName, data)
-
-	err = eaaCtx.MsgBrokerCtx.publish(notifTopic, msg)
-	if err != nil {
-		log.Errf("Error during Message publishing: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusNotFound, errorCodeNotRegistered,
+			"Producer has to register its service before sending notifications")
 		return
 	}
 
-	w.WriteHeader(http.StatusAccepted)
-	log.Debugf("Successfully processed PushNotificationToSubscribers from %s",
-		commonName)
+	publishNotification(w, r, commonName, URN, &notif, eaaCtx)
 }
 
 // RegisterApplication implements https API
@@ -246,7 +317,29 @@ func RegisterApplication(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&serv)
 	if err != nil {
 		log.Errf("Register Application: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeMalformedBodyError(w, err)
+		return
+	}
+
+	if problems := validateServiceSchemas(&serv); len(problems) > 0 {
+		log.Errf("Register Application: invalid notification schemas from %s",
+			commonName)
+		writeErrorResponse(w, http.StatusBadRequest, ErrorResponse{
+			Code:    errorCodeInvalidRequest,
+			Message: "Invalid notification schema",
+			Details: problems,
+		})
+		return
+	}
+
+	if problems := validateServiceHealthCheck(r.Context(), &serv,
+		eaaCtx.cfg.HealthChecks); len(problems) > 0 {
+		log.Errf("Register Application: invalid health check from %s", commonName)
+		writeErrorResponse(w, http.StatusBadRequest, ErrorResponse{
+			Code:    errorCodeInvalidRequest,
+			Message: "Invalid health check",
+			Details: problems,
+		})
 		return
 	}
 
@@ -254,27 +347,29 @@ func RegisterApplication(w http.ResponseWriter, r *http.Request) {
 	var URN URN
 	if URN, err = CommonNameStringToURN(commonName); err != nil {
 		log.Errf("Error during URN generation: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusForbidden, errorCodeInvalidIdentity,
+			"Common Name of the client certificate is not a valid URN")
 		return
 	}
 	serv.URN = &URN
 
 	// Prepare ServiceMessage that will be published using a Message Broker
-	svcMsg := ServiceMessage{Svc: &serv, Action: serviceActionRegister}
+	svcMsg := ServiceMessage{Svc: &serv, Action: serviceActionRegister,
+		Origin: eaaCtx.instanceID}
 
 	// Create Watermill Message and publish it
 	data, err := json.Marshal(svcMsg)
 	if err != nil {
 		log.Errf("Error during Service structure marshaling: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, "Failed to encode the service message")
 		return
 	}
-	msg := message.NewMessage(commonName, data)
+	msg := message.NewMessage(watermill.NewUUID(), data)
 
 	err = eaaCtx.MsgBrokerCtx.publish(servicesTopic, msg)
 	if err != nil {
 		log.Errf("Error during Message publishing: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, "Failed to publish the service registration")
 		return
 	}
 
@@ -292,9 +387,9 @@ func SubscribeNamespaceNotifications(w http.ResponseWriter, r *http.Request) {
 
 	err := json.NewDecoder(r.Body).Decode(&sub)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		log.Errf("Namespace Notification Registration: %s",
 			err.Error())
+		writeMalformedBodyError(w, err)
 		return
 	}
 
@@ -304,11 +399,35 @@ func SubscribeNamespaceNotifications(w http.ResponseWriter, r *http.Request) {
 	namespace := mux.Vars(r)["urn.namespace"]
 	urn := URN{Namespace: namespace}
 
+	problems := append(validateSubscriptionPatterns(namespace, sub),
+		validateSubscriptionFilters(sub)...)
+	if len(problems) > 0 {
+		log.Err("Namespace Notification Registration: invalid subscription")
+		writeErrorResponse(w, http.StatusBadRequest, ErrorResponse{
+			Code:    errorCodeInvalidRequest,
+			Message: "Invalid subscription",
+			Details: problems,
+		})
+		return
+	}
+
+	allowed, err := allowSubscriptions(commonName, urn, sub, eaaCtx)
+	if err != nil {
+		log.Errf("Error during Namespace Subscription Request processing: %s", err.Error())
+		writeInternalError(w, "Failed to process the subscription request")
+		return
+	}
+	if !allowed {
+		log.Errf("Subscription limit of %s exceeded", commonName)
+		writeLimitExceeded(w, "Subscription limit exceeded")
+		return
+	}
+
 	err = processSubscriptionRequest(subscriptionActionSubscribe, subscriptionScopeNamespace,
 		commonName, &urn, sub, r, eaaCtx)
 	if err != nil {
 		log.Errf("Error during Namespace Subscription Request processing: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, "Failed to process the subscription request")
 		return
 	}
 
@@ -326,8 +445,8 @@ func SubscribeServiceNotifications(w http.ResponseWriter, r *http.Request) {
 
 	err := json.NewDecoder(r.Body).Decode(&sub)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		log.Errf("Service Notification Registration: %s", err.Error())
+		writeMalformedBodyError(w, err)
 		return
 	}
 
@@ -339,11 +458,35 @@ func SubscribeServiceNotifications(w http.ResponseWriter, r *http.Request) {
 	serviceID := vars["urn.id"]
 	urn := URN{Namespace: namespace, ID: serviceID}
 
+	problems := append(validateSubscriptionPatterns(namespace, sub),
+		validateSubscriptionFilters(sub)...)
+	if len(problems) > 0 {
+		log.Err("Service Notification Registration: invalid subscription")
+		writeErrorResponse(w, http.StatusBadRequest, ErrorResponse{
+			Code:    errorCodeInvalidRequest,
+			Message: "Invalid subscription",
+			Details: problems,
+		})
+		return
+	}
+
+	allowed, err := allowSubscriptions(commonName, urn, sub, eaaCtx)
+	if err != nil {
+		log.Errf("Error during Service Subscription Request processing: %s", err.Error())
+		writeInternalError(w, "Failed to process the subscription request")
+		return
+	}
+	if !allowed {
+		log.Errf("Subscription limit of %s exceeded", commonName)
+		writeLimitExceeded(w, "Subscription limit exceeded")
+		return
+	}
+
 	err = processSubscriptionRequest(subscriptionActionSubscribe, subscriptionScopeService,
 		commonName, &urn, sub, r, eaaCtx)
 	if err != nil {
 		log.Errf("Error during Service Subscription Request processing: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, "Failed to process the subscription request")
 		return
 	}
 
@@ -363,7 +506,7 @@ func UnsubscribeAllNotifications(w http.ResponseWriter, r *http.Request) {
 		commonName, nil, nil, r, eaaCtx)
 	if err != nil {
 		log.Errf("Error during All Unsubscription Request processing: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, "Failed to process the subscription request")
 		return
 	}
 
@@ -380,9 +523,9 @@ func UnsubscribeNamespaceNotifications(w http.ResponseWriter, r *http.Request) {
 
 	err := json.NewDecoder(r.Body).Decode(&sub)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		log.Errf("Namespace Notification Unregistration: %s",
 			err.Error())
+		writeMalformedBodyError(w, err)
 		return
 	}
 
@@ -396,7 +539,7 @@ func UnsubscribeNamespaceNotifications(w http.ResponseWriter, r *http.Request) {
 		commonName, &urn, sub, r, eaaCtx)
 	if err != nil {
 		log.Errf("Error during Namespace Unsubscription Request processing: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, "Failed to process the subscription request")
 		return
 	}
 
@@ -413,8 +556,8 @@ func UnsubscribeServiceNotifications(w http.ResponseWriter, r *http.Request) {
 
 	err := json.NewDecoder(r.Body).Decode(&sub)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		log.Errf("Service Notification Unregistration: %s", err.Error())
+		writeMalformedBodyError(w, err)
 		return
 	}
 
@@ -430,7 +573,7 @@ func UnsubscribeServiceNotifications(w http.ResponseWriter, r *http.Request) {
 		commonName, &urn, sub, r, eaaCtx)
 	if err != nil {
 		log.Errf("Error during Service Unsubscription Request processing: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, "Failed to process the subscription request")
 		return
 	}
 
@@ -463,14 +606,18 @@ func processSubscriptionRequest(subscriptionAction string, subscriptionScope str
 		if URN == nil {
 			return errors.New("URN can't be nil when trying to Subscribe")
 		}
-		notifTopic := getNotificationTopicName(URN.Namespace)
-
-		err = eaaCtx.MsgBrokerCtx.addSubscriber(notificationSubscriber, notifTopic, r)
-		if err != nil {
-			// Ignore objectAlreadyExistsError error
-			if _, ok := err.(objectAlreadyExistsError); !ok {
-				return errors.Wrapf(err, "Error when subscribing to Notification topic '%v'",
-					notifTopic)
+		// Topics of namespaces matching a pattern are subscribed when
+		// the subscription is stored
+		if !isNamespacePattern(URN.Namespace) {
+			notifTopic := getNotificationTopicName(URN.Namespace)
+
+			err = eaaCtx.MsgBrokerCtx.addSubscriber(notificationSubscriber, notifTopic, r)
+			if err != nil {
+				// Ignore objectAlreadyExistsError error
+				if _, ok := err.(objectAlreadyExistsError); !ok {
+					return errors.Wrapf(err,
+						"Error when subscribing to Notification topic '%v'", notifTopic)
+				}
 			}
 		}
 	}
@@ -495,7 +642,7 @@ func processSubscriptionRequest(subscriptionAction string, subscriptionScope str
 	if err != nil {
 		return errors.Wrap(err, "Error during SubscriptionMessage structure marshaling")
 	}
-	msg := message.NewMessage(clientCommonName, data)
+	msg := message.NewMessage(watermill.NewUUID(), data)
 
 	err = eaaCtx.MsgBrokerCtx.publish(clientTopic, msg)
 	if err != nil {
@@ -504,3 +651,92 @@ func processSubscriptionRequest(subscriptionAction string, subscriptionScope str
 
 	return nil
 }
+
+// publishNotification validates a notification of a producer and publishes
+// it to the topic of the producer namespace
+func publishNotification(w http.ResponseWriter, r *http.Request, commonName string, URN URN,
+	notif *NotificationFromProducer, eaaCtx *Context) {
+
+	if isBuiltinNotification(notif.Name) {
+		log.Errf("Notification %s from %s uses a reserved name", notif.Name, commonName)
+		writeErrorResponse(w, http.StatusBadRequest, ErrorResponse{
+			Code:    errorCodeInvalidRequest,
+			Message: "Notification name is reserved",
+			Details: []string{"Names starting with " + builtinNotificationPrefix +
+				" are reserved for EAA"},
+		})
+		return
+	}
+
+	// Reject payloads that don't match the schema attached by the producer
+	schemaKey := UniqueNotif{URN.Namespace, notif.Name, notif.Version}
+	if schema := getNotificationSchema(schemaKey, eaaCtx); schema != nil {
+		problems, err := schema.validatePayload(notif.Payload)
+		if err != nil {
+			log.Errf("Error in Publish Notification: %s", err.Error())
+			writeErrorResponse(w, http.StatusBadRequest, ErrorResponse{
+				Code:    errorCodeMalformedBody,
+				Message: "Notification payload is not a valid JSON",
+				Details: []string{err.Error()},
+			})
+			return
+		}
+		if len(problems) > 0 {
+			log.Errf("Notification %v from %s doesn't match its schema", schemaKey,
+				commonName)
+			writeErrorResponse(w, http.StatusBadRequest, ErrorResponse{
+				Code:    errorCodeInvalidRequest,
+				Message: "Notification payload doesn't match the notification schema",
+				Details: problems,
+			})
+			return
+		}
+	}
+
+	notifTopic := getNotificationTopicName(URN.Namespace)
+
+	// Add a Publisher to the Notification Namespace topic (if not subscribed already)
+	err := eaaCtx.MsgBrokerCtx.addPublisher(notificationPublisher, notifTopic, r)
+	if err != nil {
+		// Ignore objectAlreadyExistsError error
+		if _, ok := err.(objectAlreadyExistsError); !ok {
+			log.Errf("Error when adding a Publisher of type: '%v', id: '%v'. Error: %s",
+				notificationPublisher, notifTopic, err.Error())
+			writeInternalError(w, "Failed to publish the notification")
+			return
+		}
+	}
+
+	// Notifications are recorded in the history when they're received back
+	// from the Message Broker, so the namespace has to be subscribed
+	if eaaCtx.cfg.History.Enabled && eaaCtx.history.replayer == nil {
+		subscribeNotificationTopic(URN.Namespace, eaaCtx)
+	}
+
+	// Prepare NotificationMessage that will be published using a Message Broker
+	notifMsg := NotificationMessage{Notification: notif, URN: &URN}
+
+	// Create Watermill Message and publish it
+	data, err := json.Marshal(notifMsg)
+	if err != nil {
+		log.Errf("Error during Service structure marshaling: %s", err.Error())
+		writeInternalError(w, "Failed to encode the service message")
+		return
+	}
+	// Message UUID is used by consumers to acknowledge the notification
+	msg := message.NewMessage(watermill.NewUUID(), data)
+
+	err = eaaCtx.MsgBrokerCtx.publish(notifTopic, msg)
+	if err != nil {
+		log.Errf("Error during Message publishing: %s", err.Error())
+		writeInternalError(w, "Failed to publish the notification")
+		return
+	}
+
+	recordUsage(commonName, eaaCtx, func(usage *AppUsage) { usage.Published++ })
+	eaaCtx.metrics.notificationPublished(URN.Namespace, notif.Name)
+
+	w.WriteHeader(http.StatusAccepted)
+	log.Debugf("Successfully published notification %s from %s", notif.Name,
+		commonName)
+}
@@ -13,12 +13,17 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ThreeDotsLabs/watermill/message"
 	g "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/smart-edge-open/edgeservices/pkg/util"
 
 	. "github.com/undefinedlabs/go-mpatch"
 )
@@ -30,6 +35,54 @@ type brokerMock struct {
 	removeAllError     []error
 }
 
+// decodeErrorResponse decodes a problem details body of an error response
+func decodeErrorResponse(response *httptest.ResponseRecorder) ErrorResponse {
+	Expect(response.Header().Get("Content-Type")).To(HavePrefix("application/problem+json"))
+
+	var errResp ErrorResponse
+	Expect(json.NewDecoder(response.Body).Decode(&errResp)).To(Succeed())
+	Expect(errResp.Status).To(Equal(response.Code))
+	return errResp
+}
+
+// newTestContext returns a Context with empty services, subscriptions and
+// consumer connections, and a Message Broker mock
+func newTestContext() *Context {
+	eaaCtx := &Context{}
+	eaaCtx.serviceInfo.m = make(map[string]Service)
+	eaaCtx.consumerConnections.m = make(map[string]ConsumerConnection)
+	eaaCtx.subscriptionInfo.m = make(map[UniqueNotif]*ConsumerSubscription)
+	eaaCtx.MsgBrokerCtx = &brokerMock{}
+	return eaaCtx
+}
+
+// newTestRequest creates a request of an application authenticated with a
+// certificate of commonName
+func newTestRequest(commonName string, method string, path string,
+	body string) *http.Request {
+
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: commonName}}},
+	}
+	return request
+}
+
+// serveTestRequest serves a request with the EAA router
+func serveTestRequest(eaaCtx *Context, request *http.Request) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	NewEaaRouter(eaaCtx).ServeHTTP(response, request)
+	return response
+}
+
+// serveAs serves a request of an application authenticated with a
+// certificate of commonName
+func serveAs(eaaCtx *Context, commonName string, method string, path string,
+	body string) *httptest.ResponseRecorder {
+
+	return serveTestRequest(eaaCtx, newTestRequest(commonName, method, path, body))
+}
+
 func nextResult(e *[]error) error {
 	if len(*e) > 0 {
 		r := (*e)[0]
@@ -59,6 +112,40 @@ func (b *brokerMock) removeAll() error {
 	return nextResult(&b.removeAllError)
 }
 
+// syncResponseRecorder allows to read a response body while a handler
+// is still writing it
+type syncResponseRecorder struct {
+	*httptest.ResponseRecorder
+	sync.Mutex
+}
+
+func (r *syncResponseRecorder) Write(data []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.ResponseRecorder.Write(data)
+}
+
+func (r *syncResponseRecorder) Flush() {
+	r.Lock()
+	defer r.Unlock()
+	r.ResponseRecorder.Flush()
+}
+
+func (r *syncResponseRecorder) body() string {
+	r.Lock()
+	defer r.Unlock()
+	return r.ResponseRecorder.Body.String()
+}
+
+// failingResponseWriter fails to write a response body
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (failingResponseWriter) Write(_ []byte) (int, error) {
+	return 0, errors.New("unit test error")
+}
+
 var _ = g.Describe("ApiEaa internal errors", func() {
 	var (
 		request    *http.Request
@@ -106,7 +193,8 @@ var _ = g.Describe("ApiEaa internal errors", func() {
 				request.TLS.PeerCertificates[0].Subject = pkix.Name{CommonName: "bad name"}
 				DeregisterApplication(response, request)
 
-				Expect(response.Code).To(Equal(http.StatusInternalServerError))
+				Expect(response.Code).To(Equal(http.StatusForbidden))
+				Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeInvalidIdentity))
 			})
 		})
 
@@ -134,6 +222,18 @@ var _ = g.Describe("ApiEaa internal errors", func() {
 				DeregisterApplication(response, request)
 
 				Expect(response.Code).To(Equal(http.StatusInternalServerError))
+				Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeInternal))
+			})
+		})
+
+		g.When("service is not registered", func() {
+			g.It("should fail with not found", func() {
+				delete(eaaContext.serviceInfo.m, serviceName)
+
+				DeregisterApplication(response, request)
+
+				Expect(response.Code).To(Equal(http.StatusNotFound))
+				Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeNotFound))
 			})
 		})
 	})
@@ -166,6 +266,131 @@ var _ = g.Describe("ApiEaa internal errors", func() {
 				Expect(response.Code).To(Equal(http.StatusInternalServerError))
 			})
 		})
+
+		g.When("consumer asks for long polling", func() {
+			g.It("should return a batch of notifications", func() {
+				request.Host = serviceName
+				request.Header.Set("Accept", "application/json")
+				request.URL.RawQuery = "timeout=5"
+
+				go func() {
+					defer g.GinkgoRecover()
+					Eventually(func() error {
+						return sendNotificationToSubscriber(serviceName, "id1",
+							[]byte(`{"id":"id1"}`), eaaContext)
+					}).Should(Succeed())
+				}()
+
+				GetNotifications(response, request)
+
+				Expect(response.Code).To(Equal(http.StatusOK))
+				Expect(response.Body.String()).To(MatchJSON(`[{"id":"id1"}]`))
+			})
+
+			g.It("should queue the batch offline when the response fails", func() {
+				dir, err := ioutil.TempDir("", "eaaLongPoll")
+				Expect(err).NotTo(HaveOccurred())
+				defer os.RemoveAll(dir)
+				eaaContext.offlineQueue, err = openOfflineQueue(
+					OfflineQueueConfig{Path: filepath.Join(dir, "queue.db")})
+				Expect(err).NotTo(HaveOccurred())
+				defer eaaContext.offlineQueue.close()
+
+				request.Host = serviceName
+				request.Header.Set("Accept", "application/json")
+				request.URL.RawQuery = "timeout=5"
+
+				go func() {
+					defer g.GinkgoRecover()
+					Eventually(func() error {
+						return sendNotificationToSubscriber(serviceName, "id1",
+							[]byte(`{"id":"id1"}`), eaaContext)
+					}).Should(Succeed())
+				}()
+
+				GetNotifications(failingResponseWriter{response}, request)
+
+				Expect(eaaContext.consumerConnections.m).NotTo(HaveKey(serviceName))
+				var queued []string
+				Expect(eaaContext.offlineQueue.replay(serviceName,
+					func(_ string, msgPayload []byte) error {
+						queued = append(queued, string(msgPayload))
+						return nil
+					})).To(Succeed())
+				Expect(queued).To(Equal([]string{`{"id":"id1"}`}))
+			})
+
+			g.It("should close the stream of a consumer that stops polling", func() {
+				eaaContext.cfg.Websocket.LongPollIdleTimeout =
+					util.Duration{Duration: 50 * time.Millisecond}
+				request.Host = serviceName
+				request.Header.Set("Accept", "application/json")
+				request.URL.RawQuery = "timeout=5"
+				ctx, cancel := context.WithCancel(request.Context())
+				request = request.WithContext(ctx)
+
+				hasStream := func() bool {
+					eaaContext.consumerConnections.RLock()
+					defer eaaContext.consumerConnections.RUnlock()
+					_, found := eaaContext.consumerConnections.m[serviceName]
+					return found
+				}
+
+				done := make(chan struct{})
+				go func() {
+					defer g.GinkgoRecover()
+					GetNotifications(response, request)
+					close(done)
+				}()
+
+				Eventually(hasStream).Should(BeTrue())
+				Consistently(hasStream, 200*time.Millisecond).Should(BeTrue())
+				cancel()
+				Eventually(done).Should(BeClosed())
+				Eventually(hasStream).Should(BeFalse())
+			})
+
+			g.It("should return an empty batch on timeout", func() {
+				request.Host = serviceName
+				request.Header.Set("Accept", "application/json")
+				request.URL.RawQuery = "timeout=0"
+
+				GetNotifications(response, request)
+
+				Expect(response.Code).To(Equal(http.StatusOK))
+				Expect(response.Body.String()).To(MatchJSON(`[]`))
+			})
+		})
+
+		g.When("consumer asks for Server-Sent Events", func() {
+			g.It("should stream notifications until the consumer disconnects", func() {
+				request.Host = serviceName
+				request.Header.Set("Accept", "text/event-stream")
+				ctx, cancel := context.WithCancel(request.Context())
+				request = request.WithContext(ctx)
+
+				sseResponse := &syncResponseRecorder{ResponseRecorder: response}
+				done := make(chan struct{})
+				go func() {
+					defer g.GinkgoRecover()
+					GetNotifications(sseResponse, request)
+					close(done)
+				}()
+
+				Eventually(func() error {
+					return sendNotificationToSubscriber(serviceName, "id1",
+						[]byte(`{"id":"id1"}`), eaaContext)
+				}).Should(Succeed())
+				Eventually(sseResponse.body).Should(ContainSubstring(
+					"id: id1\nevent: notification\ndata: {\"id\":\"id1\"}\n\n"))
+				cancel()
+				Eventually(done).Should(BeClosed())
+
+				Expect(response.Code).To(Equal(http.StatusOK))
+				Expect(response.Header().Get("Content-Type")).To(Equal("text/event-stream"))
+				Expect(eaaContext.consumerConnections.m).NotTo(HaveKey(serviceName))
+			})
+		})
 	})
 
 	g.Describe("GetServices", func() {
@@ -227,6 +452,39 @@ var _ = g.Describe("ApiEaa internal errors", func() {
 	})
 
 	g.Describe("PushNotificationToSubscribers", func() {
+		g.When("request body is malformed", func() {
+			g.It("should fail with bad request", func() {
+				request.Body = ioutil.NopCloser(strings.NewReader("---"))
+
+				PushNotificationToSubscribers(response, request)
+
+				Expect(response.Code).To(Equal(http.StatusBadRequest))
+				Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeMalformedBody))
+			})
+		})
+
+		g.When("producer is not registered", func() {
+			g.It("should fail with not found", func() {
+				delete(eaaContext.serviceInfo.m, serviceName)
+
+				PushNotificationToSubscribers(response, request)
+
+				Expect(response.Code).To(Equal(http.StatusNotFound))
+				Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeNotRegistered))
+			})
+		})
+
+		g.When("Common Name is not a URN", func() {
+			g.It("should fail with forbidden", func() {
+				request.TLS.PeerCertificates[0].Subject = pkix.Name{CommonName: "bad name"}
+
+				PushNotificationToSubscribers(response, request)
+
+				Expect(response.Code).To(Equal(http.StatusForbidden))
+				Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeInvalidIdentity))
+			})
+		})
+
 		g.When("broker fails to add a publisher", func() {
 			g.It("should fail", func() {
 
@@ -271,6 +529,17 @@ var _ = g.Describe("ApiEaa internal errors", func() {
 	})
 
 	g.Describe("RegisterApplication", func() {
+		g.When("request body is malformed", func() {
+			g.It("should fail with bad request", func() {
+				request.Body = ioutil.NopCloser(strings.NewReader("---"))
+
+				RegisterApplication(response, request)
+
+				Expect(response.Code).To(Equal(http.StatusBadRequest))
+				Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeMalformedBody))
+			})
+		})
+
 		g.When("json marshal fails", func() {
 			g.It("should fail", func() {
 				p, e := PatchMethodByReflectValue(reflect.ValueOf(json.Marshal),
@@ -138,7 +138,7 @@ func registerProducer(c *http.Client, service eaa.Service,
 	Expect(respPost.Status).To(Equal("200 OK"))
 }
 
-// registerProducerErr sends a registration POST request to the EAA and expects Internal Server Error
+// registerProducerErr sends a registration POST request to the EAA and expects Forbidden
 func registerProducerErr(c *http.Client, service eaa.Service) {
 	By("Service struct list encoding")
 	payload, err := json.Marshal(service)
@@ -152,7 +152,7 @@ func registerProducerErr(c *http.Client, service eaa.Service) {
 
 	By("Comparing POST response code")
 	defer respPost.Body.Close()
-	Expect(respPost.Status).To(Equal("500 Internal Server Error"))
+	Expect(respPost.Status).To(Equal("403 Forbidden"))
 }
 
 // registerProducerWithBadRequest sends a registration POST request to the EAA
@@ -165,7 +165,7 @@ func registerProducerWithBadRequest(c *http.Client) {
 
 	By("Comparing POST response code")
 	defer respPost.Body.Close()
-	Expect(respPost.Status).To(Equal("500 Internal Server Error"))
+	Expect(respPost.Status).To(Equal("400 Bad Request"))
 }
 
 // deregisterProducer sends a deregistration DELETE request to the EAA
@@ -224,7 +224,7 @@ func subscribeConsumerBadRequest(c *http.Client, path string) {
 
 	By("Comparing POST response code")
 	defer respPost.Body.Close()
-	Expect(respPost.Status).To(Equal("500 Internal Server Error"))
+	Expect(respPost.Status).To(Equal("400 Bad Request"))
 }
 
 // unsubscribeConsumer sends a consumer subscription DELETE request
@@ -259,7 +259,7 @@ func unsubscribeConsumerWithBadRequest(c *http.Client, path string) {
 
 	By("Comparing DELETE response code")
 	defer respPost.Body.Close()
-	Expect(respPost.Status).To(Equal("500 Internal Server Error"))
+	Expect(respPost.Status).To(Equal("400 Bad Request"))
 }
 
 // unsubscribeAll sends a all consumer subscription DELETE request
@@ -335,7 +335,7 @@ func produceEventWithUnregisteredProducer(c *http.Client, notif eaa.Notification
 
 	By("Comparing POST response code")
 	defer respPost.Body.Close()
-	Expect(respPost.Status).To(Equal("500 Internal Server Error"))
+	Expect(respPost.Status).To(Equal("404 Not Found"))
 }
 
 // produceEventWithBadRequest sends a notification POST request to the EAA
@@ -349,7 +349,7 @@ func produceEventWithBadRequest(c *http.Client) {
 
 	By("Comparing POST response code")
 	defer respPost.Body.Close()
-	Expect(respPost.Status).To(Equal("500 Internal Server Error"))
+	Expect(respPost.Status).To(Equal("400 Bad Request"))
 }
 
 // produceEventWithBadCommonName sends a notification POST request to the EAA
@@ -367,7 +367,7 @@ func produceEventWithBadCommonName(c *http.Client, notif eaa.NotificationFromPro
 
 	By("Comparing POST response code")
 	defer respPost.Body.Close()
-	Expect(respPost.Status).To(Equal("401 Unauthorized"))
+	Expect(respPost.Status).To(Equal("403 Forbidden"))
 }
 
 // getServiceList sends a GET request to the EAA and retrieves
@@ -447,6 +447,12 @@ func getMsgFromConn(conn *websocket.Conn, response *eaa.NotificationToConsumer,
 	err = json.NewDecoder(output).
 		Decode(response)
 	Expect(err).ShouldNot(HaveOccurred())
+
+	// Notification IDs are generated by EAA, so they can't be compared with
+	// the expected notifications
+	By("Checking notification ID " + subject)
+	Expect(response.ID).ShouldNot(BeEmpty())
+	response.ID = ""
 }
 
 // getMsgFromClosedConn tries to use closed connection
@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ErrorResponse 'Code' values
+const (
+	// The request body is not a valid JSON of the expected type
+	errorCodeMalformedBody = "malformed_body"
+	// The request is well-formed but its content is invalid
+	errorCodeInvalidRequest = "invalid_request"
+	// The request lacks valid credentials
+	errorCodeUnauthorized = "unauthorized"
+	// The Common Name of the client certificate doesn't identify the client
+	errorCodeInvalidIdentity = "invalid_identity"
+	// The requested resource doesn't exist
+	errorCodeNotFound = "not_found"
+	// The authorization policy doesn't allow the client to use the route
+	errorCodeForbidden = "forbidden"
+	// A producer uses the API before registering its service
+	errorCodeNotRegistered = "service_not_registered"
+	// The requested function is not configured in EAA
+	errorCodeUnavailable = "unavailable"
+	// The client exceeded a limit of its requests
+	errorCodeLimitExceeded = "limit_exceeded"
+	// EAA failed to process a valid request
+	errorCodeInternal = "internal_error"
+)
+
+// writeErrorResponse writes an error response with a problem details body
+func writeErrorResponse(w http.ResponseWriter, statusCode int, body ErrorResponse) {
+	body.Status = statusCode
+
+	w.Header().Set("Content-Type", "application/problem+json; charset=UTF-8")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errf("Error during error response encoding: %s", err.Error())
+	}
+}
+
+// writeError writes an error response without details
+func writeError(w http.ResponseWriter, statusCode int, code string, message string) {
+	writeErrorResponse(w, statusCode, ErrorResponse{Code: code, Message: message})
+}
+
+// writeInternalError writes an error response of a request EAA failed
+// to process
+func writeInternalError(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusInternalServerError, errorCodeInternal, message)
+}
+
+// writeMalformedBodyError writes an error response of a request with
+// a body that couldn't be decoded
+func writeMalformedBodyError(w http.ResponseWriter, err error) {
+	writeErrorResponse(w, http.StatusBadRequest, ErrorResponse{
+		Code:    errorCodeMalformedBody,
+		Message: "Request body is not a valid JSON",
+		Details: []string{err.Error()},
+	})
+}
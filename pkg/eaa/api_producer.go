@@ -6,10 +6,10 @@ package eaa
 import (
 	"encoding/json"
 	"net/http"
+	"reflect"
 	"strings"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 )
 
@@ -24,6 +24,9 @@ func validServiceNotifications(
 
 			log.Errf("Service notification is invalid - missing required" +
 				" fields: Name or Version")
+		} else if isBuiltinNotification(notif.Name) {
+			log.Errf("Service notification %s is invalid - the name is reserved",
+				notif.Name)
 		} else {
 			validNotificationList = append(validNotificationList, notif)
 		}
@@ -36,7 +39,40 @@ func isServicePresent(commonName string, eaaCtx *Context) bool {
 	return serviceFound
 }
 
+// isNotificationDeclared reports whether a notification is declared in the
+// Service registered by its producer
+func isNotificationDeclared(urn URN, name string, version string, eaaCtx *Context) bool {
+	eaaCtx.serviceInfo.RLock()
+	defer eaaCtx.serviceInfo.RUnlock()
+
+	for _, notif := range eaaCtx.serviceInfo.m[urn.String()].Notifications {
+		if notif.Name == name && notif.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// isServiceRegistered reports whether a producer is already registered with
+// the same Service, e.g. when a registration is redelivered by the broker
+func isServiceRegistered(commonName string, serv Service, eaaCtx *Context) bool {
+	eaaCtx.serviceInfo.RLock()
+	defer eaaCtx.serviceInfo.RUnlock()
+
+	current, found := eaaCtx.serviceInfo.m[commonName]
+	if !found {
+		return false
+	}
+	if serv.Notifications != nil {
+		serv.Notifications = validServiceNotifications(serv.Notifications)
+	}
+	return reflect.DeepEqual(current, serv)
+}
+
 func addService(commonName string, serv Service, eaaCtx *Context) error {
+	// Deferred first to run once serviceInfo is unlocked
+	defer subscribePatternNotificationTopic(commonName, eaaCtx)
+
 	eaaCtx.serviceInfo.Lock()
 	defer eaaCtx.serviceInfo.Unlock()
 
@@ -50,11 +86,34 @@ func addService(commonName string, serv Service, eaaCtx *Context) error {
 	}
 
 	eaaCtx.serviceInfo.m[commonName] = serv
+	eaaCtx.metrics.declareNotifications(commonName, serv.Notifications)
+	resetServiceHealth(commonName, eaaCtx)
+	if serv.URN != nil {
+		registerNotificationSchemas(commonName, serv.URN.Namespace, serv.Notifications,
+			eaaCtx)
+	}
 	log.Infof("Successfully added '%v' service", commonName)
 
 	return nil
 }
 
+// subscribePatternNotificationTopic subscribes to the notification topic of
+// a producer if its namespace matches a namespace pattern subscription
+func subscribePatternNotificationTopic(commonName string, eaaCtx *Context) {
+	urn, err := CommonNameStringToURN(commonName)
+	if err != nil || eaaCtx.MsgBrokerCtx == nil {
+		return
+	}
+
+	eaaCtx.subscriptionInfo.RLock()
+	matched := eaaCtx.subscriptionInfo.matchesNamespace(urn.Namespace)
+	eaaCtx.subscriptionInfo.RUnlock()
+
+	if matched {
+		subscribeNotificationTopic(urn.Namespace, eaaCtx)
+	}
+}
+
 func removeService(commonName string, eaaCtx *Context) error {
 	eaaCtx.serviceInfo.Lock()
 	defer eaaCtx.serviceInfo.Unlock()
@@ -66,6 +125,8 @@ func removeService(commonName string, eaaCtx *Context) error {
 	servicefound := isServicePresent(commonName, eaaCtx)
 	if servicefound {
 		delete(eaaCtx.serviceInfo.m, commonName)
+		eaaCtx.metrics.declareNotifications(commonName, nil)
+		unregisterNotificationSchemas(commonName, eaaCtx)
 		log.Infof("Successfully removed '%v' service", commonName)
 		return nil
 	}
@@ -93,9 +154,7 @@ func getUniqueSubsList(nsList []string, servList []string) []string {
 }
 
 func sendNotificationToAllSubscribers(commonName string, notif *NotificationFromProducer,
-	eaaCtx *Context) error {
-
-	var subscriberList []string
+	msgID string, eaaCtx *Context) error {
 
 	eaaCtx.serviceInfo.RLock()
 	defer eaaCtx.serviceInfo.RUnlock()
@@ -109,7 +168,23 @@ func sendNotificationToAllSubscribers(commonName string, notif *NotificationFrom
 		return err
 	}
 
+	_, serviceFound := eaaCtx.serviceInfo.m[commonName]
+	if !serviceFound {
+		return errors.New("Producer is not registered")
+	}
+
+	return sendNotificationToSubscribers(prodURN, notif, msgID, eaaCtx)
+}
+
+// sendNotificationToSubscribers sends a notification on behalf of a producer
+// to all consumers subscribed to it
+func sendNotificationToSubscribers(prodURN URN, notif *NotificationFromProducer,
+	msgID string, eaaCtx *Context) error {
+
+	var subscriberList []string
+
 	msgPayload, err := json.Marshal(NotificationToConsumer{
+		ID:      msgID,
 		Name:    notif.Name,
 		Version: notif.Version,
 		Payload: notif.Payload,
@@ -119,11 +194,6 @@ func sendNotificationToAllSubscribers(commonName string, notif *NotificationFrom
 		return errors.Wrap(err, "Failed to marshal norification JSON")
 	}
 
-	_, serviceFound := eaaCtx.serviceInfo.m[commonName]
-	if !serviceFound {
-		return errors.New("Producer is not registered")
-	}
-
 	namespaceKey := UniqueNotif{
 		namespace:    prodURN.Namespace,
 		notifName:    notif.Name,
@@ -133,41 +203,53 @@ func sendNotificationToAllSubscribers(commonName string, notif *NotificationFrom
 	eaaCtx.subscriptionInfo.RLock()
 	defer eaaCtx.subscriptionInfo.RUnlock()
 
-	namespaceSubsInfo, ok := eaaCtx.subscriptionInfo.m[namespaceKey]
-	if !ok {
+	subscriptions := eaaCtx.subscriptionInfo.matching(namespaceKey)
+	if len(subscriptions) == 0 {
 		log.Infof("No subscription to notification %v", namespaceKey)
 		return nil
 	}
 
-	srvSubsList, ok := namespaceSubsInfo.serviceSubscriptions[prodURN.ID]
-
-	if !ok {
-		subscriberList = namespaceSubsInfo.namespaceSubscriptions
-	} else {
-		subscriberList = getUniqueSubsList(
-			namespaceSubsInfo.namespaceSubscriptions, srvSubsList)
+	// A consumer may be subscribed exactly and through patterns, it receives
+	// the notification once
+	for _, namespaceSubsInfo := range subscriptions {
+		subscriberList = getUniqueSubsList(subscriberList,
+			namespaceSubsInfo.namespaceSubscriptions)
+		subscriberList = getUniqueSubsList(subscriberList,
+			namespaceSubsInfo.serviceSubscriptions[prodURN.ID])
 	}
 
+	payload := &filterPayload{raw: notif.Payload}
 	for _, subID := range subscriberList {
-		if err = sendNotificationToSubscriber(subID, msgPayload,
+		if !anyAcceptsNotification(subscriptions, subID, prodURN.ID, payload) {
+			log.Debugf("Notification %s filtered out for Subscriber ID: %s", msgID, subID)
+			continue
+		}
+		if err = sendNotificationToSubscriber(subID, msgID, msgPayload,
 			eaaCtx); err != nil {
 			log.Warningf("Couldn't send notification to Subscriber ID: %s : %v",
 				subID, err)
+			eaaCtx.metrics.notificationDropped(msgPayload)
+			continue
 		}
+		eaaCtx.metrics.notificationDelivered(prodURN.Namespace, notif.Name)
 	}
 	return nil
 }
 
-func sendNotificationToSubscriber(subID string, msgPayload []byte,
+func sendNotificationToSubscriber(subID string, msgID string, msgPayload []byte,
 	eaaCtx *Context) error {
 
+	if isEgressSubscriber(subID) {
+		return forwardToEgress(subID, msgID, msgPayload, eaaCtx)
+	}
+
 	eaaCtx.consumerConnections.RLock()
 
 	possibleConnection, connectionFound := eaaCtx.consumerConnections.m[subID]
 	log.Infof("Looking for websocket: %s from %v", subID,
 		eaaCtx.consumerConnections.m)
 	if connectionFound {
-		if possibleConnection.connection == nil {
+		if !possibleConnection.isAssigned() {
 			// Unlock consumer connections to allow the other thread to update it
 			eaaCtx.consumerConnections.RUnlock()
 
@@ -176,16 +258,62 @@ func sendNotificationToSubscriber(subID string, msgPayload []byte,
 			}
 			eaaCtx.consumerConnections.RLock()
 		}
-		messageType := websocket.TextMessage
-		conn := eaaCtx.consumerConnections.m[subID].connection
-		err := conn.WriteMessage(messageType, msgPayload)
+		if stream := eaaCtx.consumerConnections.m[subID].stream; stream != nil {
+			// Acknowledgements are supported only over websockets
+			err := stream.push(msgID, msgPayload)
+			eaaCtx.consumerConnections.RUnlock()
+			if err != nil {
+				return queueNotification(subID, msgID, msgPayload, err, eaaCtx)
+			}
+			return nil
+		}
+		writer := eaaCtx.consumerConnections.m[subID].writer
+		if writer == nil {
+			eaaCtx.consumerConnections.RUnlock()
+			return queueNotification(subID, msgID, msgPayload,
+				errors.New("websocket connection closed"), eaaCtx)
+		}
+		// The notification is written by the consumer writer. It is tracked
+		// before that so that an acknowledgement can't outrun it.
+		tracked := trackNotification(subID, msgID, msgPayload, eaaCtx)
+		err := writer.enqueue(msgID, msgPayload)
 		eaaCtx.consumerConnections.RUnlock()
-		return err
+		if err != nil {
+			if tracked {
+				untrackNotification(subID, msgID, eaaCtx)
+			}
+			if _, dropped := err.(notificationDroppedError); dropped {
+				return err
+			}
+			// The consumer is most likely gone, keep the notification until it reconnects
+			return queueNotification(subID, msgID, msgPayload, err, eaaCtx)
+		}
+		return nil
 	}
 
 	eaaCtx.consumerConnections.RUnlock()
-	return errors.New("no websocket connection created " +
-		"by GET /notifications API")
+	return queueNotification(subID, msgID, msgPayload, errors.New(
+		"no websocket connection created by GET /notifications API"), eaaCtx)
+}
+
+// queueNotification stores a notification that couldn't be delivered because
+// of reason in the offline queue of a subscriber. If the offline queue is
+// disabled the reason is returned.
+func queueNotification(subID string, msgID string, msgPayload []byte, reason error,
+	eaaCtx *Context) error {
+
+	if eaaCtx.offlineQueue == nil {
+		return reason
+	}
+
+	if err := eaaCtx.offlineQueue.push(subID, msgID, msgPayload); err != nil {
+		return errors.Wrapf(err, "Couldn't queue notification (%s)", reason.Error())
+	}
+	// Acknowledgement will be awaited again once the notification is replayed
+	untrackNotification(subID, msgID, eaaCtx)
+
+	log.Debugf("Notification queued for %s: %s", subID, reason.Error())
+	return nil
 }
 
 // waitForConnectionAssigned waits a second until a proper websocket connection
@@ -196,7 +324,7 @@ func waitForConnectionAssigned(subID string, eaaCtx *Context) error {
 	deadline := time.Now().Add(1 * time.Second)
 	for {
 		eaaCtx.consumerConnections.RLock()
-		if eaaCtx.consumerConnections.m[subID].connection != nil {
+		if eaaCtx.consumerConnections.m[subID].isAssigned() {
 			eaaCtx.consumerConnections.RUnlock()
 			return nil
 		}
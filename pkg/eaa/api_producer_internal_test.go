@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"reflect"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -33,11 +34,9 @@ var _ = g.Describe("api_procuder internal errors", func() {
 
 		eaaContext.consumerConnections = consumerConns{m: make(map[string]ConsumerConnection)}
 
-		cc := ConsumerConnection{&websocket.Conn{}}
-		eaaContext.consumerConnections.m["aa"] = cc
-		eaaContext.consumerConnections.m["bb"] = cc
-		eaaContext.consumerConnections.m["cc"] = cc
-		eaaContext.consumerConnections.m["dd"] = cc
+		for _, id := range []string{"aa", "bb", "cc", "dd"} {
+			eaaContext.consumerConnections.m[id] = startTestConsumerConnection(id, eaaContext)
+		}
 
 		eaaContext.subscriptionInfo = NotificationSubscriptions{m: make(map[UniqueNotif]*ConsumerSubscription)}
 
@@ -52,6 +51,7 @@ var _ = g.Describe("api_procuder internal errors", func() {
 	})
 
 	g.AfterEach(func() {
+		stopTestConsumerConnections(eaaContext)
 		p.Unpatch()
 	})
 
@@ -97,7 +97,7 @@ var _ = g.Describe("api_procuder internal errors", func() {
 				cs := &ConsumerSubscription{
 					namespaceSubscriptions: SubscriberIds{"aa", "bb"},
 					serviceSubscriptions:   make(map[string]SubscriberIds),
-					notification:           NotificationDescriptor{"name", "1.0", "description"},
+					notification:           NotificationDescriptor{Name: "name", Version: "1.0", Description: "description"},
 				}
 
 				cs.serviceSubscriptions[urn.ID] = SubscriberIds{"bb", "cc"}
@@ -113,20 +113,20 @@ var _ = g.Describe("api_procuder internal errors", func() {
 
 					var e error
 
-					var calls int
+					var calls int32
 					p, e = PatchInstanceMethodByName(reflect.TypeOf(websocket.Conn{}), "WriteMessage",
 						func(_ *websocket.Conn, _ int, _ []byte) error {
-							calls++
+							atomic.AddInt32(&calls, 1)
 
 							return nil
 						})
 
 					Expect(e).NotTo(HaveOccurred())
 
-					e = sendNotificationToAllSubscribers(prod, n, eaaContext)
+					e = sendNotificationToAllSubscribers(prod, n, "id", eaaContext)
 
 					Expect(e).NotTo(HaveOccurred())
-					Expect(calls).To(Equal(3))
+					Eventually(func() int32 { return atomic.LoadInt32(&calls) }).Should(Equal(int32(3)))
 				})
 			})
 
@@ -134,7 +134,7 @@ var _ = g.Describe("api_procuder internal errors", func() {
 				g.It("should fail", func() {
 					eaaContext.serviceInfo.m = nil
 
-					e := sendNotificationToAllSubscribers(prod, n, eaaContext)
+					e := sendNotificationToAllSubscribers(prod, n, "id", eaaContext)
 
 					Expect(e).To(HaveOccurred())
 				})
@@ -142,7 +142,7 @@ var _ = g.Describe("api_procuder internal errors", func() {
 
 			g.When("common name is broken", func() {
 				g.It("should fail", func() {
-					e := sendNotificationToAllSubscribers("bad common name", n, eaaContext)
+					e := sendNotificationToAllSubscribers("bad common name", n, "id", eaaContext)
 
 					Expect(e).To(HaveOccurred())
 				})
@@ -158,7 +158,7 @@ var _ = g.Describe("api_procuder internal errors", func() {
 
 					Expect(e).NotTo(HaveOccurred())
 
-					e = sendNotificationToAllSubscribers(prod, n, eaaContext)
+					e = sendNotificationToAllSubscribers(prod, n, "id", eaaContext)
 
 					Expect(e).To(HaveOccurred())
 				})
@@ -169,7 +169,7 @@ var _ = g.Describe("api_procuder internal errors", func() {
 					// remove the service/producer
 					eaaContext.serviceInfo.m = make(map[string]Service)
 
-					e := sendNotificationToAllSubscribers(prod, n, eaaContext)
+					e := sendNotificationToAllSubscribers(prod, n, "id", eaaContext)
 
 					Expect(e).To(HaveOccurred())
 				})
@@ -180,7 +180,7 @@ var _ = g.Describe("api_procuder internal errors", func() {
 					// clear subscriptions
 					eaaContext.subscriptionInfo.m = make(map[UniqueNotif]*ConsumerSubscription)
 
-					e := sendNotificationToAllSubscribers(prod, n, eaaContext)
+					e := sendNotificationToAllSubscribers(prod, n, "id", eaaContext)
 
 					Expect(e).NotTo(HaveOccurred())
 				})
@@ -203,10 +203,10 @@ var _ = g.Describe("api_procuder internal errors", func() {
 
 						var e error
 
-						var calls int
+						var calls int32
 						p, e = PatchInstanceMethodByName(reflect.TypeOf(websocket.Conn{}), "WriteMessage",
 							func(_ *websocket.Conn, _ int, _ []byte) error {
-								calls++
+								atomic.AddInt32(&calls, 1)
 
 								return nil
 							})
@@ -216,21 +216,22 @@ var _ = g.Describe("api_procuder internal errors", func() {
 						go func() {
 							time.Sleep(500 * time.Millisecond)
 
-							eaaContext.consumerConnections.RLock()
-							eaaContext.consumerConnections.m[subscriptionID] = ConsumerConnection{&websocket.Conn{}}
-							eaaContext.consumerConnections.RUnlock()
+							eaaContext.consumerConnections.Lock()
+							eaaContext.consumerConnections.m[subscriptionID] =
+								startTestConsumerConnection(subscriptionID, eaaContext)
+							eaaContext.consumerConnections.Unlock()
 						}()
 
-						e = sendNotificationToSubscriber(subscriptionID, []byte{1, 2, 3}, eaaContext)
+						e = sendNotificationToSubscriber(subscriptionID, "id", []byte{1, 2, 3}, eaaContext)
 
 						Expect(e).NotTo(HaveOccurred())
-						Expect(calls).To(Equal(1))
+						Eventually(func() int32 { return atomic.LoadInt32(&calls) }).Should(Equal(int32(1)))
 					})
 			})
 
 			g.When("and websocket is not created in time", func() {
 				g.It("should fail with an error", func() {
-					e := sendNotificationToSubscriber(subscriptionID, []byte{1, 2, 3}, eaaContext)
+					e := sendNotificationToSubscriber(subscriptionID, "id", []byte{1, 2, 3}, eaaContext)
 
 					Expect(e).To(HaveOccurred())
 				})
@@ -12,6 +12,9 @@ import (
 func addSubscriptionToNamespace(commonName string, namespace string,
 	notif []NotificationDescriptor, eaaCtx *Context) error {
 
+	// Deferred first to run once subscriptionInfo is unlocked
+	defer subscribeNamespacePatternTopics(namespace, eaaCtx)
+
 	eaaCtx.subscriptionInfo.Lock()
 	defer eaaCtx.subscriptionInfo.Unlock()
 
@@ -26,13 +29,23 @@ func addSubscriptionToNamespace(commonName string, namespace string,
 			notifVersion: n.Version,
 		}
 
-		initNamespaceNotification(key, n, eaaCtx)
+		filter, err := subscriptionFilter(n)
+		if err != nil {
+			log.Errf("Couldn't subscribe %s to %v: %s", commonName, key, err.Error())
+			continue
+		}
+
+		if err = initNamespaceNotification(key, n, eaaCtx); err != nil {
+			log.Errf("Couldn't subscribe %s to %v: %s", commonName, key, err.Error())
+			continue
+		}
 
 		if index := getNamespaceSubscriptionIndex(key,
 			commonName, eaaCtx); index == -1 {
 			eaaCtx.subscriptionInfo.m[key].namespaceSubscriptions = append(
 				eaaCtx.subscriptionInfo.m[key].namespaceSubscriptions, commonName)
 		}
+		eaaCtx.subscriptionInfo.m[key].setNamespaceFilter(commonName, filter)
 	}
 
 	return nil
@@ -71,6 +84,7 @@ func removeSubscriptionToNamespace(commonName string, namespace string,
 				eaaCtx.subscriptionInfo.m[key].
 					namespaceSubscriptions[index+1:]...)
 		}
+		eaaCtx.subscriptionInfo.m[key].setNamespaceFilter(commonName, nil)
 	}
 
 	return nil
@@ -93,6 +107,7 @@ func removeAllSubscriptionsToNamespace(commonName string, namespace string, eaaC
 					consumerSub.namespaceSubscriptions[:index],
 					consumerSub.namespaceSubscriptions[index+1:]...)
 			}
+			consumerSub.setNamespaceFilter(commonName, nil)
 		}
 	}
 
@@ -105,6 +120,9 @@ func addSubscriptionToService(commonName string, namespace string,
 	serviceID string, notif []NotificationDescriptor,
 	eaaCtx *Context) error {
 
+	// Deferred first to run once subscriptionInfo is unlocked
+	defer subscribeNamespacePatternTopics(namespace, eaaCtx)
+
 	eaaCtx.subscriptionInfo.Lock()
 	defer eaaCtx.subscriptionInfo.Unlock()
 
@@ -119,8 +137,20 @@ func addSubscriptionToService(commonName string, namespace string,
 			notifVersion: n.Version,
 		}
 
+		filter, err := subscriptionFilter(n)
+		if err != nil {
+			log.Errf("Couldn't subscribe %s to %v - %s: %s", commonName, key, serviceID,
+				err.Error())
+			continue
+		}
+
 		// If NamespaceNotif+service set not initialized, do so now
-		initServiceNotification(key, serviceID, n, eaaCtx)
+		if err = initServiceNotification(key, serviceID, n, eaaCtx); err != nil {
+			log.Errf("Couldn't subscribe %s to %v - %s: %s", commonName, key, serviceID,
+				err.Error())
+			continue
+		}
+		eaaCtx.subscriptionInfo.m[key].setServiceFilter(serviceID, commonName, filter)
 
 		// If Consumer already subscribed, do nothing
 		index := getServiceSubscriptionIndex(key, serviceID, commonName, eaaCtx)
@@ -182,6 +212,7 @@ func removeSubscriptionToService(commonName string, namespace string, serviceID
 					eaaCtx.subscriptionInfo.m[key].
 						serviceSubscriptions[serviceID][index+1:]...)
 		}
+		eaaCtx.subscriptionInfo.m[key].setServiceFilter(serviceID, commonName, nil)
 	}
 
 	return nil
@@ -211,6 +242,7 @@ func removeAllSubscriptionsToService(commonName string, namespace string, servic
 					append(consumerSub.serviceSubscriptions[serviceID][:index],
 						consumerSub.serviceSubscriptions[serviceID][index+1:]...)
 			}
+			consumerSub.setServiceFilter(serviceID, commonName, nil)
 		}
 	}
 
@@ -232,10 +264,86 @@ func removeAllSubscriptions(commonName string, eaaCtx *Context) error {
 			if srvSubsInfo.RemoveSubscriber(commonName) {
 				nsSubsInfo.serviceSubscriptions[srvID] = srvSubsInfo
 			}
+			nsSubsInfo.setServiceFilter(srvID, commonName, nil)
 		}
 
 		nsSubsInfo.namespaceSubscriptions.RemoveSubscriber(commonName)
+		nsSubsInfo.setNamespaceFilter(commonName, nil)
+	}
+
+	return nil
+}
+
+// addSubscription subscribes a consumer to notifications of a namespace or
+// a service and subscribes to the notification topic of the namespace
+func addSubscription(commonName string, sub Subscription, eaaCtx *Context) error {
+	if sub.URN == nil {
+		return errors.New("Subscription has no URN")
+	}
+
+	var err error
+	if sub.URN.ID == "" {
+		err = addSubscriptionToNamespace(commonName, sub.URN.Namespace, sub.Notifications,
+			eaaCtx)
+	} else {
+		err = addSubscriptionToService(commonName, sub.URN.Namespace, sub.URN.ID,
+			sub.Notifications, eaaCtx)
+	}
+	if err != nil {
+		return err
 	}
 
+	// Topics of namespace patterns are subscribed when the subscription
+	// is added
+	if !isNamespacePattern(sub.URN.Namespace) && eaaCtx.MsgBrokerCtx != nil {
+		subscribeNotificationTopic(sub.URN.Namespace, eaaCtx)
+	}
 	return nil
 }
+
+// subscriptionFilter compiles the filter of a subscribed notification,
+// it returns nil if the notification has no filter
+func subscriptionFilter(notif NotificationDescriptor) (*notificationFilter, error) {
+	if notif.Filter == "" {
+		return nil, nil
+	}
+	return compileNotificationFilter(notif.Filter)
+}
+
+// subscribeNamespacePatternTopics subscribes to notification topics of
+// registered producers with a namespace matching a namespace pattern.
+// Topics of producers registered later are subscribed by addService.
+func subscribeNamespacePatternTopics(pattern string, eaaCtx *Context) {
+	if !isNamespacePattern(pattern) || eaaCtx.MsgBrokerCtx == nil {
+		return
+	}
+
+	namespaces := make(map[string]struct{})
+	eaaCtx.serviceInfo.RLock()
+	for commonName := range eaaCtx.serviceInfo.m {
+		if urn, err := CommonNameStringToURN(commonName); err == nil &&
+			globMatch(pattern, urn.Namespace) {
+			namespaces[urn.Namespace] = struct{}{}
+		}
+	}
+	eaaCtx.serviceInfo.RUnlock()
+
+	for namespace := range namespaces {
+		subscribeNotificationTopic(namespace, eaaCtx)
+	}
+}
+
+// subscribeNotificationTopic subscribes to the notification topic of
+// a namespace unless it is subscribed already
+func subscribeNotificationTopic(namespace string, eaaCtx *Context) {
+	notifTopic := getNotificationTopicName(namespace)
+
+	err := eaaCtx.MsgBrokerCtx.addSubscriber(notificationSubscriber, notifTopic, nil)
+	if err != nil {
+		// Ignore objectAlreadyExistsError error
+		if _, ok := err.(objectAlreadyExistsError); !ok {
+			log.Errf("Error when subscribing to Notification topic '%v': %s", notifTopic,
+				err.Error())
+		}
+	}
+}
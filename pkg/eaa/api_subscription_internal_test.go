@@ -28,7 +28,7 @@ var _ = g.Describe("api_subscription internal errors", func() {
 
 		eaaContext.consumerConnections = consumerConns{m: make(map[string]ConsumerConnection)}
 
-		cc := ConsumerConnection{&websocket.Conn{}}
+		cc := ConsumerConnection{connection: &websocket.Conn{}}
 		eaaContext.consumerConnections.m["aa"] = cc
 		eaaContext.consumerConnections.m["bb"] = cc
 		eaaContext.consumerConnections.m["cc"] = cc
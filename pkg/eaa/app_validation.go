@@ -0,0 +1,155 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	evapb "github.com/smart-edge-open/edgeservices/pkg/eva/internal_pb"
+	"google.golang.org/grpc"
+)
+
+const (
+	// Time limit of looking up an application in EVA
+	appLookupTimeout = 5 * time.Second
+	// Default time an application looked up in EVA is cached for
+	defaultAppLookupCacheTTL = time.Minute
+)
+
+// appLookupEntry is an application ID looked up in EVA
+type appLookupEntry struct {
+	appID   string
+	expires time.Time
+}
+
+// appLookupCache caches application IDs by IP address
+type appLookupCache struct {
+	sync.Mutex
+	m map[string]appLookupEntry
+}
+
+func (c AppValidationConfig) cacheTTL() time.Duration {
+	if c.CacheTTL.Duration <= 0 {
+		return defaultAppLookupCacheTTL
+	}
+	return c.CacheTTL.Duration
+}
+
+// lookupApplication returns ID of the application with an IP address
+// using the EVA application lookup service
+func lookupApplication(ctx context.Context, endpoint string, ip string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, appLookupTimeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, endpoint, grpc.WithInsecure())
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to connect to %s", endpoint)
+	}
+	defer func() {
+		if err1 := conn.Close(); err1 != nil {
+			log.Errf("Failed to close connection: %v", err1)
+		}
+	}()
+
+	result, err := evapb.NewIPApplicationLookupServiceClient(conn).GetApplicationByIP(ctx,
+		&evapb.IPApplicationLookupInfo{IpAddress: ip})
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to look up application by IP %s", ip)
+	}
+	return result.GetAppID(), nil
+}
+
+// applicationByIP returns ID of the application with an IP address.
+// Successful lookups are cached, failed ones are retried by next requests.
+func applicationByIP(ctx context.Context, eaaCtx *Context, ip string) (string, error) {
+	now := time.Now()
+
+	eaaCtx.appLookups.Lock()
+	entry, found := eaaCtx.appLookups.m[ip]
+	eaaCtx.appLookups.Unlock()
+	if found && now.Before(entry.expires) {
+		return entry.appID, nil
+	}
+
+	appID, err := lookupApplication(ctx, eaaCtx.cfg.ValidationEndpoint, ip)
+	if err != nil {
+		return "", err
+	}
+
+	eaaCtx.appLookups.Lock()
+	if eaaCtx.appLookups.m == nil {
+		eaaCtx.appLookups.m = make(map[string]appLookupEntry)
+	}
+	// Expired entries of other addresses are dropped while adding a new one
+	for cachedIP, cached := range eaaCtx.appLookups.m {
+		if !now.Before(cached.expires) {
+			delete(eaaCtx.appLookups.m, cachedIP)
+		}
+	}
+	eaaCtx.appLookups.m[ip] = appLookupEntry{
+		appID:   appID,
+		expires: now.Add(eaaCtx.cfg.AppValidation.cacheTTL()),
+	}
+	eaaCtx.appLookups.Unlock()
+
+	return appID, nil
+}
+
+// validateAppIdentity is a middleware rejecting requests of clients whose
+// certificate Common Name doesn't match the application EVA reports
+// at the remote IP address of the request
+func validateAppIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
+
+		if !eaaCtx.cfg.AppValidation.Enabled || r.TLS == nil ||
+			len(r.TLS.PeerCertificates) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		commonName := r.TLS.PeerCertificates[0].Subject.CommonName
+		urn, err := CommonNameStringToURN(commonName)
+		if err != nil {
+			writeError(w, http.StatusForbidden, errorCodeInvalidIdentity,
+				"Common Name of the client certificate is not a valid URN")
+			return
+		}
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			log.Errf("Invalid remote address %s: %s", r.RemoteAddr, err.Error())
+			writeInternalError(w, "Failed to determine the application IP address")
+			return
+		}
+
+		appID, err := applicationByIP(r.Context(), eaaCtx, host)
+		if err != nil {
+			if eaaCtx.cfg.AppValidation.FailOpen {
+				log.Warningf("Application of %s not validated: %s", commonName, err.Error())
+				next.ServeHTTP(w, r)
+				return
+			}
+			log.Errf("Application lookup error: %s", err.Error())
+			writeError(w, http.StatusServiceUnavailable, errorCodeUnavailable,
+				"Failed to validate the application identity")
+			return
+		}
+
+		if appID != urn.ID {
+			log.Errf("Application %s at %s presented certificate of %s", appID, host,
+				commonName)
+			writeError(w, http.StatusForbidden, errorCodeInvalidIdentity,
+				"Client certificate doesn't match the application")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
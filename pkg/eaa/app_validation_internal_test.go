@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+
+	evapb "github.com/smart-edge-open/edgeservices/pkg/eva/internal_pb"
+)
+
+var _ = g.Describe("application identity validation", func() {
+	var (
+		eaaContext *Context
+		lookup     *appLookupStub
+		evaServer  *grpc.Server
+	)
+
+	getServices := func(commonName string) *httptest.ResponseRecorder {
+		request := newTestRequest(commonName, "GET", "/v1/services", "")
+		request.RemoteAddr = "10.16.0.5:41000"
+		return serveTestRequest(eaaContext, request)
+	}
+
+	g.BeforeEach(func() {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		lookup = &appLookupStub{appID: "camera-1"}
+		evaServer = grpc.NewServer()
+		evapb.RegisterIPApplicationLookupServiceServer(evaServer, lookup)
+		go func(server *grpc.Server) {
+			_ = server.Serve(lis)
+		}(evaServer)
+
+		eaaContext = newTestContext()
+		eaaContext.cfg.ValidationEndpoint = lis.Addr().String()
+		eaaContext.cfg.AppValidation.Enabled = true
+	})
+
+	g.AfterEach(func() {
+		evaServer.Stop()
+	})
+
+	g.It("should not look up applications when disabled", func() {
+		eaaContext.cfg.AppValidation.Enabled = false
+
+		Expect(getServices("video:camera-2").Code).To(Equal(http.StatusOK))
+		Expect(lookup.calls).To(BeZero())
+	})
+
+	g.It("should accept a certificate of the application", func() {
+		Expect(getServices("video:camera-1").Code).To(Equal(http.StatusOK))
+		Expect(lookup.ip).To(Equal("10.16.0.5"))
+	})
+
+	g.It("should reject a certificate of another application", func() {
+		response := getServices("video:camera-2")
+
+		Expect(response.Code).To(Equal(http.StatusForbidden))
+		Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeInvalidIdentity))
+	})
+
+	g.It("should cache looked up applications", func() {
+		Expect(getServices("video:camera-1").Code).To(Equal(http.StatusOK))
+		Expect(getServices("video:camera-2").Code).To(Equal(http.StatusForbidden))
+		Expect(lookup.calls).To(Equal(1))
+
+		eaaContext.appLookups.Lock()
+		entry := eaaContext.appLookups.m["10.16.0.5"]
+		entry.expires = time.Now()
+		eaaContext.appLookups.m["10.16.0.5"] = entry
+		eaaContext.appLookups.Unlock()
+
+		Expect(getServices("video:camera-1").Code).To(Equal(http.StatusOK))
+		Expect(lookup.calls).To(Equal(2))
+	})
+
+	g.When("EVA can't be reached", func() {
+		g.BeforeEach(func() {
+			evaServer.Stop()
+		})
+
+		g.It("should reject requests by default", func() {
+			response := getServices("video:camera-1")
+
+			Expect(response.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeUnavailable))
+		})
+
+		g.It("should accept requests when failing open", func() {
+			eaaContext.cfg.AppValidation.FailOpen = true
+
+			Expect(getServices("video:camera-1").Code).To(Equal(http.StatusOK))
+		})
+	})
+})
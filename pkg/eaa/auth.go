@@ -0,0 +1,314 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	authpb "github.com/smart-edge-open/edgeservices/pkg/auth/pb"
+	"golang.org/x/time/rate"
+)
+
+// Default values of the Credentials section of the EAA config
+const (
+	defaultAppCertValidity         = 365 * 24 * time.Hour
+	defaultCredentialsRequestRate  = 0.2
+	defaultCredentialsRequestBurst = 5
+)
+
+const (
+	// Time the validity of signed certificates starts before signing
+	// to tolerate clock skew between EAA and applications
+	appCertBackdate = 5 * time.Minute
+	// Time limit of reading request headers on the open endpoint
+	openReadHeaderTimeout = 10 * time.Second
+)
+
+// HealthStatus describes EAA health reported on the open endpoint
+type HealthStatus struct {
+	Status string `json:"status"`
+	// Endpoint of the TLS API used with credentials obtained from /auth
+	TLSEndpoint string `json:"tls_endpoint"`
+}
+
+// openRoutes are served without TLS on the OpenEndpoint to applications
+// that didn't obtain credentials yet
+var openRoutes = Routes{
+	Route{
+		"GetHealth",
+		http.MethodGet,
+		"/health",
+		GetHealth,
+	},
+
+	Route{
+		"RequestCredentials",
+		http.MethodPost,
+		"/auth",
+		RequestCredentials,
+	},
+}
+
+func (c CredentialsConfig) certValidity() time.Duration {
+	if c.CertValidity.Duration > 0 {
+		return c.CertValidity.Duration
+	}
+	return defaultAppCertValidity
+}
+
+func (c CredentialsConfig) requestRate() float64 {
+	if c.RequestRate > 0 {
+		return c.RequestRate
+	}
+	return defaultCredentialsRequestRate
+}
+
+func (c CredentialsConfig) requestBurst() int {
+	if c.RequestBurst > 0 {
+		return c.RequestBurst
+	}
+	return defaultCredentialsRequestBurst
+}
+
+// credentialsLimiter is a rate limiter of credential requests from a single
+// IP address
+type credentialsLimiter struct {
+	limiter     *rate.Limiter
+	lastRequest time.Time
+}
+
+// credentialsLimiters holds rate limiters of credential requests by the IP
+// addresses the requests come from
+type credentialsLimiters struct {
+	sync.Mutex
+	m map[string]*credentialsLimiter
+}
+
+// allowCredentialsRequest takes a token from the rate limiter of credential
+// requests from an IP address
+func allowCredentialsRequest(host string, eaaCtx *Context) bool {
+	cfg := eaaCtx.cfg.Credentials
+	limiters := &eaaCtx.credentialsLimiters
+
+	limiters.Lock()
+	defer limiters.Unlock()
+
+	now := time.Now()
+	limiter, found := limiters.m[host]
+	if !found {
+		if limiters.m == nil {
+			limiters.m = make(map[string]*credentialsLimiter)
+		}
+		// A limiter idle for the time it takes to refill its burst is the
+		// same as a new one, so it's dropped to keep the map small
+		refill := time.Duration(float64(cfg.requestBurst()) / cfg.requestRate() *
+			float64(time.Second))
+		for h, l := range limiters.m {
+			if now.Sub(l.lastRequest) > refill {
+				delete(limiters.m, h)
+			}
+		}
+
+		limiter = &credentialsLimiter{
+			limiter: rate.NewLimiter(rate.Limit(cfg.requestRate()), cfg.requestBurst())}
+		limiters.m[host] = limiter
+	}
+	limiter.lastRequest = now
+
+	return limiter.limiter.AllowN(now, 1)
+}
+
+// NewOpenRouter initializes the router of the open endpoint
+func NewOpenRouter(eaaCtx *Context) *mux.Router {
+	return newVersionedRouter(eaaCtx, openRoutes)
+}
+
+// GetHealth reports that EAA is running and where its TLS API is served
+func GetHealth(w http.ResponseWriter, r *http.Request) {
+	eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err := json.NewEncoder(w).Encode(HealthStatus{
+		Status:      "ok",
+		TLSEndpoint: eaaCtx.cfg.TLSEndpoint,
+	})
+	if err != nil {
+		log.Errf("Health status encoding error: %s", err.Error())
+	}
+}
+
+// RequestCredentials signs a CSR of an application. The Common Name
+// of the CSR must be the URN of the application, the application is looked
+// up in EVA by the IP address of the request and its ID must match the URN.
+// Requests are rate limited by their IP address.
+func RequestCredentials(w http.ResponseWriter, r *http.Request) {
+	eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
+
+	if eaaCtx.certsEaaCa.ca == nil || eaaCtx.cfg.ValidationEndpoint == "" {
+		writeError(w, http.StatusServiceUnavailable, errorCodeUnavailable,
+			"Credentials are not provided by this EAA")
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		log.Errf("Invalid remote address %s: %s", r.RemoteAddr, err.Error())
+		writeInternalError(w, "Failed to determine the application IP address")
+		return
+	}
+	if !allowCredentialsRequest(host, eaaCtx) {
+		log.Errf("Credentials request rate limit of %s exceeded", host)
+		w.Header().Set("Retry-After", "5")
+		writeLimitExceeded(w, "Credentials request rate limit exceeded")
+		return
+	}
+
+	var identity authpb.Identity
+	if err := json.NewDecoder(r.Body).Decode(&identity); err != nil {
+		log.Errf("Credentials request decoding error: %s", err.Error())
+		writeMalformedBodyError(w, err)
+		return
+	}
+
+	csr, err := parseCSR(identity.Csr)
+	if err != nil {
+		log.Errf("Credentials request error: %s", err.Error())
+		writeErrorResponse(w, http.StatusBadRequest, ErrorResponse{
+			Code:    errorCodeInvalidRequest,
+			Message: "Invalid CSR",
+			Details: []string{err.Error()},
+		})
+		return
+	}
+
+	urn, err := CommonNameStringToURN(csr.Subject.CommonName)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorCodeInvalidIdentity,
+			"CSR Common Name is not a valid URN")
+		return
+	}
+
+	appID, err := applicationByIP(r.Context(), eaaCtx, host)
+	if err != nil {
+		log.Errf("Application lookup error: %s", err.Error())
+		writeInternalError(w, "Failed to look up the application")
+		return
+	}
+	if appID != urn.ID {
+		log.Errf("Application %s at %s requested credentials of %s", appID, host,
+			csr.Subject.CommonName)
+		writeError(w, http.StatusForbidden, errorCodeInvalidIdentity,
+			"CSR Common Name doesn't match the application")
+		return
+	}
+
+	cert, err := signCSR(csr, eaaCtx.certsEaaCa.ca, eaaCtx.cfg.Credentials.certValidity())
+	if err != nil {
+		log.Errf("CSR signing error: %s", err.Error())
+		writeInternalError(w, "Failed to sign the CSR")
+		return
+	}
+
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: eaaCtx.certsEaaCa.ca.x509Cert.Raw}))
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err = json.NewEncoder(w).Encode(authpb.Credentials{
+		Id: csr.Subject.CommonName,
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+			Bytes: cert.Raw})),
+		CaChain: []string{caPEM},
+		CaPool:  []string{caPEM},
+	})
+	if err != nil {
+		log.Errf("Credentials encoding error: %s", err.Error())
+		return
+	}
+	log.Infof("Signed certificate of %s", csr.Subject.CommonName)
+}
+
+// parseCSR decodes a PEM-encoded CSR and checks its signature
+func parseCSR(csrPEM string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("CSR is not a PEM-encoded certificate request")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse CSR")
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, errors.Wrap(err, "Invalid CSR signature")
+	}
+	return csr, nil
+}
+
+// signCSR issues a client certificate for the Common Name of a CSR, which
+// is the only part of the CSR verified against EVA. Other subject fields and
+// subject alternative names of the CSR are not trusted and left out.
+func signCSR(csr *x509.CertificateRequest, ca *CertKeyPair,
+	validity time.Duration) (*x509.Certificate, error) {
+
+	signer, ok := ca.prvKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA key can't sign certificates")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate serial number")
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		NotBefore:    now.Add(-appCertBackdate),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.x509Cert,
+		csr.PublicKey, signer)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create certificate")
+	}
+	return x509.ParseCertificate(der)
+}
+
+// runOpenServer serves openRoutes on the OpenEndpoint until ctx is done
+func runOpenServer(ctx context.Context, eaaCtx *Context) {
+	server := &http.Server{
+		Addr:              eaaCtx.cfg.OpenEndpoint,
+		Handler:           NewOpenRouter(eaaCtx),
+		ReadHeaderTimeout: openReadHeaderTimeout,
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			log.Errf("Could not close EAA open server: %#v", err)
+		}
+	}()
+
+	log.Infof("Serving EAA open API on: %s", eaaCtx.cfg.OpenEndpoint)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Errf("Open server error: %#v", err)
+	}
+}
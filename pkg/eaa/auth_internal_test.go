@@ -0,0 +1,200 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+
+	authpb "github.com/smart-edge-open/edgeservices/pkg/auth/pb"
+	evapb "github.com/smart-edge-open/edgeservices/pkg/eva/internal_pb"
+)
+
+// appLookupStub is an EVA application lookup service with a single application
+type appLookupStub struct {
+	appID string
+	ip    string
+	calls int
+}
+
+func (s *appLookupStub) GetApplicationByIP(ctx context.Context,
+	info *evapb.IPApplicationLookupInfo) (*evapb.IPApplicationLookupResult, error) {
+
+	s.ip = info.GetIpAddress()
+	s.calls++
+	return &evapb.IPApplicationLookupResult{AppID: s.appID}, nil
+}
+
+var _ = g.Describe("open endpoint", func() {
+	var (
+		eaaContext *Context
+		lookup     *appLookupStub
+		evaServer  *grpc.Server
+	)
+
+	serve := func(method string, path string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		request.RemoteAddr = "10.16.0.5:41000"
+		response := httptest.NewRecorder()
+
+		NewOpenRouter(eaaContext).ServeHTTP(response, request)
+
+		return response
+	}
+
+	newCSR := func(commonName string) string {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: commonName,
+				OrganizationalUnit: []string{"admin"}},
+			DNSNames: []string{"eaa.openness"},
+		}, key)
+		Expect(err).NotTo(HaveOccurred())
+
+		identity, err := json.Marshal(authpb.Identity{Csr: string(pem.EncodeToMemory(
+			&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))})
+		Expect(err).NotTo(HaveOccurred())
+		return string(identity)
+	}
+
+	g.BeforeEach(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "root.openness"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		Expect(err).NotTo(HaveOccurred())
+		caCert, err := x509.ParseCertificate(der)
+		Expect(err).NotTo(HaveOccurred())
+
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		lookup = &appLookupStub{appID: "camera-1"}
+		evaServer = grpc.NewServer()
+		evapb.RegisterIPApplicationLookupServiceServer(evaServer, lookup)
+		go func(server *grpc.Server) {
+			_ = server.Serve(lis)
+		}(evaServer)
+
+		eaaContext = &Context{}
+		eaaContext.cfg.TLSEndpoint = ":443"
+		eaaContext.cfg.ValidationEndpoint = lis.Addr().String()
+		eaaContext.certsEaaCa.ca = &CertKeyPair{x509Cert: caCert, prvKey: key}
+	})
+
+	g.AfterEach(func() {
+		evaServer.Stop()
+	})
+
+	g.It("should report health", func() {
+		response := serve("GET", "/v1/health", "")
+		Expect(response.Code).To(Equal(http.StatusOK))
+
+		var health HealthStatus
+		Expect(json.NewDecoder(response.Body).Decode(&health)).To(Succeed())
+		Expect(health).To(Equal(HealthStatus{Status: "ok", TLSEndpoint: ":443"}))
+	})
+
+	g.It("should sign a certificate of the application", func() {
+		eaaContext.cfg.Credentials.CertValidity.Duration = 24 * time.Hour
+
+		for _, path := range []string{"/v1/auth", "/auth"} {
+			response := serve("POST", path, newCSR("video:camera-1"))
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(lookup.ip).To(Equal("10.16.0.5"))
+
+			var credentials authpb.Credentials
+			Expect(json.NewDecoder(response.Body).Decode(&credentials)).To(Succeed())
+			Expect(credentials.Id).To(Equal("video:camera-1"))
+			Expect(credentials.CaPool).To(HaveLen(1))
+
+			block, _ := pem.Decode([]byte(credentials.Certificate))
+			Expect(block).NotTo(BeNil())
+			cert, err := x509.ParseCertificate(block.Bytes)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cert.Subject.CommonName).To(Equal("video:camera-1"))
+			Expect(cert.Subject.OrganizationalUnit).To(BeEmpty())
+			Expect(cert.DNSNames).To(BeEmpty())
+			Expect(cert.ExtKeyUsage).To(Equal(
+				[]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}))
+			Expect(cert.NotAfter).To(BeTemporally("~", time.Now().Add(24*time.Hour),
+				time.Minute))
+
+			roots := x509.NewCertPool()
+			Expect(roots.AppendCertsFromPEM([]byte(credentials.CaPool[0]))).To(BeTrue())
+			_, err = cert.Verify(x509.VerifyOptions{Roots: roots,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+			Expect(err).NotTo(HaveOccurred())
+		}
+	})
+
+	g.It("should refuse credentials of another application", func() {
+		response := serve("POST", "/v1/auth", newCSR("video:camera-2"))
+
+		Expect(response.Code).To(Equal(http.StatusForbidden))
+		Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeInvalidIdentity))
+	})
+
+	g.It("should reject an invalid request", func() {
+		for _, body := range []string{
+			`{"csr": `,
+			`{"csr": "not a CSR"}`,
+			newCSR("camera-1"),
+		} {
+			response := serve("POST", "/v1/auth", body)
+			Expect(response.Code).To(Equal(http.StatusBadRequest), body)
+		}
+	})
+
+	g.It("should limit the rate of credential requests", func() {
+		eaaContext.cfg.Credentials.RequestRate = 0.001
+		eaaContext.cfg.Credentials.RequestBurst = 1
+
+		Expect(serve("POST", "/v1/auth", newCSR("video:camera-1")).Code).
+			To(Equal(http.StatusOK))
+		response := serve("POST", "/v1/auth", newCSR("video:camera-1"))
+
+		Expect(response.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(response.Header().Get("Retry-After")).NotTo(BeEmpty())
+		Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeLimitExceeded))
+		Expect(lookup.calls).To(Equal(1))
+	})
+
+	g.It("should be unavailable without a CA", func() {
+		eaaContext.certsEaaCa.ca = nil
+
+		response := serve("POST", "/v1/auth", newCSR("video:camera-1"))
+
+		Expect(response.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeUnavailable))
+	})
+
+	g.It("should not serve the TLS API", func() {
+		Expect(serve("GET", "/v1/services", "").Code).To(Equal(http.StatusNotFound))
+	})
+})
@@ -0,0 +1,334 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Actions authorized by the authorization policy
+const (
+	actionRegister     = "register"
+	actionPublish      = "publish"
+	actionSubscribe    = "subscribe"
+	actionListServices = "list_services"
+	actionManageEgress = "manage_egress"
+	actionAll          = "*"
+)
+
+// Default values of the Authorization section of the EAA config
+const defaultAuthorizationReloadInterval = 10 * time.Second
+
+// routeActions maps names of eaaRoutes to actions authorized by the policy.
+// Routes that are not listed are allowed to every client, they only access
+// data of the client itself.
+var routeActions = map[string]string{
+	"RegisterApplication":             actionRegister,
+	"DeregisterApplication":           actionRegister,
+	"PushNotificationToSubscribers":   actionPublish,
+	"SubscribeNamespaceNotifications": actionSubscribe,
+	"SubscribeServiceNotifications":   actionSubscribe,
+	"GetNotificationHistory":          actionSubscribe,
+	"GetServices":                     actionListServices,
+	"GetNotificationSchema":           actionListServices,
+	"GetEgressTargets":                actionManageEgress,
+	"AddEgressTarget":                 actionManageEgress,
+	"RemoveEgressTarget":              actionManageEgress,
+}
+
+// policyRequiredActions are forbidden to every client when no policy is
+// loaded. Egress targets can forward any notification out of EAA, so the
+// clients managing them have to be selected by the policy.
+var policyRequiredActions = map[string]bool{
+	actionManageEgress: true,
+}
+
+// authorizationRule grants actions to clients with matching certificates.
+// Certificate fields are glob patterns, fields left empty match any client.
+// Certificates signed for applications on the open endpoint carry only
+// the Common Name verified against EVA, so rules matching the Organizational
+// Unit or SANs select clients provisioned by the deployment CA.
+type authorizationRule struct {
+	// Pattern of the certificate Common Name, e.g. video:*
+	CommonName string `json:"common_name,omitempty"`
+	// Pattern of any Organizational Unit of the certificate subject
+	OrganizationalUnit string `json:"organizational_unit,omitempty"`
+	// Pattern of any DNS name, email address or URI of the certificate
+	SAN string `json:"san,omitempty"`
+	// Allowed actions: register, publish, subscribe, list_services,
+	// manage_egress or *
+	Actions []string `json:"actions"`
+	// Patterns of namespaces the actions are allowed in, empty allows all.
+	// Producers register and publish in the namespace of their Common Name.
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// authorizationPolicy is a list of rules, an action is allowed if any rule
+// allows it
+type authorizationPolicy struct {
+	Rules []authorizationRule `json:"rules"`
+}
+
+// loadAuthorizationPolicy reads and validates a policy file
+func loadAuthorizationPolicy(policyPath string) (*authorizationPolicy, error) {
+	data, err := ioutil.ReadFile(policyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read the authorization policy")
+	}
+
+	var policy authorizationPolicy
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&policy); err != nil {
+		return nil, errors.Wrap(err, "Failed to decode the authorization policy")
+	}
+
+	for i, rule := range policy.Rules {
+		for _, glob := range append([]string{rule.CommonName, rule.OrganizationalUnit,
+			rule.SAN}, rule.Namespaces...) {
+			if _, err = path.Match(glob, ""); err != nil {
+				return nil, errors.Wrapf(err, "Invalid pattern %q in rule %d", glob, i)
+			}
+		}
+		for _, action := range rule.Actions {
+			switch action {
+			case actionRegister, actionPublish, actionSubscribe, actionListServices,
+				actionManageEgress, actionAll:
+			default:
+				return nil, errors.Errorf("Unknown action %q in rule %d", action, i)
+			}
+		}
+	}
+
+	return &policy, nil
+}
+
+// matchesCertificate reports whether a rule applies to a client certificate
+func (rule *authorizationRule) matchesCertificate(cert *x509.Certificate) bool {
+	if rule.CommonName != "" && !globMatch(rule.CommonName, cert.Subject.CommonName) {
+		return false
+	}
+	if rule.OrganizationalUnit != "" &&
+		!anyGlobMatch(rule.OrganizationalUnit, cert.Subject.OrganizationalUnit) {
+		return false
+	}
+	if rule.SAN != "" {
+		sans := append(append([]string{}, cert.DNSNames...), cert.EmailAddresses...)
+		for _, uri := range cert.URIs {
+			sans = append(sans, uri.String())
+		}
+		if !anyGlobMatch(rule.SAN, sans) {
+			return false
+		}
+	}
+	return true
+}
+
+// allowsAction reports whether a rule allows an action in a namespace. Empty
+// namespace is used for actions that are not related to a namespace.
+func (rule *authorizationRule) allowsAction(action string, namespace string) bool {
+	allowed := false
+	for _, a := range rule.Actions {
+		if a == action || a == actionAll {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+
+	if namespace == "" || len(rule.Namespaces) == 0 {
+		return true
+	}
+	// A subscribed namespace pattern is compared with allowed namespaces
+	// as a string, video-* is allowed by video-* or *
+	for _, allowedNamespace := range rule.Namespaces {
+		if globMatch(allowedNamespace, namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether a client is allowed to perform an action in
+// a namespace
+func (p *authorizationPolicy) allows(cert *x509.Certificate, action string,
+	namespace string) bool {
+
+	for i := range p.Rules {
+		if p.Rules[i].matchesCertificate(cert) && p.Rules[i].allowsAction(action, namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyGlobMatch reports whether any of values matches the pattern
+func anyGlobMatch(pattern string, values []string) bool {
+	for _, v := range values {
+		if globMatch(pattern, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizationPolicyStore holds the policy loaded from the policy file.
+// A nil policy authorizes every client to all actions except
+// policyRequiredActions.
+type authorizationPolicyStore struct {
+	sync.RWMutex
+	policy  *authorizationPolicy
+	modTime time.Time
+}
+
+func (s *authorizationPolicyStore) current() *authorizationPolicy {
+	s.RLock()
+	defer s.RUnlock()
+	return s.policy
+}
+
+func (c AuthorizationConfig) reloadInterval() time.Duration {
+	if c.ReloadInterval.Duration <= 0 {
+		return defaultAuthorizationReloadInterval
+	}
+	return c.ReloadInterval.Duration
+}
+
+// reloadAuthorizationPolicy loads the policy file if it was modified since
+// it was loaded last time. An invalid policy is rejected and the previous one
+// stays in force.
+func reloadAuthorizationPolicy(eaaCtx *Context) error {
+	policyPath := eaaCtx.cfg.Authorization.PolicyPath
+
+	info, err := os.Stat(policyPath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to stat the authorization policy")
+	}
+
+	eaaCtx.authorization.RLock()
+	unchanged := eaaCtx.authorization.policy != nil &&
+		info.ModTime().Equal(eaaCtx.authorization.modTime)
+	eaaCtx.authorization.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	policy, err := loadAuthorizationPolicy(policyPath)
+	if err != nil {
+		return err
+	}
+
+	eaaCtx.authorization.Lock()
+	eaaCtx.authorization.policy = policy
+	eaaCtx.authorization.modTime = info.ModTime()
+	eaaCtx.authorization.Unlock()
+
+	log.Infof("Loaded authorization policy with %d rules", len(policy.Rules))
+	return nil
+}
+
+// runAuthorizationPolicyReloader periodically reloads the policy file
+// until ctx is done
+func runAuthorizationPolicyReloader(ctx context.Context, eaaCtx *Context) {
+	t := time.NewTicker(eaaCtx.cfg.Authorization.reloadInterval())
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := reloadAuthorizationPolicy(eaaCtx); err != nil {
+				log.Errf("Authorization policy reload error: %s", err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// authorizedNamespace returns the namespace an action is performed in
+func authorizedNamespace(action string, cert *x509.Certificate, r *http.Request) string {
+	switch action {
+	case actionRegister, actionPublish:
+		// An invalid Common Name is rejected by the handler
+		urn, err := CommonNameStringToURN(cert.Subject.CommonName)
+		if err != nil {
+			return ""
+		}
+		return urn.Namespace
+	case actionSubscribe:
+		if namespace, found := mux.Vars(r)["urn.namespace"]; found {
+			return namespace
+		}
+		// Notification history is read from a namespace given in the query
+		return r.URL.Query().Get("namespace")
+	}
+	return ""
+}
+
+// authorize is a middleware enforcing the authorization policy on routes
+// listed in routeActions
+func authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
+
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		action, found := routeActions[strings.TrimSuffix(route.GetName(),
+			deprecatedRouteSuffix)]
+		if !found {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		policy := eaaCtx.authorization.current()
+		if policy == nil {
+			if policyRequiredActions[action] {
+				log.Errf("Authorization: %s requires an authorization policy", action)
+				writeError(w, http.StatusForbidden, errorCodeForbidden,
+					"Action "+action+" requires an authorization policy")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			writeError(w, http.StatusForbidden, errorCodeForbidden,
+				"Client certificate is required")
+			return
+		}
+		cert := r.TLS.PeerCertificates[0]
+		namespace := authorizedNamespace(action, cert, r)
+
+		if !policy.allows(cert, action, namespace) {
+			log.Errf("Authorization: %s is not allowed to %s in namespace %q",
+				cert.Subject.CommonName, action, namespace)
+			message := "Client is not allowed to " + action
+			if namespace != "" {
+				message += " in namespace " + namespace
+			}
+			writeError(w, http.StatusForbidden, errorCodeForbidden, message)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = g.Describe("authorization policy", func() {
+	var (
+		eaaContext *Context
+		policyDir  string
+	)
+
+	producer := &x509.Certificate{Subject: pkix.Name{CommonName: "video:camera-1",
+		OrganizationalUnit: []string{"producers"}}}
+	consumer := &x509.Certificate{Subject: pkix.Name{CommonName: "consumer:1"},
+		DNSNames: []string{"consumer-1.analytics.svc"}}
+
+	serve := func(cert *x509.Certificate, method string, path string,
+		body string) *httptest.ResponseRecorder {
+
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		response := httptest.NewRecorder()
+
+		NewEaaRouter(eaaContext).ServeHTTP(response, request)
+
+		return response
+	}
+
+	writePolicy := func(policy string) {
+		Expect(ioutil.WriteFile(eaaContext.cfg.Authorization.PolicyPath, []byte(policy),
+			0600)).To(Succeed())
+	}
+
+	g.BeforeEach(func() {
+		var err error
+		policyDir, err = ioutil.TempDir("", "eaa-authorization")
+		Expect(err).NotTo(HaveOccurred())
+
+		eaaContext = &Context{}
+		eaaContext.serviceInfo.m = make(map[string]Service)
+		eaaContext.subscriptionInfo.m = make(map[UniqueNotif]*ConsumerSubscription)
+		eaaContext.serviceHealth.m = make(map[string]*serviceHealthState)
+		eaaContext.MsgBrokerCtx = &brokerMock{}
+		eaaContext.cfg.Authorization.PolicyPath = filepath.Join(policyDir, "policy.json")
+
+		writePolicy(`{"rules": [
+			{"organizational_unit": "producers", "actions": ["register", "publish"],
+			 "namespaces": ["video"]},
+			{"san": "*.analytics.svc", "actions": ["subscribe", "list_services"],
+			 "namespaces": ["video", "audio-*"]}
+		]}`)
+		Expect(reloadAuthorizationPolicy(eaaContext)).To(Succeed())
+	})
+
+	g.AfterEach(func() {
+		os.RemoveAll(policyDir)
+	})
+
+	g.It("should allow every client without a policy", func() {
+		eaaContext.authorization.policy = nil
+
+		Expect(serve(producer, "GET", "/v1/services", "").Code).To(Equal(http.StatusOK))
+	})
+
+	g.It("should not trust subject fields chosen by the application", func() {
+		caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		caTemplate := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "root.openness"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate,
+			caKey.Public(), caKey)
+		Expect(err).NotTo(HaveOccurred())
+		caCert, err := x509.ParseCertificate(der)
+		Expect(err).NotTo(HaveOccurred())
+
+		// The application asks for the Organizational Unit and SAN granted
+		// by the policy in the CSR sent to the open endpoint
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		der, err = x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: "video:camera-1",
+				OrganizationalUnit: []string{"producers"}},
+			DNSNames: []string{"consumer-1.analytics.svc"},
+		}, key)
+		Expect(err).NotTo(HaveOccurred())
+		csr, err := x509.ParseCertificateRequest(der)
+		Expect(err).NotTo(HaveOccurred())
+		cert, err := signCSR(csr, &CertKeyPair{x509Cert: caCert, prvKey: caKey}, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(serve(cert, "POST", "/v1/services",
+			`{"description": "camera"}`).Code).To(Equal(http.StatusForbidden))
+		Expect(serve(cert, "GET", "/v1/services", "").Code).To(Equal(http.StatusForbidden))
+	})
+
+	g.It("should forbid managing egress without a policy", func() {
+		eaaContext.authorization.policy = nil
+
+		response := serve(producer, "GET", "/v1/egress/targets", "")
+		Expect(response.Code).To(Equal(http.StatusForbidden))
+		Expect(decodeErrorResponse(response).Message).
+			To(ContainSubstring("authorization policy"))
+	})
+
+	g.It("should allow actions granted by the policy", func() {
+		Expect(serve(producer, "POST", "/v1/services",
+			`{"description": "camera"}`).Code).To(Equal(http.StatusOK))
+		Expect(serve(consumer, "GET", "/v1/services", "").Code).To(Equal(http.StatusOK))
+		Expect(serve(consumer, "POST", "/v1/subscriptions/video",
+			`[{"name": "motion", "version": "1.0"}]`).Code).To(Equal(http.StatusCreated))
+		Expect(serve(consumer, "POST", "/v1/subscriptions/audio-*",
+			`[{"name": "speech", "version": "1.0"}]`).Code).To(Equal(http.StatusCreated))
+	})
+
+	g.It("should forbid actions not granted by the policy", func() {
+		for _, req := range []struct {
+			cert                 *x509.Certificate
+			method, path, action string
+		}{
+			{producer, "GET", "/v1/services", "list_services"},
+			{producer, "POST", "/v1/subscriptions/video", "subscribe"},
+			{consumer, "POST", "/v1/services", "register"},
+			{consumer, "POST", "/v1/subscriptions/audio", "subscribe"},
+			{consumer, "POST", "/v1/subscriptions/*", "subscribe"},
+			{consumer, "POST", "/subscriptions/other", "subscribe"},
+		} {
+			response := serve(req.cert, req.method, req.path, "[]")
+			Expect(response.Code).To(Equal(http.StatusForbidden), req.path)
+
+			errResp := decodeErrorResponse(response)
+			Expect(errResp.Code).To(Equal(errorCodeForbidden))
+			Expect(errResp.Message).To(ContainSubstring(req.action))
+		}
+	})
+
+	g.It("should check the namespace of the producer", func() {
+		other := &x509.Certificate{Subject: pkix.Name{CommonName: "audio:mic-1",
+			OrganizationalUnit: []string{"producers"}}}
+
+		response := serve(other, "POST", "/v1/services", `{"description": "mic"}`)
+		Expect(response.Code).To(Equal(http.StatusForbidden))
+		Expect(decodeErrorResponse(response).Message).To(ContainSubstring("audio"))
+	})
+
+	g.It("should allow routes that aren't covered by the policy", func() {
+		Expect(serve(producer, "GET", "/v1/subscriptions", "").Code).To(Equal(http.StatusOK))
+		Expect(serve(producer, "GET", "/v1/openapi.json", "").Code).To(Equal(http.StatusOK))
+	})
+
+	g.It("should reload the policy when the file changes", func() {
+		writePolicy(`{"rules": [{"common_name": "video:*", "actions": ["*"]}]}`)
+		future := time.Now().Add(time.Minute)
+		Expect(os.Chtimes(eaaContext.cfg.Authorization.PolicyPath, future, future)).
+			To(Succeed())
+		Expect(reloadAuthorizationPolicy(eaaContext)).To(Succeed())
+
+		Expect(serve(producer, "GET", "/v1/services", "").Code).To(Equal(http.StatusOK))
+		Expect(serve(consumer, "GET", "/v1/services", "").Code).
+			To(Equal(http.StatusForbidden))
+	})
+
+	g.It("should keep the previous policy when the new one is invalid", func() {
+		for _, policy := range []string{
+			`{"rules": [`,
+			`{"rules": [{"actions": ["delete"]}]}`,
+			`{"rules": [{"common_name": "[", "actions": ["*"]}]}`,
+			`{"rules": [{"cn": "video:*", "actions": ["*"]}]}`,
+		} {
+			writePolicy(policy)
+			future := time.Now().Add(time.Minute)
+			Expect(os.Chtimes(eaaContext.cfg.Authorization.PolicyPath, future, future)).
+				To(Succeed())
+			Expect(reloadAuthorizationPolicy(eaaContext)).NotTo(Succeed(), policy)
+		}
+
+		Expect(serve(consumer, "GET", "/v1/services", "").Code).To(Equal(http.StatusOK))
+	})
+})
@@ -3,7 +3,11 @@
 
 package eaa
 
-import "github.com/smart-edge-open/edgeservices/pkg/util"
+import (
+	"encoding/json"
+
+	"github.com/smart-edge-open/edgeservices/pkg/util"
+)
 
 // CertsInfo describes paths for certs used in configuration
 type CertsInfo struct {
@@ -15,14 +19,212 @@ type CertsInfo struct {
 	KafkaCAPath       string `json:"KafkaCAPath"`
 	KafkaUserCertPath string `json:"KafkaUserCertPath"`
 	KafkaUserKeyPath  string `json:"KafkaUserKeyPath"`
+	// Interval of checking server certificate files for changes missed by
+	// the file watcher, a minute by default
+	ReloadInterval util.Duration `json:"ReloadInterval"`
+}
+
+// MsgBrokerConfig describes the Message Broker backend used by EAA
+type MsgBrokerConfig struct {
+	// Type of the backend, e.g. "kafka", "gochannels", "mqtt" or "nats". Defaults to "kafka".
+	Type string `json:"Type"`
+	// Backend specific options
+	Options json.RawMessage `json:"Options,omitempty"`
+}
+
+// OfflineQueueConfig describes the persistent queue of notifications
+// for consumers that are not connected
+type OfflineQueueConfig struct {
+	// Path to the queue DB file. The queue is disabled when empty.
+	Path string `json:"Path"`
+	// Time after which a queued notification is dropped, 0 means no limit
+	TTL util.Duration `json:"TTL"`
+	// Maximum number of notifications queued per consumer
+	MaxDepth int `json:"MaxDepth"`
+}
+
+// StateStoreConfig describes the store of registered services and consumer
+// subscriptions which EAA recovers on startup
+type StateStoreConfig struct {
+	// Type of the backend. Defaults to "bolt".
+	Type string `json:"Type"`
+	// Location of the state, a DB file for the bolt backend. The store is
+	// disabled when empty.
+	Path string `json:"Path"`
+}
+
+// AcknowledgementsConfig describes at-least-once delivery of notifications.
+// When enabled, notifications not acknowledged by consumers are retransmitted
+// with exponential backoff.
+type AcknowledgementsConfig struct {
+	Enabled bool `json:"Enabled"`
+	// Time to wait for an acknowledgement before the first retransmission
+	RetryInterval util.Duration `json:"RetryInterval"`
+	// Upper limit of the time between retransmissions
+	MaxRetryInterval util.Duration `json:"MaxRetryInterval"`
+	// Number of retransmissions after which a notification is dropped
+	MaxRetries int `json:"MaxRetries"`
+}
+
+// WebsocketConfig describes delivery of notifications over consumer websockets.
+// Each consumer has its own writer with an outbound buffer of notifications.
+type WebsocketConfig struct {
+	// Number of notifications buffered for a single consumer
+	OutboundBufferSize int `json:"OutboundBufferSize"`
+	// What to do when the buffer is full: drop-oldest, drop-newest or disconnect
+	OverflowPolicy string `json:"OverflowPolicy"`
+	// Time limit of writing a single message to a websocket
+	WriteTimeout util.Duration `json:"WriteTimeout"`
+	// Interval of pings sent to consumers
+	PingInterval util.Duration `json:"PingInterval"`
+	// Time after which a consumer that doesn't respond to pings is disconnected
+	PongTimeout util.Duration `json:"PongTimeout"`
+	// Time after which the notification stream of a long polling consumer
+	// that doesn't poll again is closed and its notifications are queued
+	LongPollIdleTimeout util.Duration `json:"LongPollIdleTimeout"`
+}
+
+// HealthChecksConfig describes probing of services that registered
+// a health check. Values are defaults for health checks that don't set them.
+// An EAA instance probes only services registered through it.
+type HealthChecksConfig struct {
+	Enabled bool `json:"Enabled"`
+	// CIDR ranges of addresses services can be probed at, endpoints outside
+	// of them are never connected to
+	AllowedNetworks []string `json:"AllowedNetworks"`
+	// Time between probes of a service
+	Interval util.Duration `json:"Interval"`
+	// Time limit of a single probe
+	Timeout util.Duration `json:"Timeout"`
+	// Number of consecutive failed probes after which a service is deregistered
+	FailureThreshold int `json:"FailureThreshold"`
+}
+
+// AuthorizationConfig describes the policy authorizing clients to use
+// EAA API. Every client is authorized when PolicyPath is empty, except for
+// managing egress targets which requires a policy.
+type AuthorizationConfig struct {
+	// Path to the JSON policy file
+	PolicyPath string `json:"PolicyPath"`
+	// Interval of checking the policy file for changes
+	ReloadInterval util.Duration `json:"ReloadInterval"`
+}
+
+// AppValidationConfig describes validation of client certificates against
+// EVA, which reports the application at the remote IP address of a request
+type AppValidationConfig struct {
+	Enabled bool `json:"Enabled"`
+	// Time an application looked up in EVA is cached for
+	CacheTTL util.Duration `json:"CacheTTL"`
+	// Whether requests are allowed when EVA lookup fails
+	FailOpen bool `json:"FailOpen"`
+}
+
+// CredentialsConfig describes certificates signed for applications
+// requesting credentials on the open endpoint
+type CredentialsConfig struct {
+	// Validity of signed certificates, a year by default
+	CertValidity util.Duration `json:"CertValidity"`
+	// Average number of credential requests per second allowed from a single
+	// IP address, 0.2 by default
+	RequestRate float64 `json:"RequestRate"`
+	// Number of credential requests allowed at once above the rate,
+	// 5 by default
+	RequestBurst int `json:"RequestBurst"`
+}
+
+// LimitsConfig describes limits of EAA usage by a single application.
+// Limits left zero are disabled.
+type LimitsConfig struct {
+	// Average number of notifications a producer can publish per second
+	PublishRate float64 `json:"PublishRate"`
+	// Number of notifications a producer can publish at once above the rate
+	PublishBurst int `json:"PublishBurst"`
+	// Maximum size of a notification payload in bytes
+	MaxPayloadSize int `json:"MaxPayloadSize"`
+	// Maximum number of notifications a consumer can subscribe to
+	MaxSubscriptions int `json:"MaxSubscriptions"`
+	// Maximum number of notification requests a consumer can have open at once
+	MaxConnections int `json:"MaxConnections"`
+}
+
+// MetricsConfig describes the Prometheus metrics endpoint of EAA
+type MetricsConfig struct {
+	// Address metrics are served on over plain HTTP, disabled if empty
+	Endpoint string `json:"Endpoint"`
+}
+
+// EgressConfig describes forwarding of notifications out of EAA
+type EgressConfig struct {
+	// Targets created on startup, more can be added by the egress API
+	Targets []EgressTarget `json:"Targets"`
+	// Hosts or host:port addresses targets added by the egress API can
+	// forward to. Targets of the config aren't restricted.
+	AllowedDestinations []string `json:"AllowedDestinations"`
+	// Number of notifications buffered for a single target
+	QueueSize int `json:"QueueSize"`
+	// Defaults of retries of targets that don't set them
+	MaxRetries       int           `json:"MaxRetries"`
+	RetryInterval    util.Duration `json:"RetryInterval"`
+	MaxRetryInterval util.Duration `json:"MaxRetryInterval"`
+}
+
+// IngestionConfig describes producers publishing through the ingestion
+// endpoint, authenticated by API tokens instead of certificates
+type IngestionConfig struct {
+	// Address of the ingestion endpoint. It's served over TLS with the EAA
+	// server certificate, client certificates are not requested.
+	Endpoint string           `json:"Endpoint"`
+	Tokens   []IngestionToken `json:"Tokens"`
+}
+
+// IngestionToken maps an API token to the producer and the notification
+// published by requests authenticated with it
+type IngestionToken struct {
+	// Secret sent by the device as a bearer token
+	Token string `json:"Token"`
+	// URN of the producer in the form namespace:id, registered by EAA
+	Producer string `json:"Producer"`
+	// Notification published with the request body as its payload
+	Notification NotificationDescriptor `json:"Notification"`
+}
+
+// HistoryConfig describes notifications kept by EAA for consumers to backfill.
+// Only notifications declared in the Service of their producer are kept.
+type HistoryConfig struct {
+	Enabled bool `json:"Enabled"`
+	// Maximum number of notifications kept per notification name and version
+	MaxNotifications int `json:"MaxNotifications"`
+	// Time notifications are kept for, 0 keeps them until they're replaced
+	MaxAge util.Duration `json:"MaxAge"`
+	// Whether history is read from the Message Broker instead of memory,
+	// supported by the Kafka Message Broker
+	ReplayFromBroker bool `json:"ReplayFromBroker"`
 }
 
-// Config describes EAA JSON config file
+// Config describes EAA JSON config file. InstanceID identifies the EAA
+// instance among instances sharing the Message Broker, it has to be stable
+// across restarts and defaults to the hostname.
 type Config struct {
-	TLSEndpoint        string        `json:"TlsEndpoint"`
-	OpenEndpoint       string        `json:"OpenEndpoint"`
-	ValidationEndpoint string        `json:"ValidationEndpoint"`
-	HeartbeatInterval  util.Duration `json:"HeartbeatInterval"`
-	Certs              CertsInfo     `json:"Certs"`
-	KafkaBroker        string        `json:"KafkaBroker"`
+	InstanceID         string                 `json:"InstanceID"`
+	TLSEndpoint        string                 `json:"TlsEndpoint"`
+	OpenEndpoint       string                 `json:"OpenEndpoint"`
+	ValidationEndpoint string                 `json:"ValidationEndpoint"`
+	HeartbeatInterval  util.Duration          `json:"HeartbeatInterval"`
+	Certs              CertsInfo              `json:"Certs"`
+	KafkaBroker        string                 `json:"KafkaBroker"`
+	MsgBroker          MsgBrokerConfig        `json:"MsgBroker"`
+	OfflineQueue       OfflineQueueConfig     `json:"OfflineQueue"`
+	Acknowledgements   AcknowledgementsConfig `json:"Acknowledgements"`
+	Websocket          WebsocketConfig        `json:"Websocket"`
+	HealthChecks       HealthChecksConfig     `json:"HealthChecks"`
+	Authorization      AuthorizationConfig    `json:"Authorization"`
+	AppValidation      AppValidationConfig    `json:"AppValidation"`
+	Credentials        CredentialsConfig      `json:"Credentials"`
+	Limits             LimitsConfig           `json:"Limits"`
+	Metrics            MetricsConfig          `json:"Metrics"`
+	StateStore         StateStoreConfig       `json:"StateStore"`
+	Egress             EgressConfig           `json:"Egress"`
+	Ingestion          IngestionConfig        `json:"Ingestion"`
+	History            HistoryConfig          `json:"History"`
 }
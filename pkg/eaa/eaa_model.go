@@ -3,7 +3,12 @@
 
 package eaa
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/smart-edge-open/edgeservices/pkg/util"
+)
 
 // NotificationDescriptor describes a type used in EAA API
 type NotificationDescriptor struct {
@@ -13,6 +18,11 @@ type NotificationDescriptor struct {
 	Version string `json:"version,omitempty"`
 	// Human readable description of notification
 	Description string `json:"description,omitempty"`
+	// JSON Schema of the notification payload, optional
+	Schema json.RawMessage `json:"schema,omitempty"`
+	// Filter expression selecting notifications by their payload, used in
+	// subscriptions only
+	Filter string `json:"filter,omitempty"`
 }
 
 // NotificationFromProducer describes a type used in EAA API
@@ -28,6 +38,8 @@ type NotificationFromProducer struct {
 
 // NotificationToConsumer describes a type used in EAA API
 type NotificationToConsumer struct {
+	// Unique ID of notification, used to acknowledge it
+	ID string `json:"id,omitempty"`
 	// Name of notification
 	Name string `json:"name,omitempty"`
 	// Version of notification
@@ -39,6 +51,42 @@ type NotificationToConsumer struct {
 	URN URN `json:"producer,omitempty"`
 }
 
+// HistoricNotification is a notification with the time it was published
+type HistoricNotification struct {
+	Notification NotificationToConsumer `json:"notification"`
+	Timestamp    time.Time              `json:"timestamp"`
+}
+
+// NotificationHistory is a list of past notifications ordered by the time
+// they were published
+type NotificationHistory struct {
+	Notifications []HistoricNotification `json:"notifications"`
+	// Set if more notifications match the query than the limit. Without
+	// since the latest notifications are returned, with since the oldest
+	// ones are and the rest is returned with the timestamp of the last
+	// notification as since.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// NotificationAck is sent by a consumer over the websocket to acknowledge
+// a received notification
+type NotificationAck struct {
+	// ID of acknowledged notification
+	ID string `json:"id"`
+}
+
+// ErrorResponse is a problem details body of an EAA API error response
+type ErrorResponse struct {
+	// Machine-readable error code, e.g. malformed_body
+	Code string `json:"code"`
+	// HTTP status code of the response
+	Status int `json:"status"`
+	// Human readable description of the error
+	Message string `json:"message"`
+	// Detailed list of problems, e.g. schema validation errors
+	Details []string `json:"details,omitempty"`
+}
+
 // NotificationMessage is a message sent/received by a message broker
 type NotificationMessage struct {
 	Notification *NotificationFromProducer
@@ -48,6 +96,8 @@ type NotificationMessage struct {
 // ServiceList JSON struct
 type ServiceList struct {
 	Services []Service `json:"services,omitempty"`
+	// Cursor of the next page of services, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 // Service JSON struct
@@ -58,12 +108,33 @@ type Service struct {
 	Status        string                   `json:"status,omitempty"`
 	Notifications []NotificationDescriptor `json:"notifications,omitempty"`
 	Info          json.RawMessage          `json:"info,omitempty"`
+	HealthCheck   *HealthCheck             `json:"health_check,omitempty"`
+}
+
+// HealthCheck describes how EAA probes the endpoint of a service.
+// Values left empty are taken from the HealthChecks section of EAA config.
+type HealthCheck struct {
+	// Type of the probe: http, tcp or grpc
+	Type string `json:"type"`
+	// Path requested by http probes, e.g. /healthz
+	Path string `json:"path,omitempty"`
+	// Service name checked by grpc probes, empty checks the whole server
+	Service string `json:"service,omitempty"`
+	// Time between probes
+	Interval util.Duration `json:"interval,omitempty"`
+	// Time limit of a single probe
+	Timeout util.Duration `json:"timeout,omitempty"`
+	// Number of consecutive failed probes after which the service
+	// is deregistered
+	FailureThreshold int `json:"failure_threshold,omitempty"`
 }
 
 // ServiceMessage is a message sent/received by a message broker
 type ServiceMessage struct {
 	Svc    *Service `json:"service"`
 	Action string   `json:"action"`
+	// ID of the EAA instance that published the message
+	Origin string `json:"origin,omitempty"`
 }
 
 // ServiceMessage 'Action' values
@@ -72,6 +143,12 @@ const (
 	serviceActionDeregister = "deregister"
 )
 
+// Service 'Status' values set by health checks
+const (
+	serviceStatusHealthy   = "healthy"
+	serviceStatusUnhealthy = "unhealthy"
+)
+
 // SubscriptionList JSON struct
 type SubscriptionList struct {
 	Subscriptions []Subscription `json:"subscriptions,omitempty"`
@@ -90,6 +167,69 @@ type Subscription struct {
 	Notifications []NotificationDescriptor `json:"notifications,omitempty"`
 }
 
+// EgressTargetList JSON struct
+type EgressTargetList struct {
+	Targets []EgressTarget `json:"targets,omitempty"`
+}
+
+// EgressTarget forwards notifications matching its subscriptions out of EAA,
+// to a webhook or to a Kafka topic. Values left empty are taken from the
+// Egress section of EAA config.
+type EgressTarget struct {
+	// Unique name of the target
+	Name string `json:"name"`
+	// Type of the target: webhook or kafka
+	Type string `json:"type"`
+	// Notifications forwarded to the target, subscribed like by a consumer
+	Subscriptions []Subscription `json:"subscriptions"`
+	// Settings of a webhook target
+	Webhook *WebhookEgress `json:"webhook,omitempty"`
+	// Settings of a kafka target
+	Kafka *KafkaEgress `json:"kafka,omitempty"`
+	// Number of retries of a failed delivery before the notification
+	// is dropped
+	MaxRetries int `json:"max_retries,omitempty"`
+	// Time before the first retry, doubled by each next one
+	RetryInterval util.Duration `json:"retry_interval,omitempty"`
+	// Maximum time between retries
+	MaxRetryInterval util.Duration `json:"max_retry_interval,omitempty"`
+}
+
+// WebhookEgress describes a webhook notifications are POSTed to
+type WebhookEgress struct {
+	// URL of the webhook
+	URL string `json:"url"`
+	// Key of the HMAC-SHA256 signature of the request body, requests aren't
+	// signed if empty. It is never returned by EAA API.
+	Secret string `json:"secret,omitempty"`
+	// Time limit of a single request
+	Timeout util.Duration `json:"timeout,omitempty"`
+	// Root CA of the webhook server certificate, system roots if empty.
+	// CAPath is a file on the EAA host, it's allowed only in targets
+	// of EAA config. CA is PEM-encoded.
+	CAPath string `json:"ca_path,omitempty"`
+	CA     string `json:"ca,omitempty"`
+}
+
+// KafkaEgress describes an external Kafka topic notifications are
+// produced to
+type KafkaEgress struct {
+	// Addresses of the Kafka brokers
+	Brokers []string `json:"brokers"`
+	// Topic notifications are produced to
+	Topic string `json:"topic"`
+	// Root CA of the brokers, TLS is used if set
+	CAPath string `json:"ca_path,omitempty"`
+	// Client certificate and its key
+	CertPath string `json:"cert_path,omitempty"`
+	KeyPath  string `json:"key_path,omitempty"`
+	// PEM-encoded alternatives of the files above, which are allowed only
+	// in targets of EAA config. The key is never returned by EAA API.
+	CA   string `json:"ca,omitempty"`
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
 // SubscriptionMessage is a message sent/received by a message broker
 type SubscriptionMessage struct {
 	ClientCommonName string
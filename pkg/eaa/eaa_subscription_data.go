@@ -16,6 +16,16 @@ type ConsumerSubscription struct {
 	// map of producer id to slice of subscriber ids
 	serviceSubscriptions map[string]SubscriberIds
 	notification         NotificationDescriptor
+
+	// pattern of a wildcard subscription, nil if the subscription key
+	// matches notifications exactly
+	pattern *notificationPattern
+
+	// map of subscriber id to the filter of its namespace subscription
+	namespaceFilters map[string]*notificationFilter
+	// map of producer id to a map of subscriber id to the filter of its
+	// service subscription
+	serviceFilters map[string]map[string]*notificationFilter
 }
 
 // UniqueNotif stores information about unique notification. It is used as
@@ -31,6 +41,36 @@ type UniqueNotif struct {
 type NotificationSubscriptions struct {
 	sync.RWMutex
 	m map[UniqueNotif]*ConsumerSubscription
+
+	// keys of m containing patterns, they are matched against
+	// every notification
+	patterns map[UniqueNotif]struct{}
+}
+
+// matching returns subscriptions to a notification: the exact one and
+// the ones with a matching pattern. The caller has to lock the map.
+func (nS *NotificationSubscriptions) matching(key UniqueNotif) []*ConsumerSubscription {
+	var subs []*ConsumerSubscription
+	if conSub, ok := nS.m[key]; ok {
+		subs = append(subs, conSub)
+	}
+	for patternKey := range nS.patterns {
+		if conSub := nS.m[patternKey]; patternKey != key && conSub.pattern.matches(key) {
+			subs = append(subs, conSub)
+		}
+	}
+	return subs
+}
+
+// matchesNamespace reports whether there is a pattern subscription to
+// notifications of a namespace. The caller has to lock the map.
+func (nS *NotificationSubscriptions) matchesNamespace(namespace string) bool {
+	for patternKey := range nS.patterns {
+		if nS.m[patternKey].pattern.matchesNamespace(namespace) {
+			return true
+		}
+	}
+	return false
 }
 
 // RemoveSubscriber delete consumer ID from subscribers list
@@ -49,41 +89,155 @@ func (sI *SubscriberIds) RemoveSubscriber(commonName string) bool {
 // initNamespaceNotification initializes structs for given
 // NamespaceNotif struct to allow for subscription
 func initNamespaceNotification(key UniqueNotif, notif NotificationDescriptor,
-	eaaCtx *Context) {
+	eaaCtx *Context) error {
 	if _, ok := eaaCtx.subscriptionInfo.m[key]; !ok {
+		var pattern *notificationPattern
+		if isNotificationPattern(key) {
+			var err error
+			if pattern, err = compileNotificationPattern(key); err != nil {
+				return err
+			}
+		}
+
+		// Filters are stored per subscriber
+		notif.Filter = ""
 		conSub := &ConsumerSubscription{
 			namespaceSubscriptions: SubscriberIds{},
 			serviceSubscriptions:   map[string]SubscriberIds{},
 			notification:           notif,
+			pattern:                pattern,
 		}
 		eaaCtx.subscriptionInfo.m[key] = conSub
+
+		if pattern != nil {
+			if eaaCtx.subscriptionInfo.patterns == nil {
+				eaaCtx.subscriptionInfo.patterns = make(map[UniqueNotif]struct{})
+			}
+			eaaCtx.subscriptionInfo.patterns[key] = struct{}{}
+		}
 	}
+	return nil
 }
 
 // initServiceNotification initializes structs for given
 // NamespaceNotif struct + serviceID, to allow for subscription
 func initServiceNotification(key UniqueNotif, serviceID string,
-	notif NotificationDescriptor, eaaCtx *Context) {
-	initNamespaceNotification(key, notif, eaaCtx)
+	notif NotificationDescriptor, eaaCtx *Context) error {
+	if err := initNamespaceNotification(key, notif, eaaCtx); err != nil {
+		return err
+	}
 
 	if _, ok := eaaCtx.subscriptionInfo.m[key].
 		serviceSubscriptions[serviceID]; !ok {
 		eaaCtx.subscriptionInfo.m[key].serviceSubscriptions[serviceID] =
 			SubscriberIds{}
 	}
+	return nil
+}
+
+// setNamespaceFilter sets the filter of a namespace subscriber,
+// nil filter removes it
+func (cs *ConsumerSubscription) setNamespaceFilter(subID string,
+	filter *notificationFilter) {
+	if filter == nil {
+		delete(cs.namespaceFilters, subID)
+		return
+	}
+	if cs.namespaceFilters == nil {
+		cs.namespaceFilters = make(map[string]*notificationFilter)
+	}
+	cs.namespaceFilters[subID] = filter
+}
+
+// setServiceFilter sets the filter of a service subscriber,
+// nil filter removes it
+func (cs *ConsumerSubscription) setServiceFilter(serviceID string, subID string,
+	filter *notificationFilter) {
+	if filter == nil {
+		delete(cs.serviceFilters[serviceID], subID)
+		return
+	}
+	if cs.serviceFilters == nil {
+		cs.serviceFilters = make(map[string]map[string]*notificationFilter)
+	}
+	if cs.serviceFilters[serviceID] == nil {
+		cs.serviceFilters[serviceID] = make(map[string]*notificationFilter)
+	}
+	cs.serviceFilters[serviceID][subID] = filter
+}
+
+// subscriberNotification returns the notification descriptor with
+// the filter of a subscriber
+func (cs *ConsumerSubscription) subscriberNotification(
+	filter *notificationFilter) NotificationDescriptor {
+	notif := cs.notification
+	if filter != nil {
+		notif.Filter = filter.expr
+	}
+	return notif
+}
+
+// acceptsNotification reports whether a notification from a producer
+// passes the filters of a subscriber. The subscriber receives it if any of
+// its namespace or service subscriptions accepts it.
+func (cs *ConsumerSubscription) acceptsNotification(subID string, serviceID string,
+	payload *filterPayload) bool {
+
+	var filters []*notificationFilter
+	for _, id := range cs.namespaceSubscriptions {
+		if id == subID {
+			filters = append(filters, cs.namespaceFilters[subID])
+			break
+		}
+	}
+	for _, id := range cs.serviceSubscriptions[serviceID] {
+		if id == subID {
+			filters = append(filters, cs.serviceFilters[serviceID][subID])
+			break
+		}
+	}
+
+	for _, filter := range filters {
+		if filter == nil {
+			return true
+		}
+		value, err := payload.get()
+		if err != nil {
+			log.Warningf("Couldn't decode notification payload for filters of %s: %v",
+				subID, err)
+			return false
+		}
+		if filter.matchPayload(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyAcceptsNotification reports whether any of subscriptions accepts
+// a notification for a subscriber
+func anyAcceptsNotification(subs []*ConsumerSubscription, subID string, serviceID string,
+	payload *filterPayload) bool {
+	for _, conSub := range subs {
+		if conSub.acceptsNotification(subID, serviceID, payload) {
+			return true
+		}
+	}
+	return false
 }
 
 // addNamespaceSubscriptionToList adds a namespace subscription
 // to a list of subscriptions
 func (sL *SubscriptionList) addNamespaceSubscriptionToList(
-	nameNotif UniqueNotif, eaaCtx *Context) {
+	nameNotif UniqueNotif, commonName string, eaaCtx *Context) {
 	found := false
+	conSub := eaaCtx.subscriptionInfo.m[nameNotif]
+	notif := conSub.subscriberNotification(conSub.namespaceFilters[commonName])
 
 	for i, s := range sL.Subscriptions {
 		if s.URN.ID == "" && s.URN.Namespace == nameNotif.namespace {
 			sL.Subscriptions[i].Notifications = append(
-				sL.Subscriptions[i].Notifications,
-				eaaCtx.subscriptionInfo.m[nameNotif].notification)
+				sL.Subscriptions[i].Notifications, notif)
 			found = true
 			break
 		}
@@ -95,9 +249,7 @@ func (sL *SubscriptionList) addNamespaceSubscriptionToList(
 					ID:        "",
 					Namespace: nameNotif.namespace,
 				},
-				Notifications: []NotificationDescriptor{
-					eaaCtx.subscriptionInfo.m[nameNotif].notification,
-				},
+				Notifications: []NotificationDescriptor{notif},
 			})
 	}
 }
@@ -105,15 +257,16 @@ func (sL *SubscriptionList) addNamespaceSubscriptionToList(
 // addServiceSubscriptionToList adds a service subscription
 // to a list of subscriptions
 func (sL *SubscriptionList) addServiceSubscriptionToList(
-	nameNotif UniqueNotif, srvID string, eaaCtx *Context) {
+	nameNotif UniqueNotif, srvID string, commonName string, eaaCtx *Context) {
 	found := false
+	conSub := eaaCtx.subscriptionInfo.m[nameNotif]
+	notif := conSub.subscriberNotification(conSub.serviceFilters[srvID][commonName])
 
 	for i, s := range sL.Subscriptions {
 		if s.URN.Namespace == nameNotif.namespace &&
 			s.URN.ID == srvID {
 			sL.Subscriptions[i].Notifications = append(
-				sL.Subscriptions[i].Notifications,
-				eaaCtx.subscriptionInfo.m[nameNotif].notification)
+				sL.Subscriptions[i].Notifications, notif)
 			found = true
 			break
 		}
@@ -125,9 +278,7 @@ func (sL *SubscriptionList) addServiceSubscriptionToList(
 					ID:        srvID,
 					Namespace: nameNotif.namespace,
 				},
-				Notifications: []NotificationDescriptor{
-					eaaCtx.subscriptionInfo.m[nameNotif].notification,
-				},
+				Notifications: []NotificationDescriptor{notif},
 			})
 	}
 }
@@ -4,13 +4,418 @@
 package eaa
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
 )
 
-// ConsumerConnection stores websocket connection of a consumer
+// ConsumerConnection stores websocket connection or notification stream of
+// a consumer
 type ConsumerConnection struct {
 
 	// The details of the websocket connection between the agent and the
 	// consumer app.
 	connection *websocket.Conn
+
+	// The writer that sends notifications over the websocket connection.
+	writer *consumerWriter
+
+	// The notification stream of a consumer app that uses Server-Sent Events
+	// or long polling instead of a websocket.
+	stream *notificationStream
+}
+
+// isAssigned checks if a consumer connection is ready to deliver notifications
+func (c ConsumerConnection) isAssigned() bool {
+	return c.connection != nil || c.stream != nil
+}
+
+// newConsumerConnection creates a consumer connection for a websocket.
+// Its writer has to be started once the connection is ready to send notifications.
+func newConsumerConnection(commonName string, conn *websocket.Conn,
+	eaaCtx *Context) ConsumerConnection {
+
+	return ConsumerConnection{
+		connection: conn,
+		writer:     newConsumerWriter(commonName, conn, eaaCtx),
+	}
+}
+
+// Websocket outbound buffer overflow policies
+const (
+	overflowDropOldest = "drop-oldest"
+	overflowDropNewest = "drop-newest"
+	overflowDisconnect = "disconnect"
+)
+
+// Default values of the Websocket section of the EAA config
+const (
+	defaultWsOutboundBufferSize = 256
+	defaultWsOverflowPolicy     = overflowDropOldest
+	defaultWsWriteTimeout       = 10 * time.Second
+	defaultWsPingInterval       = 30 * time.Second
+	defaultWsPongTimeout        = 60 * time.Second
+	defaultLongPollIdleTimeout  = 60 * time.Second
+)
+
+func (c WebsocketConfig) outboundBufferSize() int {
+	if c.OutboundBufferSize <= 0 {
+		return defaultWsOutboundBufferSize
+	}
+	return c.OutboundBufferSize
+}
+
+func (c WebsocketConfig) overflowPolicy() string {
+	if c.OverflowPolicy == "" {
+		return defaultWsOverflowPolicy
+	}
+	return c.OverflowPolicy
+}
+
+func (c WebsocketConfig) writeTimeout() time.Duration {
+	if c.WriteTimeout.Duration <= 0 {
+		return defaultWsWriteTimeout
+	}
+	return c.WriteTimeout.Duration
+}
+
+func (c WebsocketConfig) pingInterval() time.Duration {
+	if c.PingInterval.Duration <= 0 {
+		return defaultWsPingInterval
+	}
+	return c.PingInterval.Duration
+}
+
+func (c WebsocketConfig) pongTimeout() time.Duration {
+	if c.PongTimeout.Duration <= 0 {
+		return defaultWsPongTimeout
+	}
+	return c.PongTimeout.Duration
+}
+
+func (c WebsocketConfig) longPollIdleTimeout() time.Duration {
+	if c.LongPollIdleTimeout.Duration <= 0 {
+		return defaultLongPollIdleTimeout
+	}
+	return c.LongPollIdleTimeout.Duration
+}
+
+// validate checks the Websocket section of the EAA config
+func (c WebsocketConfig) validate() error {
+	switch c.overflowPolicy() {
+	case overflowDropOldest, overflowDropNewest, overflowDisconnect:
+	default:
+		return fmt.Errorf("Unknown websocket overflow policy: %v", c.OverflowPolicy)
+	}
+
+	if c.pongTimeout() <= c.pingInterval() {
+		return fmt.Errorf("Websocket PongTimeout (%v) must be longer than PingInterval (%v)",
+			c.pongTimeout(), c.pingInterval())
+	}
+
+	return nil
+}
+
+// notificationDroppedError is returned when a notification is dropped
+// because of the outbound buffer overflow
+type notificationDroppedError struct {
+	error
+}
+
+// consumerWriter sends notifications to a consumer websocket from a dedicated
+// goroutine, so that a slow consumer doesn't stall delivery to other ones.
+// Notifications are buffered in the outbound channel and the overflow policy
+// decides what happens when the buffer is full.
+type consumerWriter struct {
+	sync.Mutex
+	commonName string
+	conn       *websocket.Conn
+	outbound   chan streamedNotification
+	// Signaled when the writer takes a notification from outbound
+	taken    chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	cfg      WebsocketConfig
+	eaaCtx   *Context
+}
+
+func newConsumerWriter(commonName string, conn *websocket.Conn,
+	eaaCtx *Context) *consumerWriter {
+
+	cfg := eaaCtx.cfg.Websocket
+	return &consumerWriter{
+		commonName: commonName,
+		conn:       conn,
+		outbound:   make(chan streamedNotification, cfg.outboundBufferSize()),
+		taken:      make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		cfg:        cfg,
+		eaaCtx:     eaaCtx,
+	}
+}
+
+// start runs the writer goroutine
+func (cw *consumerWriter) start() {
+	go cw.run()
+}
+
+// stop makes the writer goroutine exit. Notifications left in the outbound
+// buffer are redelivered.
+func (cw *consumerWriter) stop() {
+	cw.stopOnce.Do(func() {
+		close(cw.done)
+	})
+}
+
+// write sends a message with the write deadline set
+func (cw *consumerWriter) write(msgPayload []byte) error {
+	if err := cw.conn.SetWriteDeadline(time.Now().Add(cw.cfg.writeTimeout())); err != nil {
+		return err
+	}
+	return cw.conn.WriteMessage(websocket.TextMessage, msgPayload)
+}
+
+// enqueue buffers a notification for the writer goroutine without blocking
+func (cw *consumerWriter) enqueue(msgID string, msgPayload []byte) error {
+	cw.Lock()
+	defer cw.Unlock()
+
+	select {
+	case <-cw.done:
+		return errors.New("websocket connection closed")
+	default:
+	}
+
+	n := streamedNotification{msgID, msgPayload}
+	select {
+	case cw.outbound <- n:
+		return nil
+	default:
+	}
+
+	switch cw.cfg.overflowPolicy() {
+	case overflowDropOldest:
+		select {
+		case oldest := <-cw.outbound:
+			log.Warningf("Outbound buffer of %s is full, dropping notification %s",
+				cw.commonName, oldest.id)
+			untrackNotification(cw.commonName, oldest.id, cw.eaaCtx)
+			cw.eaaCtx.metrics.notificationDropped(oldest.payload)
+		default:
+		}
+		select {
+		case cw.outbound <- n:
+			return nil
+		default:
+			return notificationDroppedError{errors.New("outbound buffer is full")}
+		}
+	case overflowDisconnect:
+		log.Warningf("Outbound buffer of %s is full, disconnecting", cw.commonName)
+		cw.stop()
+		// consumerConnections may be locked by the caller
+		go removeConsumerConnection(cw.commonName, cw.conn, cw.eaaCtx)
+		return errors.New("outbound buffer is full, consumer disconnected")
+	default:
+		return notificationDroppedError{errors.New("outbound buffer is full")}
+	}
+}
+
+// enqueueWait buffers a notification for the writer goroutine. Unlike
+// enqueue, it waits for space in the outbound buffer instead of applying
+// the overflow policy. It's used to replay the offline queue of a consumer.
+func (cw *consumerWriter) enqueueWait(msgID string, msgPayload []byte) error {
+	n := streamedNotification{msgID, msgPayload}
+	for {
+		cw.Lock()
+		select {
+		case <-cw.done:
+			cw.Unlock()
+			return errors.New("websocket connection closed")
+		default:
+		}
+		select {
+		case cw.outbound <- n:
+			cw.Unlock()
+			return nil
+		default:
+		}
+		cw.Unlock()
+
+		select {
+		case <-cw.taken:
+		case <-cw.done:
+		}
+	}
+}
+
+// run writes buffered notifications and pings to the websocket until the
+// writer is stopped or the connection breaks
+func (cw *consumerWriter) run() {
+	ping := time.NewTicker(cw.cfg.pingInterval())
+	defer ping.Stop()
+
+	var failed []streamedNotification
+	defer func() {
+		cw.stop()
+		cw.redeliver(failed)
+	}()
+
+	for {
+		select {
+		case n := <-cw.outbound:
+			select {
+			case cw.taken <- struct{}{}:
+			default:
+			}
+			select {
+			case <-cw.done:
+				// The connection is being closed, don't write to it anymore
+				failed = append(failed, n)
+				return
+			default:
+			}
+			if err := cw.write(n.payload); err != nil {
+				log.Warningf("Failed to write to websocket of %s: %v", cw.commonName, err)
+				failed = append(failed, n)
+				removeConsumerConnection(cw.commonName, cw.conn, cw.eaaCtx)
+				return
+			}
+		case <-ping.C:
+			err := cw.conn.WriteControl(websocket.PingMessage, nil,
+				time.Now().Add(cw.cfg.writeTimeout()))
+			if err != nil {
+				log.Warningf("Failed to ping websocket of %s: %v", cw.commonName, err)
+				removeConsumerConnection(cw.commonName, cw.conn, cw.eaaCtx)
+				return
+			}
+		case <-cw.done:
+			return
+		}
+	}
+}
+
+// redeliver sends notifications that weren't written again. They reach
+// a new connection of the consumer if there is one, otherwise they are moved
+// to the offline queue.
+func (cw *consumerWriter) redeliver(failed []streamedNotification) {
+	cw.Lock()
+	for drained := false; !drained; {
+		select {
+		case n := <-cw.outbound:
+			failed = append(failed, n)
+		default:
+			drained = true
+		}
+	}
+	cw.Unlock()
+
+	for _, n := range failed {
+		err := sendNotificationToSubscriber(cw.commonName, n.id, n.payload, cw.eaaCtx)
+		if err != nil {
+			log.Warningf("Dropping notification %s for %s: %v", n.id, cw.commonName, err)
+			cw.eaaCtx.metrics.notificationDropped(n.payload)
+		}
+	}
+}
+
+// Types of notification streams
+const (
+	sseStream      = "sse"
+	longPollStream = "long-poll"
+)
+
+// Maximum number of notifications buffered in a notification stream
+const notificationStreamBufferSize = 1000
+
+// streamedNotification is a notification buffered in a notification stream
+type streamedNotification struct {
+	id      string
+	payload []byte
+}
+
+// notificationStream buffers notifications for a consumer that receives
+// them with Server-Sent Events or long polling
+type notificationStream struct {
+	kind          string
+	notifications chan streamedNotification
+	done          chan struct{}
+	closeOnce     sync.Once
+
+	// Long polls in progress. idleSince changes whenever a poll begins or
+	// ends, so that an expiry scheduled after the last poll can be detected.
+	pollLock  sync.Mutex
+	polls     int
+	idleSince int
+}
+
+func newNotificationStream(kind string) *notificationStream {
+	return &notificationStream{
+		kind:          kind,
+		notifications: make(chan streamedNotification, notificationStreamBufferSize),
+		done:          make(chan struct{}),
+	}
+}
+
+// push buffers a notification in the stream without blocking
+func (s *notificationStream) push(msgID string, msgPayload []byte) error {
+	select {
+	case <-s.done:
+		return errors.New("notification stream closed")
+	default:
+	}
+
+	select {
+	case s.notifications <- streamedNotification{msgID, msgPayload}:
+		return nil
+	default:
+		return errors.New("notification stream buffer is full")
+	}
+}
+
+// beginPoll marks a long poll of the stream in progress
+func (s *notificationStream) beginPoll() {
+	s.pollLock.Lock()
+	defer s.pollLock.Unlock()
+	s.polls++
+	s.idleSince++
+}
+
+// endPoll marks a long poll of the stream finished. It returns whether the
+// stream is idle and a value passed to isIdleSince to check it later.
+func (s *notificationStream) endPoll() (bool, int) {
+	s.pollLock.Lock()
+	defer s.pollLock.Unlock()
+	s.polls--
+	s.idleSince++
+	return s.polls == 0, s.idleSince
+}
+
+// isIdleSince reports whether the stream hasn't been polled since endPoll
+// returned idleSince
+func (s *notificationStream) isIdleSince(idleSince int) bool {
+	s.pollLock.Lock()
+	defer s.pollLock.Unlock()
+	return s.polls == 0 && s.idleSince == idleSince
+}
+
+// close stops the stream and returns notifications that weren't delivered
+func (s *notificationStream) close() []streamedNotification {
+	var left []streamedNotification
+
+	s.closeOnce.Do(func() {
+		close(s.done)
+		for {
+			select {
+			case n := <-s.notifications:
+				left = append(left, n)
+			default:
+				return
+			}
+		}
+	})
+
+	return left
 }
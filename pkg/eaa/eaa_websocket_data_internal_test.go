@@ -0,0 +1,220 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/gorilla/websocket"
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/smart-edge-open/edgeservices/pkg/util"
+	. "github.com/undefinedlabs/go-mpatch"
+)
+
+// startTestConsumerConnection creates a consumer connection with a running
+// writer. WriteMessage of websocket.Conn has to be patched by the test.
+func startTestConsumerConnection(commonName string, eaaCtx *Context) ConsumerConnection {
+	cc := newConsumerConnection(commonName, &websocket.Conn{}, eaaCtx)
+	cc.writer.start()
+	return cc
+}
+
+// stopTestConsumerConnections stops writers of all consumer connections
+func stopTestConsumerConnections(eaaCtx *Context) {
+	eaaCtx.consumerConnections.Lock()
+	defer eaaCtx.consumerConnections.Unlock()
+
+	for _, cc := range eaaCtx.consumerConnections.m {
+		if cc.writer != nil {
+			cc.writer.stop()
+		}
+	}
+}
+
+// outboundIDs returns IDs of notifications buffered in a writer
+func outboundIDs(cw *consumerWriter) []string {
+	var ids []string
+	for len(cw.outbound) > 0 {
+		ids = append(ids, (<-cw.outbound).id)
+	}
+	return ids
+}
+
+var _ = g.Describe("consumer websocket writer", func() {
+	var (
+		eaaContext *Context
+		patches    []*Patch
+		closed     chan struct{}
+	)
+
+	const consumer = "consumer:1"
+
+	patch := func(method string, replacement interface{}) {
+		p, err := PatchInstanceMethodByName(reflect.TypeOf(websocket.Conn{}), method,
+			replacement)
+		Expect(err).NotTo(HaveOccurred())
+		patches = append(patches, p)
+	}
+
+	g.BeforeEach(func() {
+		eaaContext = &Context{}
+		eaaContext.consumerConnections = consumerConns{m: make(map[string]ConsumerConnection)}
+		eaaContext.cfg.Websocket = WebsocketConfig{OutboundBufferSize: 2}
+
+		patches = nil
+		closed = make(chan struct{}, 1)
+		patch("Close", func(_ *websocket.Conn) error {
+			select {
+			case closed <- struct{}{}:
+			default:
+			}
+			return nil
+		})
+	})
+
+	g.AfterEach(func() {
+		stopTestConsumerConnections(eaaContext)
+		for _, p := range patches {
+			Expect(p.Unpatch()).To(Succeed())
+		}
+	})
+
+	g.Describe("WebsocketConfig", func() {
+		g.It("should accept defaults", func() {
+			Expect(WebsocketConfig{}.validate()).To(Succeed())
+			Expect(WebsocketConfig{}.overflowPolicy()).To(Equal(overflowDropOldest))
+		})
+
+		g.It("should reject an unknown overflow policy", func() {
+			Expect(WebsocketConfig{OverflowPolicy: "block"}.validate()).NotTo(Succeed())
+		})
+
+		g.It("should reject a pong timeout shorter than the ping interval", func() {
+			c := WebsocketConfig{
+				PingInterval: util.Duration{Duration: time.Minute},
+				PongTimeout:  util.Duration{Duration: time.Second},
+			}
+			Expect(c.validate()).NotTo(Succeed())
+		})
+	})
+
+	g.When("the outbound buffer is full", func() {
+		var cc ConsumerConnection
+
+		g.BeforeEach(func() {
+			cc = newConsumerConnection(consumer, &websocket.Conn{}, eaaContext)
+			eaaContext.consumerConnections.m[consumer] = cc
+
+			Expect(cc.writer.enqueue("1", []byte(`1`))).To(Succeed())
+			Expect(cc.writer.enqueue("2", []byte(`2`))).To(Succeed())
+		})
+
+		g.It("should drop the oldest notification with drop-oldest policy", func() {
+			Expect(cc.writer.enqueue("3", []byte(`3`))).To(Succeed())
+			Expect(outboundIDs(cc.writer)).To(Equal([]string{"2", "3"}))
+		})
+
+		g.It("should drop the new notification with drop-newest policy", func() {
+			cc.writer.cfg.OverflowPolicy = overflowDropNewest
+
+			err := cc.writer.enqueue("3", []byte(`3`))
+			Expect(err).To(BeAssignableToTypeOf(notificationDroppedError{}))
+			Expect(outboundIDs(cc.writer)).To(Equal([]string{"1", "2"}))
+		})
+
+		g.It("should disconnect the consumer with disconnect policy", func() {
+			cc.writer.cfg.OverflowPolicy = overflowDisconnect
+			err := cc.writer.enqueue("3", []byte(`3`))
+			Expect(err).To(HaveOccurred())
+			Expect(err).NotTo(BeAssignableToTypeOf(notificationDroppedError{}))
+			Expect(cc.writer.done).To(BeClosed())
+			// The connection is closed in the background, wait for it before
+			// Close is unpatched
+			Eventually(closed).Should(Receive())
+
+			eaaContext.consumerConnections.RLock()
+			defer eaaContext.consumerConnections.RUnlock()
+			Expect(eaaContext.consumerConnections.m).NotTo(HaveKey(consumer))
+		})
+
+		g.It("should wait for space when replaying the offline queue", func() {
+			cc.writer.cfg.OverflowPolicy = overflowDisconnect
+
+			result := make(chan error, 1)
+			go func() {
+				result <- cc.writer.enqueueWait("3", []byte(`3`))
+			}()
+			Consistently(result, 100*time.Millisecond).ShouldNot(Receive())
+			Expect(cc.writer.done).NotTo(BeClosed())
+
+			// Take a notification the way the writer goroutine does
+			Expect((<-cc.writer.outbound).id).To(Equal("1"))
+			cc.writer.taken <- struct{}{}
+
+			Eventually(result).Should(Receive(BeNil()))
+			Expect(outboundIDs(cc.writer)).To(Equal([]string{"2", "3"}))
+		})
+
+		g.It("should stop waiting when the consumer is disconnected", func() {
+			result := make(chan error, 1)
+			go func() {
+				result <- cc.writer.enqueueWait("3", []byte(`3`))
+			}()
+			Consistently(result, 100*time.Millisecond).ShouldNot(Receive())
+
+			cc.writer.stop()
+			Eventually(result).Should(Receive(HaveOccurred()))
+		})
+	})
+
+	g.When("writing to the websocket fails", func() {
+		var dir string
+
+		g.BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "eaaWebsocketWriter")
+			Expect(err).NotTo(HaveOccurred())
+			eaaContext.offlineQueue, err = openOfflineQueue(
+				OfflineQueueConfig{Path: filepath.Join(dir, "queue.db")})
+			Expect(err).NotTo(HaveOccurred())
+
+			patch("WriteMessage", func(_ *websocket.Conn, _ int, _ []byte) error {
+				return errors.New("unit test error")
+			})
+		})
+
+		g.AfterEach(func() {
+			Expect(eaaContext.offlineQueue.close()).To(Succeed())
+			os.RemoveAll(dir)
+		})
+
+		g.It("should remove the connection and queue the notification", func() {
+			eaaContext.consumerConnections.m[consumer] =
+				startTestConsumerConnection(consumer, eaaContext)
+
+			Expect(sendNotificationToSubscriber(consumer, "1", []byte(`1`), eaaContext)).
+				To(Succeed())
+
+			var queued []string
+			Eventually(func() []string {
+				_ = eaaContext.offlineQueue.replay(consumer,
+					func(_ string, msgPayload []byte) error {
+						queued = append(queued, string(msgPayload))
+						return nil
+					})
+				return queued
+			}).Should(Equal([]string{`1`}))
+
+			eaaContext.consumerConnections.RLock()
+			defer eaaContext.consumerConnections.RUnlock()
+			Expect(eaaContext.consumerConnections.m).NotTo(HaveKey(consumer))
+		})
+	})
+})
@@ -0,0 +1,567 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Types of egress targets
+const (
+	webhookEgressType = "webhook"
+	kafkaEgressType   = "kafka"
+)
+
+// Default values of the Egress section of the EAA config
+const (
+	defaultEgressQueueSize        = 1000
+	defaultEgressMaxRetries       = 5
+	defaultEgressRetryInterval    = time.Second
+	defaultEgressMaxRetryInterval = time.Minute
+)
+
+// egressSubscriberPrefix prefixes subscriber IDs egress targets subscribe
+// with. Target names can't contain ':', so the IDs never collide with Common
+// Names of consumers.
+const egressSubscriberPrefix = "egress/"
+
+// egressNameRegexp matches valid names of egress targets
+var egressNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func (c EgressConfig) queueSize() int {
+	if c.QueueSize <= 0 {
+		return defaultEgressQueueSize
+	}
+	return c.QueueSize
+}
+
+// egressSender delivers notifications to an external system
+type egressSender interface {
+	// send delivers a notification. Failures of type permanentEgressError
+	// are not retried.
+	send(msgID string, msgPayload []byte) error
+	close() error
+}
+
+// permanentEgressError is returned by an egressSender when a delivery
+// can't succeed on retry, e.g. when a webhook rejects the request
+type permanentEgressError struct {
+	error
+}
+
+// egressTargetNotFoundError is returned when an egress target doesn't exist
+type egressTargetNotFoundError struct {
+	error
+}
+
+// egressSenderFactory creates an egressSender of a target
+type egressSenderFactory func(target EgressTarget) (egressSender, error)
+
+// egressSenderFactories holds all available egress target types
+var egressSenderFactories = make(map[string]egressSenderFactory)
+
+// registerEgressSenderFactory makes an egress target type available. It is
+// meant to be called from init() of the file implementing the type.
+func registerEgressSenderFactory(targetType string, factory egressSenderFactory) {
+	if _, found := egressSenderFactories[targetType]; found {
+		panic(fmt.Sprintf("Egress sender factory for type '%v' already registered",
+			targetType))
+	}
+	egressSenderFactories[targetType] = factory
+}
+
+// egressTargets is a synchronized map of egress target names to their workers
+type egressTargets struct {
+	sync.RWMutex
+	m map[string]*egressWorker
+}
+
+// egressWorker forwards notifications to an egress target from a dedicated
+// goroutine, retrying failed deliveries with an exponential backoff
+type egressWorker struct {
+	target   EgressTarget
+	sender   egressSender
+	queue    chan streamedNotification
+	done     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+	eaaCtx   *Context
+
+	maxRetries       int
+	retryInterval    time.Duration
+	maxRetryInterval time.Duration
+}
+
+func newEgressWorker(target EgressTarget, sender egressSender,
+	eaaCtx *Context) *egressWorker {
+
+	cfg := eaaCtx.cfg.Egress
+	w := &egressWorker{
+		target:           target,
+		sender:           sender,
+		queue:            make(chan streamedNotification, cfg.queueSize()),
+		done:             make(chan struct{}),
+		stopped:          make(chan struct{}),
+		eaaCtx:           eaaCtx,
+		maxRetries:       defaultEgressMaxRetries,
+		retryInterval:    defaultEgressRetryInterval,
+		maxRetryInterval: defaultEgressMaxRetryInterval,
+	}
+
+	// Settings of the target take precedence over the config
+	for _, v := range []int{cfg.MaxRetries, target.MaxRetries} {
+		if v > 0 {
+			w.maxRetries = v
+		}
+	}
+	for _, v := range []time.Duration{cfg.RetryInterval.Duration,
+		target.RetryInterval.Duration} {
+		if v > 0 {
+			w.retryInterval = v
+		}
+	}
+	for _, v := range []time.Duration{cfg.MaxRetryInterval.Duration,
+		target.MaxRetryInterval.Duration} {
+		if v > 0 {
+			w.maxRetryInterval = v
+		}
+	}
+
+	return w
+}
+
+// backoff returns the time to wait before the next retry of a notification
+// that has been already retried a given number of times
+func (w *egressWorker) backoff(attempts int) time.Duration {
+	interval := w.retryInterval
+	for i := 0; i < attempts && interval < w.maxRetryInterval; i++ {
+		interval *= 2
+	}
+	if interval > w.maxRetryInterval {
+		interval = w.maxRetryInterval
+	}
+	return interval
+}
+
+// enqueue buffers a notification for the worker goroutine without blocking
+func (w *egressWorker) enqueue(msgID string, msgPayload []byte) error {
+	select {
+	case <-w.done:
+		return errors.New("egress target removed")
+	default:
+	}
+
+	select {
+	case w.queue <- streamedNotification{msgID, msgPayload}:
+		return nil
+	default:
+		return notificationDroppedError{errors.New("egress queue is full")}
+	}
+}
+
+// run delivers buffered notifications until the worker is stopped
+func (w *egressWorker) run() {
+	defer close(w.stopped)
+	for {
+		select {
+		case n := <-w.queue:
+			w.deliver(n)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// deliver sends a notification to the target, retrying on failure. The
+// notification is dropped once the retries are exhausted.
+func (w *egressWorker) deliver(n streamedNotification) {
+	for attempt := 0; ; attempt++ {
+		err := w.sender.send(n.id, n.payload)
+		if err == nil {
+			return
+		}
+
+		_, permanent := err.(permanentEgressError)
+		if permanent || attempt >= w.maxRetries {
+			log.Warningf("Dropping notification %s for egress target %s: %v", n.id,
+				w.target.Name, err)
+			w.eaaCtx.metrics.notificationDropped(n.payload)
+			return
+		}
+		log.Debugf("Delivery of notification %s to egress target %s failed: %v", n.id,
+			w.target.Name, err)
+
+		select {
+		case <-time.After(w.backoff(attempt)):
+		case <-w.done:
+			log.Warningf("Dropping notification %s for removed egress target %s", n.id,
+				w.target.Name)
+			w.eaaCtx.metrics.notificationDropped(n.payload)
+			return
+		}
+	}
+}
+
+// stop makes the worker goroutine exit and closes the sender. Notifications
+// left in the queue are dropped.
+func (w *egressWorker) stop() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+		<-w.stopped
+		if err := w.sender.close(); err != nil {
+			log.Warningf("Failed to close egress target %s: %v", w.target.Name, err)
+		}
+	})
+}
+
+// egressSubscriberID returns the subscriber ID of an egress target
+func egressSubscriberID(name string) string {
+	return egressSubscriberPrefix + name
+}
+
+// isEgressSubscriber reports whether a subscriber ID belongs to an egress
+// target
+func isEgressSubscriber(subID string) bool {
+	return strings.HasPrefix(subID, egressSubscriberPrefix)
+}
+
+// forwardToEgress passes a notification to the worker of an egress target
+func forwardToEgress(subID string, msgID string, msgPayload []byte, eaaCtx *Context) error {
+	name := strings.TrimPrefix(subID, egressSubscriberPrefix)
+
+	eaaCtx.egress.RLock()
+	w, found := eaaCtx.egress.m[name]
+	eaaCtx.egress.RUnlock()
+	if !found {
+		return egressTargetNotFoundError{fmt.Errorf("Egress target %v doesn't exist", name)}
+	}
+
+	return w.enqueue(msgID, msgPayload)
+}
+
+// validateEgressTarget checks an egress target and returns descriptions
+// of its problems
+func validateEgressTarget(target EgressTarget) []string {
+	var problems []string
+
+	if !egressNameRegexp.MatchString(target.Name) {
+		problems = append(problems, fmt.Sprintf("invalid name: %q", target.Name))
+	}
+	if _, found := egressSenderFactories[target.Type]; !found {
+		problems = append(problems, fmt.Sprintf("unknown type: %q", target.Type))
+	}
+	if len(target.Subscriptions) == 0 {
+		problems = append(problems, "no subscriptions")
+	}
+	for _, sub := range target.Subscriptions {
+		if sub.URN == nil || sub.URN.Namespace == "" {
+			problems = append(problems, "subscription without a namespace")
+			continue
+		}
+		if len(sub.Notifications) == 0 {
+			problems = append(problems, "subscription to "+sub.URN.String()+
+				" without notifications")
+		}
+		problems = append(problems,
+			validateSubscriptionPatterns(sub.URN.Namespace, sub.Notifications)...)
+		problems = append(problems, validateSubscriptionFilters(sub.Notifications)...)
+	}
+
+	return problems
+}
+
+// validateAPIEgressTarget checks an egress target added by the egress API
+// and returns descriptions of its problems. Such targets can't use files on
+// the EAA host and forward only to the allowed destinations.
+func validateAPIEgressTarget(target EgressTarget, cfg EgressConfig) []string {
+	var problems []string
+
+	if target.Webhook != nil {
+		if target.Webhook.CAPath != "" {
+			problems = append(problems, "file paths are not allowed: ca_path")
+		}
+		if u, err := url.Parse(target.Webhook.URL); err == nil && u.Host != "" {
+			port := u.Port()
+			if port == "" {
+				port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+			}
+			if !cfg.allowsDestination(u.Hostname(), port) {
+				problems = append(problems, "destination not allowed: "+u.Host)
+			}
+		}
+	}
+
+	if target.Kafka != nil {
+		for name, path := range map[string]string{"ca_path": target.Kafka.CAPath,
+			"cert_path": target.Kafka.CertPath, "key_path": target.Kafka.KeyPath} {
+			if path != "" {
+				problems = append(problems, "file paths are not allowed: "+name)
+			}
+		}
+		for _, broker := range target.Kafka.Brokers {
+			host, port, err := net.SplitHostPort(broker)
+			if err != nil {
+				host, port = broker, ""
+			}
+			if !cfg.allowsDestination(host, port) {
+				problems = append(problems, "destination not allowed: "+broker)
+			}
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
+// allowsDestination tells whether targets added by the egress API can
+// forward to a host and port
+func (c EgressConfig) allowsDestination(host string, port string) bool {
+	for _, allowed := range c.AllowedDestinations {
+		allowedHost, allowedPort, err := net.SplitHostPort(allowed)
+		if err != nil {
+			allowedHost, allowedPort = allowed, ""
+		}
+		if strings.EqualFold(allowedHost, host) &&
+			(allowedPort == "" || allowedPort == port) {
+			return true
+		}
+	}
+	return false
+}
+
+// egressTLSSettings are TLS settings of an egress target given either
+// by paths of files on the EAA host or by PEM-encoded values
+type egressTLSSettings struct {
+	caPath, certPath, keyPath string
+	ca, cert, key             string
+}
+
+// newEgressTLSConfig returns TLS config of connections to an egress target
+func newEgressTLSConfig(settings egressTLSSettings) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if settings.caPath != "" {
+		caPool, err := CreateAndSetCACertPool(settings.caPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to load egress target CA")
+		}
+		tlsConfig.RootCAs = caPool
+	} else if settings.ca != "" {
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM([]byte(settings.ca)) {
+			return nil, errors.New("Failed to parse egress target CA")
+		}
+		tlsConfig.RootCAs = caPool
+	}
+
+	if settings.certPath != "" {
+		cert, err := tls.LoadX509KeyPair(settings.certPath, settings.keyPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to load egress Cert/Key pair")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else if settings.cert != "" {
+		cert, err := tls.X509KeyPair([]byte(settings.cert), []byte(settings.key))
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to parse egress Cert/Key pair")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// addEgressTarget starts forwarding notifications to an egress target.
+// The target subscribes to notifications like a consumer does.
+func addEgressTarget(target EgressTarget, eaaCtx *Context) error {
+	if problems := validateEgressTarget(target); len(problems) > 0 {
+		return fmt.Errorf("Invalid egress target %v: %v", target.Name,
+			strings.Join(problems, "; "))
+	}
+
+	sender, err := egressSenderFactories[target.Type](target)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create egress target %v", target.Name)
+	}
+	w := newEgressWorker(target, sender, eaaCtx)
+
+	eaaCtx.egress.Lock()
+	if _, found := eaaCtx.egress.m[target.Name]; found {
+		eaaCtx.egress.Unlock()
+		_ = sender.close()
+		return objectAlreadyExistsError{fmt.Errorf("Egress target %v already exists",
+			target.Name)}
+	}
+	if eaaCtx.egress.m == nil {
+		eaaCtx.egress.m = make(map[string]*egressWorker)
+	}
+	eaaCtx.egress.m[target.Name] = w
+	eaaCtx.egress.Unlock()
+
+	go w.run()
+
+	subID := egressSubscriberID(target.Name)
+	for _, sub := range target.Subscriptions {
+		if err = addSubscription(subID, sub, eaaCtx); err != nil {
+			_ = removeEgressTarget(target.Name, eaaCtx)
+			return errors.Wrapf(err, "Failed to subscribe egress target %v", target.Name)
+		}
+	}
+
+	log.Infof("Added %s egress target %s", target.Type, target.Name)
+	return nil
+}
+
+// removeEgressTarget unsubscribes an egress target and stops its worker
+func removeEgressTarget(name string, eaaCtx *Context) error {
+	eaaCtx.egress.RLock()
+	_, found := eaaCtx.egress.m[name]
+	eaaCtx.egress.RUnlock()
+	if !found {
+		return egressTargetNotFoundError{fmt.Errorf("Egress target %v doesn't exist", name)}
+	}
+
+	// Subscriptions are removed first, so that no notification is passed
+	// to the worker once it's stopped
+	if err := removeAllSubscriptions(egressSubscriberID(name), eaaCtx); err != nil {
+		return errors.Wrapf(err, "Failed to unsubscribe egress target %v", name)
+	}
+
+	eaaCtx.egress.Lock()
+	w, found := eaaCtx.egress.m[name]
+	delete(eaaCtx.egress.m, name)
+	eaaCtx.egress.Unlock()
+	if found {
+		w.stop()
+	}
+
+	log.Infof("Removed egress target %s", name)
+	return nil
+}
+
+// listEgressTargets returns egress targets ordered by name. Webhook secrets
+// and keys of Kafka client certificates are left out.
+func listEgressTargets(eaaCtx *Context) []EgressTarget {
+	eaaCtx.egress.RLock()
+	targets := make([]EgressTarget, 0, len(eaaCtx.egress.m))
+	for _, w := range eaaCtx.egress.m {
+		target := w.target
+		if target.Webhook != nil {
+			webhook := *target.Webhook
+			webhook.Secret = ""
+			target.Webhook = &webhook
+		}
+		if target.Kafka != nil {
+			kafka := *target.Kafka
+			kafka.Key = ""
+			target.Kafka = &kafka
+		}
+		targets = append(targets, target)
+	}
+	eaaCtx.egress.RUnlock()
+
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+	return targets
+}
+
+// startEgressTargets adds egress targets declared in the EAA config
+func startEgressTargets(eaaCtx *Context) error {
+	for _, target := range eaaCtx.cfg.Egress.Targets {
+		if err := addEgressTarget(target, eaaCtx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopEgressTargets removes all egress targets
+func stopEgressTargets(eaaCtx *Context) {
+	for _, target := range listEgressTargets(eaaCtx) {
+		if err := removeEgressTarget(target.Name, eaaCtx); err != nil {
+			log.Errf("Failed to remove egress target %s: %s", target.Name, err.Error())
+		}
+	}
+}
+
+// GetEgressTargets implements https API
+func GetEgressTargets(w http.ResponseWriter, r *http.Request) {
+	eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err := json.NewEncoder(w).Encode(EgressTargetList{Targets: listEgressTargets(eaaCtx)})
+	if err != nil {
+		log.Errf("Egress targets encoding error: %s", err.Error())
+	}
+}
+
+// AddEgressTarget implements https API
+func AddEgressTarget(w http.ResponseWriter, r *http.Request) {
+	eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
+
+	var target EgressTarget
+	if err := json.NewDecoder(r.Body).Decode(&target); err != nil {
+		log.Errf("Add Egress Target: %s", err.Error())
+		writeMalformedBodyError(w, err)
+		return
+	}
+
+	problems := append(validateEgressTarget(target),
+		validateAPIEgressTarget(target, eaaCtx.cfg.Egress)...)
+	if len(problems) > 0 {
+		log.Err("Add Egress Target: invalid target")
+		writeErrorResponse(w, http.StatusBadRequest, ErrorResponse{
+			Code:    errorCodeInvalidRequest,
+			Message: "Invalid egress target",
+			Details: problems,
+		})
+		return
+	}
+
+	err := addEgressTarget(target, eaaCtx)
+	if err != nil {
+		log.Errf("Add Egress Target: %s", err.Error())
+		if _, exists := err.(objectAlreadyExistsError); exists {
+			writeError(w, http.StatusConflict, errorCodeInvalidRequest,
+				"Egress target already exists")
+			return
+		}
+		writeError(w, http.StatusBadRequest, errorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// RemoveEgressTarget implements https API
+func RemoveEgressTarget(w http.ResponseWriter, r *http.Request) {
+	eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
+
+	err := removeEgressTarget(mux.Vars(r)["name"], eaaCtx)
+	if err != nil {
+		log.Errf("Remove Egress Target: %s", err.Error())
+		if _, notFound := err.(egressTargetNotFoundError); notFound {
+			writeError(w, http.StatusNotFound, errorCodeNotFound,
+				"Egress target doesn't exist")
+			return
+		}
+		writeInternalError(w, "Failed to remove the egress target")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
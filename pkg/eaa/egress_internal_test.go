@@ -0,0 +1,386 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/smart-edge-open/edgeservices/pkg/util"
+)
+
+// webhookRecorder is a webhook responding with queued status codes and
+// recording received requests
+type webhookRecorder struct {
+	sync.Mutex
+	statuses []int
+	headers  []http.Header
+	bodies   []string
+}
+
+func (rec *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	rec.Lock()
+	defer rec.Unlock()
+	rec.headers = append(rec.headers, r.Header)
+	rec.bodies = append(rec.bodies, string(body))
+	status := http.StatusNoContent
+	if len(rec.statuses) > 0 {
+		status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (rec *webhookRecorder) requests() int {
+	rec.Lock()
+	defer rec.Unlock()
+	return len(rec.bodies)
+}
+
+var _ = g.Describe("egress", func() {
+	var (
+		eaaCtx   *Context
+		recorder *webhookRecorder
+		webhook  *httptest.Server
+	)
+
+	camera := URN{Namespace: "video", ID: "camera-1"}
+
+	webhookTarget := func(name string, filter string) EgressTarget {
+		return EgressTarget{
+			Name: name,
+			Type: webhookEgressType,
+			Subscriptions: []Subscription{{URN: &URN{Namespace: "video"},
+				Notifications: []NotificationDescriptor{
+					{Name: "motion", Version: "1.0", Filter: filter}}}},
+			Webhook: &WebhookEgress{URL: webhook.URL, Secret: "s3cret"},
+		}
+	}
+
+	notify := func(msgID string, payload string) {
+		Expect(sendNotificationToSubscribers(camera, &NotificationFromProducer{
+			Name: "motion", Version: "1.0", Payload: json.RawMessage(payload)},
+			msgID, eaaCtx)).To(Succeed())
+	}
+
+	g.BeforeEach(func() {
+		eaaCtx = &Context{}
+		eaaCtx.serviceInfo.m = make(map[string]Service)
+		eaaCtx.subscriptionInfo.m = make(map[UniqueNotif]*ConsumerSubscription)
+		eaaCtx.consumerConnections.m = make(map[string]ConsumerConnection)
+		eaaCtx.serviceHealth.m = make(map[string]*serviceHealthState)
+		eaaCtx.MsgBrokerCtx = &brokerMock{}
+		eaaCtx.cfg.Egress.RetryInterval = util.Duration{Duration: 10 * time.Millisecond}
+
+		recorder = &webhookRecorder{}
+		webhook = httptest.NewServer(recorder)
+	})
+
+	g.AfterEach(func() {
+		stopEgressTargets(eaaCtx)
+		webhook.Close()
+	})
+
+	g.It("should forward subscribed notifications to a signed webhook", func() {
+		Expect(addEgressTarget(webhookTarget("cloud", "score > 0.5"), eaaCtx)).To(Succeed())
+
+		notify("id-1", `{"score": 0.9}`)
+		notify("id-2", `{"score": 0.1}`)
+		Eventually(recorder.requests).Should(Equal(1))
+		Consistently(recorder.requests, 100*time.Millisecond).Should(Equal(1))
+
+		recorder.Lock()
+		defer recorder.Unlock()
+		var notif NotificationToConsumer
+		Expect(json.Unmarshal([]byte(recorder.bodies[0]), &notif)).To(Succeed())
+		Expect(notif.ID).To(Equal("id-1"))
+		Expect(notif.URN).To(Equal(camera))
+		Expect(recorder.headers[0].Get(webhookNotificationIDHeader)).To(Equal("id-1"))
+		Expect(recorder.headers[0].Get(webhookSignatureHeader)).To(Equal(
+			signWebhookPayload([]byte("s3cret"), []byte(recorder.bodies[0]))))
+		Expect(recorder.headers[0].Get(webhookSignatureHeader)).To(HavePrefix("sha256="))
+	})
+
+	g.It("should retry failed webhook requests", func() {
+		recorder.statuses = []int{http.StatusServiceUnavailable,
+			http.StatusTooManyRequests, http.StatusOK}
+		Expect(addEgressTarget(webhookTarget("cloud", ""), eaaCtx)).To(Succeed())
+
+		notify("id-1", `{}`)
+		Eventually(recorder.requests).Should(Equal(3))
+		Consistently(recorder.requests, 100*time.Millisecond).Should(Equal(3))
+	})
+
+	g.It("should drop notifications rejected by the webhook or out of retries", func() {
+		recorder.statuses = []int{http.StatusBadRequest,
+			http.StatusInternalServerError, http.StatusInternalServerError}
+		target := webhookTarget("cloud", "")
+		target.MaxRetries = 1
+		Expect(addEgressTarget(target, eaaCtx)).To(Succeed())
+
+		notify("id-1", `{}`)
+		Eventually(recorder.requests).Should(Equal(1))
+		notify("id-2", `{}`)
+		Eventually(recorder.requests).Should(Equal(3))
+		Consistently(recorder.requests, 100*time.Millisecond).Should(Equal(3))
+	})
+
+	g.It("should produce notifications to an external Kafka topic", func() {
+		produced := make(chan struct{}, 1)
+		newKafkaEgressProducer = func(brokers []string,
+			config *sarama.Config) (sarama.SyncProducer, error) {
+
+			Expect(brokers).To(ConsistOf("kafka.cloud:9092"))
+			producer := mocks.NewSyncProducer(g.GinkgoT(), config)
+			producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(val []byte) error {
+				var notif NotificationToConsumer
+				if err := json.Unmarshal(val, &notif); err != nil {
+					return err
+				}
+				Expect(notif.ID).To(Equal("id-1"))
+				produced <- struct{}{}
+				return nil
+			})
+			return producer, nil
+		}
+		defer func() { newKafkaEgressProducer = sarama.NewSyncProducer }()
+
+		Expect(addEgressTarget(EgressTarget{
+			Name: "analytics",
+			Type: kafkaEgressType,
+			Subscriptions: []Subscription{{URN: &camera,
+				Notifications: []NotificationDescriptor{{Name: "motion", Version: "1.0"}}}},
+			Kafka: &KafkaEgress{Brokers: []string{"kafka.cloud:9092"}, Topic: "edge-events"},
+		}, eaaCtx)).To(Succeed())
+
+		notify("id-1", `{}`)
+		Eventually(produced).Should(Receive())
+		Expect(removeEgressTarget("analytics", eaaCtx)).To(Succeed())
+	})
+
+	g.It("should unsubscribe a removed target", func() {
+		Expect(addEgressTarget(webhookTarget("cloud", ""), eaaCtx)).To(Succeed())
+		Expect(addEgressTarget(webhookTarget("cloud", ""), eaaCtx)).
+			To(BeAssignableToTypeOf(objectAlreadyExistsError{}))
+
+		Expect(removeEgressTarget("cloud", eaaCtx)).To(Succeed())
+		Expect(removeEgressTarget("cloud", eaaCtx)).
+			To(BeAssignableToTypeOf(egressTargetNotFoundError{}))
+
+		notify("id-1", `{}`)
+		Consistently(recorder.requests, 100*time.Millisecond).Should(BeZero())
+	})
+
+	g.It("should start targets declared in the config", func() {
+		eaaCtx.cfg.Egress.Targets = []EgressTarget{webhookTarget("cloud", "")}
+		Expect(startEgressTargets(eaaCtx)).To(Succeed())
+		notify("id-1", `{}`)
+		Eventually(recorder.requests).Should(Equal(1))
+
+		stopEgressTargets(eaaCtx)
+		invalid := webhookTarget("in:valid", "")
+		invalid.Type = "ftp"
+		eaaCtx.cfg.Egress.Targets = []EgressTarget{invalid}
+		err := startEgressTargets(eaaCtx)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("invalid name"))
+		Expect(err.Error()).To(ContainSubstring("unknown type"))
+	})
+
+	g.When("managed by the egress API", func() {
+		var policyDir string
+
+		admin := &x509.Certificate{Subject: pkix.Name{CommonName: "ops:admin",
+			OrganizationalUnit: []string{"operators"}}}
+		consumer := &x509.Certificate{Subject: pkix.Name{CommonName: "consumer:1"}}
+
+		serve := func(cert *x509.Certificate, method string, path string,
+			body string) *httptest.ResponseRecorder {
+
+			request := httptest.NewRequest(method, path, strings.NewReader(body))
+			request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+			response := httptest.NewRecorder()
+			NewEaaRouter(eaaCtx).ServeHTTP(response, request)
+			return response
+		}
+
+		g.BeforeEach(func() {
+			var err error
+			policyDir, err = ioutil.TempDir("", "eaa-egress")
+			Expect(err).NotTo(HaveOccurred())
+
+			eaaCtx.cfg.Authorization.PolicyPath = filepath.Join(policyDir, "policy.json")
+			Expect(ioutil.WriteFile(eaaCtx.cfg.Authorization.PolicyPath, []byte(`{"rules": [
+				{"organizational_unit": "operators", "actions": ["manage_egress"]},
+				{"actions": ["subscribe"]}
+			]}`), 0600)).To(Succeed())
+			Expect(reloadAuthorizationPolicy(eaaCtx)).To(Succeed())
+
+			eaaCtx.cfg.Egress.AllowedDestinations = []string{"127.0.0.1", "kafka.cloud:9092"}
+		})
+
+		g.AfterEach(func() {
+			os.RemoveAll(policyDir)
+		})
+
+		g.It("should add, list and remove targets", func() {
+			body, err := json.Marshal(webhookTarget("cloud", ""))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(serve(admin, "POST", "/v1/egress/targets", string(body)).Code).
+				To(Equal(http.StatusCreated))
+			Expect(serve(admin, "POST", "/v1/egress/targets", string(body)).Code).
+				To(Equal(http.StatusConflict))
+
+			response := serve(admin, "GET", "/v1/egress/targets", "")
+			Expect(response.Code).To(Equal(http.StatusOK))
+			var list EgressTargetList
+			Expect(json.NewDecoder(response.Body).Decode(&list)).To(Succeed())
+			Expect(list.Targets).To(HaveLen(1))
+			Expect(list.Targets[0].Name).To(Equal("cloud"))
+			Expect(list.Targets[0].Webhook.URL).To(Equal(webhook.URL))
+			Expect(list.Targets[0].Webhook.Secret).To(BeEmpty())
+
+			Expect(serve(admin, "DELETE", "/v1/egress/targets/cloud", "").Code).
+				To(Equal(http.StatusNoContent))
+			Expect(serve(admin, "DELETE", "/v1/egress/targets/cloud", "").Code).
+				To(Equal(http.StatusNotFound))
+		})
+
+		g.It("should reject invalid targets", func() {
+			response := serve(admin, "POST", "/v1/egress/targets",
+				`{"name": "cloud", "type": "webhook"}`)
+			Expect(response.Code).To(Equal(http.StatusBadRequest))
+			Expect(decodeErrorResponse(response).Details).To(ContainElement("no subscriptions"))
+
+			target := webhookTarget("cloud", "")
+			target.Webhook.URL = "ftp://cloud"
+			body, err := json.Marshal(target)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(serve(admin, "POST", "/v1/egress/targets", string(body)).Code).
+				To(Equal(http.StatusBadRequest))
+		})
+
+		g.It("should reject files on the EAA host and destinations that aren't allowed",
+			func() {
+				kafkaTarget := func(kafka KafkaEgress) EgressTarget {
+					return EgressTarget{Name: "analytics", Type: kafkaEgressType,
+						Subscriptions: []Subscription{{URN: &camera,
+							Notifications: []NotificationDescriptor{{Name: "motion",
+								Version: "1.0"}}}},
+						Kafka: &kafka}
+				}
+				withCA := webhookTarget("cloud", "")
+				withCA.Webhook.CAPath = "/etc/eaa/rootCA.pem"
+				internal := webhookTarget("cloud", "")
+				internal.Webhook.URL = "http://10.0.0.1/hook"
+
+				for _, tc := range []struct {
+					target  EgressTarget
+					problem string
+				}{
+					{withCA, "file paths are not allowed: ca_path"},
+					{internal, "destination not allowed: 10.0.0.1"},
+				} {
+					body, err := json.Marshal(tc.target)
+					Expect(err).NotTo(HaveOccurred())
+					response := serve(admin, "POST", "/v1/egress/targets", string(body))
+					Expect(response.Code).To(Equal(http.StatusBadRequest))
+					Expect(decodeErrorResponse(response).Details).To(Equal([]string{tc.problem}))
+				}
+
+				body, err := json.Marshal(kafkaTarget(KafkaEgress{
+					Brokers: []string{"kafka.cloud:9092", "kafka.cloud:9093"},
+					Topic:   "edge-events", CertPath: "/etc/eaa/key.pem",
+					KeyPath: "/etc/eaa/key.pem"}))
+				Expect(err).NotTo(HaveOccurred())
+				response := serve(admin, "POST", "/v1/egress/targets", string(body))
+				Expect(response.Code).To(Equal(http.StatusBadRequest))
+				Expect(decodeErrorResponse(response).Details).To(Equal([]string{
+					"destination not allowed: kafka.cloud:9093",
+					"file paths are not allowed: cert_path",
+					"file paths are not allowed: key_path",
+				}))
+				Expect(listEgressTargets(eaaCtx)).To(BeEmpty())
+			})
+
+		g.It("should use inline credentials and leave the key out of the list", func() {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).NotTo(HaveOccurred())
+			template := &x509.Certificate{
+				SerialNumber: big.NewInt(1),
+				Subject:      pkix.Name{CommonName: "edge"},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+			}
+			der, err := x509.CreateCertificate(rand.Reader, template, template,
+				key.Public(), key)
+			Expect(err).NotTo(HaveOccurred())
+			keyDER, err := x509.MarshalECPrivateKey(key)
+			Expect(err).NotTo(HaveOccurred())
+			certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+				Bytes: der}))
+			keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY",
+				Bytes: keyDER}))
+
+			newKafkaEgressProducer = func(brokers []string,
+				config *sarama.Config) (sarama.SyncProducer, error) {
+
+				Expect(config.Net.TLS.Enable).To(BeTrue())
+				Expect(config.Net.TLS.Config.Certificates).To(HaveLen(1))
+				Expect(config.Net.TLS.Config.RootCAs).NotTo(BeNil())
+				return mocks.NewSyncProducer(g.GinkgoT(), config), nil
+			}
+			defer func() { newKafkaEgressProducer = sarama.NewSyncProducer }()
+
+			body, err := json.Marshal(EgressTarget{Name: "analytics", Type: kafkaEgressType,
+				Subscriptions: []Subscription{{URN: &camera,
+					Notifications: []NotificationDescriptor{{Name: "motion", Version: "1.0"}}}},
+				Kafka: &KafkaEgress{Brokers: []string{"kafka.cloud:9092"},
+					Topic: "edge-events", CA: certPEM, Cert: certPEM, Key: keyPEM}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(serve(admin, "POST", "/v1/egress/targets", string(body)).Code).
+				To(Equal(http.StatusCreated))
+
+			response := serve(admin, "GET", "/v1/egress/targets", "")
+			var list EgressTargetList
+			Expect(json.NewDecoder(response.Body).Decode(&list)).To(Succeed())
+			Expect(list.Targets).To(HaveLen(1))
+			Expect(list.Targets[0].Kafka.Cert).To(Equal(certPEM))
+			Expect(list.Targets[0].Kafka.Key).To(BeEmpty())
+		})
+
+		g.It("should allow only clients granted manage_egress", func() {
+			Expect(serve(consumer, "GET", "/v1/egress/targets", "").Code).
+				To(Equal(http.StatusForbidden))
+		})
+
+		g.It("should be disabled without an authorization policy", func() {
+			eaaCtx.authorization.policy = nil
+			response := serve(admin, "GET", "/v1/egress/targets", "")
+			Expect(response.Code).To(Equal(http.StatusForbidden))
+			Expect(decodeErrorResponse(response).Message).
+				To(ContainSubstring("authorization policy"))
+		})
+	})
+})
@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+// Header of Kafka records carrying the ID of the forwarded notification
+const kafkaEgressNotificationIDHeader = "eaa-notification-id"
+
+// newKafkaEgressProducer creates producers of kafka egress targets,
+// it allows dependency injection for unit tests
+var newKafkaEgressProducer = sarama.NewSyncProducer
+
+// kafkaEgressSender produces notifications to a topic of an external Kafka
+type kafkaEgressSender struct {
+	topic    string
+	producer sarama.SyncProducer
+}
+
+func init() {
+	registerEgressSenderFactory(kafkaEgressType, newKafkaEgressSender)
+}
+
+// newKafkaEgressSender is an egressSenderFactory of kafka targets
+func newKafkaEgressSender(target EgressTarget) (egressSender, error) {
+	if target.Kafka == nil || len(target.Kafka.Brokers) == 0 || target.Kafka.Topic == "" {
+		return nil, errors.New("Kafka egress target requires brokers and a topic")
+	}
+
+	config := sarama.NewConfig()
+	// Record headers require Kafka 0.11 or newer
+	config.Version = sarama.V0_11_0_0
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	// Failed deliveries are retried by the egress worker
+	config.Producer.Retry.Max = 0
+
+	settings := egressTLSSettings{
+		caPath:   target.Kafka.CAPath,
+		certPath: target.Kafka.CertPath,
+		keyPath:  target.Kafka.KeyPath,
+		ca:       target.Kafka.CA,
+		cert:     target.Kafka.Cert,
+		key:      target.Kafka.Key,
+	}
+	if settings != (egressTLSSettings{}) {
+		tlsConfig, err := newEgressTLSConfig(settings)
+		if err != nil {
+			return nil, err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	producer, err := newKafkaEgressProducer(target.Kafka.Brokers, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't create a Kafka producer")
+	}
+
+	return &kafkaEgressSender{topic: target.Kafka.Topic, producer: producer}, nil
+}
+
+// send produces a notification keyed by its producer URN, so that
+// notifications of a producer keep their order
+func (s *kafkaEgressSender) send(msgID string, msgPayload []byte) error {
+	var notif NotificationToConsumer
+	if err := json.Unmarshal(msgPayload, &notif); err != nil {
+		return permanentEgressError{errors.Wrap(err, "Couldn't unmarshal a notification")}
+	}
+
+	_, _, err := s.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: s.topic,
+		Key:   sarama.StringEncoder(notif.URN.String()),
+		Value: sarama.ByteEncoder(msgPayload),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte(kafkaEgressNotificationIDHeader), Value: []byte(msgID)},
+		},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Error when producing a notification to %v", s.topic)
+	}
+	return nil
+}
+
+func (s *kafkaEgressSender) close() error {
+	return s.producer.Close()
+}
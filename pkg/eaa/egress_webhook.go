@@ -0,0 +1,121 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Time limit of a webhook request used when the target doesn't set it
+const defaultWebhookTimeout = 10 * time.Second
+
+// Headers of webhook requests
+const (
+	// ID of the forwarded notification
+	webhookNotificationIDHeader = "X-EAA-Notification-ID"
+	// HMAC-SHA256 of the request body keyed with the webhook secret,
+	// in the form sha256=<hex digest>
+	webhookSignatureHeader = "X-EAA-Signature-256"
+)
+
+// webhookSender POSTs notifications to a webhook
+type webhookSender struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func init() {
+	registerEgressSenderFactory(webhookEgressType, newWebhookSender)
+}
+
+// newWebhookSender is an egressSenderFactory of webhook targets
+func newWebhookSender(target EgressTarget) (egressSender, error) {
+	if target.Webhook == nil || target.Webhook.URL == "" {
+		return nil, errors.New("Webhook egress target requires the webhook URL")
+	}
+	u, err := url.Parse(target.Webhook.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid webhook URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported webhook URL scheme: %v", u.Scheme)
+	}
+
+	tlsConfig, err := newEgressTLSConfig(egressTLSSettings{
+		caPath: target.Webhook.CAPath, ca: target.Webhook.CA})
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := target.Webhook.Timeout.Duration
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+
+	return &webhookSender{
+		url:    target.Webhook.URL,
+		secret: []byte(target.Webhook.Secret),
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// signWebhookPayload returns the value of the signature header of a payload
+func signWebhookPayload(secret []byte, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// send POSTs a notification to the webhook. Client errors other than
+// timeouts and rate limiting are permanent.
+func (s *webhookSender) send(msgID string, msgPayload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(msgPayload))
+	if err != nil {
+		return permanentEgressError{errors.Wrap(err, "Failed to create a webhook request")}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookNotificationIDHeader, msgID)
+	if len(s.secret) != 0 {
+		req.Header.Set(webhookSignatureHeader, signWebhookPayload(s.secret, msgPayload))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Webhook request failed")
+	}
+	// The body is drained to reuse the connection
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout ||
+		resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode >= 500:
+		return fmt.Errorf("Webhook responded with %v", resp.Status)
+	default:
+		return permanentEgressError{fmt.Errorf("Webhook responded with %v", resp.Status)}
+	}
+}
+
+func (s *webhookSender) close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,245 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Minimum length of ingestion tokens, shorter ones are easy to guess
+	minIngestionTokenLength = 16
+	// Time limit of reading request headers on the ingestion endpoint
+	ingestionReadHeaderTimeout = 10 * time.Second
+)
+
+// ingestionRoutes are served on the ingestion endpoint to devices publishing
+// with ingestion tokens
+var ingestionRoutes = Routes{
+	Route{
+		"IngestNotification",
+		http.MethodPost,
+		"/ingest",
+		IngestNotification,
+	},
+}
+
+// ingestionTokens maps SHA-256 digests of API tokens to their producers.
+// Tokens are looked up by digest, so that lookup time doesn't depend on
+// how much of a guessed token is correct.
+type ingestionTokens map[[sha256.Size]byte]IngestionToken
+
+// loadIngestionTokens validates tokens of the Ingestion section of EAA config
+func loadIngestionTokens(cfg IngestionConfig) (ingestionTokens, error) {
+	tokens := make(ingestionTokens)
+	var problems []string
+
+	for i, token := range cfg.Tokens {
+		if len(token.Token) < minIngestionTokenLength {
+			problems = append(problems, fmt.Sprintf("token %d is shorter than %d characters",
+				i, minIngestionTokenLength))
+		}
+		if urn, err := CommonNameStringToURN(token.Producer); err != nil ||
+			urn.Namespace == "" || urn.ID == "" {
+			problems = append(problems, fmt.Sprintf("token %d: invalid producer URN %q",
+				i, token.Producer))
+		}
+		notif := token.Notification
+		switch {
+		case notif.Name == "" || notif.Version == "":
+			problems = append(problems, fmt.Sprintf(
+				"token %d: notification requires a name and a version", i))
+		case isBuiltinNotification(notif.Name):
+			problems = append(problems, fmt.Sprintf("token %d: notification name %q is reserved",
+				i, notif.Name))
+		}
+		if notif.Filter != "" {
+			problems = append(problems, fmt.Sprintf("token %d: notification filter is not allowed",
+				i))
+		}
+
+		digest := sha256.Sum256([]byte(token.Token))
+		if _, found := tokens[digest]; found {
+			problems = append(problems, fmt.Sprintf("token %d is not unique", i))
+		}
+		tokens[digest] = token
+	}
+
+	for commonName, serv := range ingestionProducers(cfg.Tokens) {
+		for _, problem := range validateServiceSchemas(&serv) {
+			problems = append(problems, commonName+": "+problem)
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, errors.Errorf("Invalid ingestion tokens: %v", strings.Join(problems, "; "))
+	}
+	return tokens, nil
+}
+
+// ingestionProducers returns services of producers of ingestion tokens
+// by their Common Names. Descriptors of a notification are taken from the
+// first token publishing it.
+func ingestionProducers(tokens []IngestionToken) map[string]Service {
+	producers := make(map[string]Service)
+	for _, token := range tokens {
+		serv, found := producers[token.Producer]
+		if !found {
+			urn, err := CommonNameStringToURN(token.Producer)
+			if err != nil {
+				continue
+			}
+			serv = Service{URN: &urn, Description: "Producer of the ingestion endpoint"}
+		}
+
+		duplicate := false
+		for _, notif := range serv.Notifications {
+			if notif.Name == token.Notification.Name &&
+				notif.Version == token.Notification.Version {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			serv.Notifications = append(serv.Notifications, token.Notification)
+		}
+		producers[token.Producer] = serv
+	}
+	return producers
+}
+
+// registerIngestionProducers registers services of producers of ingestion
+// tokens. Like regular producers they stay registered after EAA stops.
+func registerIngestionProducers(eaaCtx *Context) error {
+	for commonName, serv := range ingestionProducers(eaaCtx.cfg.Ingestion.Tokens) {
+		data, err := json.Marshal(ServiceMessage{Svc: &serv, Action: serviceActionRegister,
+			Origin: eaaCtx.instanceID})
+		if err != nil {
+			return errors.Wrapf(err, "Failed to encode the service of %v", commonName)
+		}
+
+		err = eaaCtx.MsgBrokerCtx.publish(servicesTopic,
+			message.NewMessage(watermill.NewUUID(), data))
+		if err != nil {
+			return errors.Wrapf(err, "Failed to register the service of %v", commonName)
+		}
+		log.Infof("Registered ingestion producer %s", commonName)
+	}
+	return nil
+}
+
+// bearerToken returns the token of the Authorization header of a request
+func bearerToken(r *http.Request) string {
+	const scheme = "bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(scheme) || !strings.EqualFold(auth[:len(scheme)], scheme) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(scheme):])
+}
+
+// IngestNotification publishes the JSON body of a request as a notification
+// of the producer of the API token the request is authenticated with
+func IngestNotification(w http.ResponseWriter, r *http.Request) {
+	eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	token, found := eaaCtx.ingestionTokens[sha256.Sum256([]byte(bearerToken(r)))]
+	if !found {
+		log.Errf("Ingestion request from %s with an invalid token", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="eaa"`)
+		writeError(w, http.StatusUnauthorized, errorCodeUnauthorized,
+			"Request requires a valid bearer token")
+		return
+	}
+	commonName := token.Producer
+
+	if !allowPublish(commonName, eaaCtx) {
+		log.Errf("Publish rate limit of %s exceeded", commonName)
+		w.Header().Set("Retry-After", "1")
+		writeLimitExceeded(w, "Publish rate limit exceeded")
+		return
+	}
+
+	var payload json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		log.Errf("Error in Ingest Notification: %s", err.Error())
+		writeMalformedBodyError(w, err)
+		return
+	}
+
+	if !allowPayloadSize(commonName, payload, eaaCtx) {
+		log.Errf("Notification payload of %s exceeds the size limit", commonName)
+		writeError(w, http.StatusRequestEntityTooLarge, errorCodeLimitExceeded,
+			"Notification payload exceeds the size limit")
+		return
+	}
+
+	urn, err := CommonNameStringToURN(commonName)
+	if err != nil {
+		log.Errf("Invalid producer of an ingestion token: %s", err.Error())
+		writeInternalError(w, "Invalid producer of the token")
+		return
+	}
+
+	publishNotification(w, r, commonName, urn, &NotificationFromProducer{
+		Name:    token.Notification.Name,
+		Version: token.Notification.Version,
+		Payload: payload,
+	}, eaaCtx)
+}
+
+// NewIngestionRouter initializes the router of the ingestion endpoint
+func NewIngestionRouter(eaaCtx *Context) *mux.Router {
+	return newVersionedRouter(eaaCtx, ingestionRoutes)
+}
+
+// newIngestionTLSConfig returns the TLS config of the ingestion endpoint.
+// Bearer tokens are sent over TLS, devices are not asked for certificates.
+func newIngestionTLSConfig(eaaCtx *Context) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.NoClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			eaaCtx.serverCerts.RLock()
+			defer eaaCtx.serverCerts.RUnlock()
+			return eaaCtx.serverCerts.cert, nil
+		},
+	}
+}
+
+// runIngestionServer serves ingestionRoutes on the ingestion endpoint until
+// ctx is done
+func runIngestionServer(ctx context.Context, eaaCtx *Context) {
+	server := &http.Server{
+		Addr:              eaaCtx.cfg.Ingestion.Endpoint,
+		Handler:           NewIngestionRouter(eaaCtx),
+		TLSConfig:         newIngestionTLSConfig(eaaCtx),
+		ReadHeaderTimeout: ingestionReadHeaderTimeout,
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			log.Errf("Could not close EAA ingestion server: %#v", err)
+		}
+	}()
+
+	log.Infof("Serving EAA ingestion API on: %s", eaaCtx.cfg.Ingestion.Endpoint)
+	// The server certificate is provided by the TLS config to be reloaded
+	if err := server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+		log.Errf("Ingestion server error: %#v", err)
+	}
+}
@@ -0,0 +1,241 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = g.Describe("ingestion endpoint", func() {
+	const (
+		thermoToken = "thermo-token-0123456789"
+		doorToken   = "door-token-0123456789"
+	)
+
+	var (
+		eaaCtx   *Context
+		recorder *webhookRecorder
+		webhook  *httptest.Server
+	)
+
+	serve := func(token string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/v1/ingest", strings.NewReader(body))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		NewIngestionRouter(eaaCtx).ServeHTTP(response, request)
+		return response
+	}
+
+	services := func() map[string]Service {
+		eaaCtx.serviceInfo.RLock()
+		defer eaaCtx.serviceInfo.RUnlock()
+		m := make(map[string]Service)
+		for commonName, serv := range eaaCtx.serviceInfo.m {
+			m[commonName] = serv
+		}
+		return m
+	}
+
+	g.BeforeEach(func() {
+		eaaCtx = &Context{}
+		eaaCtx.serviceInfo.m = make(map[string]Service)
+		eaaCtx.subscriptionInfo.m = make(map[UniqueNotif]*ConsumerSubscription)
+		eaaCtx.consumerConnections.m = make(map[string]ConsumerConnection)
+		eaaCtx.notificationSchemas.m = make(map[UniqueNotif]*notificationSchema)
+		eaaCtx.serviceHealth.m = make(map[string]*serviceHealthState)
+		eaaCtx.MsgBrokerCtx = NewGoChannelMsgBroker(eaaCtx)
+		eaaCtx.cfg.Ingestion.Tokens = []IngestionToken{
+			{Token: thermoToken, Producer: "sensors:thermo-1",
+				Notification: NotificationDescriptor{Name: "temperature", Version: "1.0",
+					Schema: json.RawMessage(`{"type": "object", "required": ["celsius"]}`)}},
+			{Token: doorToken, Producer: "sensors:door-1",
+				Notification: NotificationDescriptor{Name: "opened", Version: "1.0"}},
+		}
+
+		var err error
+		eaaCtx.ingestionTokens, err = loadIngestionTokens(eaaCtx.cfg.Ingestion)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(eaaCtx.MsgBrokerCtx.addPublisher(servicesPublisher, servicesTopic, nil)).
+			To(Succeed())
+		Expect(eaaCtx.MsgBrokerCtx.addSubscriber(servicesSubscriber, servicesTopic, nil)).
+			To(Succeed())
+		Expect(registerIngestionProducers(eaaCtx)).To(Succeed())
+		Eventually(services).Should(HaveLen(2))
+
+		recorder = &webhookRecorder{}
+		webhook = httptest.NewServer(recorder)
+		Expect(addEgressTarget(EgressTarget{
+			Name: "cloud",
+			Type: webhookEgressType,
+			Subscriptions: []Subscription{{URN: &URN{Namespace: "sensors"},
+				Notifications: []NotificationDescriptor{
+					{Name: "temperature", Version: "1.0"}, {Name: "opened", Version: "1.0"}}}},
+			Webhook: &WebhookEgress{URL: webhook.URL},
+		}, eaaCtx)).To(Succeed())
+	})
+
+	g.AfterEach(func() {
+		stopEgressTargets(eaaCtx)
+		webhook.Close()
+		Expect(eaaCtx.MsgBrokerCtx.removeAll()).To(Succeed())
+	})
+
+	g.It("should register producers of the tokens", func() {
+		thermo := services()["sensors:thermo-1"]
+		Expect(thermo.URN).To(Equal(&URN{Namespace: "sensors", ID: "thermo-1"}))
+		Expect(thermo.Notifications).To(HaveLen(1))
+		Expect(thermo.Notifications[0].Name).To(Equal("temperature"))
+		Expect(getNotificationSchema(UniqueNotif{"sensors", "temperature", "1.0"}, eaaCtx)).
+			NotTo(BeNil())
+	})
+
+	g.It("should publish the body as a notification of the token producer", func() {
+		Expect(serve(doorToken, `{"door": "front"}`).Code).To(Equal(http.StatusAccepted))
+		Eventually(recorder.requests).Should(Equal(1))
+
+		recorder.Lock()
+		defer recorder.Unlock()
+		var notif NotificationToConsumer
+		Expect(json.Unmarshal([]byte(recorder.bodies[0]), &notif)).To(Succeed())
+		Expect(notif.URN).To(Equal(URN{Namespace: "sensors", ID: "door-1"}))
+		Expect(notif.Name).To(Equal("opened"))
+		Expect(notif.Version).To(Equal("1.0"))
+		Expect(notif.Payload).To(MatchJSON(`{"door": "front"}`))
+	})
+
+	g.It("should reject requests without a valid token", func() {
+		for _, token := range []string{"", "unknown-token-0123456789"} {
+			response := serve(token, `{}`)
+			Expect(response.Code).To(Equal(http.StatusUnauthorized))
+			Expect(response.Header().Get("WWW-Authenticate")).To(HavePrefix("Bearer"))
+			Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeUnauthorized))
+		}
+
+		request := httptest.NewRequest(http.MethodPost, "/v1/ingest", strings.NewReader(`{}`))
+		request.Header.Set("Authorization", "Basic "+doorToken)
+		response := httptest.NewRecorder()
+		NewIngestionRouter(eaaCtx).ServeHTTP(response, request)
+		Expect(response.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	g.It("should validate the body", func() {
+		response := serve(doorToken, `{"door": `)
+		Expect(response.Code).To(Equal(http.StatusBadRequest))
+		Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeMalformedBody))
+
+		response = serve(thermoToken, `{"fahrenheit": 70}`)
+		Expect(response.Code).To(Equal(http.StatusBadRequest))
+		Expect(decodeErrorResponse(response).Message).To(ContainSubstring("schema"))
+
+		Expect(serve(thermoToken, `{"celsius": 21}`).Code).To(Equal(http.StatusAccepted))
+		Eventually(recorder.requests).Should(Equal(1))
+	})
+
+	g.It("should apply the payload size limit of the producer", func() {
+		eaaCtx.cfg.Limits.MaxPayloadSize = 8
+		Expect(serve(doorToken, `{"door": "front"}`).Code).
+			To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(serve(doorToken, `{}`).Code).To(Equal(http.StatusAccepted))
+	})
+
+	g.It("should serve tokens only over TLS", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "eaa.openness"},
+			DNSNames:     []string{"eaa.openness"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		Expect(err).NotTo(HaveOccurred())
+		eaaCtx.serverCerts.cert = &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+		cert, err := x509.ParseCertificate(der)
+		Expect(err).NotTo(HaveOccurred())
+
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		eaaCtx.cfg.Ingestion.Endpoint = lis.Addr().String()
+		Expect(lis.Close()).To(Succeed())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go runIngestionServer(ctx, eaaCtx)
+
+		roots := x509.NewCertPool()
+		roots.AddCert(cert)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:    roots,
+			ServerName: "eaa.openness",
+		}}}
+		ingest := func(scheme string) (int, error) {
+			request, err := http.NewRequest(http.MethodPost,
+				scheme+"://"+eaaCtx.cfg.Ingestion.Endpoint+"/v1/ingest",
+				strings.NewReader(`{"door": "front"}`))
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("Authorization", "Bearer "+doorToken)
+			response, err := client.Do(request)
+			if err != nil {
+				return 0, err
+			}
+			response.Body.Close()
+			return response.StatusCode, nil
+		}
+
+		Eventually(func() error {
+			_, err := ingest("https")
+			return err
+		}).Should(Succeed())
+		Expect(ingest("https")).To(Equal(http.StatusAccepted))
+		Expect(ingest("http")).To(Equal(http.StatusBadRequest))
+
+		// Tokens are not accepted by the plaintext open endpoint
+		request := httptest.NewRequest(http.MethodPost, "/v1/ingest", strings.NewReader(`{}`))
+		request.Header.Set("Authorization", "Bearer "+doorToken)
+		response := httptest.NewRecorder()
+		NewOpenRouter(eaaCtx).ServeHTTP(response, request)
+		Expect(response.Code).To(Equal(http.StatusNotFound))
+	})
+
+	g.It("should reject invalid tokens in the config", func() {
+		_, err := loadIngestionTokens(IngestionConfig{Tokens: []IngestionToken{
+			{Token: "short", Producer: "sensors:a",
+				Notification: NotificationDescriptor{Name: "n", Version: "1"}},
+			{Token: doorToken, Producer: "sensors",
+				Notification: NotificationDescriptor{Name: "n", Version: "1"}},
+			{Token: doorToken, Producer: "sensors:b",
+				Notification: NotificationDescriptor{Name: builtinNotificationPrefix + "n",
+					Version: "1"}},
+			{Token: thermoToken, Producer: "sensors:c",
+				Notification: NotificationDescriptor{Name: "n", Version: "1",
+					Schema: json.RawMessage(`{"type": 5}`)}},
+		}})
+		Expect(err).To(HaveOccurred())
+		for _, problem := range []string{"token 0 is shorter", "token 1: invalid producer",
+			"token 2: notification name", "token 2 is not unique", "sensors:c: n 1"} {
+			Expect(err.Error()).To(ContainSubstring(problem))
+		}
+	})
+})
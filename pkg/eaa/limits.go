@@ -0,0 +1,188 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// AppUsage counts requests of an application, including those rejected
+// by the limits in the Limits section of EAA config
+type AppUsage struct {
+	// Notifications published by the application
+	Published uint64 `json:"published"`
+	// Notifications rejected by the publish rate limit
+	PublishRateLimited uint64 `json:"publish_rate_limited"`
+	// Notifications rejected by the payload size limit
+	PayloadTooLarge uint64 `json:"payload_too_large"`
+	// Subscription requests rejected by the subscription limit
+	SubscriptionsRejected uint64 `json:"subscriptions_rejected"`
+	// Notification requests rejected by the connection limit
+	ConnectionsRejected uint64 `json:"connections_rejected"`
+	// Notification requests currently open
+	Connections int `json:"connections"`
+}
+
+// appLimits holds publish rate limiters and usage of applications by
+// their Common Names
+type appLimits struct {
+	sync.Mutex
+	publishLimiters map[string]*rate.Limiter
+	usage           map[string]*AppUsage
+}
+
+func (c LimitsConfig) publishBurst() int {
+	if c.PublishBurst > 0 {
+		return c.PublishBurst
+	}
+	return int(math.Max(1, math.Ceil(c.PublishRate)))
+}
+
+// usageOf returns usage of an application, appLimits must be locked
+// by the caller
+func (l *appLimits) usageOf(commonName string) *AppUsage {
+	if l.usage == nil {
+		l.usage = make(map[string]*AppUsage)
+	}
+	usage, found := l.usage[commonName]
+	if !found {
+		usage = &AppUsage{}
+		l.usage[commonName] = usage
+	}
+	return usage
+}
+
+// recordUsage updates usage of an application
+func recordUsage(commonName string, eaaCtx *Context, update func(usage *AppUsage)) {
+	eaaCtx.limits.Lock()
+	defer eaaCtx.limits.Unlock()
+
+	update(eaaCtx.limits.usageOf(commonName))
+}
+
+// allowPublish takes a token from the publish rate limiter of a producer
+func allowPublish(commonName string, eaaCtx *Context) bool {
+	cfg := eaaCtx.cfg.Limits
+	if cfg.PublishRate <= 0 {
+		return true
+	}
+
+	eaaCtx.limits.Lock()
+	defer eaaCtx.limits.Unlock()
+
+	if eaaCtx.limits.publishLimiters == nil {
+		eaaCtx.limits.publishLimiters = make(map[string]*rate.Limiter)
+	}
+	limiter, found := eaaCtx.limits.publishLimiters[commonName]
+	if !found {
+		limiter = rate.NewLimiter(rate.Limit(cfg.PublishRate), cfg.publishBurst())
+		eaaCtx.limits.publishLimiters[commonName] = limiter
+	}
+
+	if !limiter.Allow() {
+		eaaCtx.limits.usageOf(commonName).PublishRateLimited++
+		return false
+	}
+	return true
+}
+
+// allowPayloadSize checks the payload size of a notification
+func allowPayloadSize(commonName string, payload json.RawMessage, eaaCtx *Context) bool {
+	maxSize := eaaCtx.cfg.Limits.MaxPayloadSize
+	if maxSize <= 0 || len(payload) <= maxSize {
+		return true
+	}
+
+	recordUsage(commonName, eaaCtx, func(usage *AppUsage) { usage.PayloadTooLarge++ })
+	return false
+}
+
+// allowSubscriptions checks if subscribing a consumer to notifications
+// doesn't exceed its subscription limit. Notifications the consumer is
+// already subscribed to are not counted again.
+func allowSubscriptions(commonName string, urn URN, subs []NotificationDescriptor,
+	eaaCtx *Context) (bool, error) {
+
+	maxSubs := eaaCtx.cfg.Limits.MaxSubscriptions
+	if maxSubs <= 0 {
+		return true, nil
+	}
+
+	current, err := getConsumerSubscriptions(commonName, eaaCtx)
+	if err != nil {
+		return false, err
+	}
+
+	subscribed := make(map[string]bool)
+	subscriptionKey := func(urn URN, notif NotificationDescriptor) string {
+		return urn.Namespace + "/" + urn.ID + "/" + notif.Name + "/" + notif.Version
+	}
+	for _, sub := range current.Subscriptions {
+		var subURN URN
+		if sub.URN != nil {
+			subURN = *sub.URN
+		}
+		for _, notif := range sub.Notifications {
+			subscribed[subscriptionKey(subURN, notif)] = true
+		}
+	}
+	for _, notif := range subs {
+		subscribed[subscriptionKey(urn, notif)] = true
+	}
+
+	if len(subscribed) > maxSubs {
+		recordUsage(commonName, eaaCtx, func(usage *AppUsage) { usage.SubscriptionsRejected++ })
+		return false, nil
+	}
+	return true, nil
+}
+
+// acquireConnection counts a notification request of a consumer, it returns
+// false if the consumer reached its connection limit. Each acquired
+// connection has to be released with releaseConnection.
+func acquireConnection(commonName string, eaaCtx *Context) bool {
+	eaaCtx.limits.Lock()
+	defer eaaCtx.limits.Unlock()
+
+	usage := eaaCtx.limits.usageOf(commonName)
+	maxConns := eaaCtx.cfg.Limits.MaxConnections
+	if maxConns > 0 && usage.Connections >= maxConns {
+		usage.ConnectionsRejected++
+		return false
+	}
+	usage.Connections++
+	return true
+}
+
+// releaseConnection stops counting a notification request of a consumer
+func releaseConnection(commonName string, eaaCtx *Context) {
+	recordUsage(commonName, eaaCtx, func(usage *AppUsage) { usage.Connections-- })
+}
+
+// writeLimitExceeded writes a response to a request rejected by a limit
+func writeLimitExceeded(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusTooManyRequests, errorCodeLimitExceeded, message)
+}
+
+// GetUsage implements https API
+func GetUsage(w http.ResponseWriter, r *http.Request) {
+	eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
+	commonName := r.TLS.PeerCertificates[0].Subject.CommonName
+
+	eaaCtx.limits.Lock()
+	usage := *eaaCtx.limits.usageOf(commonName)
+	eaaCtx.limits.Unlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(usage); err != nil {
+		log.Errf("Usage encoding error: %s", err.Error())
+		return
+	}
+	log.Debugf("Successfully processed GetUsage from %s", commonName)
+}
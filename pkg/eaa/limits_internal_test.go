@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = g.Describe("application limits", func() {
+	var eaaContext *Context
+
+	const (
+		producer = "video:camera-1"
+		consumer = "consumer:1"
+	)
+
+	usage := func(commonName string) AppUsage {
+		response := serveAs(eaaContext, commonName, "GET", "/v1/usage", "")
+		Expect(response.Code).To(Equal(http.StatusOK))
+
+		var u AppUsage
+		Expect(json.NewDecoder(response.Body).Decode(&u)).To(Succeed())
+		return u
+	}
+
+	g.BeforeEach(func() {
+		eaaContext = newTestContext()
+		eaaContext.serviceInfo.m[producer] = Service{}
+	})
+
+	g.It("should not limit applications by default", func() {
+		for i := 0; i < 10; i++ {
+			Expect(serveAs(eaaContext, producer, "POST", "/v1/notifications",
+				`{"name": "motion", "version": "1.0", "payload": {}}`).Code).
+				To(Equal(http.StatusAccepted))
+		}
+		Expect(usage(producer).Published).To(BeEquivalentTo(10))
+	})
+
+	g.It("should limit the publish rate of a producer", func() {
+		eaaContext.cfg.Limits.PublishRate = 0.001
+		eaaContext.cfg.Limits.PublishBurst = 2
+
+		publish := func() *httptest.ResponseRecorder {
+			return serveAs(eaaContext, producer, "POST", "/v1/notifications",
+				`{"name": "motion", "version": "1.0", "payload": {}}`)
+		}
+		Expect(publish().Code).To(Equal(http.StatusAccepted))
+		Expect(publish().Code).To(Equal(http.StatusAccepted))
+
+		response := publish()
+		Expect(response.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(response.Header().Get("Retry-After")).NotTo(BeEmpty())
+		Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeLimitExceeded))
+
+		Expect(usage(producer)).To(Equal(AppUsage{Published: 2, PublishRateLimited: 1}))
+	})
+
+	g.It("should limit the payload size of a notification", func() {
+		eaaContext.cfg.Limits.MaxPayloadSize = 16
+
+		Expect(serveAs(eaaContext, producer, "POST", "/v1/notifications",
+			`{"name": "motion", "version": "1.0", "payload": {"x": 1}}`).Code).
+			To(Equal(http.StatusAccepted))
+
+		response := serveAs(eaaContext, producer, "POST", "/v1/notifications",
+			`{"name": "motion", "version": "1.0", "payload": {"x": "0123456789"}}`)
+		Expect(response.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeLimitExceeded))
+
+		Expect(usage(producer).PayloadTooLarge).To(BeEquivalentTo(1))
+	})
+
+	g.It("should limit the number of subscriptions of a consumer", func() {
+		eaaContext.cfg.Limits.MaxSubscriptions = 2
+		Expect(addSubscriptionToNamespace(consumer, "video",
+			[]NotificationDescriptor{{Name: "motion", Version: "1.0"}}, eaaContext)).
+			To(Succeed())
+
+		// Subscribing again to the same notification is not counted
+		Expect(serveAs(eaaContext, consumer, "POST", "/v1/subscriptions/video",
+			`[{"name": "motion", "version": "1.0"}, {"name": "face", "version": "1.0"}]`).Code).
+			To(Equal(http.StatusCreated))
+		Expect(addSubscriptionToNamespace(consumer, "video",
+			[]NotificationDescriptor{{Name: "face", Version: "1.0"}}, eaaContext)).
+			To(Succeed())
+
+		response := serveAs(eaaContext, consumer, "POST", "/v1/subscriptions/video/camera-1",
+			`[{"name": "motion", "version": "1.0"}]`)
+		Expect(response.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(decodeErrorResponse(response).Code).To(Equal(errorCodeLimitExceeded))
+
+		Expect(usage(consumer).SubscriptionsRejected).To(BeEquivalentTo(1))
+	})
+
+	g.It("should limit open notification requests of a consumer", func() {
+		eaaContext.cfg.Limits.MaxConnections = 1
+		Expect(acquireConnection(consumer, eaaContext)).To(BeTrue())
+
+		response := serveAs(eaaContext, consumer, "GET", "/v1/notifications", "")
+		Expect(response.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(usage(consumer)).To(Equal(AppUsage{ConnectionsRejected: 1, Connections: 1}))
+
+		releaseConnection(consumer, eaaContext)
+		Expect(usage(consumer).Connections).To(BeZero())
+	})
+})
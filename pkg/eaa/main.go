@@ -14,7 +14,6 @@ import (
 	"path/filepath"
 	"sync"
 
-	"github.com/google/uuid"
 	logger "github.com/smart-edge-open/edgeservices/common/log"
 	"github.com/smart-edge-open/edgeservices/pkg/config"
 	"github.com/smart-edge-open/edgeservices/pkg/util"
@@ -33,17 +32,33 @@ type consumerConns struct {
 
 // Context holds all EAA structures
 type Context struct {
-	serviceInfo         services
-	consumerConnections consumerConns
-	subscriptionInfo    NotificationSubscriptions
-	certsEaaCa          Certs
-	cfg                 Config
-	MsgBrokerCtx        msgBroker
+	instanceID           string
+	serviceInfo          services
+	consumerConnections  consumerConns
+	subscriptionInfo     NotificationSubscriptions
+	certsEaaCa           Certs
+	cfg                  Config
+	MsgBrokerCtx         msgBroker
+	offlineQueue         *offlineQueue
+	unackedNotifications unackedNotifications
+	notificationSchemas  notificationSchemas
+	serviceHealth        serviceHealth
+	authorization        authorizationPolicyStore
+	appLookups           appLookupCache
+	credentialsLimiters  credentialsLimiters
+	serverCerts          serverCerts
+	limits               appLimits
+	metrics              *eaaMetrics
+	stateStore           stateStore
+	egress               egressTargets
+	ingestionTokens      ingestionTokens
+	history              notificationHistory
 }
 
 // Certs stores certs and keys for root ca and eaa
 type Certs struct {
 	eaa *CertKeyPair
+	ca  *CertKeyPair
 }
 
 var (
@@ -97,6 +112,12 @@ func InitEaaContext(cfgPath string, eaaCtx *Context) error {
 	eaaCtx.consumerConnections = consumerConns{m: make(map[string]ConsumerConnection)}
 	eaaCtx.subscriptionInfo = NotificationSubscriptions{
 		m: make(map[UniqueNotif]*ConsumerSubscription)}
+	eaaCtx.unackedNotifications = unackedNotifications{
+		m: make(map[string]map[string]*pendingNotification)}
+	eaaCtx.notificationSchemas = notificationSchemas{
+		m: make(map[UniqueNotif]*notificationSchema)}
+	eaaCtx.serviceHealth = serviceHealth{m: make(map[string]*serviceHealthState),
+		origins: make(map[string]string)}
 
 	var err error
 
@@ -106,11 +127,74 @@ func InitEaaContext(cfgPath string, eaaCtx *Context) error {
 		return err
 	}
 
+	if err = eaaCtx.cfg.Websocket.validate(); err != nil {
+		log.Errf("Invalid websocket config: %#v", err)
+		return err
+	}
+
+	if eaaCtx.instanceID = eaaCtx.cfg.InstanceID; eaaCtx.instanceID == "" {
+		if eaaCtx.instanceID, err = os.Hostname(); err != nil {
+			log.Errf("Failed to get the hostname as EAA instance ID: %#v", err)
+			return err
+		}
+	}
+
+	if err = eaaCtx.cfg.HealthChecks.validate(); err != nil {
+		log.Errf("Invalid health checks config: %#v", err)
+		return err
+	}
+
+	if eaaCtx.cfg.AppValidation.Enabled && eaaCtx.cfg.ValidationEndpoint == "" {
+		err = errors.New("Application validation requires ValidationEndpoint")
+		log.Errf("Invalid application validation config: %#v", err)
+		return err
+	}
+
+	if len(eaaCtx.cfg.Ingestion.Tokens) > 0 && eaaCtx.cfg.Ingestion.Endpoint == "" {
+		err = errors.New("Ingestion tokens require the ingestion Endpoint")
+		log.Errf("Invalid ingestion config: %#v", err)
+		return err
+	}
+	if eaaCtx.ingestionTokens, err = loadIngestionTokens(eaaCtx.cfg.Ingestion); err != nil {
+		log.Errf("Invalid ingestion config: %#v", err)
+		return err
+	}
+
+	eaaCtx.metrics = newEaaMetrics(eaaCtx)
+
+	if eaaCtx.cfg.Authorization.PolicyPath != "" {
+		if err = reloadAuthorizationPolicy(eaaCtx); err != nil {
+			log.Errf("Authorization policy error: %#v", err)
+			return err
+		}
+	}
+
 	if eaaCtx.certsEaaCa.eaa, err = InitEaaCert(eaaCtx.cfg.Certs); err != nil {
 		log.Errf("EAA cert creation error: %#v", err)
 		return err
 	}
 
+	if eaaCtx.cfg.Certs.CaRootKeyPath != "" {
+		if eaaCtx.certsEaaCa.ca, err = InitEaaCA(eaaCtx.cfg.Certs); err != nil {
+			log.Errf("EAA CA loading error: %#v", err)
+			return err
+		}
+	}
+
+	if eaaCtx.cfg.OfflineQueue.Path != "" {
+		if eaaCtx.offlineQueue, err = openOfflineQueue(eaaCtx.cfg.OfflineQueue); err != nil {
+			log.Errf("Offline queue creation error: %#v", err)
+			return err
+		}
+	}
+
+	if eaaCtx.cfg.StateStore.Path != "" {
+		if eaaCtx.stateStore, err = newStateStore(eaaCtx.cfg.StateStore); err != nil {
+			log.Errf("State store creation error: %#v", err)
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -119,26 +203,26 @@ func InitEaaContext(cfgPath string, eaaCtx *Context) error {
 func RunServer(parentCtx context.Context, eaaCtx *Context) error {
 	var err error
 
-	certPool, err := CreateAndSetCACertPool(eaaCtx.cfg.Certs.CaRootPath)
-	if err != nil {
-		log.Errf("Cert Pool error: %#v", err)
-	}
-
 	router := NewEaaRouter(eaaCtx)
 	server := &http.Server{
-		Addr: eaaCtx.cfg.TLSEndpoint,
-		TLSConfig: &tls.Config{
-			ClientAuth:   tls.RequireAndVerifyClientCert,
-			ClientCAs:    certPool,
-			MinVersion:   tls.VersionTLS12,
-			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
-		},
-		Handler: router,
+		Addr:      eaaCtx.cfg.TLSEndpoint,
+		TLSConfig: newServerTLSConfig(eaaCtx),
+		Handler:   router,
 	}
 
 	stopServerCh := make(chan bool, 2)
 	var lis net.Listener
 
+	if err = reloadServerCerts(eaaCtx); err != nil {
+		log.Errf("Server certificate error: %#v", err)
+		goto cleanup
+	}
+
+	// Restored state is updated by messages replayed by the Message Broker
+	if err = restoreState(eaaCtx); err != nil {
+		goto cleanup
+	}
+
 	// Add Publisher and Subscriber for Services topic
 	err = eaaCtx.MsgBrokerCtx.addPublisher(servicesPublisher, servicesTopic, nil)
 	if err != nil {
@@ -153,6 +237,14 @@ func RunServer(parentCtx context.Context, eaaCtx *Context) error {
 		goto cleanup
 	}
 
+	if err = registerIngestionProducers(eaaCtx); err != nil {
+		goto cleanup
+	}
+
+	if err = startEgressTargets(eaaCtx); err != nil {
+		goto cleanup
+	}
+
 	lis, err = net.Listen("tcp", eaaCtx.cfg.TLSEndpoint)
 	if err != nil {
 
@@ -177,13 +269,39 @@ func RunServer(parentCtx context.Context, eaaCtx *Context) error {
 
 	defer log.Info("Stopped EAA serving")
 
+	if eaaCtx.cfg.Acknowledgements.Enabled {
+		go runNotificationRetransmitter(parentCtx, eaaCtx)
+	}
+
+	if eaaCtx.cfg.HealthChecks.Enabled {
+		go runServiceHealthChecker(parentCtx, eaaCtx)
+	}
+
+	if eaaCtx.cfg.Authorization.PolicyPath != "" {
+		go runAuthorizationPolicyReloader(parentCtx, eaaCtx)
+	}
+
+	if eaaCtx.cfg.OpenEndpoint != "" {
+		go runOpenServer(parentCtx, eaaCtx)
+	}
+
+	if eaaCtx.cfg.Ingestion.Endpoint != "" {
+		go runIngestionServer(parentCtx, eaaCtx)
+	}
+
+	if eaaCtx.cfg.Metrics.Endpoint != "" && eaaCtx.metrics != nil {
+		go runMetricsServer(parentCtx, eaaCtx)
+	}
+
+	go runServerCertsReloader(parentCtx, eaaCtx)
+
 	log.Infof("Serving EAA on: %s", eaaCtx.cfg.TLSEndpoint)
 	util.Heartbeat(parentCtx, eaaCtx.cfg.HeartbeatInterval, func() {
 		// TODO: implementation of modules checking
 		log.Info("Heartbeat")
 	})
-	if err = server.ServeTLS(lis, eaaCtx.cfg.Certs.ServerCertPath,
-		eaaCtx.cfg.Certs.ServerKeyPath); err != http.ErrServerClosed {
+	// Certificates are provided by the TLS config to be reloaded on change
+	if err = server.ServeTLS(lis, "", ""); err != http.ErrServerClosed {
 		log.Errf("server.Serve error: %#v", err)
 		goto cleanup
 	} else {
@@ -192,6 +310,8 @@ func RunServer(parentCtx context.Context, eaaCtx *Context) error {
 	<-stopServerCh
 
 cleanup:
+	stopEgressTargets(eaaCtx)
+
 	cleanupErr := eaaCtx.MsgBrokerCtx.removeAll()
 	if cleanupErr != nil {
 		if err == nil {
@@ -201,6 +321,20 @@ cleanup:
 		}
 	}
 
+	if eaaCtx.offlineQueue != nil {
+		if cleanupErr = eaaCtx.offlineQueue.close(); cleanupErr != nil {
+			log.Errf("Failed to close the offline queue: %#v", cleanupErr)
+		}
+		eaaCtx.offlineQueue = nil
+	}
+
+	if eaaCtx.stateStore != nil {
+		if cleanupErr = eaaCtx.stateStore.close(); cleanupErr != nil {
+			log.Errf("Failed to close the state store: %#v", cleanupErr)
+		}
+		eaaCtx.stateStore = nil
+	}
+
 	return err
 }
 
@@ -214,21 +348,22 @@ func Run(parentCtx context.Context, cfgPath string) error {
 		return err
 	}
 
-	kafkaTLSConfig, err := newKafkaTLSConfig(eaaCtx.cfg.Certs.KafkaUserCertPath,
-		eaaCtx.cfg.Certs.KafkaUserKeyPath, eaaCtx.cfg.Certs.KafkaCAPath)
+	msgBrokerCtx, err := newMsgBroker(&eaaCtx)
 	if err != nil {
-		log.Errf("Failed to create a Kafka Message Broker: %#v", err)
+		log.Errf("Failed to create a Message Broker: %#v", err)
 		return err
 	}
-
-	// Each EAA instance should be in a different Consumer Group to get all Service Updates
-	instanceID := uuid.New()
-	msgBrokerCtx, err := NewKafkaMsgBroker(&eaaCtx, "EAA_"+instanceID.String(), kafkaTLSConfig)
-	if err != nil {
-		log.Errf("Failed to create a Kafka Message Broker: %#v", err)
-		return err
+	eaaCtx.MsgBrokerCtx = instrumentedBroker{msgBrokerCtx, eaaCtx.metrics}
+
+	if eaaCtx.cfg.History.Enabled && eaaCtx.cfg.History.ReplayFromBroker {
+		replayer, ok := msgBrokerCtx.(notificationReplayer)
+		if !ok {
+			err = errors.New("Message Broker can't replay notification history")
+			log.Errf("Invalid history config: %#v", err)
+			return err
+		}
+		eaaCtx.history.replayer = replayer
 	}
-	eaaCtx.MsgBrokerCtx = msgBrokerCtx
 
 	return RunServer(parentCtx, &eaaCtx)
 }
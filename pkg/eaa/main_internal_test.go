@@ -12,6 +12,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/ThreeDotsLabs/watermill-kafka/v2/pkg/kafka"
@@ -35,6 +36,7 @@ var _ = g.Describe("main internal errors", func() {
 		mockKafkaSubscriber     *mockEAA.MockKafkaSubscriber
 		patchLoadJSONConfig     *Patch
 		patchInitEaaCert        *Patch
+		patchReloadServerCerts  *Patch
 		patchLoadX509KeyPair    *Patch
 		patchReadFile           *Patch
 		patchAppendCertsFromPEM *Patch
@@ -97,6 +99,7 @@ var _ = g.Describe("main internal errors", func() {
 		})
 
 		patchInitEaaCert = patchMethod(InitEaaCert, func(_ CertsInfo) (*CertKeyPair, error) { return nil, nil })
+		patchReloadServerCerts = patchMethod(reloadServerCerts, func(_ *Context) error { return nil })
 
 		patchLoadX509KeyPair = patchMethod(tls.LoadX509KeyPair, func(_, _ string) (tls.Certificate, error) {
 			return tls.Certificate{}, nil
@@ -164,6 +167,33 @@ var _ = g.Describe("main internal errors", func() {
 			})
 		})
 
+		g.When("server certificates fail to load", func() {
+			g.It("should fail with an error and close the offline queue", func() {
+				queueDir, err := ioutil.TempDir("", "eaa-queue")
+				Expect(err).NotTo(HaveOccurred())
+				defer os.RemoveAll(queueDir)
+				queueCfg := OfflineQueueConfig{Path: filepath.Join(queueDir, "queue.db")}
+
+				patchLoadJSONConfig.Unpatch()
+				patchLoadJSONConfig = patchMethod(config.LoadJSONConfig,
+					func(_ string, cfg interface{}) error {
+						cfg.(*Config).OfflineQueue = queueCfg
+						return nil
+					})
+				patchReloadServerCerts.Unpatch()
+				patchReloadServerCerts = patchMethod(reloadServerCerts,
+					func(_ *Context) error { return errors.New("no server certificate") })
+
+				e := Run(ctx, "")
+
+				Expect(e).To(MatchError("no server certificate"))
+				// The queue can't be opened again until it is closed
+				q, err := openOfflineQueue(queueCfg)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(q.close()).To(Succeed())
+			})
+		})
+
 		g.Context("newKafkaTLSConfig fails", func() {
 			g.When("LoadX509KeyPair fails", func() {
 				g.It("should fail with an error", func() {
@@ -386,6 +416,55 @@ var _ = g.Describe("main internal errors", func() {
 			})
 		})
 
+		g.Context("MsgBroker type is set in the config", func() {
+			setMsgBrokerConfig := func(msgBrokerCfg MsgBrokerConfig) {
+				patchLoadJSONConfig.Unpatch()
+				patchLoadJSONConfig = patchMethod(config.LoadJSONConfig,
+					func(_ string, cfg interface{}) error {
+						cfg.(*Config).MsgBroker = msgBrokerCfg
+						return nil
+					})
+			}
+
+			g.When("the type is gochannels", func() {
+				g.It("should work without Kafka", func() {
+					patchNewKafkaMsgBroker.Unpatch()
+					patchMethod(NewKafkaMsgBroker,
+						func(_ *Context, _ string, _ *tls.Config) (*KafkaMsgBroker, error) {
+							g.Fail("Kafka Message Broker should not be created")
+							return nil, nil
+						})
+					setMsgBrokerConfig(MsgBrokerConfig{Type: "gochannels",
+						Options: []byte(`{"OutputChannelBuffer": 10, "Persistent": true}`)})
+
+					e := Run(ctx, "")
+
+					Expect(e).NotTo(HaveOccurred())
+				})
+			})
+
+			g.When("the gochannels options are malformed", func() {
+				g.It("should fail with an error", func() {
+					setMsgBrokerConfig(MsgBrokerConfig{Type: "gochannels",
+						Options: []byte(`{"OutputChannelBuffer": "ten"}`)})
+
+					e := Run(ctx, "")
+
+					Expect(e).To(HaveOccurred())
+				})
+			})
+
+			g.When("the type is unknown", func() {
+				g.It("should fail with an error", func() {
+					setMsgBrokerConfig(MsgBrokerConfig{Type: "carrier-pigeon"})
+
+					e := Run(ctx, "")
+
+					Expect(e).To(HaveOccurred())
+				})
+			})
+		})
+
 		g.When("http server ServeTLS reports an error and Kafka fails to close a publisher", func() {
 			g.It("should fail with an error and both errors should be delivered properly", func() {
 				fail := mockKafkaPublisher.EXPECT().Close().Return(errors.New(""))
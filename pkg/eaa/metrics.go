@@ -0,0 +1,399 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "eaa"
+	metricsPath      = "/metrics"
+	// Timeout of reading request headers by the metrics server
+	metricsReadHeaderTimeout = 10 * time.Second
+	// Notification label of notifications not declared by any producer
+	unregisteredNotificationLabel = "unregistered"
+)
+
+// eaaMetrics holds Prometheus metrics of EAA. A nil *eaaMetrics is valid
+// and records nothing.
+type eaaMetrics struct {
+	registry *prometheus.Registry
+
+	notificationsPublished *prometheus.CounterVec
+	notificationsDelivered *prometheus.CounterVec
+	notificationsDropped   *prometheus.CounterVec
+	brokerPublishDuration  *prometheus.HistogramVec
+	httpRequests           *prometheus.CounterVec
+	httpRequestDuration    *prometheus.HistogramVec
+
+	// Notifications declared by registered producers. Only their names are
+	// used as labels, so that producers can't create unbounded label values.
+	declared declaredNotifications
+}
+
+// declaredNotifications counts producers declaring a notification name in
+// a namespace. It's locked independently of serviceInfo, as notifications
+// are counted while serviceInfo is locked.
+type declaredNotifications struct {
+	sync.RWMutex
+	// Keys of notifications declared by a producer common name
+	producers map[string][]declaredNotification
+	count     map[declaredNotification]int
+}
+
+type declaredNotification struct {
+	namespace string
+	name      string
+}
+
+func newEaaMetrics(eaaCtx *Context) *eaaMetrics {
+	notificationLabels := []string{"namespace", "notification"}
+	m := &eaaMetrics{
+		registry: prometheus.NewRegistry(),
+		declared: declaredNotifications{
+			producers: make(map[string][]declaredNotification),
+			count:     make(map[declaredNotification]int),
+		},
+		notificationsPublished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "notifications_published_total",
+			Help:      "Notifications published by producers.",
+		}, notificationLabels),
+		notificationsDelivered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "notifications_delivered_total",
+			Help:      "Notifications handed to subscribed consumers.",
+		}, notificationLabels),
+		notificationsDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "notifications_dropped_total",
+			Help:      "Notifications dropped before reaching subscribed consumers.",
+		}, notificationLabels),
+		brokerPublishDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "broker_publish_duration_seconds",
+			Help:      "Latency of publishing messages to the message broker.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"topic"}),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests served by the EAA API.",
+		}, []string{"route", "method", "code"}),
+		httpRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests served by the EAA API.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+	}
+
+	m.registry.MustRegister(
+		m.notificationsPublished,
+		m.notificationsDelivered,
+		m.notificationsDropped,
+		m.brokerPublishDuration,
+		m.httpRequests,
+		m.httpRequestDuration,
+		newStateCollector(eaaCtx),
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// declareNotifications sets notifications declared by a producer, nil
+// notifications remove a deregistered producer
+func (m *eaaMetrics) declareNotifications(commonName string,
+	notifs []NotificationDescriptor) {
+
+	if m == nil {
+		return
+	}
+
+	var keys []declaredNotification
+	if urn, err := CommonNameStringToURN(commonName); err == nil {
+		seen := make(map[declaredNotification]bool)
+		for _, notif := range notifs {
+			key := declaredNotification{urn.Namespace, notif.Name}
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	m.declared.Lock()
+	defer m.declared.Unlock()
+
+	for _, key := range m.declared.producers[commonName] {
+		if m.declared.count[key]--; m.declared.count[key] <= 0 {
+			delete(m.declared.count, key)
+		}
+	}
+	for _, key := range keys {
+		m.declared.count[key]++
+	}
+	if len(keys) > 0 {
+		m.declared.producers[commonName] = keys
+	} else {
+		delete(m.declared.producers, commonName)
+	}
+}
+
+// notificationLabel returns the notification label of a notification name,
+// names not declared by producers of the namespace are reported together
+func (m *eaaMetrics) notificationLabel(namespace string, name string) string {
+	if isBuiltinNotification(name) {
+		return name
+	}
+
+	m.declared.RLock()
+	defer m.declared.RUnlock()
+
+	if m.declared.count[declaredNotification{namespace, name}] > 0 {
+		return name
+	}
+	return unregisteredNotificationLabel
+}
+
+// notificationPublished counts a notification published by a producer
+func (m *eaaMetrics) notificationPublished(namespace string, name string) {
+	if m == nil {
+		return
+	}
+	m.notificationsPublished.WithLabelValues(namespace,
+		m.notificationLabel(namespace, name)).Inc()
+}
+
+// notificationDelivered counts a notification handed to a consumer
+func (m *eaaMetrics) notificationDelivered(namespace string, name string) {
+	if m == nil {
+		return
+	}
+	m.notificationsDelivered.WithLabelValues(namespace,
+		m.notificationLabel(namespace, name)).Inc()
+}
+
+// notificationDropped counts a dropped notification, its labels are taken
+// from the NotificationToConsumer payload sent to consumers
+func (m *eaaMetrics) notificationDropped(msgPayload []byte) {
+	if m == nil {
+		return
+	}
+	var notif NotificationToConsumer
+	if err := json.Unmarshal(msgPayload, &notif); err != nil {
+		log.Debugf("Failed to decode dropped notification labels: %s", err.Error())
+	}
+	m.notificationsDropped.WithLabelValues(notif.URN.Namespace,
+		m.notificationLabel(notif.URN.Namespace, notif.Name)).Inc()
+}
+
+// observeBrokerPublish records latency of a message broker publish
+func (m *eaaMetrics) observeBrokerPublish(topic string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.brokerPublishDuration.WithLabelValues(topicKind(topic)).Observe(d.Seconds())
+}
+
+// topicKind returns a topic name without the application or namespace part,
+// so that the number of label values is bounded
+func topicKind(topic string) string {
+	if i := strings.Index(topic, "_"); i >= 0 {
+		return topic[:i]
+	}
+	return topic
+}
+
+// stateCollector reports the number of services, subscriptions and websocket
+// consumers held in EAA context at the time of a scrape
+type stateCollector struct {
+	eaaCtx        *Context
+	services      *prometheus.Desc
+	subscriptions *prometheus.Desc
+	consumers     *prometheus.Desc
+}
+
+func newStateCollector(eaaCtx *Context) *stateCollector {
+	return &stateCollector{
+		eaaCtx: eaaCtx,
+		services: prometheus.NewDesc(metricsNamespace+"_registered_services",
+			"Services registered by producers.", []string{"namespace"}, nil),
+		subscriptions: prometheus.NewDesc(metricsNamespace+"_subscriptions",
+			"Consumer subscriptions to notifications.", []string{"namespace"}, nil),
+		consumers: prometheus.NewDesc(metricsNamespace+"_websocket_consumers",
+			"Consumers connected over a websocket.", nil, nil),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.services
+	ch <- c.subscriptions
+	ch <- c.consumers
+}
+
+// Collect implements prometheus.Collector
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	services := make(map[string]int)
+	c.eaaCtx.serviceInfo.RLock()
+	for commonName, service := range c.eaaCtx.serviceInfo.m {
+		if service.URN != nil {
+			services[service.URN.Namespace]++
+		} else if urn, err := CommonNameStringToURN(commonName); err == nil {
+			services[urn.Namespace]++
+		}
+	}
+	c.eaaCtx.serviceInfo.RUnlock()
+	for namespace, n := range services {
+		ch <- prometheus.MustNewConstMetric(c.services, prometheus.GaugeValue,
+			float64(n), namespace)
+	}
+
+	subscriptions := make(map[string]int)
+	c.eaaCtx.subscriptionInfo.RLock()
+	for key, sub := range c.eaaCtx.subscriptionInfo.m {
+		subscriptions[key.namespace] += len(sub.namespaceSubscriptions)
+		for _, subscribers := range sub.serviceSubscriptions {
+			subscriptions[key.namespace] += len(subscribers)
+		}
+	}
+	c.eaaCtx.subscriptionInfo.RUnlock()
+	for namespace, n := range subscriptions {
+		ch <- prometheus.MustNewConstMetric(c.subscriptions, prometheus.GaugeValue,
+			float64(n), namespace)
+	}
+
+	consumers := 0
+	c.eaaCtx.consumerConnections.RLock()
+	for _, conn := range c.eaaCtx.consumerConnections.m {
+		if conn.connection != nil {
+			consumers++
+		}
+	}
+	c.eaaCtx.consumerConnections.RUnlock()
+	ch <- prometheus.MustNewConstMetric(c.consumers, prometheus.GaugeValue,
+		float64(consumers))
+}
+
+// instrumentedBroker records latency of publishing to a message broker
+type instrumentedBroker struct {
+	msgBroker
+	metrics *eaaMetrics
+}
+
+func (b instrumentedBroker) publish(topic string, msg *message.Message) error {
+	start := time.Now()
+	err := b.msgBroker.publish(topic, msg)
+	b.metrics.observeBrokerPublish(topic, time.Since(start))
+	return err
+}
+
+// statusRecorder records the status code written by a handler. Flushing and
+// hijacking are passed through for notification streams and websockets.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Response writer doesn't support hijacking")
+	}
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// instrumentRequests is a middleware counting requests and their latency
+// per route. Deprecated unversioned aliases are reported as their routes.
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
+		if eaaCtx.metrics == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route = strings.TrimSuffix(current.GetName(), deprecatedRouteSuffix)
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		eaaCtx.metrics.httpRequests.WithLabelValues(route, r.Method,
+			strconv.Itoa(recorder.status)).Inc()
+		eaaCtx.metrics.httpRequestDuration.WithLabelValues(route, r.Method).
+			Observe(time.Since(start).Seconds())
+	})
+}
+
+// runMetricsServer serves Prometheus metrics on the metrics endpoint until
+// ctx is done
+func runMetricsServer(ctx context.Context, eaaCtx *Context) {
+	handler := http.NewServeMux()
+	handler.Handle(metricsPath, promhttp.HandlerFor(eaaCtx.metrics.registry,
+		promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Addr:              eaaCtx.cfg.Metrics.Endpoint,
+		Handler:           handler,
+		ReadHeaderTimeout: metricsReadHeaderTimeout,
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			log.Errf("Could not close EAA metrics server: %#v", err)
+		}
+	}()
+
+	log.Infof("Serving EAA metrics on: %s", eaaCtx.cfg.Metrics.Endpoint)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Errf("Metrics server error: %#v", err)
+	}
+}
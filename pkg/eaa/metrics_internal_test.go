@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = g.Describe("metrics", func() {
+	var eaaContext *Context
+
+	const (
+		producer = "video:camera-1"
+		consumer = "consumer:1"
+	)
+
+	// metricValue returns the value of a counter or a gauge, or the sample
+	// count of a histogram with the given labels
+	metricValue := func(name string, labels map[string]string) float64 {
+		families, err := eaaContext.metrics.registry.Gather()
+		Expect(err).NotTo(HaveOccurred())
+		for _, family := range families {
+			if family.GetName() != name {
+				continue
+			}
+		metrics:
+			for _, metric := range family.GetMetric() {
+				for _, label := range metric.GetLabel() {
+					if value, found := labels[label.GetName()]; found &&
+						value != label.GetValue() {
+						continue metrics
+					}
+				}
+				switch {
+				case metric.Counter != nil:
+					return metric.GetCounter().GetValue()
+				case metric.Gauge != nil:
+					return metric.GetGauge().GetValue()
+				case metric.Histogram != nil:
+					return float64(metric.GetHistogram().GetSampleCount())
+				}
+			}
+		}
+		return 0
+	}
+
+	g.BeforeEach(func() {
+		eaaContext = newTestContext()
+		eaaContext.metrics = newEaaMetrics(eaaContext)
+		eaaContext.MsgBrokerCtx = instrumentedBroker{&brokerMock{}, eaaContext.metrics}
+
+		Expect(addService(producer, Service{Notifications: []NotificationDescriptor{
+			{Name: "motion", Version: "1.0"}}}, eaaContext)).To(Succeed())
+	})
+
+	g.It("should count requests per route", func() {
+		Expect(serveAs(eaaContext, producer, "GET", "/v1/services", "").Code).To(Equal(http.StatusOK))
+		Expect(serveAs(eaaContext, producer, "GET", "/services", "").Code).To(Equal(http.StatusOK))
+		Expect(serveAs(eaaContext, producer, "POST", "/v1/notifications", `{"name": `).Code).
+			To(Equal(http.StatusBadRequest))
+
+		Expect(metricValue("eaa_http_requests_total", map[string]string{
+			"route": "GetServices", "method": "GET", "code": "200"})).To(Equal(2.0))
+		Expect(metricValue("eaa_http_requests_total", map[string]string{
+			"route": "PushNotificationToSubscribers", "code": "400"})).To(Equal(1.0))
+		Expect(metricValue("eaa_http_request_duration_seconds", map[string]string{
+			"route": "GetServices"})).To(Equal(2.0))
+	})
+
+	g.It("should count published notifications", func() {
+		Expect(serveAs(eaaContext, producer, "POST", "/v1/notifications",
+			`{"name": "motion", "version": "1.0", "payload": {}}`).Code).
+			To(Equal(http.StatusAccepted))
+
+		Expect(metricValue("eaa_notifications_published_total", map[string]string{
+			"namespace": "video", "notification": "motion"})).To(Equal(1.0))
+		Expect(metricValue("eaa_broker_publish_duration_seconds", map[string]string{
+			"topic": "ns"})).To(Equal(1.0))
+	})
+
+	g.It("should count delivered and dropped notifications", func() {
+		eaaContext.consumerConnections.m[consumer] = ConsumerConnection{
+			stream: newNotificationStream(sseStream)}
+		Expect(addSubscriptionToNamespace(consumer, "video",
+			[]NotificationDescriptor{{Name: "motion", Version: "1.0"}}, eaaContext)).
+			To(Succeed())
+		Expect(addSubscriptionToNamespace("consumer:2", "video",
+			[]NotificationDescriptor{{Name: "motion", Version: "1.0"}}, eaaContext)).
+			To(Succeed())
+
+		Expect(sendNotificationToSubscribers(URN{ID: "camera-1", Namespace: "video"},
+			&NotificationFromProducer{Name: "motion", Version: "1.0"}, "1",
+			eaaContext)).To(Succeed())
+
+		labels := map[string]string{"namespace": "video", "notification": "motion"}
+		Expect(metricValue("eaa_notifications_delivered_total", labels)).To(Equal(1.0))
+		Expect(metricValue("eaa_notifications_dropped_total", labels)).To(Equal(1.0))
+	})
+
+	g.It("should count notifications undeclared by producers as unregistered", func() {
+		for i := 0; i < 3; i++ {
+			Expect(serveAs(eaaContext, producer, "POST", "/v1/notifications",
+				`{"name": "motion-`+strconv.Itoa(i)+`", "version": "1.0", "payload": {}}`).
+				Code).To(Equal(http.StatusAccepted))
+		}
+		Expect(metricValue("eaa_notifications_published_total", map[string]string{
+			"namespace": "video", "notification": "unregistered"})).To(Equal(3.0))
+
+		Expect(removeService(producer, eaaContext)).To(Succeed())
+		eaaContext.serviceInfo.m[producer] = Service{}
+		Expect(serveAs(eaaContext, producer, "POST", "/v1/notifications",
+			`{"name": "motion", "version": "1.0", "payload": {}}`).Code).
+			To(Equal(http.StatusAccepted))
+
+		Expect(metricValue("eaa_notifications_published_total", map[string]string{
+			"namespace": "video", "notification": "motion"})).To(Equal(0.0))
+		Expect(metricValue("eaa_notifications_published_total", map[string]string{
+			"namespace": "video", "notification": "unregistered"})).To(Equal(4.0))
+	})
+
+	g.It("should report registered services, subscriptions and consumers", func() {
+		eaaContext.serviceInfo.m["audio:mic-1"] = Service{}
+		eaaContext.consumerConnections.m[consumer] = ConsumerConnection{
+			connection: &websocket.Conn{}}
+		Expect(addSubscriptionToNamespace(consumer, "video",
+			[]NotificationDescriptor{{Name: "motion", Version: "1.0"}}, eaaContext)).
+			To(Succeed())
+
+		Expect(metricValue("eaa_registered_services",
+			map[string]string{"namespace": "video"})).To(Equal(1.0))
+		Expect(metricValue("eaa_registered_services",
+			map[string]string{"namespace": "audio"})).To(Equal(1.0))
+		Expect(metricValue("eaa_subscriptions",
+			map[string]string{"namespace": "video"})).To(Equal(1.0))
+		Expect(metricValue("eaa_websocket_consumers", nil)).To(Equal(1.0))
+	})
+})
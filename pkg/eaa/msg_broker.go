@@ -5,6 +5,7 @@ package eaa
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strings"
 
@@ -73,6 +74,40 @@ type msgBroker interface {
 	removeAll() error
 }
 
+// msgBrokerFactory creates a msgBroker for an EAA context. The options are taken verbatim from
+// the MsgBroker.Options section of the EAA config and are interpreted by the factory itself.
+type msgBrokerFactory func(eaaCtx *Context, options json.RawMessage) (msgBroker, error)
+
+// Message Broker backend used when MsgBroker.Type is not set in the config
+const defaultMsgBrokerType = kafkaMsgBrokerType
+
+// msgBrokerFactories holds all available Message Broker backends indexed by their type
+var msgBrokerFactories = make(map[string]msgBrokerFactory)
+
+// registerMsgBrokerFactory makes a Message Broker backend available under a given type.
+// It is meant to be called from init() of the file implementing the backend.
+func registerMsgBrokerFactory(brokerType string, factory msgBrokerFactory) {
+	if _, found := msgBrokerFactories[brokerType]; found {
+		panic(fmt.Sprintf("Message Broker factory for type '%v' already registered", brokerType))
+	}
+	msgBrokerFactories[brokerType] = factory
+}
+
+// newMsgBroker creates a Message Broker of a type selected in the EAA config
+func newMsgBroker(eaaCtx *Context) (msgBroker, error) {
+	brokerType := eaaCtx.cfg.MsgBroker.Type
+	if brokerType == "" {
+		brokerType = defaultMsgBrokerType
+	}
+
+	factory, found := msgBrokerFactories[brokerType]
+	if !found {
+		return nil, fmt.Errorf("Unknown Message Broker type: %v", brokerType)
+	}
+
+	return factory(eaaCtx, eaaCtx.cfg.MsgBroker.Options)
+}
+
 // --------
 // Message Handlers
 
@@ -101,7 +136,11 @@ func handleNotificationUpdates(messages <-chan *message.Message, eaaCtx *Context
 			continue
 		}
 
-		err = sendNotificationToAllSubscribers(notifMsg.URN.String(), notifMsg.Notification, eaaCtx)
+		// Notifications published by every EAA instance are kept in the history
+		recordNotificationHistory(*notifMsg.URN, notifMsg.Notification, msg.UUID, eaaCtx)
+
+		err = sendNotificationToAllSubscribers(notifMsg.URN.String(), notifMsg.Notification,
+			msg.UUID, eaaCtx)
 		if err != nil {
 			log.Errf("Error in Publish Notification: %s", err.Error())
 		}
@@ -137,10 +176,17 @@ func handleServiceUpdates(messages <-chan *message.Message, eaaCtx *Context) {
 		}
 		commonName := svcMsg.Svc.URN.String()
 
+		// Messages may be delivered again, e.g. replayed from the beginning
+		// of the topic or retained by the broker. Lifecycle notifications are
+		// sent only when they change the registered services.
+		changed := true
 		switch svcMsg.Action {
 		case serviceActionRegister:
+			changed = !isServiceRegistered(commonName, *svcMsg.Svc, eaaCtx)
 			if err = addService(commonName, *svcMsg.Svc, eaaCtx); err != nil {
 				log.Errf("Register Application error: %s", err.Error())
+			} else {
+				setServiceOrigin(commonName, svcMsg.Origin, eaaCtx)
 			}
 		case serviceActionDeregister:
 			if err = removeService(commonName, eaaCtx); err != nil {
@@ -148,6 +194,17 @@ func handleServiceUpdates(messages <-chan *message.Message, eaaCtx *Context) {
 			}
 		default:
 			log.Errf("Unknown Service Action: %v", svcMsg.Action)
+			msg.Ack()
+			continue
+		}
+
+		if err == nil {
+			persistService(commonName, eaaCtx)
+		}
+		if err == nil && changed {
+			if err = sendServiceNotification(&svcMsg, msg.UUID, eaaCtx); err != nil {
+				log.Errf("Error in Service Notification: %s", err.Error())
+			}
 		}
 
 		// we need to Acknowledge that we received and processed the message,
@@ -203,6 +260,7 @@ func handleClientUpdates(messages <-chan *message.Message, eaaCtx *Context) {
 		default:
 			log.Errf("Unknown SubscriptionMessage Action: %v", subscriptionMsg.Action)
 		}
+		persistSubscriptions(clientCommonName, eaaCtx)
 
 		msg.Ack()
 	}
@@ -5,6 +5,7 @@ package eaa
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sync"
@@ -32,6 +33,49 @@ type GoChannelMsgBroker struct {
 	pubSubs       goChannels
 }
 
+const goChannelMsgBrokerType = "gochannels"
+
+// goChannelMsgBrokerOptions describes the MsgBroker.Options section of the EAA config
+// for the GoChannel backend. Options that are not set keep their default values.
+type goChannelMsgBrokerOptions struct {
+	OutputChannelBuffer            *int64 `json:"OutputChannelBuffer,omitempty"`
+	Persistent                     *bool  `json:"Persistent,omitempty"`
+	BlockPublishUntilSubscriberAck *bool  `json:"BlockPublishUntilSubscriberAck,omitempty"`
+}
+
+func init() {
+	registerMsgBrokerFactory(goChannelMsgBrokerType, newGoChannelMsgBrokerFromOptions)
+}
+
+// newGoChannelMsgBrokerFromOptions is a msgBrokerFactory of the GoChannel backend
+func newGoChannelMsgBrokerFromOptions(eaaCtx *Context, options json.RawMessage) (msgBroker,
+	error) {
+
+	var opts goChannelMsgBrokerOptions
+	if len(options) != 0 {
+		if err := json.Unmarshal(options, &opts); err != nil {
+			return nil, errors.Wrap(err, "Failed to parse GoChannel Message Broker options")
+		}
+	}
+
+	broker := NewGoChannelMsgBroker(eaaCtx)
+	if opts.OutputChannelBuffer != nil {
+		if *opts.OutputChannelBuffer < 0 {
+			return nil, fmt.Errorf("Invalid GoChannel OutputChannelBuffer: %v",
+				*opts.OutputChannelBuffer)
+		}
+		broker.defaultConfig.OutputChannelBuffer = *opts.OutputChannelBuffer
+	}
+	if opts.Persistent != nil {
+		broker.defaultConfig.Persistent = *opts.Persistent
+	}
+	if opts.BlockPublishUntilSubscriberAck != nil {
+		broker.defaultConfig.BlockPublishUntilSubscriberAck = *opts.BlockPublishUntilSubscriberAck
+	}
+
+	return broker, nil
+}
+
 // NewGoChannelMsgBroker creates and returns a GoChannel-backed msgBroker
 func NewGoChannelMsgBroker(eaaCtx *Context) *GoChannelMsgBroker {
 	broker := GoChannelMsgBroker{eaaCtx: eaaCtx}
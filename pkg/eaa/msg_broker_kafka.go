@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/ThreeDotsLabs/watermill"
@@ -59,8 +60,26 @@ var (
 	KafkaBroker KafkaInterface
 )
 
+const kafkaMsgBrokerType = "kafka"
+
 func init() {
 	KafkaBroker = &kafkaImplementation{}
+	registerMsgBrokerFactory(kafkaMsgBrokerType, newKafkaMsgBrokerFromOptions)
+}
+
+// newKafkaMsgBrokerFromOptions is a msgBrokerFactory of the Kafka backend.
+// The Kafka backend has no options - the broker address and the TLS credentials are taken
+// from KafkaBroker and Certs sections of the EAA config.
+func newKafkaMsgBrokerFromOptions(eaaCtx *Context, options json.RawMessage) (msgBroker, error) {
+	kafkaTLSConfig, err := newKafkaTLSConfig(eaaCtx.cfg.Certs.KafkaUserCertPath,
+		eaaCtx.cfg.Certs.KafkaUserKeyPath, eaaCtx.cfg.Certs.KafkaCAPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each EAA instance should be in a different Consumer Group to get all Service Updates
+	instanceID := uuid.New()
+	return NewKafkaMsgBroker(eaaCtx, "EAA_"+instanceID.String(), kafkaTLSConfig)
 }
 
 type publishers struct {
@@ -385,3 +404,184 @@ func (b *KafkaMsgBroker) removeAll() error {
 
 	return nil
 }
+
+// REPLAY
+
+// Time limit of reading the notification history from Kafka
+const kafkaReplayTimeout = 10 * time.Second
+
+// newKafkaReplayClient creates Kafka clients reading the notification history,
+// it allows dependency injection for unit tests
+var newKafkaReplayClient = sarama.NewClient
+
+// replayNotifications reads notifications of a namespace from its topic.
+// Partitions are read forward from offsets of the time of the query or,
+// without the time, backward from their ends, until one notification more
+// than the query limit is read from each. Notifications published after
+// the request are not read.
+func (b *KafkaMsgBroker) replayNotifications(ctx context.Context,
+	q historyQuery) ([]HistoricNotification, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, kafkaReplayTimeout)
+	defer cancel()
+
+	config := KafkaBroker.DefaultSaramaSubscriberConfig()
+	// Offsets by timestamp and record headers require Kafka 0.11 or newer
+	if !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+		config.Version = sarama.V0_11_0_0
+	}
+	config.Consumer.Return.Errors = true
+	config.Net.TLS.Enable = true
+	config.Net.TLS.Config = b.tlsConfig
+
+	client, err := newKafkaReplayClient([]string{b.eaaCtx.cfg.KafkaBroker}, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't create a Kafka client")
+	}
+	defer client.Close()
+
+	topic := getNotificationTopicName(q.namespace)
+	partitions, err := client.Partitions(topic)
+	if err == sarama.ErrUnknownTopicOrPartition {
+		// Nothing has been published in the namespace yet
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Couldn't get partitions of %v", topic)
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't create a Kafka consumer")
+	}
+	defer consumer.Close()
+
+	// The extra notification tells whether the page of the query is truncated
+	max := q.limit + 1
+
+	var notifs []HistoricNotification
+	for _, partition := range partitions {
+		end, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Couldn't get the offset of %v/%v", topic,
+				partition)
+		}
+
+		var replayed []HistoricNotification
+		if q.since.IsZero() {
+			replayed, err = replayLatest(ctx, client, consumer, topic, partition, end, q, max)
+		} else {
+			var from int64
+			from, err = client.GetOffset(topic, partition,
+				q.since.UnixNano()/int64(time.Millisecond))
+			if err != nil {
+				return nil, errors.Wrapf(err, "Couldn't get the offset of %v/%v", topic,
+					partition)
+			}
+			// Offset of a time after the last notification is -1
+			if from < 0 || from >= end {
+				continue
+			}
+			replayed, err = replayPartition(ctx, consumer, topic, partition, from, end, q,
+				max)
+		}
+		if err != nil {
+			return nil, err
+		}
+		notifs = append(notifs, replayed...)
+	}
+
+	return notifs, nil
+}
+
+// replayLatest reads up to max latest notifications of a partition before
+// offset end. Windows of max offsets are read backward from the end until
+// enough notifications match the query.
+func replayLatest(ctx context.Context, client sarama.Client, consumer sarama.Consumer,
+	topic string, partition int32, end int64, q historyQuery,
+	max int) ([]HistoricNotification, error) {
+
+	oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Couldn't get the offset of %v/%v", topic, partition)
+	}
+
+	var notifs []HistoricNotification
+	for to := end; to > oldest && len(notifs) < max; {
+		from := to - int64(max)
+		if from < oldest {
+			from = oldest
+		}
+		window, err := replayPartition(ctx, consumer, topic, partition, from, to, q, 0)
+		if err != nil {
+			return nil, err
+		}
+		notifs = append(window, notifs...)
+		to = from
+	}
+
+	if len(notifs) > max {
+		notifs = notifs[len(notifs)-max:]
+	}
+	return notifs, nil
+}
+
+// replayPartition reads notifications of a partition from offset from
+// until offset end or until max notifications match the query, 0 reads
+// all of them
+func replayPartition(ctx context.Context, consumer sarama.Consumer, topic string,
+	partition int32, from int64, end int64, q historyQuery,
+	max int) ([]HistoricNotification, error) {
+
+	pc, err := consumer.ConsumePartition(topic, partition, from)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Couldn't consume %v/%v", topic, partition)
+	}
+	defer func() { _ = pc.Close() }()
+
+	var notifs []HistoricNotification
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "Replay of %v/%v interrupted", topic,
+				partition)
+		case consumerErr := <-pc.Errors():
+			return nil, errors.Wrapf(consumerErr, "Couldn't consume %v/%v", topic, partition)
+		case kafkaMsg := <-pc.Messages():
+			msg, err := kafka.DefaultMarshaler{}.Unmarshal(kafkaMsg)
+			if err != nil {
+				log.Errf("Skipping a notification at %v/%v/%v: %s", topic, partition,
+					kafkaMsg.Offset, err.Error())
+			} else if notif, ok := decodeHistoricNotification(msg, kafkaMsg.Timestamp); ok &&
+				q.matches(&notif.Notification) {
+				notifs = append(notifs, notif)
+			}
+			if kafkaMsg.Offset >= end-1 || (max > 0 && len(notifs) >= max) {
+				return notifs, nil
+			}
+		}
+	}
+}
+
+// decodeHistoricNotification decodes a notification published to a topic
+func decodeHistoricNotification(msg *message.Message,
+	timestamp time.Time) (HistoricNotification, bool) {
+
+	var notifMsg NotificationMessage
+	if err := json.Unmarshal(msg.Payload, &notifMsg); err != nil ||
+		notifMsg.Notification == nil || notifMsg.URN == nil {
+		log.Errf("Skipping an invalid notification message %v", msg.UUID)
+		return HistoricNotification{}, false
+	}
+
+	return HistoricNotification{
+		Notification: NotificationToConsumer{
+			ID:      msg.UUID,
+			Name:    notifMsg.Notification.Name,
+			Version: notifMsg.Notification.Version,
+			Payload: notifMsg.Notification.Payload,
+			URN:     *notifMsg.URN,
+		},
+		Timestamp: timestamp,
+	}, true
+}
@@ -0,0 +1,427 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	mqttMsgBrokerType = "mqtt"
+
+	// Defaults of MsgBroker.Options of the MQTT backend
+	defaultMQTTTopicRoot = "eaa"
+	defaultMQTTQoS       = 1
+
+	// Time limit of connecting, subscribing and publishing
+	mqttOperationTimeout = 10 * time.Second
+	// Time in milliseconds left for pending work when disconnecting
+	mqttDisconnectQuiesce = 250
+	// Number of received messages buffered for a single subscriber
+	mqttSubscriberBufferSize = 10000
+)
+
+// Subtrees of the MQTT topic root the EAA topics are mapped onto:
+//
+//	ns_<namespace>  -> <root>/notifications/<namespace>
+//	services        -> <root>/services/<producer URN>
+//	client_<URN>    -> <root>/clients/<consumer URN>
+const (
+	mqttNotificationsTree = "notifications"
+	mqttServicesTree      = "services"
+	mqttClientsTree       = "clients"
+)
+
+// mqttMsgBrokerOptions describes the MsgBroker.Options section of the EAA config
+// for the MQTT backend. TLS is used with the ssl://, tls:// and mqtts:// broker
+// schemes and the client certificate is presented when CertPath is set.
+type mqttMsgBrokerOptions struct {
+	// Address of the MQTT broker, e.g. "ssl://mqtt.openness:8883"
+	Broker string `json:"Broker"`
+	// Client ID of EAA, a random ID is generated when empty
+	ClientID string `json:"ClientID,omitempty"`
+	// Root of the topic tree used by EAA, defaults to "eaa"
+	TopicRoot string `json:"TopicRoot,omitempty"`
+	// QoS of publications and subscriptions, defaults to 1
+	QoS *int `json:"QoS,omitempty"`
+	// Root CA of the broker certificate
+	CAPath string `json:"CAPath,omitempty"`
+	// Client certificate and its key
+	CertPath string `json:"CertPath,omitempty"`
+	KeyPath  string `json:"KeyPath,omitempty"`
+}
+
+// mqttEnvelope carries a Watermill message over MQTT. The message UUID is
+// kept, it identifies notifications acknowledged by consumers.
+type mqttEnvelope struct {
+	UUID    string `json:"uuid"`
+	Payload []byte `json:"payload"`
+}
+
+// mqttSubscription passes messages received on a topic to a message handler
+type mqttSubscription struct {
+	sync.RWMutex
+	filter   string
+	messages chan *message.Message
+	closed   bool
+}
+
+// deliver passes a received message to the handler unless the subscription
+// is closed
+func (s *mqttSubscription) deliver(msg *message.Message) {
+	s.RLock()
+	defer s.RUnlock()
+	if !s.closed {
+		s.messages <- msg
+	}
+}
+
+// close makes the handler of the subscription finish
+func (s *mqttSubscription) close() {
+	s.Lock()
+	defer s.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.messages)
+	}
+}
+
+// MQTTMsgBroker is an MQTT-backed msgBroker. Service registrations are
+// published as retained messages so that EAA instances connecting later
+// learn about all registered services. Other messages aren't retained.
+type MQTTMsgBroker struct {
+	sync.RWMutex
+	eaaCtx    *Context
+	opts      *mqtt.ClientOptions
+	topicRoot string
+	qos       byte
+	client    mqtt.Client
+	pubs      map[string]struct{}
+	subs      map[string]*mqttSubscription
+}
+
+func init() {
+	registerMsgBrokerFactory(mqttMsgBrokerType, newMQTTMsgBrokerFromOptions)
+}
+
+// newMQTTMsgBrokerFromOptions is a msgBrokerFactory of the MQTT backend
+func newMQTTMsgBrokerFromOptions(eaaCtx *Context, options json.RawMessage) (msgBroker,
+	error) {
+
+	var opts mqttMsgBrokerOptions
+	if len(options) != 0 {
+		if err := json.Unmarshal(options, &opts); err != nil {
+			return nil, errors.Wrap(err, "Failed to parse MQTT Message Broker options")
+		}
+	}
+	return NewMQTTMsgBroker(eaaCtx, opts)
+}
+
+// newMQTTTLSConfig returns TLS config of the connection to the MQTT broker
+func newMQTTTLSConfig(opts mqttMsgBrokerOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if opts.CAPath != "" {
+		caPool, err := CreateAndSetCACertPool(opts.CAPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to load MQTT broker CA")
+		}
+		tlsConfig.RootCAs = caPool
+	}
+
+	if opts.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertPath, opts.KeyPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to load MQTT client Cert/Key pair")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// NewMQTTMsgBroker creates an MQTT-backed msgBroker and connects it to the broker
+func NewMQTTMsgBroker(eaaCtx *Context, opts mqttMsgBrokerOptions) (*MQTTMsgBroker, error) {
+	if opts.Broker == "" {
+		return nil, errors.New("MQTT Message Broker requires the Broker option")
+	}
+
+	broker := MQTTMsgBroker{
+		eaaCtx:    eaaCtx,
+		topicRoot: defaultMQTTTopicRoot,
+		qos:       defaultMQTTQoS,
+		pubs:      make(map[string]struct{}),
+		subs:      make(map[string]*mqttSubscription),
+	}
+	if opts.TopicRoot != "" {
+		broker.topicRoot = strings.TrimSuffix(opts.TopicRoot, "/")
+	}
+	if opts.QoS != nil {
+		if *opts.QoS < 0 || *opts.QoS > 2 {
+			return nil, fmt.Errorf("Invalid MQTT QoS: %v", *opts.QoS)
+		}
+		broker.qos = byte(*opts.QoS)
+	}
+	if opts.ClientID == "" {
+		opts.ClientID = "EAA_" + uuid.New().String()
+	}
+
+	tlsConfig, err := newMQTTTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	broker.opts = mqtt.NewClientOptions().
+		AddBroker(opts.Broker).
+		SetClientID(opts.ClientID).
+		SetTLSConfig(tlsConfig).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetConnectTimeout(mqttOperationTimeout).
+		SetOnConnectHandler(broker.resubscribe)
+
+	if err = broker.connect(); err != nil {
+		return nil, errors.Wrap(err, "Failed to create an MQTTMsgBroker")
+	}
+	return &broker, nil
+}
+
+// waitMQTT waits for an MQTT operation to complete
+func waitMQTT(token mqtt.Token) error {
+	if !token.WaitTimeout(mqttOperationTimeout) {
+		return errors.New("MQTT operation timed out")
+	}
+	return token.Error()
+}
+
+// connect connects to the MQTT broker unless connected already,
+// the broker has to be locked by the caller
+func (b *MQTTMsgBroker) connect() error {
+	if b.client != nil {
+		return nil
+	}
+
+	client := mqtt.NewClient(b.opts)
+	if err := waitMQTT(client.Connect()); err != nil {
+		return errors.Wrapf(err, "Couldn't connect to MQTT broker %v", b.opts.Servers)
+	}
+	b.client = client
+	log.Infof("Connected to MQTT broker %v", b.opts.Servers)
+	return nil
+}
+
+// resubscribe restores subscriptions after the client reconnects, MQTT
+// sessions are clean so the broker doesn't keep them
+func (b *MQTTMsgBroker) resubscribe(client mqtt.Client) {
+	b.RLock()
+	defer b.RUnlock()
+
+	for _, sub := range b.subs {
+		token := client.Subscribe(sub.filter, b.qos, b.handler(sub))
+		go func(filter string) {
+			if err := waitMQTT(token); err != nil {
+				log.Errf("Failed to resubscribe to MQTT topic %v: %s", filter, err.Error())
+			}
+		}(sub.filter)
+	}
+}
+
+// mqttTopic maps a topic onto the MQTT topic tree. A service message is
+// published to a subtopic of its producer to be retained per service.
+func (b *MQTTMsgBroker) mqttTopic(topic string, msg *message.Message) (string, error) {
+	switch {
+	case strings.HasPrefix(topic, notificationsTopicPrefix):
+		return b.topicRoot + "/" + mqttNotificationsTree + "/" +
+			strings.TrimPrefix(topic, notificationsTopicPrefix), nil
+	case strings.HasPrefix(topic, clientTopicPrefix):
+		return b.topicRoot + "/" + mqttClientsTree + "/" +
+			strings.TrimPrefix(topic, clientTopicPrefix), nil
+	case topic == servicesTopic:
+		if msg == nil {
+			return b.topicRoot + "/" + mqttServicesTree + "/+", nil
+		}
+		var svcMsg ServiceMessage
+		if err := json.Unmarshal(msg.Payload, &svcMsg); err != nil {
+			return "", errors.Wrap(err, "Couldn't unmarshal a service message")
+		}
+		if svcMsg.Svc == nil || svcMsg.Svc.URN == nil {
+			return "", fmt.Errorf("URN shouldn't be nil (topic: %v)", topic)
+		}
+		return b.topicRoot + "/" + mqttServicesTree + "/" + svcMsg.Svc.URN.String(), nil
+	}
+
+	return "", fmt.Errorf("Unknown topic type: %v", topic)
+}
+
+// Add a Publisher for a given topic. All topics are published by the same
+// MQTT client, publishers only mark topics that can be published to.
+func (b *MQTTMsgBroker) addPublisher(t publisherType, topic string, r *http.Request) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if _, found := b.pubs[topic]; found {
+		return objectAlreadyExistsError{fmt.Errorf("Publisher with ID '%v' already exists", topic)}
+	}
+
+	// The client may have been disconnected in removeAll()
+	if err := b.connect(); err != nil {
+		return err
+	}
+
+	b.pubs[topic] = struct{}{}
+	log.Infof("Added Publisher for a topic: %v", topic)
+
+	return nil
+}
+
+// Publish a msg to a given topic. Service registrations are retained, the
+// retained registration is cleared when the service is deregistered.
+func (b *MQTTMsgBroker) publish(topic string, msg *message.Message) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	if _, found := b.pubs[topic]; !found {
+		return fmt.Errorf("Invalid Publisher topic: %v", topic)
+	}
+
+	mqttTopic, err := b.mqttTopic(topic, msg)
+	if err != nil {
+		return errors.Wrapf(err, "Couldn't map topic '%v' to MQTT", topic)
+	}
+
+	retained, cleared := false, false
+	if topic == servicesTopic {
+		var svcMsg ServiceMessage
+		if err = json.Unmarshal(msg.Payload, &svcMsg); err == nil {
+			retained = svcMsg.Action == serviceActionRegister
+			cleared = svcMsg.Action == serviceActionDeregister
+		}
+	}
+
+	data, err := json.Marshal(mqttEnvelope{UUID: msg.UUID, Payload: msg.Payload})
+	if err != nil {
+		return errors.Wrap(err, "Couldn't marshal an MQTT message")
+	}
+
+	err = waitMQTT(b.client.Publish(mqttTopic, b.qos, retained, data))
+	if err == nil && cleared {
+		// An empty retained message removes the retained registration
+		err = waitMQTT(b.client.Publish(mqttTopic, b.qos, true, []byte{}))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Error when Publishing a message to the topic: %v", topic)
+	}
+	return nil
+}
+
+// handler returns an MQTT message handler passing messages to a subscription
+func (b *MQTTMsgBroker) handler(sub *mqttSubscription) mqtt.MessageHandler {
+	return func(_ mqtt.Client, m mqtt.Message) {
+		// Clearing of a retained message is delivered as an empty message
+		if len(m.Payload()) == 0 {
+			return
+		}
+
+		var envelope mqttEnvelope
+		if err := json.Unmarshal(m.Payload(), &envelope); err != nil {
+			log.Errf("Error Decoding MQTT message on %s: %s", m.Topic(), err.Error())
+			return
+		}
+		sub.deliver(message.NewMessage(envelope.UUID, envelope.Payload))
+	}
+}
+
+// Add a Subscriber of type t for a topic. The Subscriber can be later
+// accessed using its topic. If a Subscriber for a given topic already exists,
+// objectAlreadyExistsError is returned.
+func (b *MQTTMsgBroker) addSubscriber(t subscriberType, topic string, r *http.Request) error {
+	b.Lock()
+	defer b.Unlock()
+
+	// Only one Subscriber per topic is permitted
+	if _, found := b.subs[topic]; found {
+		return objectAlreadyExistsError{fmt.Errorf("Subscriber for a topic '%v' already exists",
+			topic)}
+	}
+
+	var handle func(<-chan *message.Message, *Context)
+	switch t {
+	case notificationSubscriber:
+		handle = handleNotificationUpdates
+	case servicesSubscriber:
+		handle = handleServiceUpdates
+	case clientSubscriber:
+		handle = handleClientUpdates
+	default:
+		return fmt.Errorf("Unknown Subscriber type: %v", t)
+	}
+
+	filter, err := b.mqttTopic(topic, nil)
+	if err != nil {
+		return errors.Wrapf(err, "Couldn't map topic '%v' to MQTT", topic)
+	}
+
+	if err = b.connect(); err != nil {
+		return err
+	}
+
+	sub := &mqttSubscription{
+		filter:   filter,
+		messages: make(chan *message.Message, mqttSubscriberBufferSize),
+	}
+	go handle(sub.messages, b.eaaCtx)
+
+	if err = waitMQTT(b.client.Subscribe(filter, b.qos, b.handler(sub))); err != nil {
+		sub.close()
+		return errors.Wrapf(err, "Couldn't create Subscriber of type '%v' for a topic: %v", t,
+			topic)
+	}
+
+	b.subs[topic] = sub
+	log.Infof("Added Subscriber for a topic: %v", topic)
+
+	return nil
+}
+
+// Unsubscribe from all topics and disconnect from the MQTT broker
+func (b *MQTTMsgBroker) removeAll() error {
+	b.Lock()
+	defer b.Unlock()
+
+	var errs []string
+	for topic, sub := range b.subs {
+		if b.client != nil {
+			if err := waitMQTT(b.client.Unsubscribe(sub.filter)); err != nil {
+				errs = append(errs, errors.Wrapf(err,
+					"Failed to remove a Subscriber for a topic '%v'", topic).Error())
+			}
+		}
+		sub.close()
+	}
+
+	if b.client != nil {
+		b.client.Disconnect(mqttDisconnectQuiesce)
+		b.client = nil
+	}
+
+	// Clear the maps
+	b.pubs = make(map[string]struct{})
+	b.subs = make(map[string]*mqttSubscription)
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
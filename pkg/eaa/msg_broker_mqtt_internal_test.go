@@ -0,0 +1,415 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/smart-edge-open/edgeservices/pkg/auth"
+)
+
+// localMQTTBroker is a minimal embedded MQTT 3.1.1 broker. It supports
+// wildcard subscriptions and retained messages, messages are forwarded
+// with QoS 0.
+type localMQTTBroker struct {
+	sync.Mutex
+	lis      net.Listener
+	conns    map[net.Conn]*localMQTTConn
+	retained map[string]*packets.PublishPacket
+	// Topics of all messages published to the broker
+	published []string
+}
+
+type localMQTTConn struct {
+	sync.Mutex
+	conn    net.Conn
+	filters map[string]bool
+}
+
+func (c *localMQTTConn) write(p packets.ControlPacket) {
+	c.Lock()
+	defer c.Unlock()
+	_ = p.Write(c.conn)
+}
+
+func newLocalMQTTBroker(tlsConfig *tls.Config) *localMQTTBroker {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	if tlsConfig != nil {
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+
+	b := &localMQTTBroker{
+		lis:      lis,
+		conns:    make(map[net.Conn]*localMQTTConn),
+		retained: make(map[string]*packets.PublishPacket),
+	}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *localMQTTBroker) address(scheme string) string {
+	return scheme + "://" + b.lis.Addr().String()
+}
+
+func (b *localMQTTBroker) close() {
+	b.lis.Close()
+	b.Lock()
+	defer b.Unlock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+}
+
+func (b *localMQTTBroker) publishedTopics() []string {
+	b.Lock()
+	defer b.Unlock()
+	return append([]string(nil), b.published...)
+}
+
+// topicMatches matches an MQTT topic against a subscription filter
+func topicMatches(filter string, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func (b *localMQTTBroker) serve(conn net.Conn) {
+	c := &localMQTTConn{conn: conn, filters: make(map[string]bool)}
+	b.Lock()
+	b.conns[conn] = c
+	b.Unlock()
+	defer func() {
+		b.Lock()
+		delete(b.conns, conn)
+		b.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := p.(type) {
+		case *packets.ConnectPacket:
+			c.write(packets.NewControlPacket(packets.Connack))
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			suback.ReturnCodes = p.Qoss
+			c.write(suback)
+
+			b.Lock()
+			var retained []*packets.PublishPacket
+			for _, filter := range p.Topics {
+				c.filters[filter] = true
+				for topic, msg := range b.retained {
+					if topicMatches(filter, topic) {
+						retained = append(retained, msg)
+					}
+				}
+			}
+			b.Unlock()
+			for _, msg := range retained {
+				c.write(msg)
+			}
+		case *packets.UnsubscribePacket:
+			b.Lock()
+			for _, filter := range p.Topics {
+				delete(c.filters, filter)
+			}
+			b.Unlock()
+			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			unsuback.MessageID = p.MessageID
+			c.write(unsuback)
+		case *packets.PublishPacket:
+			if p.Qos > 0 {
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = p.MessageID
+				c.write(puback)
+			}
+			b.route(p)
+		case *packets.PingreqPacket:
+			c.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+// route stores a retained message and forwards a message to subscribers
+func (b *localMQTTBroker) route(p *packets.PublishPacket) {
+	msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	msg.TopicName = p.TopicName
+	msg.Payload = p.Payload
+
+	b.Lock()
+	b.published = append(b.published, p.TopicName)
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(b.retained, p.TopicName)
+		} else {
+			retained := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			retained.TopicName = p.TopicName
+			retained.Payload = p.Payload
+			retained.Retain = true
+			b.retained[p.TopicName] = retained
+		}
+	}
+	var receivers []*localMQTTConn
+	for _, c := range b.conns {
+		for filter := range c.filters {
+			if topicMatches(filter, p.TopicName) {
+				receivers = append(receivers, c)
+				break
+			}
+		}
+	}
+	b.Unlock()
+
+	for _, c := range receivers {
+		c.write(msg)
+	}
+}
+
+var _ = g.Describe("MQTT Message Broker", func() {
+	var (
+		broker   *localMQTTBroker
+		eaaCtxs  []*Context
+		certsDir string
+	)
+
+	newContext := func(options string) (*Context, error) {
+		eaaCtx := &Context{}
+		eaaCtx.serviceInfo.m = make(map[string]Service)
+		eaaCtx.subscriptionInfo.m = make(map[UniqueNotif]*ConsumerSubscription)
+		eaaCtx.consumerConnections.m = make(map[string]ConsumerConnection)
+		eaaCtx.notificationSchemas.m = make(map[UniqueNotif]*notificationSchema)
+		eaaCtx.serviceHealth.m = make(map[string]*serviceHealthState)
+		eaaCtx.cfg.MsgBroker = MsgBrokerConfig{Type: mqttMsgBrokerType,
+			Options: json.RawMessage(options)}
+
+		var err error
+		if eaaCtx.MsgBrokerCtx, err = newMsgBroker(eaaCtx); err != nil {
+			return nil, err
+		}
+		eaaCtxs = append(eaaCtxs, eaaCtx)
+		return eaaCtx, nil
+	}
+
+	// startInstance starts an EAA instance connected to the local broker
+	startInstance := func() *Context {
+		eaaCtx, err := newContext(`{"Broker": "` + broker.address("tcp") + `"}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(eaaCtx.MsgBrokerCtx.addPublisher(servicesPublisher, servicesTopic, nil)).
+			To(Succeed())
+		Expect(eaaCtx.MsgBrokerCtx.addSubscriber(servicesSubscriber, servicesTopic, nil)).
+			To(Succeed())
+		return eaaCtx
+	}
+
+	services := func(eaaCtx *Context) func() []string {
+		return func() []string {
+			eaaCtx.serviceInfo.RLock()
+			defer eaaCtx.serviceInfo.RUnlock()
+			var names []string
+			for commonName := range eaaCtx.serviceInfo.m {
+				names = append(names, commonName)
+			}
+			return names
+		}
+	}
+
+	publishService := func(eaaCtx *Context, action string) {
+		data, err := json.Marshal(ServiceMessage{
+			Svc:    &Service{URN: &URN{ID: "camera-1", Namespace: "video"}},
+			Action: action})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(eaaCtx.MsgBrokerCtx.publish(servicesTopic,
+			message.NewMessage(watermill.NewUUID(), data))).To(Succeed())
+	}
+
+	g.BeforeEach(func() {
+		eaaCtxs = nil
+	})
+
+	g.AfterEach(func() {
+		for _, eaaCtx := range eaaCtxs {
+			Expect(eaaCtx.MsgBrokerCtx.removeAll()).To(Succeed())
+		}
+		broker.close()
+		if certsDir != "" {
+			os.RemoveAll(certsDir)
+			certsDir = ""
+		}
+	})
+
+	g.When("connected to a local broker", func() {
+		g.BeforeEach(func() {
+			broker = newLocalMQTTBroker(nil)
+		})
+
+		g.It("should share service registrations with instances started later", func() {
+			first := startInstance()
+			publishService(first, serviceActionRegister)
+			Eventually(services(first)).Should(ConsistOf("video:camera-1"))
+
+			second := startInstance()
+			Eventually(services(second)).Should(ConsistOf("video:camera-1"))
+
+			publishService(first, serviceActionDeregister)
+			Eventually(services(first)).Should(BeEmpty())
+			Eventually(services(second)).Should(BeEmpty())
+
+			third := startInstance()
+			Consistently(services(third), 200*time.Millisecond).Should(BeEmpty())
+		})
+
+		g.It("should map topics onto the MQTT topic tree", func() {
+			eaaCtx := startInstance()
+			publishService(eaaCtx, serviceActionRegister)
+			Eventually(services(eaaCtx)).Should(ConsistOf("video:camera-1"))
+
+			for _, topic := range []string{getNotificationTopicName("video"),
+				getClientTopicName("consumer:1")} {
+				Expect(eaaCtx.MsgBrokerCtx.addPublisher(notificationPublisher, topic, nil)).
+					To(Succeed())
+				Expect(eaaCtx.MsgBrokerCtx.publish(topic,
+					message.NewMessage(watermill.NewUUID(), []byte(`{}`)))).To(Succeed())
+			}
+			Eventually(broker.publishedTopics).Should(ConsistOf(
+				"eaa/services/video:camera-1",
+				"eaa/notifications/video",
+				"eaa/clients/consumer.1"))
+		})
+
+		g.It("should reject publishing without a publisher", func() {
+			eaaCtx := startInstance()
+			Expect(eaaCtx.MsgBrokerCtx.publish(getNotificationTopicName("video"),
+				message.NewMessage(watermill.NewUUID(), []byte(`{}`)))).NotTo(Succeed())
+			Expect(eaaCtx.MsgBrokerCtx.addSubscriber(servicesSubscriber, servicesTopic,
+				nil)).To(BeAssignableToTypeOf(objectAlreadyExistsError{}))
+		})
+
+		g.It("should reject invalid options", func() {
+			_, err := newContext(`{}`)
+			Expect(err).To(HaveOccurred())
+			_, err = newContext(`{"Broker": "` + broker.address("tcp") + `", "QoS": 3}`)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	g.When("the broker requires client certificates", func() {
+		var options string
+
+		g.BeforeEach(func() {
+			var err error
+			certsDir, err = ioutil.TempDir("", "eaaMQTT")
+			Expect(err).NotTo(HaveOccurred())
+
+			caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).NotTo(HaveOccurred())
+			caTemplate := &x509.Certificate{
+				SerialNumber:          big.NewInt(1),
+				Subject:               pkix.Name{CommonName: "root.openness"},
+				NotBefore:             time.Now().Add(-time.Hour),
+				NotAfter:              time.Now().Add(time.Hour),
+				IsCA:                  true,
+				BasicConstraintsValid: true,
+				KeyUsage:              x509.KeyUsageCertSign,
+			}
+			der, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate,
+				caKey.Public(), caKey)
+			Expect(err).NotTo(HaveOccurred())
+			caCert, err := x509.ParseCertificate(der)
+			Expect(err).NotTo(HaveOccurred())
+
+			issue := func(serial int64, commonName string) tls.Certificate {
+				key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				Expect(err).NotTo(HaveOccurred())
+				der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+					SerialNumber: big.NewInt(serial),
+					Subject:      pkix.Name{CommonName: commonName},
+					IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+					NotBefore:    time.Now().Add(-time.Hour),
+					NotAfter:     time.Now().Add(time.Hour),
+					ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+						x509.ExtKeyUsageClientAuth},
+				}, caCert, key.Public(), caKey)
+				Expect(err).NotTo(HaveOccurred())
+				return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+			}
+
+			clientCert := issue(3, "eaa.openness")
+			leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+			Expect(err).NotTo(HaveOccurred())
+			caPath := filepath.Join(certsDir, "root.pem")
+			certPath := filepath.Join(certsDir, "cert.pem")
+			keyPath := filepath.Join(certsDir, "key.pem")
+			Expect(auth.SaveCert(caPath, caCert)).To(Succeed())
+			Expect(auth.SaveCert(certPath, leaf)).To(Succeed())
+			Expect(auth.SaveKey(clientCert.PrivateKey.(*ecdsa.PrivateKey), keyPath)).
+				To(Succeed())
+
+			clientCAs := x509.NewCertPool()
+			clientCAs.AddCert(caCert)
+			broker = newLocalMQTTBroker(&tls.Config{
+				Certificates: []tls.Certificate{issue(2, "mqtt.openness")},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    clientCAs,
+			})
+			options = `"Broker": "` + broker.address("ssl") + `", "CAPath": "` + caPath + `"`
+		})
+
+		g.It("should connect with the client certificate", func() {
+			eaaCtx, err := newContext(`{` + options + `, "CertPath": "` +
+				filepath.Join(certsDir, "cert.pem") + `", "KeyPath": "` +
+				filepath.Join(certsDir, "key.pem") + `"}`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(eaaCtx.MsgBrokerCtx.addSubscriber(servicesSubscriber, servicesTopic,
+				nil)).To(Succeed())
+		})
+
+		g.It("should fail to connect without the client certificate", func() {
+			_, err := newContext(`{` + options + `}`)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
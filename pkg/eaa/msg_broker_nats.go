@@ -0,0 +1,555 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/smart-edge-open/edgeservices/pkg/util"
+)
+
+const (
+	natsMsgBrokerType = "nats"
+
+	// Defaults of MsgBroker.Options of the NATS backend
+	defaultNATSSubjectRoot = "eaa"
+
+	// Names of JetStream streams keeping services and client messages
+	natsServicesStream = "EAA_SERVICES"
+	natsClientsStream  = "EAA_CLIENTS"
+
+	// Time limit of connecting and of JetStream API requests
+	natsOperationTimeout = 10 * time.Second
+	// Number of received messages buffered for a single subscriber
+	natsSubscriberBufferSize = 10000
+	// Maximum number of unacknowledged messages of a durable consumer
+	natsMaxAckPending = 1000
+)
+
+// Subjects the EAA topics are mapped onto:
+//
+//	ns_<namespace>  -> <root>.notifications.<namespace>  (NATS Core)
+//	services        -> <root>.services                   (JetStream)
+//	client_<URN>    -> <root>.clients.<consumer URN>     (JetStream)
+const (
+	natsNotificationsToken = "notifications"
+	natsServicesToken      = "services"
+	natsClientsToken       = "clients"
+)
+
+// natsStreamOptions describes retention of a JetStream stream, zero values
+// leave a limit unset. Messages removed from a stream aren't replayed to EAA
+// instances that start later, so the limits should keep all registrations
+// and subscriptions that are still in use.
+type natsStreamOptions struct {
+	// Maximum age of a message in the stream
+	MaxAge util.Duration `json:"MaxAge"`
+	// Maximum number of messages in the stream
+	MaxMsgs int64 `json:"MaxMsgs,omitempty"`
+	// Maximum size of the stream in bytes
+	MaxBytes int64 `json:"MaxBytes,omitempty"`
+	// Number of stream replicas in a clustered JetStream
+	Replicas int `json:"Replicas,omitempty"`
+}
+
+// natsMsgBrokerOptions describes the MsgBroker.Options section of the EAA
+// config for the NATS backend
+type natsMsgBrokerOptions struct {
+	// Comma separated URLs of NATS servers, e.g. "tls://nats.openness:4222"
+	Servers string `json:"Servers"`
+	// Root of the subjects used by EAA, defaults to "eaa"
+	SubjectRoot string `json:"SubjectRoot,omitempty"`
+	// Name of the EAA instance used as a prefix of its durable consumers,
+	// defaults to "EAA_<hostname>". It has to be unique and stable across
+	// restarts of the instance.
+	Durable string `json:"Durable,omitempty"`
+	// Retention of the services stream
+	ServicesStream natsStreamOptions `json:"ServicesStream"`
+	// Retention of the client_ stream
+	ClientsStream natsStreamOptions `json:"ClientsStream"`
+	// Root CA of the server certificate
+	CAPath string `json:"CAPath,omitempty"`
+	// Client certificate and its key
+	CertPath string `json:"CertPath,omitempty"`
+	KeyPath  string `json:"KeyPath,omitempty"`
+}
+
+// natsSubscription passes messages received on a subject to a message handler
+type natsSubscription struct {
+	sync.RWMutex
+	messages chan *message.Message
+	closing  chan struct{}
+	closed   bool
+	// Subscription on the NATS connection, nil until subscribed
+	natsSub *nats.Subscription
+}
+
+// deliver passes a received message to the handler unless the subscription
+// is closed and waits until the handler acknowledges it. It returns false if
+// the message wasn't processed.
+func (s *natsSubscription) deliver(msg *message.Message) bool {
+	s.RLock()
+	if s.closed {
+		s.RUnlock()
+		return false
+	}
+	s.messages <- msg
+	s.RUnlock()
+
+	select {
+	case <-msg.Acked():
+		return true
+	case <-msg.Nacked():
+		return false
+	case <-s.closing:
+		return false
+	}
+}
+
+// close makes the handler of the subscription finish
+func (s *natsSubscription) close() {
+	s.Lock()
+	defer s.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.closing)
+		close(s.messages)
+	}
+}
+
+// NATSMsgBroker is a NATS-backed msgBroker. Notifications are passed by NATS
+// Core while services and client messages are kept in JetStream streams and
+// consumed by durable consumers of the EAA instance, so that messages
+// published while the instance is down are delivered when it's back.
+type NATSMsgBroker struct {
+	sync.RWMutex
+	eaaCtx      *Context
+	opts        natsMsgBrokerOptions
+	natsOpts    []nats.Option
+	subjectRoot string
+	durable     string
+	conn        *nats.Conn
+	js          nats.JetStreamContext
+	pubs        map[string]struct{}
+	subs        map[string]*natsSubscription
+}
+
+func init() {
+	registerMsgBrokerFactory(natsMsgBrokerType, newNATSMsgBrokerFromOptions)
+}
+
+// newNATSMsgBrokerFromOptions is a msgBrokerFactory of the NATS backend
+func newNATSMsgBrokerFromOptions(eaaCtx *Context, options json.RawMessage) (msgBroker,
+	error) {
+
+	var opts natsMsgBrokerOptions
+	if len(options) != 0 {
+		if err := json.Unmarshal(options, &opts); err != nil {
+			return nil, errors.Wrap(err, "Failed to parse NATS Message Broker options")
+		}
+	}
+	return NewNATSMsgBroker(eaaCtx, opts)
+}
+
+// natsToken replaces characters that can't be used in a subject token or
+// in a consumer name
+func natsToken(s string) string {
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_").Replace(s)
+}
+
+// defaultNATSDurable returns a durable name prefix of the EAA instance
+func defaultNATSDurable() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to get the hostname for NATS durable consumers")
+	}
+	return "EAA_" + natsToken(hostname), nil
+}
+
+// NewNATSMsgBroker creates a NATS-backed msgBroker, connects it to the NATS
+// server and sets up the JetStream streams
+func NewNATSMsgBroker(eaaCtx *Context, opts natsMsgBrokerOptions) (*NATSMsgBroker, error) {
+	if opts.Servers == "" {
+		return nil, errors.New("NATS Message Broker requires the Servers option")
+	}
+
+	broker := NATSMsgBroker{
+		eaaCtx:      eaaCtx,
+		opts:        opts,
+		subjectRoot: defaultNATSSubjectRoot,
+		durable:     opts.Durable,
+		pubs:        make(map[string]struct{}),
+		subs:        make(map[string]*natsSubscription),
+	}
+	if opts.SubjectRoot != "" {
+		broker.subjectRoot = strings.TrimSuffix(opts.SubjectRoot, ".")
+	}
+	if broker.durable == "" {
+		var err error
+		if broker.durable, err = defaultNATSDurable(); err != nil {
+			return nil, err
+		}
+	} else if natsToken(broker.durable) != broker.durable {
+		return nil, fmt.Errorf("Invalid NATS durable name: %v", broker.durable)
+	}
+
+	broker.natsOpts = []nats.Option{
+		nats.Name(broker.durable),
+		nats.Timeout(natsOperationTimeout),
+		nats.MaxReconnects(-1),
+	}
+	if opts.CAPath != "" {
+		broker.natsOpts = append(broker.natsOpts, nats.RootCAs(opts.CAPath))
+	}
+	if opts.CertPath != "" {
+		broker.natsOpts = append(broker.natsOpts, nats.ClientCert(opts.CertPath, opts.KeyPath))
+	}
+
+	if err := broker.connect(); err != nil {
+		return nil, errors.Wrap(err, "Failed to create a NATSMsgBroker")
+	}
+	return &broker, nil
+}
+
+// streamConfig returns the config of a JetStream stream with a given
+// retention
+func streamConfig(name, subject string, retention natsStreamOptions) *nats.StreamConfig {
+	cfg := &nats.StreamConfig{
+		Name:     name,
+		Subjects: []string{subject},
+		Storage:  nats.FileStorage,
+		MaxAge:   retention.MaxAge.Duration,
+		MaxMsgs:  -1,
+		MaxBytes: -1,
+		Replicas: retention.Replicas,
+	}
+	if retention.MaxMsgs > 0 {
+		cfg.MaxMsgs = retention.MaxMsgs
+	}
+	if retention.MaxBytes > 0 {
+		cfg.MaxBytes = retention.MaxBytes
+	}
+	return cfg
+}
+
+// ensureStream creates a JetStream stream or updates its retention if it
+// already exists
+func (b *NATSMsgBroker) ensureStream(cfg *nats.StreamConfig) error {
+	var err error
+	if _, err = b.js.StreamInfo(cfg.Name); err != nil {
+		_, err = b.js.AddStream(cfg)
+	} else {
+		_, err = b.js.UpdateStream(cfg)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Couldn't set up JetStream stream %v", cfg.Name)
+	}
+	return nil
+}
+
+// connect connects to the NATS server and sets up the streams unless
+// connected already, the broker has to be locked by the caller
+func (b *NATSMsgBroker) connect() error {
+	if b.conn != nil {
+		return nil
+	}
+
+	conn, err := nats.Connect(b.opts.Servers, b.natsOpts...)
+	if err != nil {
+		return errors.Wrapf(err, "Couldn't connect to NATS server %v", b.opts.Servers)
+	}
+
+	js, err := conn.JetStream(nats.MaxWait(natsOperationTimeout))
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "Couldn't get JetStream context")
+	}
+
+	b.conn, b.js = conn, js
+	streams := []*nats.StreamConfig{
+		streamConfig(natsServicesStream, b.subjectRoot+"."+natsServicesToken,
+			b.opts.ServicesStream),
+		streamConfig(natsClientsStream, b.subjectRoot+"."+natsClientsToken+".>",
+			b.opts.ClientsStream),
+	}
+	for _, cfg := range streams {
+		if err = b.ensureStream(cfg); err != nil {
+			conn.Close()
+			b.conn, b.js = nil, nil
+			return err
+		}
+	}
+
+	log.Infof("Connected to NATS server %v", conn.ConnectedUrl())
+	return nil
+}
+
+// natsSubject maps a topic onto a NATS subject
+func (b *NATSMsgBroker) natsSubject(topic string) (string, error) {
+	switch {
+	case strings.HasPrefix(topic, notificationsTopicPrefix):
+		return b.subjectRoot + "." + natsNotificationsToken + "." +
+			natsToken(strings.TrimPrefix(topic, notificationsTopicPrefix)), nil
+	case strings.HasPrefix(topic, clientTopicPrefix):
+		return b.subjectRoot + "." + natsClientsToken + "." +
+			strings.TrimPrefix(topic, clientTopicPrefix), nil
+	case topic == servicesTopic:
+		return b.subjectRoot + "." + natsServicesToken, nil
+	}
+
+	return "", fmt.Errorf("Unknown topic type: %v", topic)
+}
+
+// durableName returns the name of the durable consumer of the EAA instance
+// for a topic
+func (b *NATSMsgBroker) durableName(topic string) string {
+	return b.durable + "_" + natsToken(topic)
+}
+
+// Add a Publisher for a given topic. All topics are published by the same
+// NATS connection, publishers only mark topics that can be published to.
+func (b *NATSMsgBroker) addPublisher(t publisherType, topic string, r *http.Request) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if _, found := b.pubs[topic]; found {
+		return objectAlreadyExistsError{fmt.Errorf("Publisher with ID '%v' already exists", topic)}
+	}
+
+	// The connection may have been closed in removeAll()
+	if err := b.connect(); err != nil {
+		return err
+	}
+
+	b.pubs[topic] = struct{}{}
+	log.Infof("Added Publisher for a topic: %v", topic)
+
+	return nil
+}
+
+// Publish a msg to a given topic. Notifications are published by NATS Core,
+// other messages are stored in JetStream. The message UUID is sent as the
+// JetStream message ID, so that retransmissions are deduplicated.
+func (b *NATSMsgBroker) publish(topic string, msg *message.Message) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	if _, found := b.pubs[topic]; !found {
+		return fmt.Errorf("Invalid Publisher topic: %v", topic)
+	}
+
+	subject, err := b.natsSubject(topic)
+	if err != nil {
+		return errors.Wrapf(err, "Couldn't map topic '%v' to NATS", topic)
+	}
+
+	m := nats.NewMsg(subject)
+	m.Header.Set(nats.MsgIdHdr, msg.UUID)
+	m.Data = msg.Payload
+
+	if strings.HasPrefix(topic, notificationsTopicPrefix) {
+		err = b.conn.PublishMsg(m)
+	} else {
+		_, err = b.js.PublishMsg(m)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Error when Publishing a message to the topic: %v", topic)
+	}
+	return nil
+}
+
+// toMessage converts a received NATS message to a Watermill message
+func toMessage(m *nats.Msg) *message.Message {
+	uuid := m.Header.Get(nats.MsgIdHdr)
+	if uuid == "" {
+		uuid = watermill.NewUUID()
+	}
+	return message.NewMessage(uuid, m.Data)
+}
+
+// subscribeCore subscribes to notifications by NATS Core
+func (b *NATSMsgBroker) subscribeCore(subject string,
+	sub *natsSubscription) (*nats.Subscription, error) {
+
+	return b.conn.Subscribe(subject, func(m *nats.Msg) {
+		sub.deliver(toMessage(m))
+	})
+}
+
+// ensureDurableConsumer creates the durable consumer of the EAA instance
+// for a topic unless it exists already. The consumer is created explicitly
+// rather than by js.Subscribe, which would delete it on unsubscribe.
+func (b *NATSMsgBroker) ensureDurableConsumer(stream, durable, subject string) error {
+	_, err := b.js.ConsumerInfo(stream, durable)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrConsumerNotFound) {
+		return errors.Wrapf(err, "Couldn't get NATS consumer %v", durable)
+	}
+
+	_, err = b.js.AddConsumer(stream, &nats.ConsumerConfig{
+		Durable:        durable,
+		DeliverSubject: nats.NewInbox(),
+		DeliverPolicy:  nats.DeliverAllPolicy,
+		AckPolicy:      nats.AckExplicitPolicy,
+		FilterSubject:  subject,
+		MaxAckPending:  natsMaxAckPending,
+	})
+	return errors.Wrapf(err, "Couldn't create NATS consumer %v", durable)
+}
+
+// subscribeDurable subscribes to a JetStream subject by a durable consumer
+// of the EAA instance. A message is acknowledged when the handler processes
+// it, otherwise JetStream redelivers it.
+func (b *NATSMsgBroker) subscribeDurable(topic, subject string,
+	sub *natsSubscription) (*nats.Subscription, error) {
+
+	stream := natsServicesStream
+	if topic != servicesTopic {
+		stream = natsClientsStream
+	}
+	durable := b.durableName(topic)
+	if err := b.ensureDurableConsumer(stream, durable, subject); err != nil {
+		return nil, err
+	}
+
+	return b.js.Subscribe(subject, func(m *nats.Msg) {
+		if !sub.deliver(toMessage(m)) {
+			return
+		}
+		if err := m.Ack(); err != nil {
+			log.Errf("Failed to Ack a NATS message on %s: %s", m.Subject, err.Error())
+		}
+	},
+		nats.Bind(stream, durable),
+		nats.ManualAck(),
+	)
+}
+
+// resetDurableConsumer removes the durable consumer of the EAA instance for
+// a topic when there's no State Store to restore services and subscriptions
+// from. They are then rebuilt from the whole stream instead of continuing
+// where the previous run of the instance stopped.
+func (b *NATSMsgBroker) resetDurableConsumer(topic string) {
+	if b.eaaCtx.stateStore != nil {
+		return
+	}
+
+	stream := natsServicesStream
+	if topic != servicesTopic {
+		stream = natsClientsStream
+	}
+	durable := b.durableName(topic)
+	if _, err := b.js.ConsumerInfo(stream, durable); err != nil {
+		// The consumer doesn't exist yet
+		return
+	}
+	if err := b.js.DeleteConsumer(stream, durable); err != nil {
+		log.Warningf("Failed to reset NATS consumer %s: %v", durable, err)
+	}
+}
+
+// Add a Subscriber of type t for a topic. The Subscriber can be later
+// accessed using its topic. If a Subscriber for a given topic already exists,
+// objectAlreadyExistsError is returned.
+func (b *NATSMsgBroker) addSubscriber(t subscriberType, topic string, r *http.Request) error {
+	b.Lock()
+	defer b.Unlock()
+
+	// Only one Subscriber per topic is permitted
+	if _, found := b.subs[topic]; found {
+		return objectAlreadyExistsError{fmt.Errorf("Subscriber for a topic '%v' already exists",
+			topic)}
+	}
+
+	var handle func(<-chan *message.Message, *Context)
+	switch t {
+	case notificationSubscriber:
+		handle = handleNotificationUpdates
+	case servicesSubscriber:
+		handle = handleServiceUpdates
+	case clientSubscriber:
+		handle = handleClientUpdates
+	default:
+		return fmt.Errorf("Unknown Subscriber type: %v", t)
+	}
+
+	subject, err := b.natsSubject(topic)
+	if err != nil {
+		return errors.Wrapf(err, "Couldn't map topic '%v' to NATS", topic)
+	}
+
+	if err = b.connect(); err != nil {
+		return err
+	}
+
+	sub := &natsSubscription{
+		messages: make(chan *message.Message, natsSubscriberBufferSize),
+		closing:  make(chan struct{}),
+	}
+	go handle(sub.messages, b.eaaCtx)
+
+	if t == notificationSubscriber {
+		sub.natsSub, err = b.subscribeCore(subject, sub)
+	} else {
+		b.resetDurableConsumer(topic)
+		sub.natsSub, err = b.subscribeDurable(topic, subject, sub)
+	}
+	if err != nil {
+		sub.close()
+		return errors.Wrapf(err, "Couldn't create Subscriber of type '%v' for a topic: %v", t,
+			topic)
+	}
+
+	b.subs[topic] = sub
+	log.Infof("Added Subscriber for a topic: %v", topic)
+
+	return nil
+}
+
+// Remove all Subscribers and close the connection to the NATS server.
+// Durable consumers are kept so that the EAA instance continues where it
+// stopped. Subscriptions are unsubscribed and flushed before the connection
+// is closed, otherwise JetStream could deliver a message to the closing
+// connection and redeliver it only after the ack wait of the consumer.
+func (b *NATSMsgBroker) removeAll() error {
+	b.Lock()
+	defer b.Unlock()
+
+	var err error
+	if b.conn != nil {
+		for topic, sub := range b.subs {
+			if unsubErr := sub.natsSub.Unsubscribe(); unsubErr != nil {
+				log.Warningf("Failed to unsubscribe from NATS topic %v: %v", topic, unsubErr)
+			}
+		}
+		err = b.conn.Flush()
+		b.conn.Close()
+		b.conn, b.js = nil, nil
+	}
+
+	for _, sub := range b.subs {
+		sub.close()
+	}
+
+	// Clear the maps
+	b.pubs = make(map[string]struct{})
+	b.subs = make(map[string]*natsSubscription)
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to flush the NATS connection")
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = g.Describe("NATS Message Broker", func() {
+	var (
+		natsServer *server.Server
+		storeDir   string
+		eaaCtxs    []*Context
+	)
+
+	newContext := func(options string) (*Context, error) {
+		eaaCtx := &Context{}
+		eaaCtx.serviceInfo.m = make(map[string]Service)
+		eaaCtx.subscriptionInfo.m = make(map[UniqueNotif]*ConsumerSubscription)
+		eaaCtx.consumerConnections.m = make(map[string]ConsumerConnection)
+		eaaCtx.notificationSchemas.m = make(map[UniqueNotif]*notificationSchema)
+		eaaCtx.serviceHealth.m = make(map[string]*serviceHealthState)
+		eaaCtx.cfg.MsgBroker = MsgBrokerConfig{Type: natsMsgBrokerType,
+			Options: json.RawMessage(options)}
+
+		var err error
+		if eaaCtx.MsgBrokerCtx, err = newMsgBroker(eaaCtx); err != nil {
+			return nil, err
+		}
+		eaaCtxs = append(eaaCtxs, eaaCtx)
+		return eaaCtx, nil
+	}
+
+	// startInstance starts an EAA instance with a given durable name
+	// connected to the embedded server
+	startInstance := func(durable string) *Context {
+		eaaCtx, err := newContext(`{"Servers": "` + natsServer.ClientURL() +
+			`", "Durable": "` + durable + `"}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(eaaCtx.MsgBrokerCtx.addPublisher(servicesPublisher, servicesTopic, nil)).
+			To(Succeed())
+		Expect(eaaCtx.MsgBrokerCtx.addSubscriber(servicesSubscriber, servicesTopic, nil)).
+			To(Succeed())
+		return eaaCtx
+	}
+
+	services := func(eaaCtx *Context) func() []string {
+		return func() []string {
+			eaaCtx.serviceInfo.RLock()
+			defer eaaCtx.serviceInfo.RUnlock()
+			var names []string
+			for commonName := range eaaCtx.serviceInfo.m {
+				names = append(names, commonName)
+			}
+			return names
+		}
+	}
+
+	publishService := func(eaaCtx *Context, id, action string) {
+		data, err := json.Marshal(ServiceMessage{
+			Svc:    &Service{URN: &URN{ID: id, Namespace: "video"}},
+			Action: action})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(eaaCtx.MsgBrokerCtx.publish(servicesTopic,
+			message.NewMessage(watermill.NewUUID(), data))).To(Succeed())
+	}
+
+	g.BeforeEach(func() {
+		var err error
+		storeDir, err = ioutil.TempDir("", "eaaNATS")
+		Expect(err).NotTo(HaveOccurred())
+
+		opts := natsserver.DefaultTestOptions
+		opts.Port = -1
+		opts.JetStream = true
+		opts.StoreDir = storeDir
+		natsServer = natsserver.RunServer(&opts)
+		eaaCtxs = nil
+	})
+
+	g.AfterEach(func() {
+		for _, eaaCtx := range eaaCtxs {
+			Expect(eaaCtx.MsgBrokerCtx.removeAll()).To(Succeed())
+		}
+		natsServer.Shutdown()
+		os.RemoveAll(storeDir)
+	})
+
+	g.It("should share service registrations with instances started later", func() {
+		first := startInstance("EAA_first")
+		publishService(first, "camera-1", serviceActionRegister)
+		Eventually(services(first)).Should(ConsistOf("video:camera-1"))
+
+		second := startInstance("EAA_second")
+		Eventually(services(second)).Should(ConsistOf("video:camera-1"))
+
+		publishService(first, "camera-1", serviceActionDeregister)
+		Eventually(services(first)).Should(BeEmpty())
+		Eventually(services(second)).Should(BeEmpty())
+	})
+
+	g.It("should resume a durable consumer after restart", func() {
+		first := startInstance("EAA_first")
+		second := startInstance("EAA_second")
+		publishService(first, "camera-1", serviceActionRegister)
+		Eventually(services(second)).Should(ConsistOf("video:camera-1"))
+
+		// Services registered while the second instance is down are
+		// delivered after it restarts, earlier ones come from its State Store
+		Expect(second.MsgBrokerCtx.removeAll()).To(Succeed())
+		publishService(first, "camera-2", serviceActionRegister)
+
+		restarted, err := newContext(`{"Servers": "` + natsServer.ClientURL() +
+			`", "Durable": "EAA_second"}`)
+		Expect(err).NotTo(HaveOccurred())
+		restarted.stateStore, err = newStateStore(
+			StateStoreConfig{Path: filepath.Join(storeDir, "state.db")})
+		Expect(err).NotTo(HaveOccurred())
+		defer restarted.stateStore.close()
+		Expect(restarted.MsgBrokerCtx.addSubscriber(servicesSubscriber, servicesTopic,
+			nil)).To(Succeed())
+		Eventually(services(restarted)).Should(ConsistOf("video:camera-2"))
+		Consistently(services(restarted), 200*time.Millisecond).
+			Should(ConsistOf("video:camera-2"))
+	})
+
+	g.It("should replay all services after restart without a State Store", func() {
+		first := startInstance("EAA_first")
+		second := startInstance("EAA_second")
+		publishService(first, "camera-1", serviceActionRegister)
+		Eventually(services(second)).Should(ConsistOf("video:camera-1"))
+
+		Expect(second.MsgBrokerCtx.removeAll()).To(Succeed())
+		publishService(first, "camera-2", serviceActionRegister)
+
+		restarted := startInstance("EAA_second")
+		Eventually(services(restarted)).Should(
+			ConsistOf("video:camera-1", "video:camera-2"))
+	})
+
+	g.It("should replay client subscriptions after restart without a State Store",
+		func() {
+			first := startInstance("EAA_first")
+			clientTopic := getClientTopicName("consumer:1")
+			subscriptions := func(eaaCtx *Context) func() int {
+				return func() int {
+					eaaCtx.subscriptionInfo.RLock()
+					defer eaaCtx.subscriptionInfo.RUnlock()
+					return len(eaaCtx.subscriptionInfo.m)
+				}
+			}
+
+			Expect(processSubscriptionRequest(subscriptionActionSubscribe,
+				subscriptionScopeNamespace, "consumer:1", &URN{Namespace: "video"},
+				[]NotificationDescriptor{{Name: "motion", Version: "1.0"}}, nil,
+				first)).To(Succeed())
+			Eventually(subscriptions(first)).Should(Equal(1))
+
+			Expect(first.MsgBrokerCtx.removeAll()).To(Succeed())
+			restarted := startInstance("EAA_first")
+			Expect(restarted.MsgBrokerCtx.addSubscriber(clientSubscriber, clientTopic,
+				nil)).To(Succeed())
+			Eventually(subscriptions(restarted)).Should(Equal(1))
+		})
+
+	g.It("should set up the streams with the configured retention", func() {
+		_, err := newContext(`{"Servers": "` + natsServer.ClientURL() + `",
+			"Durable": "EAA_first",
+			"ServicesStream": {"MaxAge": "1h", "MaxMsgs": 1000},
+			"ClientsStream": {"MaxAge": "10m", "MaxBytes": 1048576}}`)
+		Expect(err).NotTo(HaveOccurred())
+
+		conn, err := nats.Connect(natsServer.ClientURL())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		js, err := conn.JetStream()
+		Expect(err).NotTo(HaveOccurred())
+
+		info, err := js.StreamInfo(natsServicesStream)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Config.Subjects).To(ConsistOf("eaa.services"))
+		Expect(info.Config.MaxAge).To(Equal(time.Hour))
+		Expect(info.Config.MaxMsgs).To(Equal(int64(1000)))
+
+		info, err = js.StreamInfo(natsClientsStream)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Config.Subjects).To(ConsistOf("eaa.clients.>"))
+		Expect(info.Config.MaxAge).To(Equal(10 * time.Minute))
+		Expect(info.Config.MaxBytes).To(Equal(int64(1048576)))
+	})
+
+	g.It("should pass client messages and notifications", func() {
+		eaaCtx := startInstance("EAA_first")
+		clientTopic := getClientTopicName("consumer:1")
+		notifTopic := getNotificationTopicName("video")
+		Expect(eaaCtx.MsgBrokerCtx.addPublisher(clientPublisher, clientTopic, nil)).
+			To(Succeed())
+		Expect(eaaCtx.MsgBrokerCtx.addPublisher(notificationPublisher, notifTopic, nil)).
+			To(Succeed())
+
+		conn, err := nats.Connect(natsServer.ClientURL())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		received := make(chan *nats.Msg, 2)
+		_, err = conn.ChanSubscribe("eaa.>", received)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conn.Flush()).To(Succeed())
+
+		for _, topic := range []string{clientTopic, notifTopic} {
+			Expect(eaaCtx.MsgBrokerCtx.publish(topic,
+				message.NewMessage(watermill.NewUUID(), []byte(`{}`)))).To(Succeed())
+		}
+		var subjects []string
+		for i := 0; i < 2; i++ {
+			var m *nats.Msg
+			Eventually(received).Should(Receive(&m))
+			subjects = append(subjects, m.Subject)
+		}
+		Expect(subjects).To(ConsistOf("eaa.clients.consumer.1", "eaa.notifications.video"))
+	})
+
+	g.It("should keep every subscription of a client", func() {
+		eaaCtx := startInstance("EAA_first")
+
+		for _, namespace := range []string{"video", "audio"} {
+			Expect(processSubscriptionRequest(subscriptionActionSubscribe,
+				subscriptionScopeNamespace, "consumer:1", &URN{Namespace: namespace},
+				[]NotificationDescriptor{{Name: "motion", Version: "1.0"}}, nil,
+				eaaCtx)).To(Succeed())
+		}
+
+		Eventually(func() int {
+			eaaCtx.subscriptionInfo.RLock()
+			defer eaaCtx.subscriptionInfo.RUnlock()
+			return len(eaaCtx.subscriptionInfo.m)
+		}).Should(Equal(2))
+	})
+
+	g.It("should reject invalid options", func() {
+		_, err := newContext(`{}`)
+		Expect(err).To(HaveOccurred())
+		_, err = newContext(`{"Servers": "` + natsServer.ClientURL() +
+			`", "Durable": "EAA.first"}`)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,242 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Default values of the Acknowledgements section of the EAA config
+const (
+	defaultAckRetryInterval    = 5 * time.Second
+	defaultAckMaxRetryInterval = time.Minute
+	defaultAckMaxRetries       = 5
+)
+
+// pendingNotification is a notification sent to a consumer and not
+// acknowledged yet
+type pendingNotification struct {
+	payload  []byte
+	attempts int
+	due      time.Time
+}
+
+// unackedNotifications is a synchronized map of a consumer Common Name to
+// its pending notifications indexed by notification ID
+type unackedNotifications struct {
+	sync.Mutex
+	m map[string]map[string]*pendingNotification
+}
+
+func (c AcknowledgementsConfig) retryInterval() time.Duration {
+	if c.RetryInterval.Duration <= 0 {
+		return defaultAckRetryInterval
+	}
+	return c.RetryInterval.Duration
+}
+
+func (c AcknowledgementsConfig) maxRetryInterval() time.Duration {
+	if c.MaxRetryInterval.Duration <= 0 {
+		return defaultAckMaxRetryInterval
+	}
+	return c.MaxRetryInterval.Duration
+}
+
+func (c AcknowledgementsConfig) maxRetries() int {
+	if c.MaxRetries <= 0 {
+		return defaultAckMaxRetries
+	}
+	return c.MaxRetries
+}
+
+// backoff returns the time to wait before the next retransmission of a notification
+// that has been already retransmitted a given number of times
+func (c AcknowledgementsConfig) backoff(attempts int) time.Duration {
+	interval := c.retryInterval()
+	for i := 0; i < attempts && interval < c.maxRetryInterval(); i++ {
+		interval *= 2
+	}
+	if interval > c.maxRetryInterval() {
+		interval = c.maxRetryInterval()
+	}
+	return interval
+}
+
+// trackNotification starts waiting for an acknowledgement of a notification
+// sent to a consumer and reports whether it wasn't tracked yet.
+// Retransmissions of already tracked notifications are scheduled by
+// retransmitUnackedNotifications.
+func trackNotification(subID string, msgID string, msgPayload []byte,
+	eaaCtx *Context) bool {
+
+	if !eaaCtx.cfg.Acknowledgements.Enabled || msgID == "" {
+		return false
+	}
+
+	eaaCtx.unackedNotifications.Lock()
+	defer eaaCtx.unackedNotifications.Unlock()
+
+	if eaaCtx.unackedNotifications.m == nil {
+		eaaCtx.unackedNotifications.m = make(map[string]map[string]*pendingNotification)
+	}
+	pending, ok := eaaCtx.unackedNotifications.m[subID]
+	if !ok {
+		pending = make(map[string]*pendingNotification)
+		eaaCtx.unackedNotifications.m[subID] = pending
+	}
+
+	if _, found := pending[msgID]; found {
+		return false
+	}
+	pending[msgID] = &pendingNotification{
+		payload: msgPayload,
+		due:     time.Now().Add(eaaCtx.cfg.Acknowledgements.backoff(0)),
+	}
+	return true
+}
+
+// untrackNotification stops waiting for an acknowledgement of a notification.
+// It returns false if the notification wasn't awaited.
+func untrackNotification(subID string, msgID string, eaaCtx *Context) bool {
+	eaaCtx.unackedNotifications.Lock()
+	defer eaaCtx.unackedNotifications.Unlock()
+
+	pending, ok := eaaCtx.unackedNotifications.m[subID]
+	if !ok {
+		return false
+	}
+	if _, found := pending[msgID]; !found {
+		return false
+	}
+
+	delete(pending, msgID)
+	if len(pending) == 0 {
+		delete(eaaCtx.unackedNotifications.m, subID)
+	}
+	return true
+}
+
+// retransmitUnackedNotifications sends again all notifications whose
+// acknowledgement timed out. Notifications that exceeded the retransmission
+// limit are dropped.
+func retransmitUnackedNotifications(eaaCtx *Context) {
+	type retransmission struct {
+		subID   string
+		msgID   string
+		payload []byte
+	}
+	var toSend []retransmission
+
+	ackCfg := eaaCtx.cfg.Acknowledgements
+	now := time.Now()
+
+	eaaCtx.unackedNotifications.Lock()
+	for subID, pending := range eaaCtx.unackedNotifications.m {
+		for msgID, n := range pending {
+			if now.Before(n.due) {
+				continue
+			}
+			if n.attempts >= ackCfg.maxRetries() {
+				log.Warningf("Notification %s was not acknowledged by %s, dropping it",
+					msgID, subID)
+				eaaCtx.metrics.notificationDropped(n.payload)
+				delete(pending, msgID)
+				continue
+			}
+			n.attempts++
+			n.due = now.Add(ackCfg.backoff(n.attempts))
+			toSend = append(toSend, retransmission{subID, msgID, n.payload})
+		}
+		if len(pending) == 0 {
+			delete(eaaCtx.unackedNotifications.m, subID)
+		}
+	}
+	eaaCtx.unackedNotifications.Unlock()
+
+	for _, r := range toSend {
+		log.Debugf("Retransmitting notification %s to %s", r.msgID, r.subID)
+		if err := sendNotificationToSubscriber(r.subID, r.msgID, r.payload, eaaCtx); err != nil {
+			log.Warningf("Couldn't retransmit notification %s to %s: %v", r.msgID, r.subID,
+				err)
+		}
+	}
+}
+
+// runNotificationRetransmitter periodically retransmits unacknowledged
+// notifications until ctx is done
+func runNotificationRetransmitter(ctx context.Context, eaaCtx *Context) {
+	interval := eaaCtx.cfg.Acknowledgements.retryInterval() / 2
+	if interval > time.Second {
+		interval = time.Second
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			retransmitUnackedNotifications(eaaCtx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readConsumerMessages handles acknowledgements sent by a consumer over
+// the websocket. When the connection breaks, it is removed from the consumer
+// connections so that notifications are queued until the consumer reconnects.
+// Pongs extend the read deadline, so a consumer that stops responding to
+// pings is disconnected after PongTimeout.
+func readConsumerMessages(commonName string, conn *websocket.Conn, eaaCtx *Context) {
+	pongTimeout := eaaCtx.cfg.Websocket.pongTimeout()
+	extendDeadline := func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	}
+	if err := extendDeadline(""); err != nil {
+		log.Warningf("Failed to set read deadline on websocket of %s: %v", commonName, err)
+	}
+	conn.SetPongHandler(extendDeadline)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			log.Debugf("Websocket of %s closed: %v", commonName, err)
+			removeConsumerConnection(commonName, conn, eaaCtx)
+			return
+		}
+
+		var ack NotificationAck
+		if err = json.Unmarshal(data, &ack); err != nil || ack.ID == "" {
+			log.Warningf("Unexpected message from %s: %s", commonName, string(data))
+			continue
+		}
+
+		if !untrackNotification(commonName, ack.ID, eaaCtx) {
+			log.Debugf("Acknowledgement of unknown notification %s from %s", ack.ID,
+				commonName)
+		}
+	}
+}
+
+// removeConsumerConnection closes a consumer websocket and removes it from
+// consumer connections unless it was already replaced by a new one
+func removeConsumerConnection(commonName string, conn *websocket.Conn, eaaCtx *Context) {
+	eaaCtx.consumerConnections.Lock()
+	if c, found := eaaCtx.consumerConnections.m[commonName]; found && c.connection == conn {
+		if c.writer != nil {
+			c.writer.stop()
+		}
+		delete(eaaCtx.consumerConnections.m, commonName)
+	}
+	eaaCtx.consumerConnections.Unlock()
+
+	if err := conn.Close(); err != nil {
+		log.Debugf("Failed to close websocket of %s: %v", commonName, err)
+	}
+}
@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/smart-edge-open/edgeservices/pkg/util"
+	. "github.com/undefinedlabs/go-mpatch"
+)
+
+var _ = g.Describe("notification acknowledgements", func() {
+	var (
+		eaaContext *Context
+		p          *Patch
+		writes     []string
+		untracked  []string
+		writesLock sync.Mutex
+	)
+
+	written := func() []string {
+		writesLock.Lock()
+		defer writesLock.Unlock()
+		return append([]string(nil), writes...)
+	}
+
+	const consumer = "consumer:1"
+
+	g.BeforeEach(func() {
+		eaaContext = &Context{}
+		eaaContext.consumerConnections = consumerConns{m: make(map[string]ConsumerConnection)}
+		eaaContext.consumerConnections.m[consumer] = startTestConsumerConnection(consumer, eaaContext)
+		eaaContext.cfg.Acknowledgements = AcknowledgementsConfig{
+			Enabled:          true,
+			RetryInterval:    util.Duration{Duration: 10 * time.Millisecond},
+			MaxRetryInterval: util.Duration{Duration: 20 * time.Millisecond},
+			MaxRetries:       2,
+		}
+
+		writes = nil
+		untracked = nil
+		var e error
+		p, e = PatchInstanceMethodByName(reflect.TypeOf(websocket.Conn{}), "WriteMessage",
+			func(_ *websocket.Conn, _ int, data []byte) error {
+				eaaContext.unackedNotifications.Lock()
+				_, tracked := eaaContext.unackedNotifications.m[consumer]["id1"]
+				eaaContext.unackedNotifications.Unlock()
+
+				writesLock.Lock()
+				writes = append(writes, string(data))
+				if !tracked {
+					untracked = append(untracked, string(data))
+				}
+				writesLock.Unlock()
+				return nil
+			})
+		Expect(e).NotTo(HaveOccurred())
+	})
+
+	g.AfterEach(func() {
+		stopTestConsumerConnections(eaaContext)
+		p.Unpatch()
+	})
+
+	g.It("should compute exponential backoff up to the limit", func() {
+		c := AcknowledgementsConfig{
+			RetryInterval:    util.Duration{Duration: time.Second},
+			MaxRetryInterval: util.Duration{Duration: 5 * time.Second},
+		}
+		Expect(c.backoff(0)).To(Equal(time.Second))
+		Expect(c.backoff(1)).To(Equal(2 * time.Second))
+		Expect(c.backoff(2)).To(Equal(4 * time.Second))
+		Expect(c.backoff(3)).To(Equal(5 * time.Second))
+		Expect(AcknowledgementsConfig{}.backoff(0)).To(Equal(defaultAckRetryInterval))
+	})
+
+	g.When("a notification is acknowledged", func() {
+		g.It("should not be retransmitted", func() {
+			Expect(sendNotificationToSubscriber(consumer, "id1", []byte(`1`), eaaContext)).
+				To(Succeed())
+			Expect(untrackNotification(consumer, "id1", eaaContext)).To(BeTrue())
+			Expect(untrackNotification(consumer, "id1", eaaContext)).To(BeFalse())
+
+			time.Sleep(15 * time.Millisecond)
+			retransmitUnackedNotifications(eaaContext)
+
+			Consistently(written, 50*time.Millisecond).Should(Equal([]string{`1`}))
+		})
+	})
+
+	g.When("a notification is sent", func() {
+		g.It("should be tracked before it's written", func() {
+			Expect(sendNotificationToSubscriber(consumer, "id1", []byte(`1`), eaaContext)).
+				To(Succeed())
+
+			Eventually(written).Should(Equal([]string{`1`}))
+			writesLock.Lock()
+			defer writesLock.Unlock()
+			Expect(untracked).To(BeEmpty())
+		})
+
+		g.It("should not be tracked when the consumer writer refuses it", func() {
+			eaaContext.consumerConnections.m[consumer].writer.stop()
+
+			Expect(sendNotificationToSubscriber(consumer, "id1", []byte(`1`), eaaContext)).
+				NotTo(Succeed())
+			Expect(eaaContext.unackedNotifications.m).To(BeEmpty())
+		})
+	})
+
+	g.When("a notification is not acknowledged", func() {
+		g.It("should be retransmitted until the retry limit is reached", func() {
+			Expect(sendNotificationToSubscriber(consumer, "id1", []byte(`1`), eaaContext)).
+				To(Succeed())
+
+			for i := 0; i < 5; i++ {
+				time.Sleep(25 * time.Millisecond)
+				retransmitUnackedNotifications(eaaContext)
+			}
+
+			Eventually(written).Should(Equal([]string{`1`, `1`, `1`}))
+			Expect(eaaContext.unackedNotifications.m).To(BeEmpty())
+		})
+	})
+
+	g.When("acknowledgements are disabled", func() {
+		g.It("should not track notifications", func() {
+			eaaContext.cfg.Acknowledgements.Enabled = false
+
+			Expect(sendNotificationToSubscriber(consumer, "id1", []byte(`1`), eaaContext)).
+				To(Succeed())
+
+			Eventually(written).Should(Equal([]string{`1`}))
+			Expect(eaaContext.unackedNotifications.m).To(BeEmpty())
+		})
+	})
+})
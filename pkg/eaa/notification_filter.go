@@ -0,0 +1,526 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// notificationFilter is a compiled filter expression attached by a consumer
+// to a subscription. Only notifications with a payload matching the filter
+// are sent to the consumer.
+//
+// Filter expressions compare payload fields with literals, e.g.
+//
+//	severity >= 3 and camera_id in ["cam1", "cam2"]
+//
+// Nested fields are selected with dots (location.zone). Supported operators
+// are ==, !=, <, <=, >, >=, in, not in and logical and, or, not with
+// parentheses. Literals are numbers, strings in single or double quotes,
+// true, false and null. A field alone is true when it is present and isn't
+// false, null, zero or an empty string.
+type notificationFilter struct {
+	expr string
+	root filterCondition
+}
+
+// filterCondition is a node of a filter expression evaluated to a boolean
+type filterCondition interface {
+	match(payload interface{}) bool
+}
+
+// filterOperand is a node of a filter expression evaluated to a value.
+// It reports false if the value is not present in the payload.
+type filterOperand interface {
+	value(payload interface{}) (interface{}, bool)
+}
+
+type andCondition struct{ left, right filterCondition }
+
+func (c andCondition) match(payload interface{}) bool {
+	return c.left.match(payload) && c.right.match(payload)
+}
+
+type orCondition struct{ left, right filterCondition }
+
+func (c orCondition) match(payload interface{}) bool {
+	return c.left.match(payload) || c.right.match(payload)
+}
+
+type notCondition struct{ cond filterCondition }
+
+func (c notCondition) match(payload interface{}) bool {
+	return !c.cond.match(payload)
+}
+
+type compareCondition struct {
+	op          string
+	left, right filterOperand
+}
+
+func (c compareCondition) match(payload interface{}) bool {
+	l, ok := c.left.value(payload)
+	if !ok {
+		return false
+	}
+	r, ok := c.right.value(payload)
+	if !ok {
+		return false
+	}
+	return compareFilterValues(c.op, l, r)
+}
+
+type inCondition struct {
+	operand filterOperand
+	list    []interface{}
+	negate  bool
+}
+
+func (c inCondition) match(payload interface{}) bool {
+	v, ok := c.operand.value(payload)
+	if !ok {
+		return false
+	}
+	for _, item := range c.list {
+		if compareFilterValues("==", v, item) {
+			return !c.negate
+		}
+	}
+	return c.negate
+}
+
+type truthyCondition struct{ operand filterOperand }
+
+func (c truthyCondition) match(payload interface{}) bool {
+	v, ok := c.operand.value(payload)
+	if !ok {
+		return false
+	}
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case float64:
+		return t != 0
+	case string:
+		return t != ""
+	default:
+		return true
+	}
+}
+
+// filterField selects a payload field by its path
+type filterField []string
+
+func (f filterField) value(payload interface{}) (interface{}, bool) {
+	v := payload
+	for _, name := range f {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[name]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+type filterLiteral struct{ v interface{} }
+
+func (l filterLiteral) value(_ interface{}) (interface{}, bool) {
+	return l.v, true
+}
+
+// compareFilterValues compares two JSON values. Values of different types
+// are never equal and can't be ordered.
+func compareFilterValues(op string, l, r interface{}) bool {
+	switch lv := l.(type) {
+	case float64:
+		if rv, ok := r.(float64); ok {
+			switch op {
+			case "==":
+				return lv == rv
+			case "!=":
+				return lv != rv
+			case "<":
+				return lv < rv
+			case "<=":
+				return lv <= rv
+			case ">":
+				return lv > rv
+			case ">=":
+				return lv >= rv
+			}
+		}
+	case string:
+		if rv, ok := r.(string); ok {
+			switch op {
+			case "==":
+				return lv == rv
+			case "!=":
+				return lv != rv
+			case "<":
+				return lv < rv
+			case "<=":
+				return lv <= rv
+			case ">":
+				return lv > rv
+			case ">=":
+				return lv >= rv
+			}
+		}
+	case bool, nil:
+		switch op {
+		case "==":
+			return l == r
+		case "!=":
+			return l != r
+		}
+		return false
+	}
+	return op == "!="
+}
+
+// compileNotificationFilter parses a filter expression
+func compileNotificationFilter(expr string) (*notificationFilter, error) {
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid filter %q", expr)
+	}
+
+	p := filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.peek().kind != filterTokenEnd {
+		err = p.unexpected()
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid filter %q", expr)
+	}
+
+	return &notificationFilter{expr: expr, root: root}, nil
+}
+
+// matchPayload reports whether a notification payload matches the filter
+func (f *notificationFilter) matchPayload(payload interface{}) bool {
+	return f.root.match(payload)
+}
+
+// validateSubscriptionFilters checks that all filters attached to
+// subscribed notifications are valid. It returns a list of problems.
+func validateSubscriptionFilters(notifs []NotificationDescriptor) []string {
+	var problems []string
+	for _, notif := range notifs {
+		if notif.Filter == "" {
+			continue
+		}
+		if _, err := compileNotificationFilter(notif.Filter); err != nil {
+			problems = append(problems, notif.Name+" "+notif.Version+": "+err.Error())
+		}
+	}
+	return problems
+}
+
+// filterPayload decodes a notification payload for filters once, when it is
+// needed for the first time
+type filterPayload struct {
+	raw     json.RawMessage
+	decoded bool
+	value   interface{}
+	err     error
+}
+
+func (p *filterPayload) get() (interface{}, error) {
+	if !p.decoded {
+		p.decoded = true
+		if len(p.raw) != 0 {
+			p.err = json.Unmarshal(p.raw, &p.value)
+		}
+	}
+	return p.value, p.err
+}
+
+type filterTokenKind int
+
+const (
+	filterTokenEnd filterTokenKind = iota
+	filterTokenIdent
+	filterTokenNumber
+	filterTokenString
+	filterTokenOperator
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	// String value of filterTokenString or number of filterTokenNumber
+	value interface{}
+	pos   int
+}
+
+func (t filterToken) String() string {
+	if t.kind == filterTokenEnd {
+		return "end of filter"
+	}
+	return fmt.Sprintf("%q at position %d", t.text, t.pos)
+}
+
+// tokenizeFilter splits a filter expression into tokens
+func tokenizeFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(expr)
+
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		start := i
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+			continue
+		case unicode.IsLetter(c) || c == '_':
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) ||
+				runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, filterToken{kind: filterTokenIdent,
+				text: string(runes[start:i]), pos: start})
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || strings.ContainsRune(".eE", runes[i]) ||
+				((runes[i] == '-' || runes[i] == '+') && strings.ContainsRune("eE", runes[i-1]))) {
+				i++
+			}
+			text := string(runes[start:i])
+			n, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, errors.Errorf("invalid number %q at position %d", text, start)
+			}
+			tokens = append(tokens, filterToken{kind: filterTokenNumber, text: text,
+				value: n, pos: start})
+		case c == '"' || c == '\'':
+			var sb strings.Builder
+			for i++; i < len(runes) && runes[i] != c; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				sb.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				return nil, errors.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, filterToken{kind: filterTokenString,
+				text: string(runes[start:i]), value: sb.String(), pos: start})
+		case strings.ContainsRune("=!<>", c):
+			i++
+			if i < len(runes) && runes[i] == '=' {
+				i++
+			}
+			op := string(runes[start:i])
+			if op == "=" || op == "!" {
+				return nil, errors.Errorf("unknown operator %q at position %d", op, start)
+			}
+			tokens = append(tokens, filterToken{kind: filterTokenOperator, text: op,
+				pos: start})
+		case strings.ContainsRune("()[],", c):
+			i++
+			tokens = append(tokens, filterToken{kind: filterTokenOperator, text: string(c),
+				pos: start})
+		default:
+			return nil, errors.Errorf("unexpected character %q at position %d", c, start)
+		}
+	}
+
+	return append(tokens, filterToken{kind: filterTokenEnd, pos: len(runes)}), nil
+}
+
+// filterParser is a recursive descent parser of filter expressions
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	t := p.tokens[p.pos]
+	if t.kind != filterTokenEnd {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is a keyword or an operator
+// with the given text
+func (p *filterParser) accept(text string) bool {
+	t := p.peek()
+	if (t.kind == filterTokenIdent || t.kind == filterTokenOperator) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) unexpected() error {
+	return errors.Errorf("unexpected %s", p.peek())
+}
+
+func (p *filterParser) parseOr() (filterCondition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orCondition{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterCondition, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andCondition{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterCondition, error) {
+	if p.accept("not") {
+		cond, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notCondition{cond}, nil
+	}
+	if p.accept("(") {
+		cond, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.unexpected()
+		}
+		return cond, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterCondition, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.accept("in") {
+		list, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return inCondition{operand: left, list: list}, nil
+	}
+	if t := p.peek(); t.kind == filterTokenIdent && t.text == "not" &&
+		p.tokens[p.pos+1].kind == filterTokenIdent && p.tokens[p.pos+1].text == "in" {
+		p.pos += 2
+		list, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return inCondition{operand: left, list: list, negate: true}, nil
+	}
+
+	switch op := p.peek(); op.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return compareCondition{op: op.text, left: left, right: right}, nil
+	}
+
+	return truthyCondition{left}, nil
+}
+
+func (p *filterParser) parseOperand() (filterOperand, error) {
+	t := p.peek()
+	switch t.kind {
+	case filterTokenNumber, filterTokenString:
+		p.next()
+		return filterLiteral{t.value}, nil
+	case filterTokenIdent:
+		switch t.text {
+		case "true":
+			p.next()
+			return filterLiteral{true}, nil
+		case "false":
+			p.next()
+			return filterLiteral{false}, nil
+		case "null":
+			p.next()
+			return filterLiteral{nil}, nil
+		case "and", "or", "not", "in":
+			return nil, p.unexpected()
+		}
+		path := strings.Split(t.text, ".")
+		for _, name := range path {
+			if name == "" {
+				return nil, errors.Errorf("invalid field %s", t)
+			}
+		}
+		p.next()
+		return filterField(path), nil
+	}
+	return nil, p.unexpected()
+}
+
+func (p *filterParser) parseList() ([]interface{}, error) {
+	if !p.accept("[") {
+		return nil, p.unexpected()
+	}
+
+	var list []interface{}
+	if p.accept("]") {
+		return list, nil
+	}
+	for {
+		operand, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		literal, ok := operand.(filterLiteral)
+		if !ok {
+			return nil, errors.Errorf("list items must be literals, got %s",
+				p.tokens[p.pos-1])
+		}
+		list = append(list, literal.v)
+
+		if p.accept("]") {
+			return list, nil
+		}
+		if !p.accept(",") {
+			return nil, p.unexpected()
+		}
+	}
+}
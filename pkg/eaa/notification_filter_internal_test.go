@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gorilla/mux"
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = g.Describe("notification filters", func() {
+	matches := func(expr string, payload string) bool {
+		filter, err := compileNotificationFilter(expr)
+		Expect(err).NotTo(HaveOccurred())
+		value, err := (&filterPayload{raw: json.RawMessage(payload)}).get()
+		Expect(err).NotTo(HaveOccurred())
+		return filter.matchPayload(value)
+	}
+
+	g.Describe("compileNotificationFilter", func() {
+		g.It("should evaluate comparisons", func() {
+			payload := `{"severity":3,"camera_id":"cam2","active":true,"location":{"zone":"A"}}`
+
+			Expect(matches("severity >= 3", payload)).To(BeTrue())
+			Expect(matches("severity > 3", payload)).To(BeFalse())
+			Expect(matches("severity != 2.5", payload)).To(BeTrue())
+			Expect(matches(`camera_id == 'cam2'`, payload)).To(BeTrue())
+			Expect(matches(`location.zone == "A"`, payload)).To(BeTrue())
+			Expect(matches("active == true", payload)).To(BeTrue())
+			Expect(matches("active", payload)).To(BeTrue())
+			Expect(matches("severity == '3'", payload)).To(BeFalse())
+		})
+
+		g.It("should evaluate list membership", func() {
+			payload := `{"camera_id":"cam2"}`
+
+			Expect(matches(`camera_id in ["cam1", "cam2"]`, payload)).To(BeTrue())
+			Expect(matches(`camera_id not in ["cam1", "cam2"]`, payload)).To(BeFalse())
+			Expect(matches(`camera_id in []`, payload)).To(BeFalse())
+		})
+
+		g.It("should evaluate logical operators", func() {
+			payload := `{"severity":1,"camera_id":"cam1"}`
+
+			Expect(matches(`severity >= 3 or camera_id == "cam1"`, payload)).To(BeTrue())
+			Expect(matches(`severity >= 3 and camera_id == "cam1"`, payload)).To(BeFalse())
+			Expect(matches(`not (severity >= 3 and camera_id == "cam1")`, payload)).To(BeTrue())
+		})
+
+		g.It("should not match missing fields", func() {
+			Expect(matches("severity >= 3", `{}`)).To(BeFalse())
+			Expect(matches("severity != 3", `{}`)).To(BeFalse())
+			Expect(matches("location.zone == 'A'", `{"location":"A"}`)).To(BeFalse())
+			Expect(matches("severity >= 3", `[1]`)).To(BeFalse())
+		})
+
+		g.It("should reject invalid expressions", func() {
+			for _, expr := range []string{
+				"", "severity >=", "severity = 3", "(severity > 3", "severity > 3 3",
+				"camera_id in [\"cam1\"", "camera_id in [other]", "name == 'abc",
+				"severity & 1", "and", "a..b",
+			} {
+				_, err := compileNotificationFilter(expr)
+				Expect(err).To(HaveOccurred(), expr)
+			}
+		})
+	})
+
+	g.Describe("subscriptions", func() {
+		var eaaContext *Context
+
+		const (
+			consumer = "consumer:1"
+			other    = "consumer:2"
+		)
+
+		key := UniqueNotif{"ns", "name", "1.0"}
+
+		g.BeforeEach(func() {
+			eaaContext = &Context{}
+			eaaContext.subscriptionInfo = NotificationSubscriptions{
+				m: make(map[UniqueNotif]*ConsumerSubscription)}
+		})
+
+		g.It("should apply the filter of a namespace subscription", func() {
+			Expect(addSubscriptionToNamespace(consumer, "ns", []NotificationDescriptor{
+				{Name: "name", Version: "1.0", Filter: "severity >= 3"}}, eaaContext)).To(Succeed())
+			Expect(addSubscriptionToNamespace(other, "ns", []NotificationDescriptor{
+				{Name: "name", Version: "1.0"}}, eaaContext)).To(Succeed())
+
+			cs := eaaContext.subscriptionInfo.m[key]
+			low := &filterPayload{raw: json.RawMessage(`{"severity":1}`)}
+			high := &filterPayload{raw: json.RawMessage(`{"severity":5}`)}
+
+			Expect(cs.acceptsNotification(consumer, "prod", low)).To(BeFalse())
+			Expect(cs.acceptsNotification(consumer, "prod", high)).To(BeTrue())
+			Expect(cs.acceptsNotification(other, "prod", low)).To(BeTrue())
+		})
+
+		g.It("should accept a notification passing any subscription of a consumer", func() {
+			Expect(addSubscriptionToNamespace(consumer, "ns", []NotificationDescriptor{
+				{Name: "name", Version: "1.0", Filter: "severity >= 3"}}, eaaContext)).To(Succeed())
+			Expect(addSubscriptionToService(consumer, "ns", "prod", []NotificationDescriptor{
+				{Name: "name", Version: "1.0", Filter: "severity == 1"}}, eaaContext)).To(Succeed())
+
+			cs := eaaContext.subscriptionInfo.m[key]
+			Expect(cs.acceptsNotification(consumer, "prod",
+				&filterPayload{raw: json.RawMessage(`{"severity":1}`)})).To(BeTrue())
+			Expect(cs.acceptsNotification(consumer, "other",
+				&filterPayload{raw: json.RawMessage(`{"severity":1}`)})).To(BeFalse())
+		})
+
+		g.It("should return the filter of a consumer in its subscriptions", func() {
+			Expect(addSubscriptionToNamespace(consumer, "ns", []NotificationDescriptor{
+				{Name: "name", Version: "1.0", Filter: "severity >= 3"}}, eaaContext)).To(Succeed())
+			Expect(addSubscriptionToNamespace(other, "ns", []NotificationDescriptor{
+				{Name: "name", Version: "1.0"}}, eaaContext)).To(Succeed())
+
+			subs, err := getConsumerSubscriptions(consumer, eaaContext)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(subs.Subscriptions).To(HaveLen(1))
+			Expect(subs.Subscriptions[0].Notifications[0].Filter).To(Equal("severity >= 3"))
+
+			subs, err = getConsumerSubscriptions(other, eaaContext)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(subs.Subscriptions[0].Notifications[0].Filter).To(BeEmpty())
+		})
+
+		g.It("should remove the filter on unsubscription", func() {
+			Expect(addSubscriptionToNamespace(consumer, "ns", []NotificationDescriptor{
+				{Name: "name", Version: "1.0", Filter: "severity >= 3"}}, eaaContext)).To(Succeed())
+			Expect(removeAllSubscriptions(consumer, eaaContext)).To(Succeed())
+
+			Expect(eaaContext.subscriptionInfo.m[key].namespaceFilters).NotTo(HaveKey(consumer))
+		})
+	})
+
+	g.Describe("SubscribeNamespaceNotifications", func() {
+		g.It("should reject an invalid filter", func() {
+			eaaContext := &Context{}
+			eaaContext.MsgBrokerCtx = &brokerMock{}
+
+			request := httptest.NewRequest("POST", "/subscriptions/ns",
+				strings.NewReader(`[{"name":"name","version":"1.0","filter":"severity >="}]`))
+			request = request.WithContext(context.WithValue(request.Context(),
+				contextKey("appliance-ctx"), eaaContext))
+			request = mux.SetURLVars(request, map[string]string{"urn.namespace": "ns"})
+			request.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "consumer:1"}}},
+			}
+			response := httptest.NewRecorder()
+
+			SubscribeNamespaceNotifications(response, request)
+
+			Expect(response.Code).To(Equal(http.StatusBadRequest))
+			var errResp ErrorResponse
+			Expect(json.NewDecoder(response.Body).Decode(&errResp)).To(Succeed())
+			Expect(errResp.Details).To(HaveLen(1))
+		})
+	})
+})
@@ -0,0 +1,283 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default values of the History section of the EAA config
+const defaultHistoryMaxNotifications = 100
+
+// Number of notifications returned by a history request without a limit
+// and the maximum limit
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+func (c HistoryConfig) maxNotifications() int {
+	if c.MaxNotifications > 0 {
+		return c.MaxNotifications
+	}
+	return defaultHistoryMaxNotifications
+}
+
+// notificationReplayer is implemented by Message Brokers able to read past
+// notifications of a namespace
+type notificationReplayer interface {
+	replayNotifications(ctx context.Context, q historyQuery) ([]HistoricNotification, error)
+}
+
+// historyRing is a ring buffer of the latest notifications of a single
+// name and version, ordered by the time they were published
+type historyRing struct {
+	entries []HistoricNotification
+	// Index of the oldest entry
+	start int
+	count int
+}
+
+func newHistoryRing(size int) *historyRing {
+	return &historyRing{entries: make([]HistoricNotification, size)}
+}
+
+// add appends a notification, replacing the oldest one if the ring is full
+func (ring *historyRing) add(notif HistoricNotification) {
+	if ring.count < len(ring.entries) {
+		ring.entries[(ring.start+ring.count)%len(ring.entries)] = notif
+		ring.count++
+		return
+	}
+	ring.entries[ring.start] = notif
+	ring.start = (ring.start + 1) % len(ring.entries)
+}
+
+// dropBefore removes notifications published before a time
+func (ring *historyRing) dropBefore(t time.Time) {
+	for ring.count > 0 && ring.entries[ring.start].Timestamp.Before(t) {
+		ring.entries[ring.start] = HistoricNotification{}
+		ring.start = (ring.start + 1) % len(ring.entries)
+		ring.count--
+	}
+}
+
+// since returns notifications published at or after a time
+func (ring *historyRing) since(t time.Time) []HistoricNotification {
+	var notifs []HistoricNotification
+	for i := 0; i < ring.count; i++ {
+		notif := ring.entries[(ring.start+i)%len(ring.entries)]
+		if !notif.Timestamp.Before(t) {
+			notifs = append(notifs, notif)
+		}
+	}
+	return notifs
+}
+
+// notificationHistory is a synchronized map of a notification to the ring
+// buffer of its latest occurrences
+type notificationHistory struct {
+	sync.Mutex
+	m map[UniqueNotif]*historyRing
+	// History is read from the Message Broker instead of the map if set
+	replayer notificationReplayer
+}
+
+// historyQuery selects notifications returned by GET /notifications/history
+type historyQuery struct {
+	namespace string
+	name      string
+	version   string
+	// Notifications published before since are skipped
+	since time.Time
+	limit int
+}
+
+// parseHistoryQuery parses query parameters of GET /notifications/history.
+// It returns a list of problems with invalid parameters.
+func parseHistoryQuery(values url.Values) (historyQuery, []string) {
+	var problems []string
+
+	q := historyQuery{
+		namespace: values.Get("namespace"),
+		name:      values.Get("name"),
+		version:   values.Get("version"),
+		limit:     defaultHistoryLimit,
+	}
+
+	if q.namespace == "" {
+		problems = append(problems, "namespace is required")
+	}
+	if q.version != "" && q.name == "" {
+		problems = append(problems, "version requires name")
+	}
+
+	if since := values.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			problems = append(problems, "since has to be an RFC 3339 timestamp")
+		}
+		q.since = t
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > maxHistoryLimit {
+			problems = append(problems, "limit has to be an integer from 1 to "+
+				strconv.Itoa(maxHistoryLimit))
+		}
+		q.limit = n
+	}
+
+	return q, problems
+}
+
+// matches reports whether a notification of the queried namespace is
+// selected by the query
+func (q historyQuery) matches(notif *NotificationToConsumer) bool {
+	return (q.name == "" || notif.Name == q.name) &&
+		(q.version == "" || notif.Version == q.version)
+}
+
+// page returns the notifications selected by the query up to its limit,
+// the oldest ones since the time of the query or the latest ones without it
+func (q historyQuery) page(notifs []HistoricNotification) NotificationHistory {
+	sort.SliceStable(notifs, func(i, j int) bool {
+		return notifs[i].Timestamp.Before(notifs[j].Timestamp)
+	})
+
+	history := NotificationHistory{Notifications: notifs}
+	if len(notifs) > q.limit {
+		if q.since.IsZero() {
+			history.Notifications = notifs[len(notifs)-q.limit:]
+		} else {
+			history.Notifications = notifs[:q.limit]
+		}
+		history.Truncated = true
+	}
+	if history.Notifications == nil {
+		history.Notifications = []HistoricNotification{}
+	}
+	return history
+}
+
+// recordNotificationHistory keeps a notification received from the Message
+// Broker in memory unless history is read from the Message Broker. Only
+// notifications declared by the producer are kept, so that the number of
+// ring buffers is bounded by the registered services.
+func recordNotificationHistory(urn URN, notif *NotificationFromProducer, msgID string,
+	eaaCtx *Context) {
+
+	cfg := eaaCtx.cfg.History
+	if !cfg.Enabled || eaaCtx.history.replayer != nil {
+		return
+	}
+	if !isNotificationDeclared(urn, notif.Name, notif.Version, eaaCtx) {
+		log.Debugf("Not recording notification %s %s of %s undeclared by the producer",
+			notif.Name, notif.Version, urn.String())
+		return
+	}
+
+	eaaCtx.history.Lock()
+	defer eaaCtx.history.Unlock()
+
+	if eaaCtx.history.m == nil {
+		eaaCtx.history.m = make(map[UniqueNotif]*historyRing)
+	}
+	key := UniqueNotif{urn.Namespace, notif.Name, notif.Version}
+	ring, found := eaaCtx.history.m[key]
+	if !found {
+		ring = newHistoryRing(cfg.maxNotifications())
+		eaaCtx.history.m[key] = ring
+	}
+
+	// Timestamps are taken under the lock to keep rings ordered
+	now := time.Now()
+	ring.add(HistoricNotification{
+		Notification: NotificationToConsumer{
+			ID:      msgID,
+			Name:    notif.Name,
+			Version: notif.Version,
+			Payload: notif.Payload,
+			URN:     urn,
+		},
+		Timestamp: now,
+	})
+	if cfg.MaxAge.Duration > 0 {
+		ring.dropBefore(now.Add(-cfg.MaxAge.Duration))
+	}
+}
+
+// queryNotificationHistory returns notifications kept in memory that are
+// selected by the query
+func queryNotificationHistory(q historyQuery, eaaCtx *Context) []HistoricNotification {
+	eaaCtx.history.Lock()
+	defer eaaCtx.history.Unlock()
+
+	maxAge := eaaCtx.cfg.History.MaxAge.Duration
+	var notifs []HistoricNotification
+	for key, ring := range eaaCtx.history.m {
+		if key.namespace != q.namespace ||
+			(q.name != "" && key.notifName != q.name) ||
+			(q.version != "" && key.notifVersion != q.version) {
+			continue
+		}
+		if maxAge > 0 {
+			ring.dropBefore(time.Now().Add(-maxAge))
+		}
+		notifs = append(notifs, ring.since(q.since)...)
+	}
+	return notifs
+}
+
+// GetNotificationHistory returns past notifications of a namespace for
+// consumers to backfill notifications published before they subscribed
+func GetNotificationHistory(w http.ResponseWriter, r *http.Request) {
+	eaaCtx := r.Context().Value(contextKey("appliance-ctx")).(*Context)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if !eaaCtx.cfg.History.Enabled {
+		writeError(w, http.StatusServiceUnavailable, errorCodeUnavailable,
+			"Notification history is not enabled")
+		return
+	}
+
+	query, problems := parseHistoryQuery(r.URL.Query())
+	if len(problems) > 0 {
+		writeErrorResponse(w, http.StatusBadRequest, ErrorResponse{
+			Code:    errorCodeInvalidRequest,
+			Message: "Invalid notification history query",
+			Details: problems,
+		})
+		return
+	}
+
+	var notifs []HistoricNotification
+	if eaaCtx.history.replayer != nil {
+		var err error
+		notifs, err = eaaCtx.history.replayer.replayNotifications(r.Context(), query)
+		if err != nil {
+			log.Errf("Notification history replay error: %s", err.Error())
+			writeInternalError(w, "Failed to read the notification history")
+			return
+		}
+	} else {
+		notifs = queryNotificationHistory(query, eaaCtx)
+	}
+
+	if err := json.NewEncoder(w).Encode(query.page(notifs)); err != nil {
+		log.Errf("Error during notification history encoding: %s", err.Error())
+		return
+	}
+
+	log.Debugf("Successfully processed GetNotificationHistory from %s",
+		r.TLS.PeerCertificates[0].Subject.CommonName)
+}
@@ -0,0 +1,335 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/ThreeDotsLabs/watermill-kafka/v2/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/smart-edge-open/edgeservices/pkg/util"
+)
+
+var _ = g.Describe("notification history", func() {
+	var eaaCtx *Context
+
+	camera := URN{Namespace: "video", ID: "camera-1"}
+
+	record := func(name string, payload string) {
+		recordNotificationHistory(camera, &NotificationFromProducer{Name: name,
+			Version: "1.0", Payload: json.RawMessage(payload)}, "id-"+payload, eaaCtx)
+	}
+
+	getHistory := func(query string) NotificationHistory {
+		response := serveAs(eaaCtx, "consumer:1", http.MethodGet, "/v1/notifications/history?"+query, "")
+		Expect(response.Code).To(Equal(http.StatusOK))
+		var history NotificationHistory
+		Expect(json.NewDecoder(response.Body).Decode(&history)).To(Succeed())
+		return history
+	}
+
+	payloads := func(history NotificationHistory) []string {
+		var p []string
+		for _, notif := range history.Notifications {
+			p = append(p, string(notif.Notification.Payload))
+		}
+		return p
+	}
+
+	g.BeforeEach(func() {
+		eaaCtx = newTestContext()
+		eaaCtx.notificationSchemas.m = make(map[UniqueNotif]*notificationSchema)
+		eaaCtx.cfg.History = HistoryConfig{Enabled: true, MaxNotifications: 2}
+
+		eaaCtx.serviceInfo.m[camera.String()] = Service{URN: &camera,
+			Notifications: []NotificationDescriptor{
+				{Name: "motion", Version: "1.0"}, {Name: "audio", Version: "1.0"}}}
+	})
+
+	g.It("should keep the latest notifications of each name and version", func() {
+		record("motion", "1")
+		record("audio", "2")
+		record("motion", "3")
+		record("motion", "4")
+
+		history := getHistory("namespace=video")
+		Expect(payloads(history)).To(Equal([]string{"2", "3", "4"}))
+		Expect(history.Truncated).To(BeFalse())
+		Expect(history.Notifications[0].Notification).To(Equal(NotificationToConsumer{
+			ID: "id-2", Name: "audio", Version: "1.0", Payload: json.RawMessage("2"),
+			URN: camera}))
+
+		Expect(payloads(getHistory("namespace=video&name=motion&version=1.0"))).
+			To(Equal([]string{"3", "4"}))
+		Expect(getHistory("namespace=video&name=motion&version=2.0").Notifications).
+			To(BeEmpty())
+		Expect(getHistory("namespace=audio").Notifications).To(BeEmpty())
+	})
+
+	g.It("should return notifications since a time up to the limit", func() {
+		eaaCtx.cfg.History.MaxNotifications = 10
+		record("motion", "1")
+		record("motion", "2")
+		record("motion", "3")
+
+		since := getHistory("namespace=video").Notifications[1].Timestamp
+		query := "namespace=video&limit=1&since=" +
+			url.QueryEscape(since.Format(time.RFC3339Nano))
+		history := getHistory(query)
+		Expect(payloads(history)).To(Equal([]string{"2"}))
+		Expect(history.Truncated).To(BeTrue())
+	})
+
+	g.It("should return the latest notifications without since", func() {
+		eaaCtx.cfg.History.MaxNotifications = 10
+		record("motion", "1")
+		record("motion", "2")
+		record("motion", "3")
+
+		history := getHistory("namespace=video&limit=2")
+		Expect(payloads(history)).To(Equal([]string{"2", "3"}))
+		Expect(history.Truncated).To(BeTrue())
+	})
+
+	g.It("should drop notifications older than the max age", func() {
+		eaaCtx.cfg.History.MaxAge = util.Duration{Duration: 50 * time.Millisecond}
+		record("motion", "1")
+		Expect(getHistory("namespace=video").Notifications).To(HaveLen(1))
+		Eventually(func() []HistoricNotification {
+			return getHistory("namespace=video").Notifications
+		}).Should(BeEmpty())
+	})
+
+	g.It("should record published notifications", func() {
+		eaaCtx.MsgBrokerCtx = NewGoChannelMsgBroker(eaaCtx)
+		defer func() {
+			Expect(eaaCtx.MsgBrokerCtx.removeAll()).To(Succeed())
+		}()
+		Expect(serveAs(eaaCtx, camera.String(), http.MethodPost, "/v1/notifications",
+			`{"name": "motion", "version": "1.0", "payload": {"zone": 1}}`).Code).
+			To(Equal(http.StatusAccepted))
+
+		Eventually(func() []HistoricNotification {
+			return getHistory("namespace=video").Notifications
+		}).Should(HaveLen(1))
+		history := getHistory("namespace=video")
+		Expect(history.Notifications[0].Notification.ID).NotTo(BeEmpty())
+		Expect(history.Notifications[0].Notification.Payload).To(MatchJSON(`{"zone": 1}`))
+		Expect(history.Notifications[0].Timestamp).
+			To(BeTemporally("~", time.Now(), time.Second))
+	})
+
+	g.It("should record notifications published by other EAA instances", func() {
+		data, err := json.Marshal(NotificationMessage{
+			Notification: &NotificationFromProducer{Name: "motion", Version: "1.0",
+				Payload: json.RawMessage(`{}`)},
+			URN: &camera,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		messages := make(chan *message.Message, 1)
+		messages <- message.NewMessage("id-1", data)
+		close(messages)
+		handleNotificationUpdates(messages, eaaCtx)
+
+		history := getHistory("namespace=video")
+		Expect(history.Notifications).To(HaveLen(1))
+		Expect(history.Notifications[0].Notification.ID).To(Equal("id-1"))
+	})
+
+	g.It("should not record notifications undeclared by the producer", func() {
+		record("motion", "1")
+		for i := 0; i < 10; i++ {
+			record("motion-"+strconv.Itoa(i), "2")
+		}
+		recordNotificationHistory(camera, &NotificationFromProducer{Name: "motion",
+			Version: "2.0", Payload: json.RawMessage(`3`)}, "id-3", eaaCtx)
+		other := URN{Namespace: "video", ID: "camera-2"}
+		recordNotificationHistory(other, &NotificationFromProducer{Name: "motion",
+			Version: "1.0", Payload: json.RawMessage(`4`)}, "id-4", eaaCtx)
+
+		Expect(eaaCtx.history.m).To(HaveLen(1))
+		Expect(payloads(getHistory("namespace=video"))).To(Equal([]string{"1"}))
+	})
+
+	g.It("should reject invalid queries", func() {
+		response := serveAs(eaaCtx, "consumer:1", http.MethodGet,
+			"/v1/notifications/history?version=1.0&since=yesterday&limit=0", "")
+		Expect(response.Code).To(Equal(http.StatusBadRequest))
+		Expect(decodeErrorResponse(response).Details).To(ConsistOf(
+			"namespace is required", "version requires name",
+			"since has to be an RFC 3339 timestamp",
+			"limit has to be an integer from 1 to 1000"))
+	})
+
+	g.It("should be unavailable when disabled", func() {
+		eaaCtx.cfg.History.Enabled = false
+		record("motion", "1")
+		response := serveAs(eaaCtx, "consumer:1", http.MethodGet,
+			"/v1/notifications/history?namespace=video", "")
+		Expect(response.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(eaaCtx.history.m).To(BeEmpty())
+	})
+
+	g.It("should allow only consumers subscribing to the namespace", func() {
+		policyDir, err := ioutil.TempDir("", "eaa-history")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(policyDir)
+
+		eaaCtx.cfg.Authorization.PolicyPath = filepath.Join(policyDir, "policy.json")
+		Expect(ioutil.WriteFile(eaaCtx.cfg.Authorization.PolicyPath, []byte(`{"rules": [
+			{"actions": ["subscribe"], "namespaces": ["video"]}
+		]}`), 0600)).To(Succeed())
+		Expect(reloadAuthorizationPolicy(eaaCtx)).To(Succeed())
+
+		Expect(serveAs(eaaCtx, "consumer:1", http.MethodGet,
+			"/v1/notifications/history?namespace=audio", "").Code).
+			To(Equal(http.StatusForbidden))
+		Expect(serveAs(eaaCtx, "consumer:1", http.MethodGet,
+			"/v1/notifications/history?namespace=video", "").Code).
+			To(Equal(http.StatusOK))
+	})
+
+	g.When("replayed from Kafka", func() {
+		const topic = notificationsTopicPrefix + "video"
+
+		var (
+			mockBroker *sarama.MockBroker
+			since      time.Time
+			// Time after the last notification
+			after time.Time
+		)
+
+		// notificationRecord returns a record of a notification published
+		// by EAA with the watermill message UUID header
+		notificationRecord := func(id string, name string) *sarama.Record {
+			data, err := json.Marshal(NotificationMessage{
+				Notification: &NotificationFromProducer{Name: name, Version: "1.0",
+					Payload: json.RawMessage(`{}`)},
+				URN: &camera,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return &sarama.Record{Value: data, Headers: []*sarama.RecordHeader{
+				{Key: []byte(kafka.UUIDHeaderKey), Value: []byte(id)}}}
+		}
+
+		g.BeforeEach(func() {
+			KafkaBroker = &kafkaImplementation{}
+			since = time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+			after = since.Add(time.Hour)
+			mockBroker = sarama.NewMockBroker(g.GinkgoT(), 1)
+
+			// Offsets 0-1 were published before since, 2-4 after it
+			fetchResponse := &sarama.FetchResponse{Version: 4}
+			fetchResponse.AddError(topic, 0, sarama.ErrNoError)
+			batch := &sarama.RecordBatch{Version: 2, FirstOffset: 2, LastOffsetDelta: 2,
+				FirstTimestamp: since.Add(time.Minute)}
+			for i, notif := range []struct{ id, name string }{
+				{"id-2", "motion"}, {"id-3", "audio"}, {"id-4", "motion"}} {
+
+				rec := notificationRecord(notif.id, notif.name)
+				rec.OffsetDelta = int64(i)
+				rec.TimestampDelta = time.Duration(i) * time.Second
+				batch.Records = append(batch.Records, rec)
+			}
+			block := fetchResponse.Blocks[topic][0]
+			block.HighWaterMarkOffset = 5
+			block.RecordsSet = []*sarama.Records{{RecordBatch: batch}}
+
+			mockBroker.SetHandlerByMap(map[string]sarama.MockResponse{
+				"MetadataRequest": sarama.NewMockMetadataResponse(g.GinkgoT()).
+					SetBroker(mockBroker.Addr(), mockBroker.BrokerID()).
+					SetLeader(topic, 0, mockBroker.BrokerID()),
+				"OffsetRequest": sarama.NewMockOffsetResponse(g.GinkgoT()).
+					SetVersion(1).
+					SetOffset(topic, 0, since.UnixNano()/int64(time.Millisecond), 2).
+					SetOffset(topic, 0, after.UnixNano()/int64(time.Millisecond), -1).
+					SetOffset(topic, 0, sarama.OffsetOldest, 0).
+					SetOffset(topic, 0, sarama.OffsetNewest, 5),
+				"FetchRequest": sarama.NewMockWrapper(fetchResponse),
+			})
+
+			newKafkaReplayClient = func(addrs []string,
+				config *sarama.Config) (sarama.Client, error) {
+
+				Expect(config.Net.TLS.Enable).To(BeTrue())
+				config.Net.TLS.Enable = false
+				return sarama.NewClient([]string{mockBroker.Addr()}, config)
+			}
+
+			eaaCtx.cfg.History.ReplayFromBroker = true
+			eaaCtx.history.replayer = &KafkaMsgBroker{eaaCtx: eaaCtx}
+		})
+
+		g.AfterEach(func() {
+			newKafkaReplayClient = sarama.NewClient
+			mockBroker.Close()
+		})
+
+		g.It("should read notifications from offsets of the since time", func() {
+			history := getHistory("namespace=video&name=motion&since=" +
+				url.QueryEscape(since.Format(time.RFC3339Nano)))
+			Expect(history.Notifications).To(HaveLen(2))
+			Expect(history.Notifications[0].Notification).To(Equal(NotificationToConsumer{
+				ID: "id-2", Name: "motion", Version: "1.0", Payload: json.RawMessage(`{}`),
+				URN: camera}))
+			Expect(history.Notifications[0].Timestamp).
+				To(BeTemporally("==", since.Add(time.Minute)))
+			Expect(history.Notifications[1].Notification.ID).To(Equal("id-4"))
+		})
+
+		g.It("should read only the notifications of the page", func() {
+			history := getHistory("namespace=video&limit=1&since=" +
+				url.QueryEscape(since.Format(time.RFC3339Nano)))
+			Expect(history.Notifications).To(HaveLen(1))
+			Expect(history.Notifications[0].Notification.ID).To(Equal("id-2"))
+			Expect(history.Truncated).To(BeTrue())
+
+			notifs, err := eaaCtx.history.replayer.replayNotifications(context.Background(),
+				historyQuery{namespace: "video", since: since, limit: 1})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(notifs).To(HaveLen(2))
+		})
+
+		g.It("should read the latest notifications backward without since", func() {
+			history := getHistory("namespace=video&name=motion&limit=1")
+			Expect(history.Notifications).To(HaveLen(1))
+			Expect(history.Notifications[0].Notification.ID).To(Equal("id-4"))
+			Expect(history.Truncated).To(BeTrue())
+
+			history = getHistory("namespace=video&limit=2")
+			Expect(history.Notifications).To(HaveLen(2))
+			Expect(history.Notifications[0].Notification.ID).To(Equal("id-3"))
+			Expect(history.Notifications[1].Notification.ID).To(Equal("id-4"))
+			Expect(history.Truncated).To(BeTrue())
+
+			notifs, err := eaaCtx.history.replayer.replayNotifications(context.Background(),
+				historyQuery{namespace: "video", limit: 1})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(notifs).To(HaveLen(2))
+		})
+
+		g.It("should not keep published notifications in memory", func() {
+			record("motion", "1")
+			Expect(eaaCtx.history.m).To(BeEmpty())
+		})
+
+		g.It("should return no notifications after the last one", func() {
+			notifs, err := eaaCtx.history.replayer.replayNotifications(context.Background(),
+				historyQuery{namespace: "video", since: after, limit: 10})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(notifs).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,340 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// notificationPattern matches notifications of a pattern subscription.
+//
+// Namespace and notification name are glob patterns (video-*, motion-?).
+// Version is either a glob pattern or a semver range: comparators
+// (>=1.0 <2.0), caret (^1.2), tilde (~1.2) and x-ranges (1.x) optionally
+// joined with ||. A version that isn't a pattern has to match exactly.
+type notificationPattern struct {
+	namespace string
+	name      string
+	version   func(version string) bool
+}
+
+// globChars are characters that make a namespace, name or version a glob
+// pattern
+const globChars = "*?["
+
+// semverRangeChars are characters that make a version a semver range
+const semverRangeChars = "<>=^~|"
+
+// isNotificationPattern reports whether a subscription key contains
+// a pattern and has to be matched with notificationPattern
+func isNotificationPattern(key UniqueNotif) bool {
+	return isNamespacePattern(key.namespace) ||
+		strings.ContainsAny(key.notifName, globChars) ||
+		isVersionPattern(key.notifVersion)
+}
+
+// isNamespacePattern reports whether a subscribed namespace is a pattern
+func isNamespacePattern(namespace string) bool {
+	return strings.ContainsAny(namespace, globChars)
+}
+
+func isVersionPattern(version string) bool {
+	return strings.ContainsAny(version, globChars+semverRangeChars) ||
+		hasXVersionComponent(version)
+}
+
+// hasXVersionComponent reports whether a version has an x component (1.x)
+func hasXVersionComponent(version string) bool {
+	for _, c := range strings.FieldsFunc(version, func(r rune) bool {
+		return r == '.' || r == ' '
+	}) {
+		if c == "x" || c == "X" {
+			return true
+		}
+	}
+	return false
+}
+
+// compileNotificationPattern compiles a subscription key containing patterns
+func compileNotificationPattern(key UniqueNotif) (*notificationPattern, error) {
+	for _, glob := range []string{key.namespace, key.notifName} {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, errors.Wrapf(err, "Invalid pattern %q", glob)
+		}
+	}
+
+	p := &notificationPattern{namespace: key.namespace, name: key.notifName}
+
+	switch version := key.notifVersion; {
+	case strings.ContainsAny(version, semverRangeChars) || hasXVersionComponent(version):
+		r, err := parseVersionRange(version)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid version range %q", version)
+		}
+		p.version = r.matches
+	case strings.ContainsAny(version, globChars):
+		if _, err := path.Match(version, ""); err != nil {
+			return nil, errors.Wrapf(err, "Invalid pattern %q", version)
+		}
+		p.version = func(v string) bool {
+			matched, _ := path.Match(version, v)
+			return matched
+		}
+	default:
+		p.version = func(v string) bool { return v == version }
+	}
+
+	return p, nil
+}
+
+// matches reports whether a notification matches the pattern
+func (p *notificationPattern) matches(key UniqueNotif) bool {
+	return p.matchesNamespace(key.namespace) && globMatch(p.name, key.notifName) &&
+		p.version(key.notifVersion)
+}
+
+// matchesNamespace reports whether a namespace matches the pattern
+func (p *notificationPattern) matchesNamespace(namespace string) bool {
+	return globMatch(p.namespace, namespace)
+}
+
+func globMatch(pattern string, s string) bool {
+	matched, _ := path.Match(pattern, s)
+	return matched
+}
+
+// validateSubscriptionPatterns checks that patterns of subscribed
+// notifications are valid. It returns a list of problems.
+func validateSubscriptionPatterns(namespace string,
+	notifs []NotificationDescriptor) []string {
+
+	var problems []string
+	for _, notif := range notifs {
+		key := UniqueNotif{namespace, notif.Name, notif.Version}
+		if !isNotificationPattern(key) {
+			continue
+		}
+		if _, err := compileNotificationPattern(key); err != nil {
+			problems = append(problems, notif.Name+" "+notif.Version+": "+err.Error())
+		}
+	}
+	return problems
+}
+
+// semver is a parsed major.minor.patch version
+type semver [3]int
+
+func (v semver) compare(o semver) int {
+	for i := range v {
+		if v[i] != o[i] {
+			if v[i] < o[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// partialVersion is a version with n leading components specified,
+// the other ones are x or missing
+type partialVersion struct {
+	v semver
+	n int
+}
+
+// next returns the lowest version that is greater than all versions
+// matching the partial version
+func (p partialVersion) next() semver {
+	var v semver
+	copy(v[:], p.v[:p.n-1])
+	v[p.n-1] = p.v[p.n-1] + 1
+	return v
+}
+
+// parsePartialVersion parses a version with optional x components.
+// Pre-release and build metadata are ignored.
+func parsePartialVersion(s string) (partialVersion, error) {
+	var p partialVersion
+
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "v"), "V")
+	if i := strings.IndexAny(s, "-+"); i != -1 {
+		s = s[:i]
+	}
+	components := strings.Split(s, ".")
+	if s == "" || len(components) > len(p.v) {
+		return p, errors.Errorf("invalid version %q", s)
+	}
+
+	wildcard := false
+	for i, c := range components {
+		if c == "x" || c == "X" || c == "*" {
+			wildcard = true
+			continue
+		}
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 0 || wildcard {
+			return p, errors.Errorf("invalid version %q", s)
+		}
+		p.v[i] = n
+		p.n = i + 1
+	}
+	return p, nil
+}
+
+// parseSemver parses a version of a notification, missing minor and patch
+// versions are 0
+func parseSemver(s string) (semver, bool) {
+	p, err := parsePartialVersion(s)
+	if err != nil || strings.ContainsAny(s, "xX*") {
+		return semver{}, false
+	}
+	return p.v, true
+}
+
+type versionComparator struct {
+	op string
+	v  semver
+}
+
+func (c versionComparator) matches(v semver) bool {
+	switch cmp := v.compare(c.v); c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	default:
+		return cmp == 0
+	}
+}
+
+// versionRange is a semver range, a version matches it if it matches
+// all comparators of any of its sets
+type versionRange [][]versionComparator
+
+func (r versionRange) matches(version string) bool {
+	v, ok := parseSemver(version)
+	if !ok {
+		return false
+	}
+	for _, set := range r {
+		matched := true
+		for _, c := range set {
+			if !c.matches(v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// parseVersionRange parses a semver range
+func parseVersionRange(s string) (versionRange, error) {
+	var r versionRange
+	for _, part := range strings.Split(s, "||") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			return nil, errors.New("empty range")
+		}
+
+		set := []versionComparator{}
+		for _, field := range fields {
+			comparators, err := parseVersionComparator(field)
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, comparators...)
+		}
+		r = append(r, set)
+	}
+	return r, nil
+}
+
+// parseVersionComparator translates a single range term into comparators
+func parseVersionComparator(s string) ([]versionComparator, error) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(s, prefix) {
+			op = prefix
+			break
+		}
+	}
+
+	p, err := parsePartialVersion(s[len(op):])
+	if err != nil {
+		return nil, err
+	}
+
+	// Comparators matching all versions and no version
+	all := []versionComparator{}
+	none := []versionComparator{{"<", semver{}}}
+
+	switch op {
+	case "", "=":
+		if p.n == 0 {
+			return all, nil
+		}
+		if p.n == len(p.v) {
+			return []versionComparator{{"=", p.v}}, nil
+		}
+		return []versionComparator{{">=", p.v}, {"<", p.next()}}, nil
+	case ">=":
+		return []versionComparator{{">=", p.v}}, nil
+	case ">":
+		if p.n == 0 {
+			return none, nil
+		}
+		if p.n == len(p.v) {
+			return []versionComparator{{">", p.v}}, nil
+		}
+		return []versionComparator{{">=", p.next()}}, nil
+	case "<":
+		if p.n == 0 {
+			return none, nil
+		}
+		return []versionComparator{{"<", p.v}}, nil
+	case "<=":
+		if p.n == 0 {
+			return all, nil
+		}
+		if p.n == len(p.v) {
+			return []versionComparator{{"<=", p.v}}, nil
+		}
+		return []versionComparator{{"<", p.next()}}, nil
+	case "^":
+		if p.n == 0 {
+			return all, nil
+		}
+		// Changes left of the first non-zero component are incompatible
+		upper := partialVersion{p.v, p.n}
+		for i := 0; i < p.n; i++ {
+			if p.v[i] != 0 || i == p.n-1 {
+				upper.n = i + 1
+				break
+			}
+		}
+		return []versionComparator{{">=", p.v}, {"<", upper.next()}}, nil
+	default: // "~"
+		if p.n == 0 {
+			return all, nil
+		}
+		upper := partialVersion{p.v, 2}
+		if p.n == 1 {
+			upper.n = 1
+		}
+		return []versionComparator{{">=", p.v}, {"<", upper.next()}}, nil
+	}
+}
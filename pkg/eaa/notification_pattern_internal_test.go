@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"net/http"
+
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// subscriberRecorder is a message broker recording subscribed topics
+type subscriberRecorder struct {
+	brokerMock
+	topics []string
+}
+
+func (b *subscriberRecorder) addSubscriber(_ subscriberType, topic string,
+	_ *http.Request) error {
+	b.topics = append(b.topics, topic)
+	return nil
+}
+
+var _ = g.Describe("notification patterns", func() {
+	matches := func(namespace, name, version string, notif UniqueNotif) bool {
+		p, err := compileNotificationPattern(UniqueNotif{namespace, name, version})
+		Expect(err).NotTo(HaveOccurred())
+		return p.matches(notif)
+	}
+
+	g.Describe("compileNotificationPattern", func() {
+		g.It("should match globs", func() {
+			Expect(matches("video-*", "motion-?", "*", UniqueNotif{"video-1", "motion-a", "2.0"})).
+				To(BeTrue())
+			Expect(matches("video-*", "motion", "1.0", UniqueNotif{"audio-1", "motion", "1.0"})).
+				To(BeFalse())
+			Expect(matches("video-*", "motion", "1.0", UniqueNotif{"video-1", "motion", "1.1"})).
+				To(BeFalse())
+			Expect(matches("ns", "motion", "1.*", UniqueNotif{"ns", "motion", "1.2.3"})).
+				To(BeTrue())
+		})
+
+		g.It("should match semver ranges", func() {
+			for version, expected := range map[string]map[string]bool{
+				">=1.0 <2.0":   {"1.0": true, "1.9.9": true, "2.0": false, "0.9": false},
+				"^1.2":         {"1.2.0": true, "1.9": true, "2.0.0": false, "1.1": false},
+				"^0.2.3":       {"0.2.3": true, "0.2.9": true, "0.3.0": false},
+				"~1.2":         {"1.2.5": true, "1.3": false},
+				"1.x":          {"1.0": true, "1.5.1": true, "2.0": false},
+				">1.2 || <0.5": {"1.3": true, "1.2.5": false, "0.4": true, "1.0": false},
+				"<=1.2":        {"1.2.7": true, "1.3": false},
+				"=1.0.0":       {"1.0": true, "1.0.1": false},
+				">=1.0":        {"v1.1": true, "latest": false},
+			} {
+				for notifVersion, match := range expected {
+					Expect(matches("ns", "name", version,
+						UniqueNotif{"ns", "name", notifVersion})).To(Equal(match),
+						version+" "+notifVersion)
+				}
+			}
+		})
+
+		g.It("should reject invalid patterns", func() {
+			for _, key := range []UniqueNotif{
+				{"video-[", "name", "1.0"},
+				{"ns", "name", ">=1.a"},
+				{"ns", "name", "^"},
+				{"ns", "name", "1.0 ||"},
+				{"ns", "name", "1.x.2"},
+			} {
+				_, err := compileNotificationPattern(key)
+				Expect(err).To(HaveOccurred(), key.namespace+" "+key.notifVersion)
+			}
+		})
+	})
+
+	g.Describe("subscriptions", func() {
+		var (
+			eaaContext *Context
+			broker     *subscriberRecorder
+		)
+
+		const consumer = "consumer:1"
+
+		g.BeforeEach(func() {
+			eaaContext = &Context{}
+			eaaContext.serviceInfo.m = make(map[string]Service)
+			eaaContext.subscriptionInfo = NotificationSubscriptions{
+				m: make(map[UniqueNotif]*ConsumerSubscription)}
+
+			broker = &subscriberRecorder{}
+			eaaContext.MsgBrokerCtx = broker
+		})
+
+		g.It("should match notifications of pattern subscriptions once", func() {
+			Expect(addSubscriptionToNamespace(consumer, "video-*", []NotificationDescriptor{
+				{Name: "motion-detected", Version: "*"}}, eaaContext)).To(Succeed())
+			Expect(addSubscriptionToNamespace(consumer, "video-1", []NotificationDescriptor{
+				{Name: "motion-detected", Version: "1.0"}}, eaaContext)).To(Succeed())
+
+			Expect(eaaContext.subscriptionInfo.matching(
+				UniqueNotif{"video-1", "motion-detected", "1.0"})).To(HaveLen(2))
+			Expect(eaaContext.subscriptionInfo.matching(
+				UniqueNotif{"video-2", "motion-detected", "3.0"})).To(HaveLen(1))
+			Expect(eaaContext.subscriptionInfo.matching(
+				UniqueNotif{"audio", "motion-detected", "1.0"})).To(BeEmpty())
+		})
+
+		g.It("should subscribe topics of registered producers", func() {
+			eaaContext.serviceInfo.m["video-1:prod"] = Service{}
+			eaaContext.serviceInfo.m["audio:prod"] = Service{}
+
+			Expect(addSubscriptionToNamespace(consumer, "video-*", []NotificationDescriptor{
+				{Name: "motion-detected", Version: "*"}}, eaaContext)).To(Succeed())
+
+			Expect(broker.topics).To(ConsistOf("ns_video-1"))
+		})
+
+		g.It("should subscribe topics of producers registered later", func() {
+			Expect(addSubscriptionToService(consumer, "video-*", "prod",
+				[]NotificationDescriptor{{Name: "motion-detected", Version: "^1.0"}},
+				eaaContext)).To(Succeed())
+			Expect(broker.topics).To(BeEmpty())
+
+			urn := URN{Namespace: "video-2", ID: "prod"}
+			Expect(addService(urn.String(), Service{URN: &urn}, eaaContext)).To(Succeed())
+			urn = URN{Namespace: "audio", ID: "prod"}
+			Expect(addService(urn.String(), Service{URN: &urn}, eaaContext)).To(Succeed())
+
+			Expect(broker.topics).To(ConsistOf("ns_video-2"))
+		})
+
+		g.It("should not subscribe an invalid pattern", func() {
+			Expect(addSubscriptionToNamespace(consumer, "video-[", []NotificationDescriptor{
+				{Name: "motion-detected", Version: "1.0"}}, eaaContext)).To(Succeed())
+
+			Expect(eaaContext.subscriptionInfo.m).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,263 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Maximum number of notifications kept for a single consumer when
+// OfflineQueue.MaxDepth is not set in the config
+const defaultOfflineQueueMaxDepth = 1000
+
+// Number of notifications read from the offline queue at once on replay
+const offlineQueueReplayBatchSize = 100
+
+// Root bucket of the offline queue DB, it holds a nested bucket per consumer
+var offlineQueueBucket = []byte("notifications")
+
+// queuedNotification is a notification stored in the offline queue
+type queuedNotification struct {
+	ID        string          `json:"id,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// offlineQueue is a bbolt-backed store of notifications that couldn't be
+// delivered to consumers because they had no websocket connection.
+// Notifications are kept per consumer Common Name in the order of arrival.
+type offlineQueue struct {
+	db       *bolt.DB
+	ttl      time.Duration
+	maxDepth int
+}
+
+// openOfflineQueue opens (or creates) the offline queue DB file
+func openOfflineQueue(cfg OfflineQueueConfig) (*offlineQueue, error) {
+	db, err := bolt.Open(cfg.Path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open offline queue DB: %v", cfg.Path)
+	}
+
+	q := &offlineQueue{db: db, ttl: cfg.TTL.Duration, maxDepth: cfg.MaxDepth}
+	if q.maxDepth <= 0 {
+		q.maxDepth = defaultOfflineQueueMaxDepth
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(offlineQueueBucket)
+		if err != nil {
+			return err
+		}
+		// Get rid of notifications that expired while EAA was down
+		return root.ForEach(func(k, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			return q.purgeExpired(root.Bucket(k))
+		})
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Wrap(err, "Failed to initialize offline queue DB")
+	}
+
+	log.Infof("Offline notification queue opened: %v", cfg.Path)
+	return q, nil
+}
+
+// close closes the offline queue DB file
+func (q *offlineQueue) close() error {
+	return q.db.Close()
+}
+
+// seqToKey converts a bucket sequence to a key that keeps the insertion order
+func seqToKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// isExpired checks if a queued notification outlived the TTL
+func (q *offlineQueue) isExpired(n *queuedNotification) bool {
+	return q.ttl > 0 && time.Since(n.Timestamp) > q.ttl
+}
+
+// purgeExpired removes expired notifications from a consumer bucket.
+// Notifications are ordered by arrival so it stops on the first valid one.
+func (q *offlineQueue) purgeExpired(b *bolt.Bucket) error {
+	if q.ttl <= 0 {
+		return nil
+	}
+
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.First() {
+		var n queuedNotification
+		if err := json.Unmarshal(v, &n); err == nil && !q.isExpired(&n) {
+			return nil
+		}
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// push stores a notification for a consumer. When the consumer queue is full
+// the oldest notification is dropped.
+func (q *offlineQueue) push(commonName string, msgID string, msgPayload []byte) error {
+	data, err := json.Marshal(queuedNotification{
+		ID:        msgID,
+		Timestamp: time.Now(),
+		Payload:   msgPayload,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal queued notification")
+	}
+
+	return q.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(offlineQueueBucket).CreateBucketIfNotExists([]byte(commonName))
+		if err != nil {
+			return err
+		}
+
+		if err = q.purgeExpired(b); err != nil {
+			return err
+		}
+
+		depth := 0
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			depth++
+		}
+		for k, _ := c.First(); k != nil && depth >= q.maxDepth; k, _ = c.First() {
+			log.Warningf("Offline queue of %s is full, dropping the oldest notification",
+				commonName)
+			if err = c.Delete(); err != nil {
+				return err
+			}
+			depth--
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(seqToKey(seq), data)
+	})
+}
+
+// replay sends all valid notifications queued for a consumer in the order
+// of arrival. Notifications are removed from the queue once sent. If send
+// fails, the notification and all following ones are kept in the queue.
+// Notifications are read in batches and sent outside of DB transactions, so
+// a slow send doesn't hold up queueing for other consumers.
+func (q *offlineQueue) replay(commonName string,
+	send func(msgID string, msgPayload []byte) error) error {
+
+	for {
+		keys, batch, err := q.peek(commonName, offlineQueueReplayBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return q.removeEmpty(commonName)
+		}
+
+		sent := 0
+		var sendErr error
+		for ; sent < len(keys); sent++ {
+			n := batch[sent]
+			if n == nil || q.isExpired(n) {
+				continue
+			}
+			if sendErr = send(n.ID, n.Payload); sendErr != nil {
+				break
+			}
+		}
+
+		if err = q.remove(commonName, keys[:sent]); err != nil {
+			return err
+		}
+		if sendErr != nil {
+			return errors.Wrapf(sendErr, "Failed to replay notification to %s", commonName)
+		}
+	}
+}
+
+// peek returns up to max oldest notifications queued for a consumer with
+// their keys. Malformed notifications are returned as nil.
+func (q *offlineQueue) peek(commonName string, max int) ([][]byte,
+	[]*queuedNotification, error) {
+
+	var keys [][]byte
+	var batch []*queuedNotification
+	err := q.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(offlineQueueBucket).Bucket([]byte(commonName))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil && len(keys) < max; k, v = c.Next() {
+			var n queuedNotification
+			if err := json.Unmarshal(v, &n); err != nil {
+				log.Errf("Dropping malformed queued notification for %s: %s", commonName,
+					err.Error())
+				batch = append(batch, nil)
+			} else {
+				batch = append(batch, &n)
+			}
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Failed to read offline queue of %s", commonName)
+	}
+	return keys, batch, nil
+}
+
+// remove deletes notifications of a consumer by their keys
+func (q *offlineQueue) remove(commonName string, keys [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(offlineQueueBucket).Bucket([]byte(commonName))
+		if b == nil {
+			return nil
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return errors.Wrapf(err, "Failed to update offline queue of %s", commonName)
+}
+
+// removeEmpty deletes the bucket of a consumer unless notifications have
+// been queued in the meantime
+func (q *offlineQueue) removeEmpty(commonName string) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(offlineQueueBucket)
+		b := root.Bucket([]byte(commonName))
+		if b == nil {
+			return nil
+		}
+		if k, _ := b.Cursor().First(); k != nil {
+			return nil
+		}
+		return root.DeleteBucket([]byte(commonName))
+	})
+	return errors.Wrapf(err, "Failed to update offline queue of %s", commonName)
+}
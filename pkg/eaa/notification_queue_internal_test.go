@@ -0,0 +1,157 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = g.Describe("offline notification queue", func() {
+	var (
+		dir   string
+		queue *offlineQueue
+		cfg   OfflineQueueConfig
+	)
+
+	const consumer = "consumer:1"
+
+	collect := func(commonName string) ([]string, error) {
+		var sent []string
+		err := queue.replay(commonName, func(_ string, msgPayload []byte) error {
+			sent = append(sent, string(msgPayload))
+			return nil
+		})
+		return sent, err
+	}
+
+	g.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "eaaOfflineQueue")
+		Expect(err).NotTo(HaveOccurred())
+
+		cfg = OfflineQueueConfig{Path: filepath.Join(dir, "queue.db"), MaxDepth: 3}
+		queue, err = openOfflineQueue(cfg)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	g.AfterEach(func() {
+		if queue != nil {
+			Expect(queue.close()).To(Succeed())
+		}
+		os.RemoveAll(dir)
+	})
+
+	g.It("should replay notifications in order and only once", func() {
+		Expect(queue.push(consumer, "", []byte(`1`))).To(Succeed())
+		Expect(queue.push(consumer, "", []byte(`2`))).To(Succeed())
+		Expect(queue.push("other:1", "", []byte(`3`))).To(Succeed())
+
+		sent, err := collect(consumer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sent).To(Equal([]string{`1`, `2`}))
+
+		sent, err = collect(consumer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sent).To(BeEmpty())
+	})
+
+	g.It("should drop the oldest notifications above MaxDepth", func() {
+		for _, n := range []string{`1`, `2`, `3`, `4`, `5`} {
+			Expect(queue.push(consumer, "", []byte(n))).To(Succeed())
+		}
+
+		sent, err := collect(consumer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sent).To(Equal([]string{`3`, `4`, `5`}))
+	})
+
+	g.It("should keep notifications across reopening", func() {
+		Expect(queue.push(consumer, "", []byte(`1`))).To(Succeed())
+		Expect(queue.close()).To(Succeed())
+
+		var err error
+		queue, err = openOfflineQueue(cfg)
+		Expect(err).NotTo(HaveOccurred())
+
+		sent, err := collect(consumer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sent).To(Equal([]string{`1`}))
+	})
+
+	g.It("should not replay expired notifications", func() {
+		queue.ttl = 50 * time.Millisecond
+		Expect(queue.push(consumer, "", []byte(`1`))).To(Succeed())
+		time.Sleep(100 * time.Millisecond)
+		Expect(queue.push(consumer, "", []byte(`2`))).To(Succeed())
+
+		sent, err := collect(consumer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sent).To(Equal([]string{`2`}))
+	})
+
+	g.It("should keep notifications that failed to be sent", func() {
+		for _, n := range []string{`1`, `2`, `3`} {
+			Expect(queue.push(consumer, "", []byte(n))).To(Succeed())
+		}
+
+		calls := 0
+		err := queue.replay(consumer, func(_ string, _ []byte) error {
+			calls++
+			if calls == 2 {
+				return errors.New("unit test error")
+			}
+			return nil
+		})
+		Expect(err).To(HaveOccurred())
+
+		sent, err := collect(consumer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sent).To(Equal([]string{`2`, `3`}))
+	})
+
+	g.It("should not block queueing while replaying", func() {
+		Expect(queue.push(consumer, "", []byte(`1`))).To(Succeed())
+		Expect(queue.push(consumer, "", []byte(`2`))).To(Succeed())
+
+		var sent []string
+		err := queue.replay(consumer, func(_ string, msgPayload []byte) error {
+			if len(sent) == 0 {
+				pushed := make(chan error, 1)
+				go func() {
+					pushed <- queue.push(consumer, "", []byte(`3`))
+				}()
+				Eventually(pushed).Should(Receive(BeNil()))
+			}
+			sent = append(sent, string(msgPayload))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sent).To(Equal([]string{`1`, `2`, `3`}))
+
+		sent, err = collect(consumer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sent).To(BeEmpty())
+	})
+
+	g.Describe("sendNotificationToSubscriber", func() {
+		g.It("should queue a notification for a consumer without websocket", func() {
+			eaaContext := &Context{offlineQueue: queue}
+			eaaContext.consumerConnections = consumerConns{m: make(map[string]ConsumerConnection)}
+
+			e := sendNotificationToSubscriber(consumer, "", []byte(`1`), eaaContext)
+			Expect(e).NotTo(HaveOccurred())
+
+			sent, err := collect(consumer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sent).To(Equal([]string{`1`}))
+		})
+	})
+})
@@ -0,0 +1,178 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonreference"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// notificationSchema is a JSON Schema of a notification payload
+// attached by a producer to its notification descriptor
+type notificationSchema struct {
+	raw      json.RawMessage
+	compiled *gojsonschema.Schema
+	// Common Name of the producer that registered the schema
+	owner string
+}
+
+// notificationSchemas is a synchronized map of notification schemas.
+// Notifications are identified by a namespace, name and version.
+type notificationSchemas struct {
+	sync.RWMutex
+	m map[UniqueNotif]*notificationSchema
+}
+
+// schemaLoader loads a notification schema from its bytes. References are
+// resolved only within the schema, other documents are never loaded, so that
+// producers can't make EAA fetch URLs or read local files.
+type schemaLoader struct {
+	gojsonschema.JSONLoader
+}
+
+func (l schemaLoader) LoaderFactory() gojsonschema.JSONLoaderFactory {
+	return refusingLoaderFactory{}
+}
+
+// refusingLoaderFactory creates loaders of documents referenced by a schema
+// that fail to load
+type refusingLoaderFactory struct{}
+
+func (refusingLoaderFactory) New(source string) gojsonschema.JSONLoader {
+	return refusedLoader{source}
+}
+
+// refusedLoader is a loader of a document referenced by a schema
+type refusedLoader struct {
+	source string
+}
+
+func (l refusedLoader) JsonSource() interface{} {
+	return l.source
+}
+
+func (l refusedLoader) LoadJSON() (interface{}, error) {
+	return nil, errors.Errorf("Reference to another document %q is not allowed", l.source)
+}
+
+func (l refusedLoader) JsonReference() (gojsonreference.JsonReference, error) {
+	return gojsonreference.NewJsonReference(l.source)
+}
+
+func (l refusedLoader) LoaderFactory() gojsonschema.JSONLoaderFactory {
+	return refusingLoaderFactory{}
+}
+
+// compileNotificationSchema parses a JSON Schema of a notification payload
+func compileNotificationSchema(raw json.RawMessage) (*gojsonschema.Schema, error) {
+	schema, err := gojsonschema.NewSchema(
+		schemaLoader{gojsonschema.NewBytesLoader(raw)})
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid notification schema")
+	}
+	return schema, nil
+}
+
+// validateServiceSchemas checks that all schemas attached to service
+// notifications are valid JSON Schemas. It returns a list of problems.
+func validateServiceSchemas(serv *Service) []string {
+	var problems []string
+	for _, notif := range serv.Notifications {
+		if len(notif.Schema) == 0 {
+			continue
+		}
+		if _, err := compileNotificationSchema(notif.Schema); err != nil {
+			problems = append(problems, notif.Name+" "+notif.Version+": "+err.Error())
+		}
+	}
+	return problems
+}
+
+// registerNotificationSchemas replaces schemas registered by a producer
+// with the ones attached to its notification descriptors
+func registerNotificationSchemas(commonName string, namespace string,
+	notifications []NotificationDescriptor, eaaCtx *Context) {
+
+	eaaCtx.notificationSchemas.Lock()
+	defer eaaCtx.notificationSchemas.Unlock()
+
+	if eaaCtx.notificationSchemas.m == nil {
+		eaaCtx.notificationSchemas.m = make(map[UniqueNotif]*notificationSchema)
+	}
+	removeOwnedSchemas(commonName, eaaCtx)
+
+	for _, notif := range notifications {
+		if len(notif.Schema) == 0 {
+			continue
+		}
+
+		compiled, err := compileNotificationSchema(notif.Schema)
+		if err != nil {
+			log.Errf("Ignoring schema of notification %s %s from %s: %s", notif.Name,
+				notif.Version, commonName, err.Error())
+			continue
+		}
+
+		key := UniqueNotif{namespace, notif.Name, notif.Version}
+		if prev, found := eaaCtx.notificationSchemas.m[key]; found && prev.owner != commonName {
+			log.Warningf("Schema of notification %v registered by %s is replaced by %s",
+				key, prev.owner, commonName)
+		}
+		eaaCtx.notificationSchemas.m[key] = &notificationSchema{
+			raw:      notif.Schema,
+			compiled: compiled,
+			owner:    commonName,
+		}
+	}
+}
+
+// unregisterNotificationSchemas removes all schemas registered by a producer
+func unregisterNotificationSchemas(commonName string, eaaCtx *Context) {
+	eaaCtx.notificationSchemas.Lock()
+	defer eaaCtx.notificationSchemas.Unlock()
+
+	removeOwnedSchemas(commonName, eaaCtx)
+}
+
+// removeOwnedSchemas removes schemas registered by a producer.
+// notificationSchemas must be locked by the caller.
+func removeOwnedSchemas(commonName string, eaaCtx *Context) {
+	for key, schema := range eaaCtx.notificationSchemas.m {
+		if schema.owner == commonName {
+			delete(eaaCtx.notificationSchemas.m, key)
+		}
+	}
+}
+
+// getNotificationSchema returns a schema of a notification or nil if there
+// is no schema registered
+func getNotificationSchema(key UniqueNotif, eaaCtx *Context) *notificationSchema {
+	eaaCtx.notificationSchemas.RLock()
+	defer eaaCtx.notificationSchemas.RUnlock()
+
+	return eaaCtx.notificationSchemas.m[key]
+}
+
+// validatePayload validates a notification payload against the schema.
+// It returns a list of validation errors, empty if the payload is valid.
+func (s *notificationSchema) validatePayload(payload json.RawMessage) ([]string, error) {
+	if len(payload) == 0 {
+		payload = json.RawMessage("null")
+	}
+
+	result, err := s.compiled.Validate(gojsonschema.NewBytesLoader(payload))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to validate notification payload")
+	}
+
+	var problems []string
+	for _, e := range result.Errors() {
+		problems = append(problems, e.String())
+	}
+	return problems, nil
+}
@@ -0,0 +1,176 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gorilla/mux"
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = g.Describe("notification schemas", func() {
+	var (
+		eaaContext *Context
+		broker     brokerMock
+		response   *httptest.ResponseRecorder
+	)
+
+	const (
+		producer = "namespace:producer"
+		schema   = `{"type":"object","properties":{"temp":{"type":"number"}},"required":["temp"]}`
+	)
+
+	newRequest := func(method string, body string) *http.Request {
+		request := httptest.NewRequest(method, "/foo", strings.NewReader(body))
+		request = request.WithContext(context.WithValue(request.Context(),
+			contextKey("appliance-ctx"), eaaContext))
+		request.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: producer}}},
+		}
+		return request
+	}
+
+	decodeError := func() ErrorResponse {
+		var errResp ErrorResponse
+		Expect(json.NewDecoder(response.Body).Decode(&errResp)).To(Succeed())
+		return errResp
+	}
+
+	g.BeforeEach(func() {
+		eaaContext = &Context{}
+		eaaContext.serviceInfo.m = make(map[string]Service)
+		eaaContext.notificationSchemas.m = make(map[UniqueNotif]*notificationSchema)
+
+		broker = brokerMock{}
+		eaaContext.MsgBrokerCtx = &broker
+		response = httptest.NewRecorder()
+
+		urn := URN{Namespace: "namespace", ID: "producer"}
+		Expect(addService(producer, Service{
+			URN: &urn,
+			Notifications: []NotificationDescriptor{
+				{Name: "temperature", Version: "1.0", Schema: json.RawMessage(schema)},
+				{Name: "free-form", Version: "1.0"},
+			},
+		}, eaaContext)).To(Succeed())
+	})
+
+	g.Describe("RegisterApplication", func() {
+		g.It("rejects an invalid schema", func() {
+			RegisterApplication(response, newRequest("POST",
+				`{"notifications":[{"name":"n","version":"1","schema":{"type":"nope"}}]}`))
+
+			Expect(response.Code).To(Equal(http.StatusBadRequest))
+			errResp := decodeError()
+			Expect(errResp.Message).To(Equal("Invalid notification schema"))
+			Expect(errResp.Details).To(HaveLen(1))
+		})
+
+		g.It("accepts a valid schema", func() {
+			RegisterApplication(response, newRequest("POST",
+				`{"notifications":[{"name":"n","version":"1","schema":`+schema+`}]}`))
+
+			Expect(response.Code).To(Equal(http.StatusOK))
+		})
+
+		g.It("rejects a schema referencing other documents", func() {
+			requested := false
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					requested = true
+					_, _ = w.Write([]byte(schema))
+				}))
+			defer server.Close()
+
+			for _, ref := range []string{
+				server.URL + "/schema.json",
+				"file:///etc/hostname",
+				"other.json#/definitions/temp",
+			} {
+				response = httptest.NewRecorder()
+				RegisterApplication(response, newRequest("POST",
+					`{"notifications":[{"name":"n","version":"1","schema":{"$ref":"`+ref+`"}}]}`))
+
+				Expect(response.Code).To(Equal(http.StatusBadRequest), ref)
+				Expect(decodeError().Message).To(Equal("Invalid notification schema"))
+			}
+			Expect(requested).To(BeFalse())
+
+			response = httptest.NewRecorder()
+			RegisterApplication(response, newRequest("POST",
+				`{"notifications":[{"name":"n","version":"1","schema":{"$id":"`+server.URL+
+					`/schema.json","$ref":"#/definitions/temp","definitions":{"temp":`+schema+`}}}]}`))
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(requested).To(BeFalse())
+		})
+	})
+
+	g.Describe("PushNotificationToSubscribers", func() {
+		g.It("rejects a payload that doesn't match the schema", func() {
+			PushNotificationToSubscribers(response, newRequest("POST",
+				`{"name":"temperature","version":"1.0","payload":{"temp":"hot"}}`))
+
+			Expect(response.Code).To(Equal(http.StatusBadRequest))
+			errResp := decodeError()
+			Expect(errResp.Details).NotTo(BeEmpty())
+		})
+
+		g.It("accepts a payload that matches the schema", func() {
+			PushNotificationToSubscribers(response, newRequest("POST",
+				`{"name":"temperature","version":"1.0","payload":{"temp":21.5}}`))
+
+			Expect(response.Code).To(Equal(http.StatusAccepted))
+		})
+
+		g.It("accepts any payload of a notification without a schema", func() {
+			PushNotificationToSubscribers(response, newRequest("POST",
+				`{"name":"free-form","version":"1.0","payload":"anything"}`))
+
+			Expect(response.Code).To(Equal(http.StatusAccepted))
+		})
+	})
+
+	g.Describe("GetNotificationSchema", func() {
+		getSchema := func(name string) {
+			request := mux.SetURLVars(newRequest("GET", ""), map[string]string{
+				"namespace": "namespace",
+				"name":      name,
+				"version":   "1.0",
+			})
+			GetNotificationSchema(response, request)
+		}
+
+		g.It("returns a registered schema", func() {
+			getSchema("temperature")
+
+			Expect(response.Code).To(Equal(http.StatusOK))
+			body, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(MatchJSON(schema))
+		})
+
+		g.It("returns 404 for a notification without a schema", func() {
+			getSchema("free-form")
+
+			Expect(response.Code).To(Equal(http.StatusNotFound))
+		})
+
+		g.It("returns 404 once the producer is deregistered", func() {
+			Expect(removeService(producer, eaaContext)).To(Succeed())
+			getSchema("temperature")
+
+			Expect(response.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+})
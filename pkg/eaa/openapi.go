@@ -0,0 +1,453 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	authpb "github.com/smart-edge-open/edgeservices/pkg/auth/pb"
+	"github.com/smart-edge-open/edgeservices/pkg/util"
+)
+
+// apiVersionPrefix is the path prefix of the current version of EAA API.
+// Routes are also served without it as deprecated aliases.
+const apiVersionPrefix = "/v1"
+
+// openAPIPath is the path of the OpenAPI document describing EAA API
+const openAPIPath = apiVersionPrefix + "/openapi.json"
+
+// routeDoc documents a route of eaaRoutes in the OpenAPI document
+type routeDoc struct {
+	summary string
+	query   []queryParamDoc
+	// Model of the request body, nil if the route has no body
+	request   interface{}
+	responses []responseDoc
+}
+
+// queryParamDoc documents an optional query parameter
+type queryParamDoc struct {
+	name        string
+	schemaType  string
+	description string
+}
+
+// responseDoc documents a response of a route
+type responseDoc struct {
+	status      int
+	description string
+	// Content type of the response body, application/json if empty
+	contentType string
+	// Model of the response body, nil if the response has no body
+	body interface{}
+}
+
+// anyJSON is a response body model for any JSON value
+type anyJSON = json.RawMessage
+
+// problemContentType is the content type of error responses
+const problemContentType = "application/problem+json"
+
+// Error responses shared by routes
+var (
+	badRequest = responseDoc{http.StatusBadRequest, "Malformed or invalid request",
+		problemContentType, ErrorResponse{}}
+	invalidIdentity = responseDoc{http.StatusForbidden,
+		"Common Name of the client certificate is not a valid URN", problemContentType,
+		ErrorResponse{}}
+	limitExceeded = responseDoc{http.StatusTooManyRequests,
+		"A limit of the client requests was exceeded", problemContentType, ErrorResponse{}}
+)
+
+// Error response of the egress API used without an authorization policy
+// or by a client the policy doesn't allow to manage egress
+var egressForbidden = responseDoc{http.StatusForbidden,
+	"No authorization policy or the client is not allowed to manage egress",
+	problemContentType, ErrorResponse{}}
+
+var eaaRouteDocs = map[string]routeDoc{
+	"AddEgressTarget": {
+		summary: "Start forwarding subscribed notifications to a webhook or Kafka topic",
+		request: EgressTarget{},
+		responses: []responseDoc{
+			{http.StatusCreated, "Egress target added", "", nil},
+			badRequest,
+			egressForbidden,
+			{http.StatusConflict, "Egress target already exists", problemContentType,
+				ErrorResponse{}},
+		},
+	},
+	"DeregisterApplication": {
+		summary: "Deregister the producer",
+		responses: []responseDoc{
+			{http.StatusNoContent, "Producer deregistered", "", nil},
+			invalidIdentity,
+			{http.StatusNotFound, "Producer is not registered", problemContentType,
+				ErrorResponse{}},
+		},
+	},
+	"GetEgressTargets": {
+		summary: "List egress targets, webhook secrets and client keys are left out",
+		responses: []responseDoc{
+			{http.StatusOK, "Egress targets ordered by name", "", EgressTargetList{}},
+			egressForbidden,
+		},
+	},
+	"GetHealth": {
+		summary: "Report that EAA is running",
+		responses: []responseDoc{
+			{http.StatusOK, "EAA is running", "", HealthStatus{}}},
+	},
+	"GetNotifications": {
+		summary: "Receive notifications over a websocket, Server-Sent Events or long polling",
+		query: []queryParamDoc{{"timeout", "integer",
+			"Long polling timeout in seconds"}},
+		responses: []responseDoc{
+			{http.StatusSwitchingProtocols, "Notifications are sent over the websocket", "", nil},
+			{http.StatusOK, "Notifications received by long polling", "",
+				[]NotificationToConsumer{}},
+			badRequest,
+			{http.StatusForbidden, "Host doesn't match the client certificate",
+				problemContentType, ErrorResponse{}},
+			limitExceeded,
+		},
+	},
+	"GetNotificationHistory": {
+		summary: "Get notifications of a namespace published in the past",
+		query: []queryParamDoc{
+			{"namespace", "string", "Namespace of notifications, required"},
+			{"name", "string", "Name of notifications"},
+			{"version", "string", "Version of notifications, requires name"},
+			{"since", "string",
+				"RFC 3339 time of the oldest notification, the latest ones are returned without it"},
+			{"limit", "integer", "Maximum number of notifications"},
+		},
+		responses: []responseDoc{
+			{http.StatusOK, "Notifications ordered by the time they were published", "",
+				NotificationHistory{}},
+			badRequest,
+			{http.StatusServiceUnavailable, "Notification history is not enabled",
+				problemContentType, ErrorResponse{}},
+		},
+	},
+	"GetNotificationSchema": {
+		summary: "Get JSON Schema of a notification payload",
+		responses: []responseDoc{
+			{http.StatusOK, "JSON Schema of the notification", "application/schema+json",
+				anyJSON{}},
+			{http.StatusNotFound, "The notification has no schema", problemContentType,
+				ErrorResponse{}},
+		},
+	},
+	"GetServices": {
+		summary: "List registered services",
+		query: []queryParamDoc{
+			{"namespace", "string", "Namespace of services"},
+			{"id_prefix", "string", "Prefix of service IDs"},
+			{"status", "string", "Status of services"},
+			{"notification", "string", "Name of a notification advertised by services"},
+			{"limit", "integer", "Maximum number of services in a page"},
+			{"cursor", "string", "Cursor of the page returned with the previous one"},
+		},
+		responses: []responseDoc{
+			{http.StatusOK, "Services ordered by URN", "", ServiceList{}},
+			{http.StatusNotModified, "Services match the If-None-Match ETag", "", nil},
+			badRequest,
+		},
+	},
+	"GetSubscriptions": {
+		summary: "List subscriptions of the consumer",
+		responses: []responseDoc{
+			{http.StatusOK, "Subscriptions of the consumer", "", SubscriptionList{}}},
+	},
+	"GetUsage": {
+		summary: "Get usage counters of the client",
+		responses: []responseDoc{
+			{http.StatusOK, "Usage of the client", "", AppUsage{}}},
+	},
+	"IngestNotification": {
+		summary: "Publish the JSON body as a notification of the producer of the bearer token",
+		request: anyJSON{},
+		responses: []responseDoc{
+			{http.StatusAccepted, "Notification accepted", "", nil},
+			badRequest,
+			{http.StatusUnauthorized, "Missing or unknown bearer token", problemContentType,
+				ErrorResponse{}},
+			{http.StatusRequestEntityTooLarge, "Notification payload exceeds the size limit",
+				problemContentType, ErrorResponse{}},
+			limitExceeded,
+		},
+	},
+	"PushNotificationToSubscribers": {
+		summary: "Send a notification to subscribed consumers",
+		request: NotificationFromProducer{},
+		responses: []responseDoc{
+			{http.StatusAccepted, "Notification accepted", "", nil},
+			badRequest,
+			invalidIdentity,
+			{http.StatusNotFound, "Producer is not registered", problemContentType,
+				ErrorResponse{}},
+			{http.StatusRequestEntityTooLarge, "Notification payload exceeds the size limit",
+				problemContentType, ErrorResponse{}},
+			limitExceeded,
+		},
+	},
+	"RequestCredentials": {
+		summary: "Sign a certificate of the application",
+		request: authpb.Identity{},
+		responses: []responseDoc{
+			{http.StatusOK, "Certificate signed", "", authpb.Credentials{}},
+			badRequest,
+			{http.StatusForbidden, "CSR Common Name doesn't match the application",
+				problemContentType, ErrorResponse{}},
+			limitExceeded,
+			{http.StatusServiceUnavailable, "Credentials are not provided by this EAA",
+				problemContentType, ErrorResponse{}},
+		},
+	},
+	"RegisterApplication": {
+		summary: "Register the producer as a service",
+		request: Service{},
+		responses: []responseDoc{
+			{http.StatusOK, "Service registered", "", nil},
+			badRequest,
+			invalidIdentity,
+		},
+	},
+	"RemoveEgressTarget": {
+		summary: "Stop forwarding notifications to an egress target",
+		responses: []responseDoc{
+			{http.StatusNoContent, "Egress target removed", "", nil},
+			egressForbidden,
+			{http.StatusNotFound, "Egress target doesn't exist", problemContentType,
+				ErrorResponse{}},
+		},
+	},
+	"SubscribeNamespaceNotifications": {
+		summary: "Subscribe to notifications of a namespace",
+		request: []NotificationDescriptor{},
+		responses: []responseDoc{
+			{http.StatusCreated, "Subscribed", "", nil},
+			badRequest,
+			limitExceeded,
+		},
+	},
+	"SubscribeServiceNotifications": {
+		summary: "Subscribe to notifications of a service",
+		request: []NotificationDescriptor{},
+		responses: []responseDoc{
+			{http.StatusCreated, "Subscribed", "", nil},
+			badRequest,
+			limitExceeded,
+		},
+	},
+	"UnsubscribeAllNotifications": {
+		summary:   "Remove all subscriptions of the consumer",
+		responses: []responseDoc{{http.StatusNoContent, "Unsubscribed", "", nil}},
+	},
+	"UnsubscribeNamespaceNotifications": {
+		summary: "Unsubscribe from notifications of a namespace",
+		request: []NotificationDescriptor{},
+		responses: []responseDoc{
+			{http.StatusNoContent, "Unsubscribed", "", nil},
+			badRequest,
+		},
+	},
+	"UnsubscribeServiceNotifications": {
+		summary: "Unsubscribe from notifications of a service",
+		request: []NotificationDescriptor{},
+		responses: []responseDoc{
+			{http.StatusNoContent, "Unsubscribed", "", nil},
+			badRequest,
+		},
+	},
+}
+
+// pathParamRegexp matches path parameters of route patterns
+var pathParamRegexp = regexp.MustCompile(`{([^}]+)}`)
+
+// openAPISchemas generates schemas of model types and collects schemas
+// of named structs as reusable components
+type openAPISchemas map[string]interface{}
+
+var (
+	durationType   = reflect.TypeOf(util.Duration{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	timeType       = reflect.TypeOf(time.Time{})
+)
+
+// schemaOf returns the schema of a model type
+func (s openAPISchemas) schemaOf(t reflect.Type) map[string]interface{} {
+	switch t {
+	case durationType:
+		return map[string]interface{}{"type": "string", "example": "10s"}
+	case rawMessageType:
+		return map[string]interface{}{}
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return s.schemaOf(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": s.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object",
+			"additionalProperties": s.schemaOf(t.Elem())}
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, found := s[t.Name()]; !found {
+			// Registered before the properties to stop recursion
+			s[t.Name()] = nil
+			s[t.Name()] = s.structSchema(t)
+		}
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema returns the schema of a struct with properties named after
+// their JSON keys
+func (s openAPISchemas) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		properties[name] = s.schemaOf(field.Type)
+	}
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// newOpenAPIDocument generates the OpenAPI 3 document of routes mounted under
+// apiVersionPrefix
+func newOpenAPIDocument(routes Routes) map[string]interface{} {
+	schemas := openAPISchemas{}
+	paths := map[string]interface{}{}
+
+	for _, route := range routes {
+		doc := eaaRouteDocs[route.Name]
+
+		var params []interface{}
+		for _, match := range pathParamRegexp.FindAllStringSubmatch(route.Pattern, -1) {
+			params = append(params, map[string]interface{}{
+				"name": match[1], "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, q := range doc.query {
+			params = append(params, map[string]interface{}{
+				"name": q.name, "in": "query", "description": q.description,
+				"schema": map[string]interface{}{"type": q.schemaType},
+			})
+		}
+
+		responses := map[string]interface{}{}
+		for _, resp := range doc.responses {
+			response := map[string]interface{}{"description": resp.description}
+			if resp.body != nil {
+				contentType := resp.contentType
+				if contentType == "" {
+					contentType = "application/json"
+				}
+				response["content"] = map[string]interface{}{contentType: map[string]interface{}{
+					"schema": schemas.schemaOf(reflect.TypeOf(resp.body))}}
+			}
+			responses[strconv.Itoa(resp.status)] = response
+		}
+		responses["default"] = map[string]interface{}{
+			"description": "Unexpected error",
+			"content": map[string]interface{}{problemContentType: map[string]interface{}{
+				"schema": schemas.schemaOf(reflect.TypeOf(ErrorResponse{}))}},
+		}
+
+		operation := map[string]interface{}{
+			"operationId": route.Name,
+			"summary":     doc.summary,
+			"responses":   responses,
+		}
+		if params != nil {
+			operation["parameters"] = params
+		}
+		if doc.request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{"application/json": map[string]interface{}{
+					"schema": schemas.schemaOf(reflect.TypeOf(doc.request))}},
+			}
+		}
+
+		path := apiVersionPrefix + route.Pattern
+		if _, found := paths[path]; !found {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path].(map[string]interface{})[strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Edge Application Agent API",
+			"version": strings.TrimPrefix(apiVersionPrefix, "/") + ".0.0",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": map[string]interface{}(schemas)},
+	}
+}
+
+// serveOpenAPIDocument returns a handler serving the OpenAPI document of routes
+func serveOpenAPIDocument(routes Routes) http.HandlerFunc {
+	document, err := json.Marshal(newOpenAPIDocument(routes))
+	if err != nil {
+		log.Errf("Failed to generate OpenAPI document: %s", err.Error())
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if document == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		if _, err := w.Write(document); err != nil {
+			log.Errf("Failed to write OpenAPI document: %s", err.Error())
+		}
+	}
+}
+
+// deprecatedRouteSuffix is appended to names of routes served as deprecated
+// aliases
+const deprecatedRouteSuffix = "Deprecated"
+
+// deprecatedAlias serves a route at its unversioned path and points clients
+// to the versioned one
+func deprecatedAlias(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+apiVersionPrefix+r.URL.Path+`>; rel="successor-version"`)
+		handler.ServeHTTP(w, r)
+	})
+}
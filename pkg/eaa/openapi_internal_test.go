@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = g.Describe("versioned API", func() {
+	var eaaContext *Context
+
+	serve := func(method string, path string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, nil)
+		request.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "consumer:1"}}},
+		}
+		response := httptest.NewRecorder()
+
+		NewEaaRouter(eaaContext).ServeHTTP(response, request)
+
+		return response
+	}
+
+	g.BeforeEach(func() {
+		eaaContext = &Context{}
+		eaaContext.serviceInfo.m = make(map[string]Service)
+	})
+
+	g.It("should document all routes", func() {
+		for _, route := range append(append(append(Routes{}, eaaRoutes...), openRoutes...),
+			ingestionRoutes...) {
+			Expect(eaaRouteDocs).To(HaveKey(route.Name))
+		}
+	})
+
+	g.It("should serve routes under the version prefix", func() {
+		response := serve("GET", "/v1/services")
+
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Header().Get("Deprecation")).To(BeEmpty())
+	})
+
+	g.It("should serve unversioned routes as deprecated aliases", func() {
+		response := serve("GET", "/services")
+
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Header().Get("Deprecation")).To(Equal("true"))
+		Expect(response.Header().Get("Link")).To(Equal(`</v1/services>; rel="successor-version"`))
+	})
+
+	g.It("should serve the OpenAPI document", func() {
+		response := serve("GET", "/v1/openapi.json")
+		Expect(response.Code).To(Equal(http.StatusOK))
+
+		var document struct {
+			OpenAPI string `json:"openapi"`
+			Paths   map[string]map[string]struct {
+				OperationID string `json:"operationId"`
+				Parameters  []struct {
+					Name string `json:"name"`
+					In   string `json:"in"`
+				} `json:"parameters"`
+				Responses map[string]json.RawMessage `json:"responses"`
+			} `json:"paths"`
+			Components struct {
+				Schemas map[string]struct {
+					Properties map[string]map[string]interface{} `json:"properties"`
+				} `json:"schemas"`
+			} `json:"components"`
+		}
+		Expect(json.NewDecoder(response.Body).Decode(&document)).To(Succeed())
+
+		Expect(document.OpenAPI).To(HavePrefix("3."))
+		Expect(document.Paths["/v1/services"]).To(HaveKey("get"))
+		Expect(document.Paths["/v1/services"]).To(HaveKey("post"))
+		Expect(document.Paths["/v1/services"]["get"].Responses).To(HaveKey("304"))
+
+		subscribe := document.Paths["/v1/subscriptions/{urn.namespace}/{urn.id}"]["post"]
+		Expect(subscribe.OperationID).To(Equal("SubscribeServiceNotifications"))
+		Expect(subscribe.Parameters).To(HaveLen(2))
+		Expect(subscribe.Parameters[0].In).To(Equal("path"))
+
+		service := document.Components.Schemas["Service"].Properties
+		Expect(service["health_check"]).To(HaveKeyWithValue("$ref",
+			"#/components/schemas/HealthCheck"))
+		Expect(service["notifications"]).To(HaveKeyWithValue("type", "array"))
+		Expect(document.Components.Schemas["HealthCheck"].Properties["interval"]).
+			To(HaveKeyWithValue("type", "string"))
+	})
+})
@@ -48,6 +48,35 @@ func InitEaaCert(certInfo CertsInfo) (*CertKeyPair, error) {
 	}, nil
 }
 
+// InitEaaCA loads the root CA used to sign certificates of applications
+func InitEaaCA(certInfo CertsInfo) (*CertKeyPair, error) {
+	var (
+		err    error
+		caKey  crypto.PrivateKey
+		caCert *x509.Certificate
+	)
+
+	if caKey, err = auth.LoadKey(certInfo.CaRootKeyPath); err != nil {
+		return nil, errors.Wrap(err, "LoadKey failed")
+	}
+
+	if caCert, err = auth.LoadCert(certInfo.CaRootPath); err != nil {
+		return nil, errors.Wrap(err, "LoadCert failed")
+	}
+
+	if !caCert.IsCA {
+		return nil, errors.New("Root certificate is not a CA")
+	}
+	if err = validateCert(caCert); err != nil {
+		return nil, errors.Wrap(err, "CA cert validation failed")
+	}
+
+	return &CertKeyPair{
+		x509Cert: caCert,
+		prvKey:   caKey,
+	}, nil
+}
+
 func validateCert(cert *x509.Certificate) error {
 	if time.Now().Before(cert.NotBefore) {
 		return errors.New("Cartificate expired, valid from: " +
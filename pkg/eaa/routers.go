@@ -26,14 +26,37 @@ type contextKey string
 
 // NewEaaRouter initializes EAA router
 func NewEaaRouter(eaaCtx *Context) *mux.Router {
+	router := newVersionedRouter(eaaCtx, eaaRoutes)
+	router.Use(instrumentRequests, validateAppIdentity, authorize)
+	return router
+}
+
+// newVersionedRouter initializes a router serving routes under
+// apiVersionPrefix along with their OpenAPI document
+func newVersionedRouter(eaaCtx *Context, routes Routes) *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
-	for _, route := range eaaRoutes {
-		router.
+	v1 := router.PathPrefix(apiVersionPrefix).Subrouter()
+	for _, route := range routes {
+		v1.
 			Methods(route.Method).
 			Path(route.Pattern).
 			Name(route.Name).
 			Handler(route.HandlerFunc)
 	}
+	v1.
+		Methods(http.MethodGet).
+		Path(strings.TrimPrefix(openAPIPath, apiVersionPrefix)).
+		Name("GetOpenAPIDocument").
+		Handler(serveOpenAPIDocument(routes))
+
+	// Unversioned paths are kept for clients of the API prior to versioning
+	for _, route := range routes {
+		router.
+			Methods(route.Method).
+			Path(route.Pattern).
+			Name(route.Name + deprecatedRouteSuffix).
+			Handler(deprecatedAlias(route.HandlerFunc))
+	}
 	router.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := context.WithValue(
@@ -47,6 +70,13 @@ func NewEaaRouter(eaaCtx *Context) *mux.Router {
 }
 
 var eaaRoutes = Routes{
+	Route{
+		"AddEgressTarget",
+		strings.ToUpper("Post"),
+		"/egress/targets",
+		AddEgressTarget,
+	},
+
 	Route{
 		"DeregisterApplication",
 		strings.ToUpper("Delete"),
@@ -54,6 +84,13 @@ var eaaRoutes = Routes{
 		DeregisterApplication,
 	},
 
+	Route{
+		"GetEgressTargets",
+		strings.ToUpper("Get"),
+		"/egress/targets",
+		GetEgressTargets,
+	},
+
 	Route{
 		"GetNotifications",
 		strings.ToUpper("Get"),
@@ -61,6 +98,20 @@ var eaaRoutes = Routes{
 		GetNotifications,
 	},
 
+	Route{
+		"GetNotificationHistory",
+		strings.ToUpper("Get"),
+		"/notifications/history",
+		GetNotificationHistory,
+	},
+
+	Route{
+		"GetNotificationSchema",
+		strings.ToUpper("Get"),
+		"/notifications/{namespace}/{name}/{version}/schema",
+		GetNotificationSchema,
+	},
+
 	Route{
 		"GetServices",
 		strings.ToUpper("Get"),
@@ -75,6 +126,13 @@ var eaaRoutes = Routes{
 		GetSubscriptions,
 	},
 
+	Route{
+		"GetUsage",
+		strings.ToUpper("Get"),
+		"/usage",
+		GetUsage,
+	},
+
 	Route{
 		"PushNotificationToSubscribers",
 		strings.ToUpper("Post"),
@@ -89,6 +147,13 @@ var eaaRoutes = Routes{
 		RegisterApplication,
 	},
 
+	Route{
+		"RemoveEgressTarget",
+		strings.ToUpper("Delete"),
+		"/egress/targets/{name}",
+		RemoveEgressTarget,
+	},
+
 	Route{
 		"SubscribeNamespaceNotifications",
 		strings.ToUpper("Post"),
@@ -0,0 +1,184 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// Default interval of checking server certificate files for changes missed
+// by the watcher
+const defaultCertsReloadInterval = time.Minute
+
+// serverCerts holds the server certificate and the client CA pool loaded
+// from paths in CertsInfo, they are replaced when the files change
+type serverCerts struct {
+	sync.RWMutex
+	cert     *tls.Certificate
+	caPool   *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+func (c CertsInfo) reloadInterval() time.Duration {
+	if c.ReloadInterval.Duration <= 0 {
+		return defaultCertsReloadInterval
+	}
+	return c.ReloadInterval.Duration
+}
+
+// reloadServerCerts loads the server certificate, its key and the client CA
+// pool if any of their files was modified since they were loaded last time.
+// Invalid files are rejected and the previous certificates stay in use.
+func reloadServerCerts(eaaCtx *Context) error {
+	certInfo := eaaCtx.cfg.Certs
+
+	modTimes := make(map[string]time.Time)
+	for _, path := range []string{certInfo.ServerCertPath, certInfo.ServerKeyPath,
+		certInfo.CaRootPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to stat %s", path)
+		}
+		modTimes[path] = info.ModTime()
+	}
+
+	eaaCtx.serverCerts.RLock()
+	unchanged := eaaCtx.serverCerts.cert != nil
+	for path, modTime := range modTimes {
+		unchanged = unchanged && modTime.Equal(eaaCtx.serverCerts.modTimes[path])
+	}
+	eaaCtx.serverCerts.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certInfo.ServerCertPath, certInfo.ServerKeyPath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to load server certificate")
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return errors.Wrap(err, "Failed to parse server certificate")
+	}
+	if err = validateCert(cert.Leaf); err != nil {
+		return errors.Wrap(err, "Server certificate validation failed")
+	}
+
+	caPool, err := CreateAndSetCACertPool(certInfo.CaRootPath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to load client CA pool")
+	}
+
+	eaaCtx.serverCerts.Lock()
+	eaaCtx.serverCerts.cert = &cert
+	eaaCtx.serverCerts.caPool = caPool
+	eaaCtx.serverCerts.modTimes = modTimes
+	eaaCtx.serverCerts.Unlock()
+
+	log.Infof("Loaded server certificate of %s valid to %s", cert.Leaf.Subject.CommonName,
+		cert.Leaf.NotAfter.String())
+	return nil
+}
+
+// runServerCertsReloader reloads server certificates until ctx is done.
+// Directories of the certificate files are watched so that a renewed
+// certificate is served right after it is written. The files are also
+// checked every ReloadInterval in case the watcher misses a change or
+// can't be created, e.g. on a file system without inotify support.
+func runServerCertsReloader(ctx context.Context, eaaCtx *Context) {
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+
+	watcher, err := newServerCertsWatcher(eaaCtx.cfg.Certs)
+	if err != nil {
+		log.Errf("Server certificate watcher error, falling back to polling every %s: %s",
+			eaaCtx.cfg.Certs.reloadInterval(), err.Error())
+	} else {
+		defer func() { _ = watcher.Close() }()
+		events = watcher.Events
+		watchErrors = watcher.Errors
+	}
+
+	reload := func() {
+		if err := reloadServerCerts(eaaCtx); err != nil {
+			log.Errf("Server certificate reload error: %s", err.Error())
+		}
+	}
+
+	t := time.NewTicker(eaaCtx.cfg.Certs.reloadInterval())
+	defer t.Stop()
+	for {
+		select {
+		case <-events:
+			reload()
+		case err := <-watchErrors:
+			log.Errf("Server certificate watcher error: %s", err.Error())
+		case <-t.C:
+			reload()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newServerCertsWatcher watches directories of the server certificate files.
+// Directories are watched rather than the files to notice files replaced by
+// a rename, e.g. an updated Kubernetes secret.
+func newServerCertsWatcher(certInfo CertsInfo) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create a file watcher")
+	}
+
+	dirs := make(map[string]bool)
+	for _, path := range []string{certInfo.ServerCertPath, certInfo.ServerKeyPath,
+		certInfo.CaRootPath} {
+		dir := filepath.Dir(path)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err = watcher.Add(dir); err != nil {
+			_ = watcher.Close()
+			return nil, errors.Wrapf(err, "Failed to watch %s", dir)
+		}
+	}
+	return watcher, nil
+}
+
+// newServerTLSConfig returns TLS config of the EAA server using certificates
+// currently held in eaaCtx for each connection
+func newServerTLSConfig(eaaCtx *Context) *tls.Config {
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		eaaCtx.serverCerts.RLock()
+		defer eaaCtx.serverCerts.RUnlock()
+		return eaaCtx.serverCerts.cert, nil
+	}
+
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: getCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			eaaCtx.serverCerts.RLock()
+			caPool := eaaCtx.serverCerts.caPool
+			eaaCtx.serverCerts.RUnlock()
+
+			return &tls.Config{
+				ClientAuth:     tls.RequireAndVerifyClientCert,
+				ClientCAs:      caPool,
+				MinVersion:     tls.VersionTLS12,
+				CipherSuites:   []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+				GetCertificate: getCertificate,
+			}, nil
+		},
+	}
+}
@@ -0,0 +1,224 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/smart-edge-open/edgeservices/pkg/auth"
+)
+
+var _ = g.Describe("server certificates", func() {
+	var (
+		eaaContext *Context
+		certsDir   string
+		caCert     *x509.Certificate
+		caKey      *ecdsa.PrivateKey
+		serial     int64
+	)
+
+	// newCA creates a self-signed CA
+	newCA := func() (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		serial++
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: "root.openness"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		Expect(err).NotTo(HaveOccurred())
+		cert, err := x509.ParseCertificate(der)
+		Expect(err).NotTo(HaveOccurred())
+		return cert, key
+	}
+
+	// issue creates a certificate signed by the test CA
+	issue := func(commonName string, validity time.Duration) (*x509.Certificate,
+		*ecdsa.PrivateKey) {
+
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		serial++
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: commonName},
+			DNSNames:     []string{commonName},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(validity),
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+				x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+		Expect(err).NotTo(HaveOccurred())
+		cert, err := x509.ParseCertificate(der)
+		Expect(err).NotTo(HaveOccurred())
+		return cert, key
+	}
+
+	// writeServerCert replaces the server certificate files, their
+	// modification time is moved forward to be noticed as a change
+	writeServerCert := func(validity time.Duration) *x509.Certificate {
+		cert, key := issue("eaa.openness", validity)
+		Expect(auth.SaveCert(eaaContext.cfg.Certs.ServerCertPath, cert)).To(Succeed())
+		Expect(auth.SaveKey(key, eaaContext.cfg.Certs.ServerKeyPath)).To(Succeed())
+
+		future := time.Now().Add(time.Duration(serial) * time.Minute)
+		for _, path := range []string{eaaContext.cfg.Certs.ServerCertPath,
+			eaaContext.cfg.Certs.ServerKeyPath} {
+			Expect(os.Chtimes(path, future, future)).To(Succeed())
+		}
+		return cert
+	}
+
+	// handshake returns the certificate EAA server presents to a client
+	handshake := func() *x509.Certificate {
+		lis, err := tls.Listen("tcp", "127.0.0.1:0", newServerTLSConfig(eaaContext))
+		Expect(err).NotTo(HaveOccurred())
+		defer lis.Close()
+		go func() {
+			conn, err := lis.Accept()
+			if err == nil {
+				_ = conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+
+		clientCert, clientKey := issue("consumer:1", time.Hour)
+		roots := x509.NewCertPool()
+		roots.AddCert(caCert)
+		conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{
+			RootCAs:    roots,
+			ServerName: "eaa.openness",
+			Certificates: []tls.Certificate{{Certificate: [][]byte{clientCert.Raw},
+				PrivateKey: clientKey}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0]
+	}
+
+	g.BeforeEach(func() {
+		var err error
+		certsDir, err = ioutil.TempDir("", "eaa-certs")
+		Expect(err).NotTo(HaveOccurred())
+
+		caCert, caKey = newCA()
+
+		eaaContext = &Context{}
+		eaaContext.cfg.Certs = CertsInfo{
+			CaRootPath:     filepath.Join(certsDir, "root.pem"),
+			ServerCertPath: filepath.Join(certsDir, "cert.pem"),
+			ServerKeyPath:  filepath.Join(certsDir, "key.pem"),
+		}
+		Expect(auth.SaveCert(eaaContext.cfg.Certs.CaRootPath, caCert)).To(Succeed())
+	})
+
+	g.AfterEach(func() {
+		os.RemoveAll(certsDir)
+	})
+
+	g.It("should serve the loaded certificate", func() {
+		cert := writeServerCert(time.Hour)
+		Expect(reloadServerCerts(eaaContext)).To(Succeed())
+
+		Expect(handshake().SerialNumber).To(Equal(cert.SerialNumber))
+	})
+
+	g.It("should serve a renewed certificate without restart", func() {
+		writeServerCert(time.Hour)
+		Expect(reloadServerCerts(eaaContext)).To(Succeed())
+
+		renewed := writeServerCert(2 * time.Hour)
+		Expect(reloadServerCerts(eaaContext)).To(Succeed())
+
+		Expect(handshake().SerialNumber).To(Equal(renewed.SerialNumber))
+	})
+
+	g.It("should serve a renewed certificate as soon as it is written", func() {
+		writeServerCert(time.Hour)
+		Expect(reloadServerCerts(eaaContext)).To(Succeed())
+
+		// Polling is far off, the change has to be noticed by the watcher
+		eaaContext.cfg.Certs.ReloadInterval.Duration = time.Hour
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go runServerCertsReloader(ctx, eaaContext)
+		// Give the reloader time to start watching
+		time.Sleep(100 * time.Millisecond)
+
+		renewed := writeServerCert(2 * time.Hour)
+		Eventually(func() *big.Int { return handshake().SerialNumber }).
+			Should(Equal(renewed.SerialNumber))
+	})
+
+	g.It("should keep the previous certificate when the new one is invalid", func() {
+		cert := writeServerCert(time.Hour)
+		Expect(reloadServerCerts(eaaContext)).To(Succeed())
+
+		writeServerCert(-time.Minute)
+		Expect(reloadServerCerts(eaaContext)).NotTo(Succeed())
+
+		Expect(handshake().SerialNumber).To(Equal(cert.SerialNumber))
+	})
+
+	g.It("should reject clients of a replaced CA", func() {
+		writeServerCert(time.Hour)
+		Expect(reloadServerCerts(eaaContext)).To(Succeed())
+
+		otherCA, _ := newCA()
+		Expect(auth.SaveCert(eaaContext.cfg.Certs.CaRootPath, otherCA)).To(Succeed())
+		future := time.Now().Add(time.Hour)
+		Expect(os.Chtimes(eaaContext.cfg.Certs.CaRootPath, future, future)).To(Succeed())
+		Expect(reloadServerCerts(eaaContext)).To(Succeed())
+
+		lis, err := tls.Listen("tcp", "127.0.0.1:0", newServerTLSConfig(eaaContext))
+		Expect(err).NotTo(HaveOccurred())
+		defer lis.Close()
+		go func() {
+			conn, err := lis.Accept()
+			if err == nil {
+				_ = conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+
+		clientCert, clientKey := issue("consumer:1", time.Hour)
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		client := tls.Client(conn, &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates: []tls.Certificate{{Certificate: [][]byte{clientCert.Raw},
+				PrivateKey: clientKey}},
+		})
+		defer client.Close()
+		// The client learns about the rejected certificate on the first read
+		err = client.Handshake()
+		if err == nil {
+			_, err = client.Read(make([]byte, 1))
+		}
+		Expect(err).To(HaveOccurred())
+	})
+})
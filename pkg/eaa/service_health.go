@@ -0,0 +1,557 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Health check types
+const (
+	healthCheckHTTP = "http"
+	healthCheckTCP  = "tcp"
+	healthCheckGRPC = "grpc"
+)
+
+// Default values of the HealthChecks section of the EAA config
+const (
+	defaultHealthCheckInterval         = 10 * time.Second
+	defaultHealthCheckTimeout          = 2 * time.Second
+	defaultHealthCheckFailureThreshold = 3
+)
+
+// serviceHealthState tracks probes of a single service
+type serviceHealthState struct {
+	failures int
+	due      time.Time
+	// probing is set while a probe is in flight and after the service
+	// has been deregistered because of failed probes
+	probing bool
+}
+
+// serviceHealth is a synchronized map of a producer Common Name to
+// the state of its health check
+type serviceHealth struct {
+	sync.Mutex
+	m map[string]*serviceHealthState
+	// IDs of EAA instances services were registered through. Only services
+	// registered through this instance are probed.
+	origins map[string]string
+}
+
+func (c HealthChecksConfig) validate() error {
+	for _, cidr := range c.AllowedNetworks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return errors.Wrapf(err, "Invalid health checks allowed network %q", cidr)
+		}
+	}
+	return nil
+}
+
+// allowsTarget tells whether services can be probed at an IP address
+func (c HealthChecksConfig) allowsTarget(ip net.IP) bool {
+	for _, cidr := range c.AllowedNetworks {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c HealthChecksConfig) interval(hc *HealthCheck) time.Duration {
+	switch {
+	case hc.Interval.Duration > 0:
+		return hc.Interval.Duration
+	case c.Interval.Duration > 0:
+		return c.Interval.Duration
+	}
+	return defaultHealthCheckInterval
+}
+
+func (c HealthChecksConfig) timeout(hc *HealthCheck) time.Duration {
+	switch {
+	case hc.Timeout.Duration > 0:
+		return hc.Timeout.Duration
+	case c.Timeout.Duration > 0:
+		return c.Timeout.Duration
+	}
+	return defaultHealthCheckTimeout
+}
+
+func (c HealthChecksConfig) failureThreshold(hc *HealthCheck) int {
+	switch {
+	case hc.FailureThreshold > 0:
+		return hc.FailureThreshold
+	case c.FailureThreshold > 0:
+		return c.FailureThreshold
+	}
+	return defaultHealthCheckFailureThreshold
+}
+
+// probeTargetRefusedError is returned when the endpoint of a service resolves
+// to an address outside of the allowed networks
+type probeTargetRefusedError struct {
+	error
+}
+
+// validateServiceHealthCheck checks the health check of a service being
+// registered. It returns a list of problems. When health checks are enabled,
+// the endpoint has to resolve to addresses in the allowed networks.
+func validateServiceHealthCheck(ctx context.Context, serv *Service,
+	cfg HealthChecksConfig) []string {
+
+	hc := serv.HealthCheck
+	if hc == nil {
+		return nil
+	}
+
+	var problems []string
+	switch hc.Type {
+	case healthCheckHTTP:
+		if _, err := healthCheckURL(serv.EndpointURI, hc.Path); err != nil {
+			problems = append(problems, err.Error())
+		}
+	case healthCheckTCP, healthCheckGRPC:
+		if _, err := healthCheckAddress(serv.EndpointURI); err != nil {
+			problems = append(problems, err.Error())
+		}
+	default:
+		problems = append(problems, "Unknown health check type: "+hc.Type)
+	}
+	if cfg.Enabled && len(problems) == 0 {
+		ctx, cancel := context.WithTimeout(ctx, cfg.timeout(hc))
+		defer cancel()
+		if err := checkHealthCheckTarget(ctx, serv, cfg); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if hc.Interval.Duration < 0 || hc.Timeout.Duration < 0 {
+		problems = append(problems, "Health check interval and timeout can't be negative")
+	}
+	if hc.FailureThreshold < 0 {
+		problems = append(problems, "Health check failure threshold can't be negative")
+	}
+	return problems
+}
+
+// healthCheckAddress returns the host:port address of a service endpoint.
+// The endpoint is either an URL or a host:port address.
+func healthCheckAddress(endpoint string) (string, error) {
+	if !strings.Contains(endpoint, "://") {
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			return "", errors.Wrapf(err, "Invalid endpoint %q", endpoint)
+		}
+		return endpoint, nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", errors.Wrapf(err, "Invalid endpoint %q", endpoint)
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	switch u.Scheme {
+	case "http":
+		return net.JoinHostPort(u.Hostname(), "80"), nil
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443"), nil
+	}
+	return "", errors.Errorf("Endpoint %q has no port", endpoint)
+}
+
+// healthCheckURL returns the URL requested by http probes of a service
+func healthCheckURL(endpoint string, path string) (string, error) {
+	if endpoint == "" {
+		return "", errors.New("Service endpoint is missing")
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", errors.Wrapf(err, "Invalid endpoint %q", endpoint)
+	}
+	if u.Host == "" {
+		return "", errors.Errorf("Endpoint %q has no host", endpoint)
+	}
+	if path != "" {
+		ref, err := url.Parse(path)
+		if err != nil {
+			return "", errors.Wrapf(err, "Invalid health check path %q", path)
+		}
+		u = u.ResolveReference(ref)
+	}
+	return u.String(), nil
+}
+
+// healthCheckHost returns the host probed by the health check of a service
+func healthCheckHost(serv *Service) (string, error) {
+	if serv.HealthCheck.Type == healthCheckHTTP {
+		target, err := healthCheckURL(serv.EndpointURI, serv.HealthCheck.Path)
+		if err != nil {
+			return "", err
+		}
+		u, err := url.Parse(target)
+		if err != nil {
+			return "", errors.Wrapf(err, "Invalid health check URL %q", target)
+		}
+		return u.Hostname(), nil
+	}
+
+	address, err := healthCheckAddress(serv.EndpointURI)
+	if err != nil {
+		return "", err
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", errors.Wrapf(err, "Invalid endpoint %q", address)
+	}
+	return host, nil
+}
+
+// checkHealthCheckTarget resolves the host probed by the health check of
+// a service and checks that all its addresses are in the allowed networks
+func checkHealthCheckTarget(ctx context.Context, serv *Service,
+	cfg HealthChecksConfig) error {
+
+	host, err := healthCheckHost(serv)
+	if err != nil {
+		return err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to resolve health check target %s", host)
+	}
+	for _, addr := range addrs {
+		if !cfg.allowsTarget(addr.IP) {
+			return probeTargetRefusedError{errors.Errorf(
+				"Health check target %s (%s) is not allowed", host, addr.IP)}
+		}
+	}
+	return nil
+}
+
+// healthCheckDialer returns a dialer of probes that refuses to connect to
+// addresses outside of the allowed networks. The address is checked after
+// name resolution, so it also covers host names and HTTP redirects.
+func healthCheckDialer(cfg HealthChecksConfig) *net.Dialer {
+	return &net.Dialer{
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return errors.Wrapf(err, "Invalid health check target %q", address)
+			}
+			if ip := net.ParseIP(host); ip == nil || !cfg.allowsTarget(ip) {
+				return errors.Errorf("Health check target %s is not allowed", host)
+			}
+			return nil
+		},
+	}
+}
+
+// probeService runs a single health check of a service. It returns nil if
+// the service is healthy.
+func probeService(serv Service, cfg HealthChecksConfig) error {
+	hc := serv.HealthCheck
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout(hc))
+	defer cancel()
+
+	if err := checkHealthCheckTarget(ctx, &serv, cfg); err != nil {
+		return err
+	}
+	dialer := healthCheckDialer(cfg)
+	switch hc.Type {
+	case healthCheckHTTP:
+		return probeHTTP(ctx, dialer, serv.EndpointURI, hc.Path)
+	case healthCheckTCP:
+		return probeTCP(ctx, dialer, serv.EndpointURI)
+	case healthCheckGRPC:
+		return probeGRPC(ctx, dialer, serv.EndpointURI, hc.Service)
+	}
+	return errors.Errorf("Unknown health check type: %v", hc.Type)
+}
+
+func probeHTTP(ctx context.Context, dialer *net.Dialer, endpoint string,
+	path string) error {
+
+	target, err := healthCheckURL(endpoint, path)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create health check request")
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext:       dialer.DialContext,
+		DisableKeepAlives: true,
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to request %s", target)
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		if err := resp.Body.Close(); err != nil {
+			log.Warningf("Failed to close health check response body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return errors.Errorf("%s responded with %s", target, resp.Status)
+	}
+	return nil
+}
+
+func probeTCP(ctx context.Context, dialer *net.Dialer, endpoint string) error {
+	address, err := healthCheckAddress(endpoint)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to connect to %s", address)
+	}
+	if err = conn.Close(); err != nil {
+		log.Warningf("Failed to close health check connection: %v", err)
+	}
+	return nil
+}
+
+func probeGRPC(ctx context.Context, dialer *net.Dialer, endpoint string,
+	service string) error {
+
+	address, err := healthCheckAddress(endpoint)
+	if err != nil {
+		return err
+	}
+
+	conn, err := grpc.DialContext(ctx, address, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", addr)
+		}))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to connect to %s", address)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Warningf("Failed to close health check connection: %v", err)
+		}
+	}()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx,
+		&healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return errors.Wrapf(err, "Health check of %s failed", address)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return errors.Errorf("%s reported %v", address, resp.Status)
+	}
+	return nil
+}
+
+// resetServiceHealth forgets probes of a service, e.g. when it registers
+// again. The caller has to hold the serviceInfo lock.
+func resetServiceHealth(commonName string, eaaCtx *Context) {
+	eaaCtx.serviceHealth.Lock()
+	delete(eaaCtx.serviceHealth.m, commonName)
+	eaaCtx.serviceHealth.Unlock()
+}
+
+// setServiceOrigin records the ID of the EAA instance a service was
+// registered through. Services registered through other instances are
+// probed there.
+func setServiceOrigin(commonName string, origin string, eaaCtx *Context) {
+	eaaCtx.serviceHealth.Lock()
+	defer eaaCtx.serviceHealth.Unlock()
+
+	if eaaCtx.serviceHealth.origins == nil {
+		eaaCtx.serviceHealth.origins = make(map[string]string)
+	}
+	eaaCtx.serviceHealth.origins[commonName] = origin
+}
+
+// serviceOrigin returns the ID of the EAA instance a service was registered
+// through
+func serviceOrigin(commonName string, eaaCtx *Context) (string, bool) {
+	eaaCtx.serviceHealth.Lock()
+	defer eaaCtx.serviceHealth.Unlock()
+
+	origin, found := eaaCtx.serviceHealth.origins[commonName]
+	return origin, found
+}
+
+// isLocalService tells whether a service was registered through this EAA
+// instance. The caller has to hold the serviceHealth lock.
+func isLocalService(commonName string, eaaCtx *Context) bool {
+	origin, found := eaaCtx.serviceHealth.origins[commonName]
+	return found && origin == eaaCtx.instanceID
+}
+
+// checkServicesHealth starts probes of local services that are due
+func checkServicesHealth(eaaCtx *Context) {
+	now := time.Now()
+
+	eaaCtx.serviceInfo.RLock()
+	defer eaaCtx.serviceInfo.RUnlock()
+	eaaCtx.serviceHealth.Lock()
+	defer eaaCtx.serviceHealth.Unlock()
+
+	if eaaCtx.serviceHealth.m == nil {
+		eaaCtx.serviceHealth.m = make(map[string]*serviceHealthState)
+	}
+	for commonName := range eaaCtx.serviceHealth.origins {
+		if _, found := eaaCtx.serviceInfo.m[commonName]; !found {
+			delete(eaaCtx.serviceHealth.origins, commonName)
+		}
+	}
+	for commonName := range eaaCtx.serviceHealth.m {
+		if serv, found := eaaCtx.serviceInfo.m[commonName]; !found ||
+			serv.HealthCheck == nil || !isLocalService(commonName, eaaCtx) {
+			delete(eaaCtx.serviceHealth.m, commonName)
+		}
+	}
+
+	for commonName, serv := range eaaCtx.serviceInfo.m {
+		if serv.HealthCheck == nil || !isLocalService(commonName, eaaCtx) {
+			continue
+		}
+		state, found := eaaCtx.serviceHealth.m[commonName]
+		if !found {
+			state = &serviceHealthState{}
+			eaaCtx.serviceHealth.m[commonName] = state
+		}
+		if state.probing || now.Before(state.due) {
+			continue
+		}
+
+		state.probing = true
+		state.due = now.Add(eaaCtx.cfg.HealthChecks.interval(serv.HealthCheck))
+		go func(commonName string, serv Service) {
+			recordProbeResult(commonName, probeService(serv, eaaCtx.cfg.HealthChecks),
+				eaaCtx)
+		}(commonName, serv)
+	}
+}
+
+// recordProbeResult updates the status of a service after a probe. A service
+// that failed too many probes in a row is deregistered.
+func recordProbeResult(commonName string, probeErr error, eaaCtx *Context) {
+	deregister := false
+	defer func() {
+		if !deregister {
+			return
+		}
+		if err := publishServiceDeregistration(commonName, eaaCtx); err != nil {
+			log.Errf("Failed to deregister unhealthy service %s: %v", commonName, err)
+
+			// Probe the service again to retry
+			eaaCtx.serviceHealth.Lock()
+			if state, found := eaaCtx.serviceHealth.m[commonName]; found {
+				state.probing = false
+			}
+			eaaCtx.serviceHealth.Unlock()
+		}
+	}()
+
+	eaaCtx.serviceInfo.Lock()
+	defer eaaCtx.serviceInfo.Unlock()
+	eaaCtx.serviceHealth.Lock()
+	defer eaaCtx.serviceHealth.Unlock()
+
+	serv, serviceFound := eaaCtx.serviceInfo.m[commonName]
+	state, stateFound := eaaCtx.serviceHealth.m[commonName]
+	if !serviceFound || !stateFound || serv.HealthCheck == nil {
+		// The service has been removed or registered again in the meantime
+		return
+	}
+	state.probing = false
+
+	if _, refused := probeErr.(probeTargetRefusedError); refused {
+		// The endpoint is unreachable by policy, not unhealthy
+		log.Warningf("Health check of %s skipped: %v", commonName, probeErr)
+		return
+	}
+
+	status := serviceStatusHealthy
+	if probeErr == nil {
+		state.failures = 0
+	} else {
+		status = serviceStatusUnhealthy
+		state.failures++
+		log.Warningf("Health check of %s failed (%d in a row): %v", commonName,
+			state.failures, probeErr)
+	}
+	if serv.Status != status {
+		serv.Status = status
+		eaaCtx.serviceInfo.m[commonName] = serv
+	}
+
+	if state.failures >= eaaCtx.cfg.HealthChecks.failureThreshold(serv.HealthCheck) {
+		log.Infof("Deregistering unhealthy service %s", commonName)
+		// Stop probing until the service is removed
+		state.probing = true
+		deregister = true
+	}
+}
+
+// publishServiceDeregistration publishes the deregistration of a service
+// the same way as DeregisterApplication does
+func publishServiceDeregistration(commonName string, eaaCtx *Context) error {
+	urn, err := CommonNameStringToURN(commonName)
+	if err != nil {
+		return errors.Wrap(err, "Failed to convert Common Name to URN")
+	}
+
+	data, err := json.Marshal(ServiceMessage{Svc: &Service{URN: &urn},
+		Action: serviceActionDeregister, Origin: eaaCtx.instanceID})
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal Service message")
+	}
+
+	return eaaCtx.MsgBrokerCtx.publish(servicesTopic,
+		message.NewMessage(watermill.NewUUID(), data))
+}
+
+// runServiceHealthChecker periodically probes services that registered
+// a health check until ctx is done
+func runServiceHealthChecker(ctx context.Context, eaaCtx *Context) {
+	interval := eaaCtx.cfg.HealthChecks.interval(&HealthCheck{})
+	if interval > time.Second {
+		interval = time.Second
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			checkServicesHealth(eaaCtx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
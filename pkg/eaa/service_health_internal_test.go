@@ -0,0 +1,324 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/smart-edge-open/edgeservices/pkg/util"
+)
+
+// publishRecorder is a message broker recording published service messages
+type publishRecorder struct {
+	brokerMock
+	sync.Mutex
+	messages []ServiceMessage
+}
+
+func (b *publishRecorder) publish(topic string, msg *message.Message) error {
+	b.Lock()
+	defer b.Unlock()
+
+	var svcMsg ServiceMessage
+	if err := json.Unmarshal(msg.Payload, &svcMsg); err != nil {
+		return err
+	}
+	b.messages = append(b.messages, svcMsg)
+	return nil
+}
+
+func (b *publishRecorder) published() []ServiceMessage {
+	b.Lock()
+	defer b.Unlock()
+	return append([]ServiceMessage(nil), b.messages...)
+}
+
+var _ = g.Describe("service health checks", func() {
+	g.Describe("probeService", func() {
+		probe := func(endpoint string, hc HealthCheck) error {
+			return probeService(Service{EndpointURI: endpoint, HealthCheck: &hc},
+				HealthChecksConfig{Timeout: util.Duration{Duration: time.Second},
+					AllowedNetworks: []string{"127.0.0.0/8"}})
+		}
+
+		g.It("should probe an HTTP endpoint", func() {
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path != "/healthz" {
+						w.WriteHeader(http.StatusServiceUnavailable)
+					}
+				}))
+			defer server.Close()
+
+			Expect(probe(server.URL, HealthCheck{Type: "http", Path: "/healthz"})).
+				To(Succeed())
+			Expect(probe(server.Listener.Addr().String(),
+				HealthCheck{Type: "http", Path: "/healthz"})).To(Succeed())
+			Expect(probe(server.URL, HealthCheck{Type: "http", Path: "/ready"})).
+				NotTo(Succeed())
+		})
+
+		g.It("should probe a TCP endpoint", func() {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			address := lis.Addr().String()
+
+			Expect(probe(address, HealthCheck{Type: "tcp"})).To(Succeed())
+			Expect(probe("tcp://"+address, HealthCheck{Type: "tcp"})).To(Succeed())
+
+			Expect(lis.Close()).To(Succeed())
+			Expect(probe(address, HealthCheck{Type: "tcp"})).NotTo(Succeed())
+		})
+
+		g.It("should probe a gRPC endpoint", func() {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			server := grpc.NewServer()
+			healthServer := health.NewServer()
+			healthpb.RegisterHealthServer(server, healthServer)
+			go func() { _ = server.Serve(lis) }()
+			defer server.Stop()
+
+			healthServer.SetServingStatus("producer", healthpb.HealthCheckResponse_SERVING)
+			Expect(probe(lis.Addr().String(), HealthCheck{Type: "grpc"})).To(Succeed())
+			Expect(probe(lis.Addr().String(),
+				HealthCheck{Type: "grpc", Service: "producer"})).To(Succeed())
+
+			healthServer.SetServingStatus("producer", healthpb.HealthCheckResponse_NOT_SERVING)
+			Expect(probe(lis.Addr().String(),
+				HealthCheck{Type: "grpc", Service: "producer"})).NotTo(Succeed())
+		})
+
+		g.It("should not connect to targets outside of allowed networks", func() {
+			lis, err := net.Listen("tcp", "127.0.0.2:0")
+			Expect(err).NotTo(HaveOccurred())
+			requested := make(chan struct{}, 10)
+			target := httptest.NewUnstartedServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					requested <- struct{}{}
+				}))
+			target.Listener = lis
+			target.Start()
+			defer target.Close()
+
+			redirect := httptest.NewServer(http.RedirectHandler(target.URL,
+				http.StatusFound))
+			defer redirect.Close()
+
+			cfg := HealthChecksConfig{Timeout: util.Duration{Duration: time.Second},
+				AllowedNetworks: []string{"127.0.0.1/32"}}
+			for _, hc := range []HealthCheck{{Type: "http"}, {Type: "tcp"}, {Type: "grpc"}} {
+				hc := hc
+				Expect(probeService(Service{EndpointURI: target.URL, HealthCheck: &hc},
+					cfg)).NotTo(Succeed(), hc.Type)
+			}
+			Expect(probeService(Service{EndpointURI: redirect.URL,
+				HealthCheck: &HealthCheck{Type: "http"}}, cfg)).NotTo(Succeed())
+			Expect(requested).NotTo(Receive())
+		})
+	})
+
+	g.Describe("validateServiceHealthCheck", func() {
+		validate := func(serv Service, cfg HealthChecksConfig) []string {
+			return validateServiceHealthCheck(context.Background(), &serv, cfg)
+		}
+
+		g.It("should accept valid health checks", func() {
+			for _, serv := range []Service{
+				{},
+				{EndpointURI: "producer:8080", HealthCheck: &HealthCheck{Type: "http"}},
+				{EndpointURI: "https://producer", HealthCheck: &HealthCheck{Type: "grpc"}},
+				{EndpointURI: "producer:8080", HealthCheck: &HealthCheck{Type: "tcp",
+					Interval: util.Duration{Duration: time.Second}, FailureThreshold: 2}},
+				// Targets aren't restricted while health checks are disabled
+				{EndpointURI: "169.254.169.254:80", HealthCheck: &HealthCheck{Type: "tcp"}},
+			} {
+				Expect(validate(serv, HealthChecksConfig{})).To(BeEmpty(), serv.EndpointURI)
+			}
+		})
+
+		g.It("should reject invalid health checks", func() {
+			for _, serv := range []Service{
+				{EndpointURI: "producer:8080", HealthCheck: &HealthCheck{Type: "icmp"}},
+				{HealthCheck: &HealthCheck{Type: "http"}},
+				{EndpointURI: "producer", HealthCheck: &HealthCheck{Type: "tcp"}},
+				{EndpointURI: "grpc://producer", HealthCheck: &HealthCheck{Type: "grpc"}},
+				{EndpointURI: "producer:8080", HealthCheck: &HealthCheck{Type: "tcp",
+					FailureThreshold: -1}},
+			} {
+				Expect(validate(serv, HealthChecksConfig{})).NotTo(BeEmpty(),
+					serv.EndpointURI)
+			}
+		})
+
+		g.It("should accept only targets in allowed networks when enabled", func() {
+			cfg := HealthChecksConfig{Enabled: true,
+				AllowedNetworks: []string{"10.16.0.0/16", "127.0.0.0/8", "::1/128"}}
+
+			for _, serv := range []Service{
+				{EndpointURI: "http://10.16.0.5:8080", HealthCheck: &HealthCheck{Type: "http"}},
+				{EndpointURI: "localhost:8080", HealthCheck: &HealthCheck{Type: "tcp"}},
+			} {
+				Expect(validate(serv, cfg)).To(BeEmpty(), serv.EndpointURI)
+			}
+			for _, serv := range []Service{
+				{EndpointURI: "169.254.169.254:80", HealthCheck: &HealthCheck{Type: "tcp"}},
+				{EndpointURI: "http://[fe80::1]:8080", HealthCheck: &HealthCheck{Type: "http"}},
+				{EndpointURI: "producer.invalid:8080", HealthCheck: &HealthCheck{Type: "grpc"}},
+			} {
+				Expect(validate(serv, cfg)).NotTo(BeEmpty(), serv.EndpointURI)
+			}
+		})
+	})
+
+	g.Describe("checkServicesHealth", func() {
+		var (
+			eaaContext *Context
+			broker     *publishRecorder
+			healthy    bool
+			server     *httptest.Server
+			mu         sync.Mutex
+		)
+
+		const commonName = "namespace:producer"
+
+		status := func() string {
+			eaaContext.serviceInfo.RLock()
+			defer eaaContext.serviceInfo.RUnlock()
+			return eaaContext.serviceInfo.m[commonName].Status
+		}
+
+		g.BeforeEach(func() {
+			healthy = true
+			server = httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					defer mu.Unlock()
+					if !healthy {
+						w.WriteHeader(http.StatusServiceUnavailable)
+					}
+				}))
+
+			broker = &publishRecorder{}
+			eaaContext = &Context{MsgBrokerCtx: broker, instanceID: "eaa-1"}
+			eaaContext.cfg.HealthChecks.AllowedNetworks = []string{"127.0.0.0/8"}
+			eaaContext.serviceInfo.m = make(map[string]Service)
+
+			urn := URN{Namespace: "namespace", ID: "producer"}
+			Expect(addService(commonName, Service{URN: &urn, EndpointURI: server.URL,
+				HealthCheck: &HealthCheck{Type: "http",
+					Interval: util.Duration{Duration: time.Millisecond}, FailureThreshold: 2},
+			}, eaaContext)).To(Succeed())
+			setServiceOrigin(commonName, "eaa-1", eaaContext)
+		})
+
+		g.AfterEach(func() {
+			server.Close()
+		})
+
+		g.It("should not probe services registered through other instances", func() {
+			mu.Lock()
+			healthy = false
+			mu.Unlock()
+
+			data, err := json.Marshal(ServiceMessage{Svc: &Service{
+				URN: &URN{Namespace: "namespace", ID: "producer"}, EndpointURI: server.URL,
+				HealthCheck: &HealthCheck{Type: "http",
+					Interval: util.Duration{Duration: time.Millisecond}, FailureThreshold: 1},
+			}, Action: serviceActionRegister, Origin: "eaa-2"})
+			Expect(err).NotTo(HaveOccurred())
+			messages := make(chan *message.Message, 1)
+			messages <- message.NewMessage("1", data)
+			close(messages)
+			handleServiceUpdates(messages, eaaContext)
+
+			Consistently(func() []ServiceMessage {
+				checkServicesHealth(eaaContext)
+				return broker.published()
+			}, 50*time.Millisecond).Should(BeEmpty())
+			Expect(status()).To(BeEmpty())
+		})
+
+		g.It("should mark a responding service healthy", func() {
+			Eventually(func() string {
+				checkServicesHealth(eaaContext)
+				return status()
+			}).Should(Equal(serviceStatusHealthy))
+			Consistently(broker.published, 50*time.Millisecond).Should(BeEmpty())
+		})
+
+		g.It("should deregister a service after failed probes", func() {
+			mu.Lock()
+			healthy = false
+			mu.Unlock()
+
+			Eventually(func() []ServiceMessage {
+				checkServicesHealth(eaaContext)
+				return broker.published()
+			}).Should(HaveLen(1))
+			Expect(status()).To(Equal(serviceStatusUnhealthy))
+
+			svcMsg := broker.published()[0]
+			Expect(svcMsg.Action).To(Equal(serviceActionDeregister))
+			Expect(svcMsg.Svc.URN.String()).To(Equal(commonName))
+
+			// The service isn't probed anymore until it is removed
+			Consistently(func() []ServiceMessage {
+				checkServicesHealth(eaaContext)
+				return broker.published()
+			}, 50*time.Millisecond).Should(HaveLen(1))
+		})
+
+		g.It("should not count probes of targets outside of allowed networks", func() {
+			eaaContext.cfg.HealthChecks.AllowedNetworks = []string{"10.0.0.0/8"}
+			mu.Lock()
+			healthy = false
+			mu.Unlock()
+
+			Consistently(func() []ServiceMessage {
+				checkServicesHealth(eaaContext)
+				return broker.published()
+			}, 50*time.Millisecond).Should(BeEmpty())
+			Expect(status()).To(BeEmpty())
+		})
+
+		g.It("should mark a recovered service healthy", func() {
+			eaaContext.serviceInfo.Lock()
+			eaaContext.serviceInfo.m[commonName].HealthCheck.FailureThreshold = 1000
+			eaaContext.serviceInfo.Unlock()
+
+			mu.Lock()
+			healthy = false
+			mu.Unlock()
+
+			Eventually(func() string {
+				checkServicesHealth(eaaContext)
+				return status()
+			}).Should(Equal(serviceStatusUnhealthy))
+
+			mu.Lock()
+			healthy = true
+			mu.Unlock()
+
+			Eventually(func() string {
+				checkServicesHealth(eaaContext)
+				return status()
+			}).Should(Equal(serviceStatusHealthy))
+			Expect(broker.published()).To(BeEmpty())
+		})
+	})
+})
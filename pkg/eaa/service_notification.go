@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Built-in notifications sent by EAA on behalf of a producer when it registers
+// or deregisters. Consumers subscribe to them in the namespace of producers
+// like to any other notification.
+const (
+	builtinNotificationPrefix       = "eaa."
+	serviceRegisteredNotification   = "eaa.service-registered"
+	serviceDeregisteredNotification = "eaa.service-deregistered"
+	serviceNotificationVersion      = "1.0.0"
+)
+
+// isBuiltinNotification reports whether a notification name is reserved
+// for notifications sent by EAA
+func isBuiltinNotification(name string) bool {
+	return strings.HasPrefix(name, builtinNotificationPrefix)
+}
+
+// sendServiceNotification notifies subscribers of a producer that it has been
+// registered or deregistered. The payload is the Service from the message.
+func sendServiceNotification(svcMsg *ServiceMessage, msgID string, eaaCtx *Context) error {
+	var name string
+	switch svcMsg.Action {
+	case serviceActionRegister:
+		name = serviceRegisteredNotification
+	case serviceActionDeregister:
+		name = serviceDeregisteredNotification
+	default:
+		return errors.Errorf("Unknown Service Action: %v", svcMsg.Action)
+	}
+
+	payload, err := json.Marshal(svcMsg.Svc)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal Service")
+	}
+
+	return sendNotificationToSubscribers(*svcMsg.Svc.URN, &NotificationFromProducer{
+		Name:    name,
+		Version: serviceNotificationVersion,
+		Payload: payload,
+	}, msgID, eaaCtx)
+}
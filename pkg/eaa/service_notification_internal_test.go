@@ -0,0 +1,185 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = g.Describe("service notifications", func() {
+	var (
+		eaaContext *Context
+		stream     *notificationStream
+	)
+
+	const consumer = "consumer:1"
+
+	urn := URN{Namespace: "video", ID: "producer"}
+
+	// handleServiceMessages passes service messages to handleServiceUpdates
+	handleServiceMessages := func(svcMsgs ...ServiceMessage) {
+		messages := make(chan *message.Message, len(svcMsgs))
+		for _, svcMsg := range svcMsgs {
+			data, err := json.Marshal(svcMsg)
+			Expect(err).NotTo(HaveOccurred())
+			messages <- message.NewMessage(svcMsg.Action, data)
+		}
+		close(messages)
+		handleServiceUpdates(messages, eaaContext)
+	}
+
+	received := func() []NotificationToConsumer {
+		var notifs []NotificationToConsumer
+		for _, n := range stream.close() {
+			var notif NotificationToConsumer
+			Expect(json.Unmarshal(n.payload, &notif)).To(Succeed())
+			notifs = append(notifs, notif)
+		}
+		return notifs
+	}
+
+	g.BeforeEach(func() {
+		eaaContext = &Context{MsgBrokerCtx: &brokerMock{}}
+		eaaContext.serviceInfo.m = make(map[string]Service)
+		eaaContext.subscriptionInfo = NotificationSubscriptions{
+			m: make(map[UniqueNotif]*ConsumerSubscription)}
+
+		stream = newNotificationStream(sseStream)
+		eaaContext.consumerConnections.m = map[string]ConsumerConnection{
+			consumer: {stream: stream}}
+	})
+
+	g.It("should notify subscribers of registration and deregistration", func() {
+		Expect(addSubscriptionToNamespace(consumer, "video", []NotificationDescriptor{
+			{Name: serviceRegisteredNotification, Version: serviceNotificationVersion},
+			{Name: serviceDeregisteredNotification, Version: serviceNotificationVersion},
+		}, eaaContext)).To(Succeed())
+
+		handleServiceMessages(
+			ServiceMessage{Svc: &Service{URN: &urn, EndpointURI: "producer:8080"},
+				Action: serviceActionRegister},
+			ServiceMessage{Svc: &Service{URN: &urn}, Action: serviceActionDeregister})
+
+		notifs := received()
+		Expect(notifs).To(HaveLen(2))
+		Expect(notifs[0].Name).To(Equal(serviceRegisteredNotification))
+		Expect(notifs[0].URN).To(Equal(urn))
+		var serv Service
+		Expect(json.Unmarshal(notifs[0].Payload, &serv)).To(Succeed())
+		Expect(serv.EndpointURI).To(Equal("producer:8080"))
+		Expect(notifs[1].Name).To(Equal(serviceDeregisteredNotification))
+		Expect(notifs[1].URN).To(Equal(urn))
+	})
+
+	g.It("should give every notification its own ID", func() {
+		eaaContext.MsgBrokerCtx = NewGoChannelMsgBroker(eaaContext)
+		eaaContext.serviceHealth.m = make(map[string]*serviceHealthState)
+		Expect(eaaContext.MsgBrokerCtx.addPublisher(servicesPublisher, servicesTopic, nil)).
+			To(Succeed())
+		Expect(eaaContext.MsgBrokerCtx.addSubscriber(servicesSubscriber, servicesTopic, nil)).
+			To(Succeed())
+		defer func() {
+			Expect(eaaContext.MsgBrokerCtx.removeAll()).To(Succeed())
+		}()
+		Expect(addSubscriptionToNamespace(consumer, "video", []NotificationDescriptor{
+			{Name: serviceRegisteredNotification, Version: serviceNotificationVersion},
+			{Name: serviceDeregisteredNotification, Version: serviceNotificationVersion},
+		}, eaaContext)).To(Succeed())
+
+		producer := &x509.Certificate{Subject: pkix.Name{CommonName: urn.String()}}
+		for _, req := range []struct{ method, body string }{
+			{"POST", `{"description": "camera"}`},
+			{"DELETE", ""},
+			{"POST", `{"description": "camera"}`},
+		} {
+			request := httptest.NewRequest(req.method, "/v1/services",
+				strings.NewReader(req.body))
+			request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{producer}}
+			response := httptest.NewRecorder()
+			NewEaaRouter(eaaContext).ServeHTTP(response, request)
+			Expect(response.Code).To(BeNumerically("<", 300))
+			Eventually(func() bool {
+				return isServicePresent(urn.String(), eaaContext)
+			}).Should(Equal(req.method == "POST"))
+		}
+
+		Eventually(func() int { return len(stream.notifications) }).Should(Equal(3))
+		notifs := received()
+		Expect(notifs[0].ID).NotTo(BeEmpty())
+		Expect(notifs[1].ID).NotTo(Equal(notifs[0].ID))
+		Expect(notifs[2].ID).NotTo(Equal(notifs[0].ID))
+		Expect(notifs[2].ID).NotTo(Equal(notifs[1].ID))
+	})
+
+	g.It("should not notify again of redelivered service messages", func() {
+		Expect(addSubscriptionToNamespace(consumer, "video", []NotificationDescriptor{
+			{Name: serviceRegisteredNotification, Version: serviceNotificationVersion},
+			{Name: serviceDeregisteredNotification, Version: serviceNotificationVersion},
+		}, eaaContext)).To(Succeed())
+
+		register := ServiceMessage{Svc: &Service{URN: &urn, EndpointURI: "producer:8080",
+			Notifications: []NotificationDescriptor{{Name: "motion-detected", Version: "1.0"}}},
+			Action: serviceActionRegister}
+		update := ServiceMessage{Svc: &Service{URN: &urn, EndpointURI: "producer:9090"},
+			Action: serviceActionRegister}
+		deregister := ServiceMessage{Svc: &Service{URN: &urn}, Action: serviceActionDeregister}
+
+		handleServiceMessages(register, register, update)
+		// Redelivered after reconnecting to the broker
+		handleServiceMessages(update, deregister, deregister)
+
+		var names []string
+		for _, n := range received() {
+			var serv Service
+			Expect(json.Unmarshal(n.Payload, &serv)).To(Succeed())
+			names = append(names, n.Name+" "+serv.EndpointURI)
+		}
+		Expect(names).To(Equal([]string{
+			serviceRegisteredNotification + " producer:8080",
+			serviceRegisteredNotification + " producer:9090",
+			serviceDeregisteredNotification + " ",
+		}))
+	})
+
+	g.It("should notify subscribers of a producer only", func() {
+		Expect(addSubscriptionToService(consumer, "video", "other", []NotificationDescriptor{
+			{Name: serviceRegisteredNotification, Version: serviceNotificationVersion},
+		}, eaaContext)).To(Succeed())
+
+		handleServiceMessages(ServiceMessage{Svc: &Service{URN: &urn},
+			Action: serviceActionRegister})
+
+		Expect(received()).To(BeEmpty())
+	})
+
+	g.It("should not notify deregistration of an unknown service", func() {
+		Expect(addSubscriptionToNamespace(consumer, "*", []NotificationDescriptor{
+			{Name: serviceDeregisteredNotification, Version: "^1.0"},
+		}, eaaContext)).To(Succeed())
+
+		handleServiceMessages(ServiceMessage{Svc: &Service{URN: &urn},
+			Action: serviceActionDeregister})
+
+		Expect(received()).To(BeEmpty())
+	})
+
+	g.It("should drop reserved notifications of a producer", func() {
+		Expect(addService(urn.String(), Service{URN: &urn, Notifications: []NotificationDescriptor{
+			{Name: serviceRegisteredNotification, Version: serviceNotificationVersion},
+			{Name: "motion-detected", Version: "1.0"},
+		}}, eaaContext)).To(Succeed())
+
+		Expect(eaaContext.serviceInfo.m[urn.String()].Notifications).To(ConsistOf(
+			NotificationDescriptor{Name: "motion-detected", Version: "1.0"}))
+	})
+})
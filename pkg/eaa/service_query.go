@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// serviceQuery selects services returned by GET /services. Services are
+// ordered by their Common Name and split into pages, a page is continued
+// from the cursor returned with the previous one.
+type serviceQuery struct {
+	namespace    string
+	idPrefix     string
+	status       string
+	notification string
+	// Maximum number of services in a page, 0 means no limit
+	limit int
+	// Common Name of the last service of the previous page
+	after string
+}
+
+// parseServiceQuery parses query parameters of GET /services. It returns
+// a list of problems with invalid parameters.
+func parseServiceQuery(values url.Values) (serviceQuery, []string) {
+	var problems []string
+
+	q := serviceQuery{
+		namespace:    values.Get("namespace"),
+		idPrefix:     values.Get("id_prefix"),
+		status:       values.Get("status"),
+		notification: values.Get("notification"),
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			problems = append(problems, "limit has to be a positive integer")
+		}
+		q.limit = n
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || len(after) == 0 {
+			problems = append(problems, "cursor is invalid")
+		}
+		q.after = string(after)
+	}
+
+	return q, problems
+}
+
+// matches reports whether a service is selected by the query
+func (q serviceQuery) matches(serv Service) bool {
+	var urn URN
+	if serv.URN != nil {
+		urn = *serv.URN
+	}
+	if q.namespace != "" && urn.Namespace != q.namespace {
+		return false
+	}
+	if !strings.HasPrefix(urn.ID, q.idPrefix) {
+		return false
+	}
+	if q.status != "" && serv.Status != q.status {
+		return false
+	}
+	if q.notification != "" {
+		for _, notif := range serv.Notifications {
+			if notif.Name == q.notification {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// queryServices returns a page of services selected by the query.
+// The caller has to hold the serviceInfo lock.
+func queryServices(q serviceQuery, eaaCtx *Context) ServiceList {
+	var commonNames []string
+	for commonName, serv := range eaaCtx.serviceInfo.m {
+		if commonName > q.after && q.matches(serv) {
+			commonNames = append(commonNames, commonName)
+		}
+	}
+	sort.Strings(commonNames)
+
+	var servList ServiceList
+	if q.limit > 0 && len(commonNames) > q.limit {
+		commonNames = commonNames[:q.limit]
+		servList.NextCursor = base64.RawURLEncoding.EncodeToString(
+			[]byte(commonNames[len(commonNames)-1]))
+	}
+	for _, commonName := range commonNames {
+		servList.Services = append(servList.Services, eaaCtx.serviceInfo.m[commonName])
+	}
+	return servList
+}
+
+// entityTag returns a strong HTTP entity tag of a response body
+func entityTag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches an entity tag
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = g.Describe("services query", func() {
+	var eaaContext *Context
+
+	getServices := func(query url.Values, header http.Header) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", "/services?"+query.Encode(), nil)
+		request = request.WithContext(context.WithValue(request.Context(),
+			contextKey("appliance-ctx"), eaaContext))
+		request.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "consumer:1"}}},
+		}
+		for name, values := range header {
+			request.Header[name] = values
+		}
+		response := httptest.NewRecorder()
+
+		GetServices(response, request)
+
+		return response
+	}
+
+	// ids returns IDs of services in a GetServices response
+	ids := func(response *httptest.ResponseRecorder) ([]string, string) {
+		Expect(response.Code).To(Equal(http.StatusOK))
+		var servList ServiceList
+		Expect(json.NewDecoder(response.Body).Decode(&servList)).To(Succeed())
+
+		ids := []string{}
+		for _, serv := range servList.Services {
+			ids = append(ids, serv.URN.Namespace+":"+serv.URN.ID)
+		}
+		return ids, servList.NextCursor
+	}
+
+	g.BeforeEach(func() {
+		eaaContext = &Context{}
+		eaaContext.serviceInfo.m = make(map[string]Service)
+
+		for _, serv := range []struct {
+			namespace, id, status, notification string
+		}{
+			{"video", "camera-2", "healthy", "motion-detected"},
+			{"video", "camera-1", "unhealthy", "motion-detected"},
+			{"video", "analytics", "healthy", "face-detected"},
+			{"audio", "camera-3", "healthy", ""},
+		} {
+			urn := URN{Namespace: serv.namespace, ID: serv.id}
+			s := Service{URN: &urn, Status: serv.status}
+			if serv.notification != "" {
+				s.Notifications = []NotificationDescriptor{{Name: serv.notification, Version: "1.0"}}
+			}
+			eaaContext.serviceInfo.m[urn.String()] = s
+		}
+	})
+
+	g.It("should return services ordered by URN", func() {
+		Expect(ids(getServices(url.Values{}, nil))).To(Equal([]string{
+			"audio:camera-3", "video:analytics", "video:camera-1", "video:camera-2"}))
+	})
+
+	g.It("should filter services", func() {
+		Expect(ids(getServices(url.Values{"namespace": {"video"}, "id_prefix": {"camera"}},
+			nil))).To(Equal([]string{"video:camera-1", "video:camera-2"}))
+		Expect(ids(getServices(url.Values{"status": {"healthy"}, "id_prefix": {"camera"}},
+			nil))).To(Equal([]string{"audio:camera-3", "video:camera-2"}))
+		Expect(ids(getServices(url.Values{"notification": {"face-detected"}}, nil))).
+			To(Equal([]string{"video:analytics"}))
+		Expect(ids(getServices(url.Values{"namespace": {"other"}}, nil))).To(BeEmpty())
+	})
+
+	g.It("should paginate services", func() {
+		var all []string
+		query := url.Values{"namespace": {"video"}, "limit": {"2"}}
+		for pages := 0; ; pages++ {
+			Expect(pages).To(BeNumerically("<", 2))
+
+			page, cursor := ids(getServices(query, nil))
+			Expect(len(page)).To(BeNumerically("<=", 2))
+			all = append(all, page...)
+			if cursor == "" {
+				break
+			}
+			query.Set("cursor", cursor)
+		}
+		Expect(all).To(Equal([]string{"video:analytics", "video:camera-1", "video:camera-2"}))
+	})
+
+	g.It("should reject an invalid query", func() {
+		for _, query := range []url.Values{
+			{"limit": {"0"}},
+			{"limit": {"all"}},
+			{"cursor": {"%%%"}},
+		} {
+			response := getServices(query, nil)
+			Expect(response.Code).To(Equal(http.StatusBadRequest), query.Encode())
+		}
+	})
+
+	g.It("should respond with 304 while services don't change", func() {
+		response := getServices(url.Values{}, nil)
+		Expect(response.Code).To(Equal(http.StatusOK))
+		etag := response.Header().Get("ETag")
+		Expect(etag).NotTo(BeEmpty())
+
+		response = getServices(url.Values{}, http.Header{"If-None-Match": {etag}})
+		Expect(response.Code).To(Equal(http.StatusNotModified))
+		Expect(response.Body.Len()).To(BeZero())
+
+		urn := URN{Namespace: "video", ID: "camera-4"}
+		eaaContext.serviceInfo.m[urn.String()] = Service{URN: &urn}
+
+		response = getServices(url.Values{}, http.Header{"If-None-Match": {etag}})
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Header().Get("ETag")).NotTo(Equal(etag))
+	})
+})
@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// storedService is a service kept by the State Store together with the ID
+// of the EAA instance it was registered through
+type storedService struct {
+	Service
+	Origin string `json:"eaa_origin,omitempty"`
+}
+
+// stateStore persists registered services and consumer subscriptions,
+// so that EAA recovers them on startup regardless of the Message Broker
+// retention.
+type stateStore interface {
+	// saveService stores a service registered by a producer
+	saveService(commonName string, serv storedService) error
+	// removeService removes a service of a producer
+	removeService(commonName string) error
+	// saveSubscriptions replaces all subscriptions of a consumer, an empty
+	// list removes them
+	saveSubscriptions(commonName string, subs SubscriptionList) error
+	// load returns stored services and subscriptions by Common Names
+	load() (map[string]storedService, map[string]SubscriptionList, error)
+	close() error
+}
+
+// stateStoreFactory creates a stateStore from the StateStore section of
+// the EAA config
+type stateStoreFactory func(cfg StateStoreConfig) (stateStore, error)
+
+// State Store backend used when StateStore.Type is not set in the config
+const defaultStateStoreType = boltStateStoreType
+
+// stateStoreFactories holds all available State Store backends indexed by
+// their type
+var stateStoreFactories = make(map[string]stateStoreFactory)
+
+// registerStateStoreFactory makes a State Store backend available under
+// a given type. It is meant to be called from init() of the file
+// implementing the backend.
+func registerStateStoreFactory(storeType string, factory stateStoreFactory) {
+	if _, found := stateStoreFactories[storeType]; found {
+		panic(fmt.Sprintf("State Store factory for type '%v' already registered", storeType))
+	}
+	stateStoreFactories[storeType] = factory
+}
+
+// newStateStore creates a State Store of a type selected in the EAA config
+func newStateStore(cfg StateStoreConfig) (stateStore, error) {
+	storeType := cfg.Type
+	if storeType == "" {
+		storeType = defaultStateStoreType
+	}
+
+	factory, found := stateStoreFactories[storeType]
+	if !found {
+		return nil, fmt.Errorf("Unknown State Store type: %v", storeType)
+	}
+
+	return factory(cfg)
+}
+
+// persistService stores the current state of a service, a service that
+// isn't registered anymore is removed from the store
+func persistService(commonName string, eaaCtx *Context) {
+	if eaaCtx.stateStore == nil {
+		return
+	}
+
+	eaaCtx.serviceInfo.RLock()
+	serv, found := eaaCtx.serviceInfo.m[commonName]
+	eaaCtx.serviceInfo.RUnlock()
+
+	var err error
+	if found {
+		origin, _ := serviceOrigin(commonName, eaaCtx)
+		err = eaaCtx.stateStore.saveService(commonName, storedService{serv, origin})
+	} else {
+		err = eaaCtx.stateStore.removeService(commonName)
+	}
+	if err != nil {
+		log.Errf("Failed to persist service %s: %s", commonName, err.Error())
+	}
+}
+
+// persistSubscriptions stores the current subscriptions of a consumer
+func persistSubscriptions(commonName string, eaaCtx *Context) {
+	if eaaCtx.stateStore == nil {
+		return
+	}
+
+	subs, err := getConsumerSubscriptions(commonName, eaaCtx)
+	if err == nil {
+		err = eaaCtx.stateStore.saveSubscriptions(commonName, *subs)
+	}
+	if err != nil {
+		log.Errf("Failed to persist subscriptions of %s: %s", commonName, err.Error())
+	}
+}
+
+// restoreState loads services and subscriptions from the State Store into
+// EAA context and subscribes to notification topics of the restored
+// subscriptions
+func restoreState(eaaCtx *Context) error {
+	if eaaCtx.stateStore == nil {
+		return nil
+	}
+
+	servs, subs, err := eaaCtx.stateStore.load()
+	if err != nil {
+		return errors.Wrap(err, "Failed to load EAA state")
+	}
+
+	for commonName, serv := range servs {
+		if err = addService(commonName, serv.Service, eaaCtx); err != nil {
+			return errors.Wrapf(err, "Failed to restore service %s", commonName)
+		}
+		setServiceOrigin(commonName, serv.Origin, eaaCtx)
+	}
+
+	for commonName, list := range subs {
+		for _, sub := range list.Subscriptions {
+			if sub.URN == nil {
+				continue
+			}
+			if err = addSubscription(commonName, sub, eaaCtx); err != nil {
+				return errors.Wrapf(err, "Failed to restore subscriptions of %s", commonName)
+			}
+		}
+	}
+
+	log.Infof("Restored %d services and subscriptions of %d consumers", len(servs),
+		len(subs))
+	return nil
+}
@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+const boltStateStoreType = "bolt"
+
+// Buckets of the state DB, both are keyed by Common Names
+var (
+	stateServicesBucket      = []byte("services")
+	stateSubscriptionsBucket = []byte("subscriptions")
+)
+
+// boltStateStore is a bbolt-backed stateStore. Services and subscription
+// lists are stored as JSON.
+type boltStateStore struct {
+	db *bolt.DB
+}
+
+func init() {
+	registerStateStoreFactory(boltStateStoreType, openBoltStateStore)
+}
+
+// openBoltStateStore opens (or creates) the state DB file, it is
+// a stateStoreFactory of the bolt backend
+func openBoltStateStore(cfg StateStoreConfig) (stateStore, error) {
+	db, err := bolt.Open(cfg.Path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open state DB: %v", cfg.Path)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{stateServicesBucket, stateSubscriptionsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Wrap(err, "Failed to initialize state DB")
+	}
+
+	log.Infof("State store opened: %v", cfg.Path)
+	return &boltStateStore{db: db}, nil
+}
+
+// put stores a value marshaled to JSON in a bucket
+func (s *boltStateStore) put(bucket []byte, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal state")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
+
+// delete removes a key from a bucket
+func (s *boltStateStore) delete(bucket []byte, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+}
+
+func (s *boltStateStore) saveService(commonName string, serv storedService) error {
+	return s.put(stateServicesBucket, commonName, serv)
+}
+
+func (s *boltStateStore) removeService(commonName string) error {
+	return s.delete(stateServicesBucket, commonName)
+}
+
+func (s *boltStateStore) saveSubscriptions(commonName string, subs SubscriptionList) error {
+	if len(subs.Subscriptions) == 0 {
+		return s.delete(stateSubscriptionsBucket, commonName)
+	}
+	return s.put(stateSubscriptionsBucket, commonName, subs)
+}
+
+func (s *boltStateStore) load() (map[string]storedService, map[string]SubscriptionList,
+	error) {
+
+	servs := make(map[string]storedService)
+	subs := make(map[string]SubscriptionList)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(stateServicesBucket).ForEach(func(k, v []byte) error {
+			var serv storedService
+			if err := json.Unmarshal(v, &serv); err != nil {
+				log.Errf("Skipping malformed stored service %s: %s", k, err.Error())
+				return nil
+			}
+			servs[string(k)] = serv
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(stateSubscriptionsBucket).ForEach(func(k, v []byte) error {
+			var list SubscriptionList
+			if err := json.Unmarshal(v, &list); err != nil {
+				log.Errf("Skipping malformed stored subscriptions of %s: %s", k,
+					err.Error())
+				return nil
+			}
+			subs[string(k)] = list
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to read state DB")
+	}
+	return servs, subs, nil
+}
+
+func (s *boltStateStore) close() error {
+	return s.db.Close()
+}
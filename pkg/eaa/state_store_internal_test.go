@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2020 Intel Corporation
+
+package eaa
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	g "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = g.Describe("state store", func() {
+	var (
+		dir string
+		cfg StateStoreConfig
+	)
+
+	newContext := func() *Context {
+		eaaCtx := &Context{}
+		eaaCtx.serviceInfo.m = make(map[string]Service)
+		eaaCtx.subscriptionInfo.m = make(map[UniqueNotif]*ConsumerSubscription)
+		eaaCtx.notificationSchemas.m = make(map[UniqueNotif]*notificationSchema)
+		eaaCtx.serviceHealth.m = make(map[string]*serviceHealthState)
+
+		var err error
+		eaaCtx.stateStore, err = newStateStore(cfg)
+		Expect(err).NotTo(HaveOccurred())
+		eaaCtx.MsgBrokerCtx = NewGoChannelMsgBroker(eaaCtx)
+		return eaaCtx
+	}
+
+	// handle passes a message to a Message Broker handler as if it was
+	// received from the topic
+	handle := func(handler func(<-chan *message.Message, *Context), v interface{},
+		eaaCtx *Context) {
+
+		data, err := json.Marshal(v)
+		Expect(err).NotTo(HaveOccurred())
+		messages := make(chan *message.Message, 1)
+		messages <- message.NewMessage(watermill.NewUUID(), data)
+		close(messages)
+		handler(messages, eaaCtx)
+	}
+
+	g.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "eaaStateStore")
+		Expect(err).NotTo(HaveOccurred())
+		cfg = StateStoreConfig{Path: filepath.Join(dir, "state.db")}
+	})
+
+	g.AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	g.It("should restore services and subscriptions after restart", func() {
+		eaaCtx := newContext()
+		handle(handleServiceUpdates, ServiceMessage{
+			Svc: &Service{URN: &URN{ID: "camera-1", Namespace: "video"},
+				Notifications: []NotificationDescriptor{{Name: "motion", Version: "1.0"}}},
+			Action: serviceActionRegister}, eaaCtx)
+		handle(handleServiceUpdates, ServiceMessage{
+			Svc:    &Service{URN: &URN{ID: "mic-1", Namespace: "audio"}},
+			Action: serviceActionRegister}, eaaCtx)
+		handle(handleServiceUpdates, ServiceMessage{
+			Svc:    &Service{URN: &URN{ID: "mic-1", Namespace: "audio"}},
+			Action: serviceActionDeregister}, eaaCtx)
+		handle(handleClientUpdates, SubscriptionMessage{
+			ClientCommonName: "consumer:1",
+			Subscription: &Subscription{URN: &URN{Namespace: "video"},
+				Notifications: []NotificationDescriptor{
+					{Name: "motion", Version: "1.0", Filter: "score > 0.5"}}},
+			Action: subscriptionActionSubscribe,
+			Scope:  subscriptionScopeNamespace}, eaaCtx)
+		handle(handleClientUpdates, SubscriptionMessage{
+			ClientCommonName: "consumer:2",
+			Subscription: &Subscription{URN: &URN{ID: "camera-1", Namespace: "video"},
+				Notifications: []NotificationDescriptor{{Name: "motion", Version: "1.0"}}},
+			Action: subscriptionActionSubscribe,
+			Scope:  subscriptionScopeService}, eaaCtx)
+		handle(handleClientUpdates, SubscriptionMessage{
+			ClientCommonName: "consumer:2",
+			Action:           subscriptionActionUnsubscribe,
+			Scope:            subscriptionScopeAll}, eaaCtx)
+
+		expectedSubs, err := getConsumerSubscriptions("consumer:1", eaaCtx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(eaaCtx.MsgBrokerCtx.removeAll()).To(Succeed())
+		Expect(eaaCtx.stateStore.close()).To(Succeed())
+
+		restarted := newContext()
+		defer restarted.stateStore.close()
+		Expect(restoreState(restarted)).To(Succeed())
+
+		Expect(restarted.serviceInfo.m).To(HaveLen(1))
+		Expect(restarted.serviceInfo.m).To(HaveKey("video:camera-1"))
+		Expect(getConsumerSubscriptions("consumer:1", restarted)).To(Equal(expectedSubs))
+		Expect(getConsumerSubscriptions("consumer:2", restarted)).
+			To(Equal(&SubscriptionList{}))
+
+		broker := restarted.MsgBrokerCtx.(*GoChannelMsgBroker)
+		Expect(broker.pubSubs.m).To(HaveKey(getNotificationTopicName("video")))
+		Expect(broker.removeAll()).To(Succeed())
+	})
+
+	g.It("should keep probing services registered through the instance after restart",
+		func() {
+			eaaCtx := newContext()
+			eaaCtx.instanceID = "eaa-1"
+			for id, origin := range map[string]string{"camera-1": "eaa-1", "camera-2": "eaa-2"} {
+				handle(handleServiceUpdates, ServiceMessage{
+					Svc: &Service{URN: &URN{ID: id, Namespace: "video"},
+						EndpointURI: "127.0.0.1:1", HealthCheck: &HealthCheck{Type: "tcp"}},
+					Action: serviceActionRegister, Origin: origin}, eaaCtx)
+			}
+			Expect(eaaCtx.MsgBrokerCtx.removeAll()).To(Succeed())
+			Expect(eaaCtx.stateStore.close()).To(Succeed())
+
+			restarted := newContext()
+			restarted.instanceID = "eaa-1"
+			restarted.cfg.HealthChecks.AllowedNetworks = []string{"127.0.0.0/8"}
+			defer restarted.stateStore.close()
+			Expect(restoreState(restarted)).To(Succeed())
+
+			checkServicesHealth(restarted)
+			restarted.serviceHealth.Lock()
+			defer restarted.serviceHealth.Unlock()
+			Expect(restarted.serviceHealth.m).To(HaveLen(1))
+			Expect(restarted.serviceHealth.m).To(HaveKey("video:camera-1"))
+			Expect(restarted.MsgBrokerCtx.removeAll()).To(Succeed())
+		})
+
+	g.It("should reject an unknown type", func() {
+		_, err := newStateStore(StateStoreConfig{Type: "unknown", Path: cfg.Path})
+		Expect(err).To(HaveOccurred())
+	})
+})